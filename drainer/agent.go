@@ -0,0 +1,53 @@
+package drainer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// isAgentOlderThan reports whether the ECS agent of the container instance is older than minVersion,
+// such as `1.20.0`. An instance that does not report its version is regarded as up to date.
+func isAgentOlderThan(containerInstance *ecs.ContainerInstance, minVersion string) (bool, error) {
+	if containerInstance.VersionInfo == nil || containerInstance.VersionInfo.AgentVersion == nil {
+		return false, nil
+	}
+	minParts, err := parseVersion(minVersion)
+	if err != nil {
+		return false, fmt.Errorf("`MIN_AGENT_VERSION` is invalid: %w", err)
+	}
+	parts, err := parseVersion(aws.StringValue(containerInstance.VersionInfo.AgentVersion))
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < len(minParts) || i < len(parts); i++ {
+		var part, minPart int
+		if i < len(parts) {
+			part = parts[i]
+		}
+		if i < len(minParts) {
+			minPart = minParts[i]
+		}
+		if part != minPart {
+			return part < minPart, nil
+		}
+	}
+	return false, nil
+}
+
+func parseVersion(version string) ([]int, error) {
+	fields := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	parts := make([]int, len(fields))
+	for i, field := range fields {
+		part, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("version %q is not numeric", version)
+		}
+		parts[i] = part
+	}
+	return parts, nil
+}
@@ -0,0 +1,65 @@
+package drainer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestIsAgentOlderThan(t *testing.T) {
+	for _, tt := range []struct {
+		version    string
+		minVersion string
+		want       bool
+		wantErr    bool
+	}{
+		{"1.19.9", "1.20.0", true, false},
+		{"1.20.0", "1.20.0", false, false},
+		{"1.70.0", "1.20.0", false, false},
+		{"v1.9.0", "1.20", true, false},
+		{"1.20", "1.20.1", true, false},
+		{"", "1.20.0", false, false},
+		{"1.20.0", "latest", false, true},
+	} {
+		t.Run(tt.version+"<"+tt.minVersion, func(t *testing.T) {
+			containerInstance := &ecs.ContainerInstance{}
+			if tt.version != "" {
+				containerInstance.VersionInfo = &ecs.VersionInfo{AgentVersion: aws.String(tt.version)}
+			}
+			got, err := isAgentOlderThan(containerInstance, tt.minVersion)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("isAgentOlderThan() = %v, %v, want %v and error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainMinAgentVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version     string
+		wantStopped int
+	}{
+		{"1.19.0", 1},
+		{"1.70.0", 0},
+	} {
+		t.Run(tt.version, func(t *testing.T) {
+			t.Setenv("MIN_AGENT_VERSION", "1.20.0")
+			f := newTestDrainFixture()
+			f.containerInstance.VersionInfo.AgentVersion = aws.String(tt.version)
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(f.ecs.stoppedTasks); got != tt.wantStopped {
+				t.Errorf("stopped tasks = %v, want %d", f.ecs.stoppedTasks, tt.wantStopped)
+			}
+			if detail.ForceStopped != (tt.wantStopped > 0) {
+				t.Errorf("ForceStopped = %v, want %v", detail.ForceStopped, tt.wantStopped > 0)
+			}
+		})
+	}
+}
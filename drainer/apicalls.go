@@ -0,0 +1,61 @@
+package drainer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+type apiCallKey struct {
+	Service   string
+	Operation string
+}
+
+// apiCallCounter counts AWS API calls per service and operation, including retried attempts.
+type apiCallCounter struct {
+	mu     sync.Mutex
+	counts map[apiCallKey]int
+	// cloudwatch publishes the counts with the session whose calls are not counted.
+	cloudwatch cloudwatchAPI
+}
+
+// countAPICalls returns a copy of the session whose requests are counted, so that
+// the shared session is not affected by other invocations.
+func countAPICalls(sess *session.Session) (*session.Session, *apiCallCounter) {
+	counter := &apiCallCounter{counts: make(map[apiCallKey]int), cloudwatch: cloudwatch.New(sess)}
+	counted := sess.Copy()
+	counted.Handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: "ecsautodraining.apiCallCounter",
+		Fn: func(r *request.Request) {
+			counter.mu.Lock()
+			defer counter.mu.Unlock()
+			counter.counts[apiCallKey{Service: r.ClientInfo.ServiceName, Operation: r.Operation.Name}]++
+		},
+	})
+	return counted, counter
+}
+
+// emitAPICalls logs the counts of c and publishes them as the `APICalls` metric.
+func (d *Drainer) emitAPICalls(ctx context.Context, c *apiCallCounter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := make([]*cloudwatch.MetricDatum, 0, len(c.counts))
+	for key, count := range c.counts {
+		d.logger.infof("API calls: service=%s operation=%s count=%d", key.Service, key.Operation, count)
+		data = append(data, &cloudwatch.MetricDatum{
+			MetricName: aws.String("APICalls"),
+			Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("Service"), Value: aws.String(key.Service)},
+				{Name: aws.String("Operation"), Value: aws.String(key.Operation)},
+			},
+			Unit:  aws.String(cloudwatch.StandardUnitCount),
+			Value: aws.Float64(float64(count)),
+		})
+	}
+	d.putMetricData(ctx, c.cloudwatch, data)
+}
@@ -0,0 +1,66 @@
+package drainer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestCountAPICalls(t *testing.T) {
+	t.Setenv("ENABLE_METRICS", "true")
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String(testRegion),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	counted, counter := countAPICalls(sess)
+	// The requests are answered without leaving the test.
+	counted.Handlers.Send.RemoveByName("core.SendHandler")
+	counted.Handlers.Send.PushBack(func(r *request.Request) {
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{},
+			Body: ioutil.NopCloser(strings.NewReader("{}"))}
+	})
+	ctx := context.Background()
+
+	svc := ecs.New(counted)
+	for i := 0; i < 2; i++ {
+		if _, err := svc.ListClustersWithContext(ctx, &ecs.ListClustersInput{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := &ecs.DescribeTasksInput{Tasks: aws.StringSlice([]string{"task-1"})}
+	if _, err := svc.DescribeTasksWithContext(ctx, input); err != nil {
+		t.Fatal(err)
+	}
+	cw := &fakeCloudWatch{}
+	counter.cloudwatch = cw
+	d, out := newTestDrainer(t, &awsClients{})
+	d.emitAPICalls(ctx, counter)
+
+	got := map[string]float64{}
+	for _, datum := range cw.metrics("APICalls") {
+		var service, operation string
+		for _, dimension := range datum.Dimensions {
+			switch aws.StringValue(dimension.Name) {
+			case "Service":
+				service = aws.StringValue(dimension.Value)
+			case "Operation":
+				operation = aws.StringValue(dimension.Value)
+			}
+		}
+		got[service+":"+operation] = aws.Float64Value(datum.Value)
+	}
+	if len(got) != 2 || got["ecs:ListClusters"] != 2 || got["ecs:DescribeTasks"] != 1 {
+		t.Errorf("APICalls = %v, want ecs:ListClusters 2 and ecs:DescribeTasks 1", got)
+	}
+	if !strings.Contains(out.String(), "operation=ListClusters count=2") {
+		t.Errorf("log = %q, want the counts logged", out.String())
+	}
+}
@@ -0,0 +1,116 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/appconfig"
+)
+
+const defaultFeatureFlagsRefreshInterval = time.Minute
+
+// featureFlags holds the configuration retrieved from AWS AppConfig. It is a JSON object whose keys are
+// environment variable names, e.g. `{"HEARTBEAT_ONLY": true}`, and it overrides the environment so that
+// draining can be tuned without redeploying.
+var featureFlags = &featureFlagStore{} // nolint:gochecknoglobals
+
+type featureFlagStore struct {
+	mu        sync.RWMutex
+	flags     map[string]string
+	version   string
+	fetchedAt time.Time
+}
+
+func (s *featureFlagStore) lookup(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.flags[name]
+	return value, ok
+}
+
+// refresh retrieves the flags at cold start and then once per `APPCONFIG_REFRESH_SECONDS`.
+// It is a no-op unless `APPCONFIG_APPLICATION`, `APPCONFIG_ENVIRONMENT` and `APPCONFIG_CONFIGURATION` are set,
+// and failures keep the previous flags because the drain must not depend on AppConfig availability.
+// It reports whether the flags changed, now being the time of the invocation.
+func (s *featureFlagStore) refresh(ctx context.Context, sess *session.Session, lg *logger, now time.Time) bool {
+	application := os.Getenv("APPCONFIG_APPLICATION")
+	environment := os.Getenv("APPCONFIG_ENVIRONMENT")
+	configuration := os.Getenv("APPCONFIG_CONFIGURATION")
+	if application == "" || environment == "" || configuration == "" {
+		return false
+	}
+
+	interval := defaultFeatureFlagsRefreshInterval
+	if value := os.Getenv("APPCONFIG_REFRESH_SECONDS"); value != "" {
+		refresh, err := getenvSeconds("APPCONFIG_REFRESH_SECONDS")
+		if err != nil {
+			lg.warnf("ignoring invalid refresh interval: %v", err)
+		} else {
+			interval = refresh
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.fetchedAt.IsZero() && now.Sub(s.fetchedAt) < interval {
+		return false
+	}
+
+	// Each container identifies itself by its log stream, which is unique per container.
+	clientID := os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")
+	if clientID == "" {
+		clientID = "ecs-auto-draining"
+	}
+	input := &appconfig.GetConfigurationInput{
+		Application:   &application,
+		Environment:   &environment,
+		Configuration: &configuration,
+		ClientId:      &clientID,
+	}
+	if s.version != "" {
+		input.ClientConfigurationVersion = &s.version
+	}
+	output, err := appconfig.New(sess).GetConfigurationWithContext(ctx, input)
+	if err != nil {
+		lg.warnf("failed to get feature flags from AppConfig: %v", err)
+		return false
+	}
+	s.fetchedAt = now
+
+	// AppConfig returns no content when the version has not changed.
+	if len(output.Content) == 0 {
+		return false
+	}
+	flags, err := parseFeatureFlags(output.Content)
+	if err != nil {
+		lg.warnf("ignoring invalid feature flags from AppConfig: %v", err)
+		return false
+	}
+	s.flags = flags
+	if output.ConfigurationVersion != nil {
+		s.version = *output.ConfigurationVersion
+	}
+	return true
+}
+
+func parseFeatureFlags(content []byte) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	flags := make(map[string]string, len(raw))
+	for name, value := range raw {
+		var s string
+		if err := json.Unmarshal(value, &s); err == nil {
+			flags[name] = s
+		} else {
+			flags[name] = string(value)
+		}
+	}
+	return flags, nil
+}
@@ -0,0 +1,128 @@
+package drainer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// fakeAppConfig serves the configuration content as AppConfig does, with no content for the version
+// the client already has.
+type fakeAppConfig struct {
+	mu       sync.Mutex
+	content  string
+	version  string
+	requests int
+}
+
+func (f *fakeAppConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if r.URL.Path != "/applications/app/environments/env/configurations/flags" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Configuration-Version", f.version)
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("client_configuration_version") != f.version {
+		_, _ = w.Write([]byte(f.content))
+	}
+}
+
+// newTestAppConfigSession returns a session whose AppConfig calls are served by svc.
+func newTestAppConfigSession(t *testing.T, svc *fakeAppConfig) *session.Session {
+	t.Helper()
+	t.Setenv("APPCONFIG_APPLICATION", "app")
+	t.Setenv("APPCONFIG_ENVIRONMENT", "env")
+	t.Setenv("APPCONFIG_CONFIGURATION", "flags")
+	server := httptest.NewServer(svc)
+	t.Cleanup(server.Close)
+	return session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String(testRegion),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+}
+
+func TestFeatureFlagStoreRefresh(t *testing.T) {
+	svc := &fakeAppConfig{content: `{"MAX_DRAIN_SECONDS": 600, "HEARTBEAT_ONLY": true}`, version: "1"}
+	sess := newTestAppConfigSession(t, svc)
+	d, _ := newTestDrainer(t, &awsClients{})
+	s := &featureFlagStore{}
+	ctx := context.Background()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if !s.refresh(ctx, sess, d.logger, now) {
+		t.Fatal("refresh() = false, want the flags retrieved at cold start")
+	}
+	for name, want := range map[string]string{"MAX_DRAIN_SECONDS": "600", "HEARTBEAT_ONLY": "true"} {
+		if got, ok := s.lookup(name); !ok || got != want {
+			t.Errorf("lookup(%s) = %q, %v, want %q", name, got, ok, want)
+		}
+	}
+
+	// The flags are not retrieved again within the refresh interval.
+	if s.refresh(ctx, sess, d.logger, now.Add(30*time.Second)) || svc.requests != 1 {
+		t.Errorf("requests = %d, want no refresh within the interval", svc.requests)
+	}
+	// An unchanged version returns no content and keeps the flags.
+	if s.refresh(ctx, sess, d.logger, now.Add(2*time.Minute)) || svc.requests != 2 {
+		t.Errorf("requests = %d, want an unchanged refresh after the interval", svc.requests)
+	}
+	if got, _ := s.lookup("HEARTBEAT_ONLY"); got != "true" {
+		t.Errorf("lookup(HEARTBEAT_ONLY) = %q, want the flags kept", got)
+	}
+
+	svc.mu.Lock()
+	svc.content, svc.version = `{"HEARTBEAT_ONLY": false}`, "2"
+	svc.mu.Unlock()
+	if !s.refresh(ctx, sess, d.logger, now.Add(4*time.Minute)) {
+		t.Fatal("refresh() = false, want the new version applied")
+	}
+	if _, ok := s.lookup("MAX_DRAIN_SECONDS"); ok {
+		t.Error("lookup(MAX_DRAIN_SECONDS) found a flag of the previous version")
+	}
+	if got, _ := s.lookup("HEARTBEAT_ONLY"); got != "false" {
+		t.Errorf("lookup(HEARTBEAT_ONLY) = %q, want false", got)
+	}
+}
+
+func TestLambdaHandlerRefreshFeatureFlags(t *testing.T) {
+	svc := &fakeAppConfig{content: `{"HEARTBEAT_ONLY": true}`, version: "1"}
+	sess := newTestAppConfigSession(t, svc)
+	flags := featureFlags
+	featureFlags = &featureFlagStore{}
+	t.Cleanup(func() { featureFlags = flags })
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	h := &LambdaHandler{drainer: d, sess: sess}
+
+	detail, err := h.Handle(context.Background(), testEvent(t, f.detail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.drainer.config.HeartbeatOnly {
+		t.Error("HeartbeatOnly = false, want the flag applied to the configuration")
+	}
+	if got := f.ecs.count("UpdateContainerInstancesState"); got != 0 || detail == nil {
+		t.Errorf("UpdateContainerInstancesState calls = %d, want the instance left ACTIVE by the flag", got)
+	}
+
+	// Flags that make the configuration invalid are ignored.
+	svc.mu.Lock()
+	svc.content, svc.version = `{"MAX_DRAIN_SECONDS": "ten"}`, "2"
+	svc.mu.Unlock()
+	h.drainer = h.drainer.withClock(newFakeClock(time.Now().Add(time.Hour)))
+	h.refresh(context.Background())
+	if !h.drainer.config.HeartbeatOnly {
+		t.Error("HeartbeatOnly = false, want the configuration kept over invalid flags")
+	}
+}
@@ -0,0 +1,241 @@
+package drainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func (d *Drainer) isAuditing() bool {
+	return d.config.AuditLog
+}
+
+// AuditRecord is a mutating call made by the function, or only logged in a dry run or, for the lifecycle action
+// calls, in `OBSERVER_MODE`.
+type AuditRecord struct {
+	Time      time.Time
+	Actor     string
+	Instance  string `json:",omitempty"`
+	Operation string
+	Input     interface{}
+	DryRun    bool   `json:",omitempty"`
+	Observer  bool   `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// auditor records the mutating calls of an invocation with the clients of the Lambda's own session.
+type auditor struct {
+	d        *Drainer
+	s3       s3API
+	dynamodb dynamodbAPI
+	// instance is the instance of the event, which names the records of the invocation.
+	instance string
+	// invocation and seq tell apart the records of concurrent invocations and those made within the
+	// resolution of the clock.
+	invocation string
+	seq        int64
+}
+
+// newAuditor returns the auditor of the invocation handling evt.
+func newAuditor(d *Drainer, clients *awsClients, evt *events.CloudWatchEvent) *auditor {
+	var detail CloudWatchEventDetail
+	_ = json.Unmarshal(evt.Detail, &detail)
+	return &auditor{
+		d:          d,
+		s3:         clients.s3,
+		dynamodb:   clients.dynamodb,
+		instance:   detail.instanceKey(),
+		invocation: fmt.Sprintf("%08x", rand.Uint32()), // nolint:gosec
+	}
+}
+
+// audit records a mutating call made with input and failed with err, if not nil.
+func (a *auditor) audit(ctx context.Context, operation string, input interface{}, err error) {
+	a.write(ctx, a.newRecord(operation, input, err))
+}
+
+// auditLifecycleAction records a lifecycle action call, which `OBSERVER_MODE` only logs.
+func (a *auditor) auditLifecycleAction(ctx context.Context, operation string, input interface{}, err error) {
+	record := a.newRecord(operation, input, err)
+	record.Observer = a.d.isObserverMode()
+	a.write(ctx, record)
+}
+
+func (a *auditor) newRecord(operation string, input interface{}, err error) *AuditRecord {
+	record := &AuditRecord{
+		Time:      a.d.clock.Now().UTC(),
+		Actor:     os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		Instance:  a.instance,
+		Operation: operation,
+		Input:     input,
+		DryRun:    a.d.isDryRun(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// write writes the record to the log, and also puts it to `AUDIT_BUCKET` and `AUDIT_TABLE`, keyed by the string
+// `Id`, when they are set. Auditing is best-effort, so failures are only logged.
+func (a *auditor) write(ctx context.Context, record *AuditRecord) {
+	a.d.logger.log(LogLevelInfo, "audit: "+record.Operation, logFields{"audit": record})
+
+	if bucket := a.d.config.AuditBucket; bucket != "" {
+		key := a.objectKey(record)
+		if err := putS3JSON(ctx, a.s3, bucket, key, record); err != nil {
+			a.d.logger.warnf("failed to put the audit record to s3://%s/%s: %v", bucket, key, err)
+		}
+	}
+	if table := a.d.config.AuditTable; table != "" {
+		if err := putAuditItem(ctx, a.dynamodb, table, record); err != nil {
+			a.d.logger.warnf("failed to put the audit record to %q: %v", table, err)
+		}
+	}
+}
+
+// objectKey returns `YYYY-MM-DD/<instance>/<time>-<invocation>-<seq>-<operation>.json` for the record. Every
+// record gets an object of its own, since concurrent drains and `BATCH_CONCURRENCY` workers would lose records
+// appending to a shared one.
+func (a *auditor) objectKey(record *AuditRecord) string {
+	instance := strings.ReplaceAll(a.instance, "/", "_")
+	if instance == "" {
+		instance = "unknown"
+	}
+	seq := atomic.AddInt64(&a.seq, 1)
+	t := record.Time.UTC()
+	return fmt.Sprintf("%s/%s/%s-%s-%d-%s.json",
+		t.Format("2006-01-02"), instance,
+		t.Format("20060102T150405.000000000Z"), a.invocation, seq, strings.ReplaceAll(record.Operation, ":", "."),
+	)
+}
+
+func putAuditItem(ctx context.Context, svc dynamodbAPI, table string, record *AuditRecord) error {
+	input, err := json.Marshal(record.Input)
+	if err != nil {
+		return err
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"Id":        {S: aws.String(fmt.Sprintf("%s/%d", record.Actor, record.Time.UnixNano()))},
+		"Time":      {S: aws.String(record.Time.Format(time.RFC3339Nano))},
+		"Operation": {S: &record.Operation},
+		"Input":     {S: aws.String(string(input))},
+		"DryRun":    {BOOL: &record.DryRun},
+	}
+	if record.Actor != "" {
+		item["Actor"] = &dynamodb.AttributeValue{S: &record.Actor}
+	}
+	if record.Observer {
+		item["Observer"] = &dynamodb.AttributeValue{BOOL: &record.Observer}
+	}
+	if record.Error != "" {
+		item["Error"] = &dynamodb.AttributeValue{S: &record.Error}
+	}
+	_, err = svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: &table, Item: item})
+	return err
+}
+
+// auditECS records the mutating calls after making them with the wrapped client, which may be a dry run.
+type auditECS struct {
+	ecsAPI
+	auditor *auditor
+}
+
+func (a auditECS) DeleteAttributesWithContext(
+	ctx aws.Context, input *ecs.DeleteAttributesInput, opts ...request.Option) (*ecs.DeleteAttributesOutput, error) {
+	output, err := a.ecsAPI.DeleteAttributesWithContext(ctx, input, opts...)
+	a.auditor.audit(ctx, "ecs:DeleteAttributes", input, err)
+	return output, err
+}
+
+func (a auditECS) DeregisterContainerInstanceWithContext(ctx aws.Context, input *ecs.DeregisterContainerInstanceInput,
+	opts ...request.Option) (*ecs.DeregisterContainerInstanceOutput, error) {
+	output, err := a.ecsAPI.DeregisterContainerInstanceWithContext(ctx, input, opts...)
+	a.auditor.audit(ctx, "ecs:DeregisterContainerInstance", input, err)
+	return output, err
+}
+
+func (a auditECS) PutAttributesWithContext(
+	ctx aws.Context, input *ecs.PutAttributesInput, opts ...request.Option) (*ecs.PutAttributesOutput, error) {
+	output, err := a.ecsAPI.PutAttributesWithContext(ctx, input, opts...)
+	a.auditor.audit(ctx, "ecs:PutAttributes", input, err)
+	return output, err
+}
+
+func (a auditECS) StopTaskWithContext(
+	ctx aws.Context, input *ecs.StopTaskInput, opts ...request.Option) (*ecs.StopTaskOutput, error) {
+	output, err := a.ecsAPI.StopTaskWithContext(ctx, input, opts...)
+	a.auditor.audit(ctx, "ecs:StopTask", input, err)
+	return output, err
+}
+
+func (a auditECS) UpdateContainerInstancesStateWithContext(ctx aws.Context,
+	input *ecs.UpdateContainerInstancesStateInput, opts ...request.Option,
+) (*ecs.UpdateContainerInstancesStateOutput, error) {
+	output, err := a.ecsAPI.UpdateContainerInstancesStateWithContext(ctx, input, opts...)
+	a.auditor.audit(ctx, "ecs:UpdateContainerInstancesState", input, err)
+	return output, err
+}
+
+type auditEC2 struct {
+	ec2API
+	auditor *auditor
+}
+
+func (a auditEC2) CreateTagsWithContext(
+	ctx aws.Context, input *ec2.CreateTagsInput, opts ...request.Option) (*ec2.CreateTagsOutput, error) {
+	output, err := a.ec2API.CreateTagsWithContext(ctx, input, opts...)
+	a.auditor.audit(ctx, "ec2:CreateTags", input, err)
+	return output, err
+}
+
+type auditAutoscaling struct {
+	autoscalingAPI
+	auditor *auditor
+}
+
+func (a auditAutoscaling) CompleteLifecycleActionWithContext(ctx aws.Context,
+	input *autoscaling.CompleteLifecycleActionInput, opts ...request.Option,
+) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	output, err := a.autoscalingAPI.CompleteLifecycleActionWithContext(ctx, input, opts...)
+	a.auditor.auditLifecycleAction(ctx, "autoscaling:CompleteLifecycleAction", input, err)
+	return output, err
+}
+
+func (a auditAutoscaling) RecordLifecycleActionHeartbeatWithContext(ctx aws.Context,
+	input *autoscaling.RecordLifecycleActionHeartbeatInput, opts ...request.Option,
+) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	output, err := a.autoscalingAPI.RecordLifecycleActionHeartbeatWithContext(ctx, input, opts...)
+	a.auditor.auditLifecycleAction(ctx, "autoscaling:RecordLifecycleActionHeartbeat", input, err)
+	return output, err
+}
+
+// putS3JSON writes v as the JSON object at key.
+func putS3JSON(ctx context.Context, svc s3API, bucket, key string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
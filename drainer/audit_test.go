@@ -0,0 +1,92 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainerDrainAuditLog(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		dryRun bool
+		want   []string
+	}{
+		{"live", false, []string{
+			"ecs:UpdateContainerInstancesState", "ecs:PutAttributes",
+			"autoscaling:RecordLifecycleActionHeartbeat", "autoscaling:CompleteLifecycleAction",
+		}},
+		// The instance is never DRAINING in a dry run, so each poll sets it again.
+		{"dry run", true, []string{
+			"ecs:UpdateContainerInstancesState", "ecs:PutAttributes", "autoscaling:RecordLifecycleActionHeartbeat",
+			"ecs:UpdateContainerInstancesState", "ecs:PutAttributes", "autoscaling:CompleteLifecycleAction",
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ENABLE_AUDIT_LOG", "true")
+			t.Setenv("AUDIT_BUCKET", "audit")
+			if tt.dryRun {
+				t.Setenv("DRY_RUN", "true")
+			}
+			f := newTestDrainFixture()
+			s3Svc := newFakeS3()
+			f.clients.s3 = s3Svc
+			d, out := newTestDrainer(t, f.clients)
+			d = d.withClock(newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+			ctx := context.Background()
+
+			detail, err := d.Drain(ctx, f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.stopTask()
+			if _, err := d.Drain(ctx, detail); err != nil {
+				t.Fatal(err)
+			}
+
+			var operations []string
+			for _, line := range logLines(t, out) {
+				msg, _ := line["msg"].(string)
+				if !strings.HasPrefix(msg, "audit: ") {
+					continue
+				}
+				record := line["audit"].(map[string]interface{})
+				operations = append(operations, record["Operation"].(string))
+				if dryRun, _ := record["DryRun"].(bool); dryRun != tt.dryRun || record["Input"] == nil {
+					t.Errorf("record = %v, want the input and DryRun %v", record, tt.dryRun)
+				}
+			}
+			if !reflect.DeepEqual(operations, tt.want) {
+				t.Errorf("audited = %q, want %q", operations, tt.want)
+			}
+
+			// Each record is also put to an object of its own under the day and the instance, in the order
+			// of the calls within each invocation.
+			keys := s3Svc.keys("audit", "2020-01-02/i-1/")
+			if len(keys) != len(tt.want) {
+				t.Fatalf("audit objects = %q, want %d records", keys, len(tt.want))
+			}
+			var objects []string
+			for _, key := range keys {
+				var record AuditRecord
+				if err := json.Unmarshal(s3Svc.object("audit", key), &record); err != nil {
+					t.Fatalf("audit object %s: %v", key, err)
+				}
+				if record.Instance != "i-1" || !strings.HasSuffix(key, strings.ReplaceAll(record.Operation, ":", ".")+".json") {
+					t.Errorf("audit object %s = %+v, want the record of i-1 named after its operation", key, record)
+				}
+				objects = append(objects, record.Operation)
+			}
+			sort.Strings(objects)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(objects, want) {
+				t.Errorf("audit objects = %q, want %q", objects, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// sqsHandler drains the instance of each record of an SQS batch, so that a large scale-in needs fewer
+// invocations. A record is the lifecycle event forwarded by EventBridge or its bare detail. Records that
+// failed or still have tasks are reported as batch item failures and SQS delivers them again after the
+// visibility timeout, which takes the place of the Step Functions loop. Sessions are shared across records.
+// Up to `BATCH_CONCURRENCY` records are drained at once; the ones not started before ctx is done fail.
+func (d *Drainer) sqsHandler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	concurrency := d.config.BatchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	errs := make([]error, len(sqsEvent.Records))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				errs[index] = d.drainSQSMessage(ctx, sqsEvent.Records[index])
+			}
+		}()
+	}
+
+feed:
+	for i := range sqsEvent.Records {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			for ; i < len(sqsEvent.Records); i++ {
+				errs[i] = ctx.Err()
+			}
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	// The failures are reported in the order of the records whichever finished first.
+	var response events.SQSEventResponse
+	for i, message := range sqsEvent.Records {
+		if err := errs[i]; err != nil {
+			d.logger.warnf("failed to drain by SQS message %q: %v", message.MessageId, err)
+			response.BatchItemFailures = append(response.BatchItemFailures,
+				events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+		}
+	}
+	return response, nil
+}
+
+func (d *Drainer) drainSQSMessage(ctx context.Context, message events.SQSMessage) error {
+	var evt *events.CloudWatchEvent
+	if err := json.Unmarshal([]byte(message.Body), &evt); err != nil {
+		return err
+	}
+	if evt == nil || evt.DetailType == "" {
+		evt = &events.CloudWatchEvent{
+			DetailType: DetailTypeTerminateLifecycle,
+			Region:     message.AWSRegion,
+			Detail:     json.RawMessage(message.Body),
+		}
+	}
+
+	evt, err := d.handleEvent(ctx, evt)
+	if err != nil || evt == nil {
+		return err
+	}
+	var detail *CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+		return err
+	}
+	if detail.Wait {
+		return fmt.Errorf("tasks on %q are still draining", detail.EC2InstanceId)
+	}
+	return nil
+}
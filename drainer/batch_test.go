@@ -0,0 +1,158 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestDrainerSQSHandler(t *testing.T) {
+	f := newTestDrainFixture()
+	f.stopTask()
+	userData := "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n"
+	records := []events.SQSMessage{{MessageId: "invalid", Body: "{"}}
+	for _, instanceID := range []string{"i-sqs-1", "i-sqs-2", "i-sqs-3"} {
+		f.ecs.addContainerInstance("default", "ci-"+instanceID, instanceID)
+		f.ec2.addInstance(instanceID, userData)
+		detail := *f.detail
+		detail.EC2InstanceId = instanceID
+		detail.LifecycleActionToken = "token-" + instanceID
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, events.SQSMessage{MessageId: instanceID, Body: string(body)})
+	}
+	// The last record is the event forwarded by EventBridge rather than its bare detail.
+	body, err := json.Marshal(testEvent(t, f.detail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = append(records, events.SQSMessage{MessageId: "i-1", Body: string(body)})
+	// Completing the lifecycle action of i-sqs-2 fails.
+	f.autoscaling.fail("CompleteLifecycleAction", nil, awserr.New("AccessDeniedException", "denied", nil))
+	d, _ := newTestDrainer(t, f.clients)
+
+	response, err := d.sqsHandler(context.Background(), events.SQSEvent{Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []events.SQSBatchItemFailure{{ItemIdentifier: "invalid"}, {ItemIdentifier: "i-sqs-2"}}
+	if !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", response.BatchItemFailures, want)
+	}
+	var completed []string
+	for _, completion := range f.autoscaling.completions {
+		completed = append(completed, aws.StringValue(completion.LifecycleActionToken))
+	}
+	if want := []string{"token-i-sqs-1", "token-i-sqs-3", "token"}; !reflect.DeepEqual(completed, want) {
+		t.Errorf("completed tokens = %v, want %v", completed, want)
+	}
+}
+
+func TestDrainerSQSHandlerConcurrent(t *testing.T) {
+	t.Setenv("BATCH_CONCURRENCY", "3")
+	f := newTestDrainFixture()
+	// i-1 still runs its task, while the instances of the batch have none.
+	userData := "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n"
+	var records []events.SQSMessage
+	for _, instanceID := range []string{"i-1", "i-batch-1", "i-batch-2", "i-batch-3"} {
+		if instanceID != "i-1" {
+			f.ecs.addContainerInstance("default", "ci-"+instanceID, instanceID)
+			f.ec2.addInstance(instanceID, userData)
+		}
+		detail := *f.detail
+		detail.EC2InstanceId = instanceID
+		detail.LifecycleActionToken = "token-" + instanceID
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, events.SQSMessage{MessageId: instanceID, Body: string(body)})
+	}
+	records = append(records, events.SQSMessage{MessageId: "invalid", Body: "{"})
+	d, _ := newTestDrainer(t, f.clients)
+
+	response, err := d.sqsHandler(context.Background(), events.SQSEvent{Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []events.SQSBatchItemFailure{{ItemIdentifier: "i-1"}, {ItemIdentifier: "invalid"}}
+	if !reflect.DeepEqual(response.BatchItemFailures, want) {
+		t.Errorf("BatchItemFailures = %v, want %v", response.BatchItemFailures, want)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 3 {
+		t.Errorf("completions = %v, want the 3 instances without tasks completed", got)
+	}
+}
+
+func TestDrainerSQSHandlerCanceled(t *testing.T) {
+	f := newTestDrainFixture()
+	body, err := json.Marshal(f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := newTestDrainer(t, f.clients)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	records := []events.SQSMessage{{MessageId: "1", Body: string(body)}, {MessageId: "2", Body: string(body)}}
+	response, err := d.sqsHandler(ctx, events.SQSEvent{Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(response.BatchItemFailures); got != 2 {
+		t.Errorf("BatchItemFailures = %v, want both records failed", response.BatchItemFailures)
+	}
+}
+
+func TestDrainerSQSHandlerLargeBatch(t *testing.T) {
+	t.Setenv("BATCH_CONCURRENCY", "10")
+	t.Setenv("MAX_RETRIES", "10")
+	t.Setenv("BASE_DELAY_MS", "1")
+	f := newTestDrainFixture()
+	var records []events.SQSMessage
+	for i := 0; i < 200; i++ {
+		instanceID := fmt.Sprintf("i-bulk-%d", i)
+		f.ecs.addContainerInstance("default", "ci-"+instanceID, instanceID)
+		detail := *f.detail
+		detail.ClusterName = "default"
+		detail.EC2InstanceId = instanceID
+		detail.LifecycleActionToken = "token-" + instanceID
+		body, err := json.Marshal(detail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, events.SQSMessage{MessageId: instanceID, Body: string(body)})
+	}
+	// Throttled completions are retried, while the others fail their records.
+	var errs []error
+	for i := 0; i < 5; i++ {
+		errs = append(errs, awserr.New("Throttling", "Rate exceeded", nil))
+	}
+	for i := 0; i < 5; i++ {
+		errs = append(errs, awserr.New("InternalFailure", "internal failure", nil))
+	}
+	f.autoscaling.fail("CompleteLifecycleAction", errs...)
+	d, _ := newTestDrainer(t, f.clients)
+
+	response, err := d.sqsHandler(context.Background(), events.SQSEvent{Records: records})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(response.BatchItemFailures); got != 5 {
+		t.Errorf("BatchItemFailures = %d, want the 5 failed completions", got)
+	}
+	if got := len(f.autoscaling.completedResults()); got != 195 {
+		t.Errorf("completions = %d, want 195", got)
+	}
+	if got := f.autoscaling.count("CompleteLifecycleAction"); got != 205 {
+		t.Errorf("CompleteLifecycleAction calls = %d, want 205 with the retries", got)
+	}
+}
@@ -0,0 +1,63 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// countActiveTasksByGroup counts the active tasks on the container instance by their group, e.g. `service:web`.
+// It only looks at the tasks that the task check already described, so it calls no API.
+func countActiveTasksByGroup(svc *ecsClient, containerInstanceArn *string) map[string]int {
+	counts := make(map[string]int)
+	for _, task := range svc.tasks {
+		if aws.StringValue(task.ContainerInstanceArn) != aws.StringValue(containerInstanceArn) ||
+			!isActiveTaskStatus(aws.StringValue(task.LastStatus)) {
+			continue
+		}
+		counts[aws.StringValue(task.Group)]++
+	}
+	return counts
+}
+
+// reportRemainingTasks logs which groups keep tasks on the container instance, and puts their counts as
+// `RemainingTasksByGroup` metrics when `ENABLE_GROUP_METRICS` is also enabled.
+func (d *Drainer) reportRemainingTasks(ctx context.Context, lg *logger, clients *awsClients,
+	dimensions []*cloudwatch.Dimension, svc *ecsClient, containerInstanceArn *string) {
+	counts := countActiveTasksByGroup(svc, containerInstanceArn)
+	if len(counts) == 0 {
+		return
+	}
+
+	groups := make([]string, 0, len(counts))
+	for group := range counts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	summary := make([]string, 0, len(groups))
+	var data []*cloudwatch.MetricDatum
+	for _, group := range groups {
+		kind, name := "group", group
+		if strings.HasPrefix(group, "service:") {
+			kind, name = "service", strings.TrimPrefix(group, "service:")
+		}
+		summary = append(summary, fmt.Sprintf("%s=%s count=%d", kind, name, counts[group]))
+		data = append(data, &cloudwatch.MetricDatum{
+			MetricName: aws.String("RemainingTasksByGroup"),
+			Dimensions: append(dimensions[:len(dimensions):len(dimensions)],
+				&cloudwatch.Dimension{Name: aws.String("Group"), Value: aws.String(group)}),
+			Unit:  aws.String(cloudwatch.StandardUnitCount),
+			Value: aws.Float64(float64(counts[group])),
+		})
+	}
+	lg.log(LogLevelInfo, "tasks remain: "+strings.Join(summary, ", "), logFields{"remainingByGroup": counts})
+
+	if d.config.GroupMetrics {
+		d.putMetricData(ctx, clients.cloudwatch, data)
+	}
+}
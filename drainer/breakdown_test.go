@@ -0,0 +1,65 @@
+package drainer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerDrainRemainingTasksByGroup(t *testing.T) {
+	t.Setenv("ENABLE_METRICS", "true")
+	t.Setenv("ENABLE_GROUP_METRICS", "true")
+	f := newTestDrainFixture()
+	svc := &fakeCloudWatch{}
+	f.clients.cloudwatch = svc
+	// Two tasks of the api service and task-1 of the web family remain; a stopped task and a task of
+	// another instance do not.
+	api1 := f.ecs.addTask("default", "task-2", f.containerInstance, "api")
+	api2 := f.ecs.addTask("default", "task-3", f.containerInstance, "api")
+	f.ecs.addService("default", "api", api1, api2)
+	stopped := f.ecs.addTask("default", "task-4", f.containerInstance, "web")
+	other := f.ecs.addContainerInstance("default", "ci-2", "i-2")
+	f.ecs.addTask("default", "task-5", other, "web")
+	f.ecs.stateMu.Lock()
+	stopped.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	stopped.LastStatus = aws.String(ecs.DesiredStatusStopped)
+	f.ecs.stateMu.Unlock()
+	d, out := newTestDrainer(t, f.clients)
+
+	if _, err := d.Drain(context.Background(), f.detail); err != nil {
+		t.Fatal(err)
+	}
+	var summary map[string]interface{}
+	for _, line := range logLines(t, out) {
+		if strings.HasPrefix(line["msg"].(string), "tasks remain: ") {
+			summary = line
+		}
+	}
+	if summary == nil || summary["msg"] != "tasks remain: group=family:web count=1, service=api count=2" {
+		t.Fatalf("summary = %v, want the remaining tasks by group", summary)
+	}
+	want := map[string]interface{}{"family:web": float64(1), "service:api": float64(2)}
+	if got := summary["remainingByGroup"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("remainingByGroup = %v, want %v", got, want)
+	}
+
+	counts := make(map[string]float64)
+	for _, datum := range svc.metrics("RemainingTasksByGroup") {
+		for _, dimension := range datum.Dimensions {
+			if aws.StringValue(dimension.Name) == "Group" {
+				counts[aws.StringValue(dimension.Value)] = aws.Float64Value(datum.Value)
+			}
+		}
+	}
+	if want := map[string]float64{"family:web": 1, "service:api": 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("RemainingTasksByGroup = %v, want %v", counts, want)
+	}
+	// The breakdown reuses the tasks that the task check described.
+	if got := f.ecs.count("DescribeTasks"); got != 2 {
+		t.Errorf("DescribeTasks calls = %d, want one per desired status", got)
+	}
+}
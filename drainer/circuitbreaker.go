@@ -0,0 +1,120 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const CompletionTypeCircuitBroken = "DrainCircuitBroken"
+
+// breakCircuit counts the failed invocation for the lifecycle action in `STATE_TABLE`, and after
+// `MAX_FAILED_ATTEMPTS` completes the lifecycle action with `ERROR_LIFECYCLE_ACTION_RESULT` and alerts the
+// escalation destinations, so that a persistent failure, e.g. a missing permission, does not leave the instance
+// hanging until the hook times out. It reports whether it completed the lifecycle action.
+func (d *Drainer) breakCircuit(evt *events.CloudWatchEvent, drainErr error) bool {
+	maxAttempts := d.config.MaxFailedAttempts
+	if maxAttempts <= 0 {
+		return false
+	}
+	var detail *CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil || detail == nil || detail.LifecycleActionToken == "" {
+		return false
+	}
+
+	lg := d.logger.with(logFields{"instanceId": detail.EC2InstanceId, "asg": detail.AutoScalingGroupName})
+	clients := d.newClients(evt)
+	// The context of the invocation may be done already.
+	ctx, cancel := context.WithTimeout(context.Background(), finalCallTimeout)
+	defer cancel()
+
+	attempts, err := d.recordFailedAttempt(ctx, clients, detail)
+	if err != nil {
+		lg.warnf("failed to record the failed attempt: %v", err)
+		return false
+	}
+	if attempts < maxAttempts {
+		lg.warnf("attempt %d of %d failed: %v", attempts, maxAttempts, drainErr)
+		return false
+	}
+
+	result := d.getErrorLifecycleActionResult(detail)
+	lg.errorf("failed %d times, completing with %s: %v", attempts, result, drainErr)
+	if err := d.complete(ctx, clients.autoscaling, detail, result); err != nil {
+		lg.errorf("failed to complete the lifecycle action after %d failures: %v", attempts, err)
+		return false
+	}
+	d.releaseDrainLease(ctx, clients, detail)
+
+	payload := &CompletionPayload{
+		Type:                 CompletionTypeCircuitBroken,
+		ClusterName:          detail.ClusterName,
+		AutoScalingGroupName: detail.AutoScalingGroupName,
+		EC2InstanceId:        detail.EC2InstanceId,
+		Outcome:              drainOutcome(detail, result),
+	}
+	if topicArn := d.config.EscalationSNSTopicArn; topicArn != "" {
+		if err := publishSNS(ctx, clients.sns, topicArn, payload); err != nil {
+			lg.warnf("failed to publish the broken circuit: %v", err)
+		}
+	}
+	if url := d.config.EscalationWebhookURL; url != "" {
+		if err := d.postWebhook(ctx, clients, url, payload); err != nil {
+			lg.warnf("failed to post the broken circuit webhook: %v", err)
+		}
+	}
+	return true
+}
+
+// recordFailedAttempt increments the failed attempts of the lifecycle action in `STATE_TABLE` and returns them.
+// A stored item of another lifecycle action is replaced as a whole, so that neither its attempts nor its drain
+// status and start time carry over to this one.
+func (d *Drainer) recordFailedAttempt(ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail) (int,
+	error) {
+	table := d.config.StateTable
+	if table == "" {
+		return 0, nil
+	}
+	svc := clients.dynamodb
+	token := &dynamodb.AttributeValue{S: &detail.LifecycleActionToken}
+	output, err := svc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &table,
+		Key:                 drainStateKey(detail),
+		UpdateExpression:    aws.String("ADD FailedAttempts :one"),
+		ConditionExpression: aws.String("LifecycleActionToken = :token"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token": token,
+			":one":   {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err == nil {
+		return strconv.Atoi(aws.StringValue(output.Attributes["FailedAttempts"].N))
+	}
+	if !isConditionalCheckFailed(err) {
+		return 0, err
+	}
+
+	_, err = svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: &table,
+		Item: map[string]*dynamodb.AttributeValue{
+			"EC2InstanceId":        {S: aws.String(detail.instanceKey())},
+			"LifecycleActionToken": token,
+			"FailedAttempts":       {N: aws.String("1")},
+		},
+		ConditionExpression:       aws.String("attribute_not_exists(EC2InstanceId) OR LifecycleActionToken <> :token"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":token": token},
+	})
+	if isConditionalCheckFailed(err) {
+		// Another invocation recorded the lifecycle action first.
+		return d.recordFailedAttempt(ctx, clients, detail)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
@@ -0,0 +1,74 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestDrainerBreakCircuit(t *testing.T) {
+	t.Setenv("STATE_TABLE", "state")
+	t.Setenv("MAX_FAILED_ATTEMPTS", "3")
+	t.Setenv("ERROR_LIFECYCLE_ACTION_RESULT", LifecycleActionResultAbandon)
+	f := newTestDrainFixture()
+	svc := newFakeDynamoDB()
+	svc.addTable("state", "EC2InstanceId")
+	f.clients.dynamodb = svc
+	d, out := newTestDrainer(t, f.clients)
+	evt := testEvent(t, f.detail)
+	failing := func(context.Context, *events.CloudWatchEvent) (*events.CloudWatchEvent, error) {
+		return nil, errors.New("AccessDeniedException")
+	}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		if _, err := d.recoverFailure(context.Background(), evt, failing); err == nil {
+			t.Fatalf("recoverFailure() = nil at attempt %d, want the error of the drain", attempt)
+		}
+		if got := f.autoscaling.completedResults(); attempt < 3 && len(got) != 0 {
+			t.Fatalf("completions after attempt %d = %v, want none below `MAX_FAILED_ATTEMPTS`", attempt, got)
+		}
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultAbandon {
+		t.Errorf("completions = %v, want a single ABANDON", got)
+	}
+	if got := aws.StringValue(svc.item("state", "i-1")["FailedAttempts"].N); got != "3" {
+		t.Errorf("FailedAttempts = %s, want 3", got)
+	}
+	for _, want := range []string{"attempt 2 of 3 failed", "failed 3 times"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log = %q, want %q", out.String(), want)
+		}
+	}
+
+	// The attempts of another lifecycle action of the instance do not count, nor does its drain state.
+	if _, err := svc.PutItemWithContext(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String("state"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"EC2InstanceId":        {S: aws.String("i-1")},
+			"LifecycleActionToken": {S: aws.String("token")},
+			"FailedAttempts":       {N: aws.String("3")},
+			"Status":               {S: aws.String(DrainStatusCompleted)},
+			"DrainStartedAt":       {S: aws.String("2020-01-02T03:04:05Z")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.detail.LifecycleActionToken = "token-2"
+	if _, err := d.recoverFailure(context.Background(), testEvent(t, f.detail), failing); err == nil {
+		t.Fatal("recoverFailure() = nil, want the error of the drain")
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 {
+		t.Errorf("completions = %v, want the new lifecycle action not completed", got)
+	}
+	if got := aws.StringValue(svc.item("state", "i-1")["FailedAttempts"].N); got != "1" {
+		t.Errorf("FailedAttempts = %s, want 1 for the new lifecycle action", got)
+	}
+	if item := svc.item("state", "i-1"); item["Status"] != nil || item["DrainStartedAt"] != nil {
+		t.Errorf("item = %v, want the drain state of the former lifecycle action cleared", item)
+	}
+}
@@ -0,0 +1,219 @@
+package drainer
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+)
+
+// ecsAPI is the subset of the ECS client that the drain flow calls, so that it can be replaced by a fake.
+type ecsAPI interface {
+	DeleteAttributesWithContext(
+		aws.Context, *ecs.DeleteAttributesInput, ...request.Option) (*ecs.DeleteAttributesOutput, error)
+	DeregisterContainerInstanceWithContext(aws.Context, *ecs.DeregisterContainerInstanceInput,
+		...request.Option) (*ecs.DeregisterContainerInstanceOutput, error)
+	DescribeClustersWithContext(
+		aws.Context, *ecs.DescribeClustersInput, ...request.Option) (*ecs.DescribeClustersOutput, error)
+	DescribeContainerInstancesWithContext(
+		aws.Context, *ecs.DescribeContainerInstancesInput, ...request.Option) (*ecs.DescribeContainerInstancesOutput, error)
+	DescribeTaskDefinitionWithContext(
+		aws.Context, *ecs.DescribeTaskDefinitionInput, ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error)
+	DescribeServicesWithContext(
+		aws.Context, *ecs.DescribeServicesInput, ...request.Option) (*ecs.DescribeServicesOutput, error)
+	DescribeTasksWithContext(aws.Context, *ecs.DescribeTasksInput, ...request.Option) (*ecs.DescribeTasksOutput, error)
+	GetTaskProtectionWithContext(
+		aws.Context, *ecs.GetTaskProtectionInput, ...request.Option) (*ecs.GetTaskProtectionOutput, error)
+	ListClustersPagesWithContext(
+		aws.Context, *ecs.ListClustersInput, func(*ecs.ListClustersOutput, bool) bool, ...request.Option) error
+	ListContainerInstancesPagesWithContext(aws.Context, *ecs.ListContainerInstancesInput,
+		func(*ecs.ListContainerInstancesOutput, bool) bool, ...request.Option) error
+	ListServicesPagesWithContext(
+		aws.Context, *ecs.ListServicesInput, func(*ecs.ListServicesOutput, bool) bool, ...request.Option) error
+	ListTagsForResourceWithContext(
+		aws.Context, *ecs.ListTagsForResourceInput, ...request.Option) (*ecs.ListTagsForResourceOutput, error)
+	ListTasksPagesWithContext(
+		aws.Context, *ecs.ListTasksInput, func(*ecs.ListTasksOutput, bool) bool, ...request.Option) error
+	PutAttributesWithContext(aws.Context, *ecs.PutAttributesInput, ...request.Option) (*ecs.PutAttributesOutput, error)
+	StopTaskWithContext(aws.Context, *ecs.StopTaskInput, ...request.Option) (*ecs.StopTaskOutput, error)
+	UpdateContainerInstancesStateWithContext(aws.Context, *ecs.UpdateContainerInstancesStateInput,
+		...request.Option) (*ecs.UpdateContainerInstancesStateOutput, error)
+}
+
+// ec2API is the subset of the EC2 client that the drain flow calls.
+type ec2API interface {
+	CreateTagsWithContext(aws.Context, *ec2.CreateTagsInput, ...request.Option) (*ec2.CreateTagsOutput, error)
+	DescribeInstanceAttributeWithContext(
+		aws.Context, *ec2.DescribeInstanceAttributeInput, ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error)
+	DescribeInstancesWithContext(
+		aws.Context, *ec2.DescribeInstancesInput, ...request.Option) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceStatusWithContext(
+		aws.Context, *ec2.DescribeInstanceStatusInput, ...request.Option) (*ec2.DescribeInstanceStatusOutput, error)
+	DescribeTagsWithContext(aws.Context, *ec2.DescribeTagsInput, ...request.Option) (*ec2.DescribeTagsOutput, error)
+}
+
+// autoscalingAPI is the subset of the Auto Scaling client that the drain flow calls.
+type autoscalingAPI interface {
+	CompleteLifecycleActionWithContext(aws.Context, *autoscaling.CompleteLifecycleActionInput,
+		...request.Option) (*autoscaling.CompleteLifecycleActionOutput, error)
+	DescribeAutoScalingInstancesWithContext(aws.Context, *autoscaling.DescribeAutoScalingInstancesInput,
+		...request.Option) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
+	DescribeLifecycleHooksWithContext(aws.Context, *autoscaling.DescribeLifecycleHooksInput,
+		...request.Option) (*autoscaling.DescribeLifecycleHooksOutput, error)
+	RecordLifecycleActionHeartbeatWithContext(aws.Context, *autoscaling.RecordLifecycleActionHeartbeatInput,
+		...request.Option) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error)
+}
+
+// elbv2API is the subset of the Elastic Load Balancing v2 client that the drain flow calls.
+type elbv2API interface {
+	DescribeTargetGroupsPagesWithContext(aws.Context, *elbv2.DescribeTargetGroupsInput,
+		func(*elbv2.DescribeTargetGroupsOutput, bool) bool, ...request.Option) error
+	DescribeTargetHealthWithContext(
+		aws.Context, *elbv2.DescribeTargetHealthInput, ...request.Option) (*elbv2.DescribeTargetHealthOutput, error)
+}
+
+// cloudtrailAPI is the subset of the CloudTrail client that resolves the cluster of an instance.
+type cloudtrailAPI interface {
+	LookupEventsPagesWithContext(aws.Context, *cloudtrail.LookupEventsInput,
+		func(*cloudtrail.LookupEventsOutput, bool) bool, ...request.Option) error
+}
+
+// dynamodbAPI is the subset of the DynamoDB client that the tables of the function call.
+type dynamodbAPI interface {
+	DeleteItemWithContext(
+		aws.Context, *dynamodb.DeleteItemInput, ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(aws.Context, *dynamodb.PutItemInput, ...request.Option) (*dynamodb.PutItemOutput, error)
+	UpdateItemWithContext(
+		aws.Context, *dynamodb.UpdateItemInput, ...request.Option) (*dynamodb.UpdateItemOutput, error)
+}
+
+// cloudwatchAPI is the subset of the CloudWatch client that publishes the metrics.
+type cloudwatchAPI interface {
+	PutMetricDataWithContext(
+		aws.Context, *cloudwatch.PutMetricDataInput, ...request.Option) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// snsAPI is the subset of the SNS client that publishes the notifications and escalations.
+type snsAPI interface {
+	PublishWithContext(aws.Context, *sns.PublishInput, ...request.Option) (*sns.PublishOutput, error)
+}
+
+// eventbridgeAPI is the subset of the EventBridge client that puts the drain events.
+type eventbridgeAPI interface {
+	PutEventsWithContext(
+		aws.Context, *eventbridge.PutEventsInput, ...request.Option) (*eventbridge.PutEventsOutput, error)
+}
+
+// s3API is the subset of the S3 client that appends the decision and audit logs.
+type s3API interface {
+	GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error)
+	PutObjectWithContext(aws.Context, *s3.PutObjectInput, ...request.Option) (*s3.PutObjectOutput, error)
+}
+
+// timestreamAPI is the subset of the Timestream client that writes the decision records.
+type timestreamAPI interface {
+	WriteRecordsWithContext(aws.Context, *timestreamwrite.WriteRecordsInput,
+		...request.Option) (*timestreamwrite.WriteRecordsOutput, error)
+}
+
+// secretsmanagerAPI is the subset of the Secrets Manager client that gets the webhook signing secret.
+type secretsmanagerAPI interface {
+	GetSecretValueWithContext(aws.Context, *secretsmanager.GetSecretValueInput,
+		...request.Option) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// awsClients are the clients of a single invocation. Those acting on the instance may assume a role in its
+// account, so the best-effort integrations such as metrics and the tables of the function use the Lambda's own
+// session.
+type awsClients struct {
+	ecs          *ecsClient
+	ec2          ec2API
+	autoscaling  autoscalingAPI
+	elbv2        elbv2API
+	cloudtrail   cloudtrailAPI
+	clusterIndex dynamodbAPI
+
+	dynamodb       dynamodbAPI
+	cloudwatch     cloudwatchAPI
+	sns            snsAPI
+	eventbridge    eventbridgeAPI
+	s3             s3API
+	timestream     timestreamAPI
+	secretsmanager secretsmanagerAPI
+
+	// apiCalls counts the calls of the invocation when `ENABLE_API_CALL_METRICS` is enabled.
+	apiCalls *apiCallCounter
+}
+
+// ClientFactory returns the clients of an invocation configured by config handling evt.
+type ClientFactory func(config *Config, evt *events.CloudWatchEvent) *awsClients
+
+// newClients returns the clients of the SDK for evt. They use the region of the event when `USE_EVENT_REGION`
+// is enabled. The calls are traced with X-Ray when `ENABLE_XRAY` is enabled, and counted when
+// `ENABLE_API_CALL_METRICS` is enabled.
+func (f *awsClientFactory) newClients(config *Config, evt *events.CloudWatchEvent) *awsClients {
+	region := ""
+	if config.UseEventRegion {
+		region = evt.Region
+	}
+	sess := f.sessions.get(region)
+	if config.XRay {
+		sess = traceSession(sess)
+	}
+	var counter *apiCallCounter
+	if config.APICallMetrics {
+		sess, counter = countAPICalls(sess)
+	}
+	target := f.targetSession(config, sess, evt)
+	return &awsClients{
+		ecs:            newECSClient(ecs.New(target)),
+		ec2:            ec2.New(target),
+		autoscaling:    autoscaling.New(target),
+		elbv2:          elbv2.New(target),
+		cloudtrail:     cloudtrail.New(target),
+		clusterIndex:   dynamodb.New(target),
+		dynamodb:       dynamodb.New(sess),
+		cloudwatch:     cloudwatch.New(sess),
+		sns:            sns.New(sess),
+		eventbridge:    eventbridge.New(sess),
+		s3:             s3.New(sess),
+		timestream:     timestreamwrite.New(sess),
+		secretsmanager: secretsmanager.New(sess),
+		apiCalls:       counter,
+	}
+}
+
+// newClients returns the clients of the invocation handling evt, with the calls changing the instance, its tasks
+// or its lifecycle action wrapped for `DRY_RUN`, `OBSERVER_MODE` and `ENABLE_AUDIT_LOG`.
+func (d *Drainer) newClients(evt *events.CloudWatchEvent) *awsClients {
+	clients := *d.clients(d.config, evt)
+	ecsSvc, ec2Svc, autoscalingSvc := clients.ecs.ecsAPI, clients.ec2, clients.autoscaling
+	if d.isDryRun() {
+		ecsSvc = dryRunECS{ecsSvc, d.logger}
+		ec2Svc = dryRunEC2{ec2Svc, d.logger}
+		autoscalingSvc = dryRunAutoscaling{autoscalingSvc, d.logger}
+	}
+	if d.isObserverMode() {
+		autoscalingSvc = observerAutoscaling{autoscalingSvc, d.logger}
+	}
+	if d.isAuditing() {
+		a := newAuditor(d, &clients, evt)
+		ecsSvc, ec2Svc, autoscalingSvc = auditECS{ecsSvc, a}, auditEC2{ec2Svc, a}, auditAutoscaling{autoscalingSvc, a}
+	}
+	clients.ecs, clients.ec2, clients.autoscaling = newECSClient(ecsSvc), ec2Svc, autoscalingSvc
+	clients.ecs.describeBatchRetries, clients.ecs.clock = d.config.DescribeBatchRetries, d.clock
+	clients.ecs.includeTags = d.config.RespectTaskDrainTag
+	return &clients
+}
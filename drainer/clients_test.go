@@ -0,0 +1,1575 @@
+package drainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+)
+
+const (
+	testRegion  = "us-east-1"
+	testAccount = "123456789012"
+)
+
+func testClusterArn(clusterName string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:cluster/%s", testRegion, testAccount, clusterName)
+}
+
+func testContainerInstanceArn(clusterName, id string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:container-instance/%s/%s", testRegion, testAccount, clusterName, id)
+}
+
+func testTaskArn(clusterName, id string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:task/%s/%s", testRegion, testAccount, clusterName, id)
+}
+
+func testServiceArn(clusterName, name string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:service/%s/%s", testRegion, testAccount, clusterName, name)
+}
+
+func testTaskDefinitionArn(family string) string {
+	return fmt.Sprintf("arn:aws:ecs:%s:%s:task-definition/%s:1", testRegion, testAccount, family)
+}
+
+// fakeCalls counts the calls of a fake by operation and returns the errors queued for them.
+type fakeCalls struct {
+	mu     sync.Mutex
+	counts map[string]int
+	errs   map[string][]error
+}
+
+// call records a call of operation and returns the next error queued for it, if any.
+func (c *fakeCalls) call(operation string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[operation]++
+	if errs := c.errs[operation]; len(errs) > 0 {
+		c.errs[operation] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// count returns how many times operation was called.
+func (c *fakeCalls) count(operation string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[operation]
+}
+
+// operations returns the operations called, in order of their names.
+func (c *fakeCalls) operations() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	operations := make([]string, 0, len(c.counts))
+	for operation := range c.counts {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+// fail queues errs to be returned by the next calls of operation, one per call.
+func (c *fakeCalls) fail(operation string, errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.errs == nil {
+		c.errs = make(map[string][]error)
+	}
+	c.errs[operation] = append(c.errs[operation], errs...)
+}
+
+func throttlingError() error {
+	return awserr.New("ThrottlingException", "Rate exceeded", nil)
+}
+
+// fakeECS is an in-memory ECS. The task counts of the container instances are derived from their tasks.
+type fakeECS struct {
+	fakeCalls
+	// pageSize bounds the ARNs of a page of the listings, 100 if it is zero.
+	pageSize int
+	// emptyFirstTaskPage makes the task listings return an empty first page, as ECS may with a filter.
+	emptyFirstTaskPage bool
+	// onDescribeContainerInstances is called by each description of container instances, outside of the lock.
+	onDescribeContainerInstances func()
+	// onPage is called for each page of the listings.
+	onPage func()
+
+	stateMu            sync.Mutex
+	clusters           map[string]*ecs.Cluster
+	containerInstances map[string][]*ecs.ContainerInstance
+	tasks              map[string][]*ecs.Task
+	services           map[string][]*ecs.Service
+	taskDefinitions    map[string]*ecs.TaskDefinition
+	protectedTasks     map[string]bool
+	attributes         map[string]map[string]string
+	stoppedTasks       []string
+	deregistered       []string
+}
+
+func newFakeECS() *fakeECS {
+	return &fakeECS{
+		clusters:           make(map[string]*ecs.Cluster),
+		containerInstances: make(map[string][]*ecs.ContainerInstance),
+		tasks:              make(map[string][]*ecs.Task),
+		services:           make(map[string][]*ecs.Service),
+		taskDefinitions:    make(map[string]*ecs.TaskDefinition),
+		protectedTasks:     make(map[string]bool),
+		attributes:         make(map[string]map[string]string),
+	}
+}
+
+// addCluster adds an ACTIVE cluster if it does not exist yet and returns it.
+func (f *fakeECS) addCluster(clusterName string) *ecs.Cluster {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	return f.addClusterLocked(clusterName)
+}
+
+func (f *fakeECS) addClusterLocked(clusterName string) *ecs.Cluster {
+	if cluster, ok := f.clusters[clusterName]; ok {
+		return cluster
+	}
+	cluster := &ecs.Cluster{
+		ClusterArn:  aws.String(testClusterArn(clusterName)),
+		ClusterName: aws.String(clusterName),
+		Status:      aws.String("ACTIVE"),
+	}
+	f.clusters[clusterName] = cluster
+	return cluster
+}
+
+// addContainerInstance registers an ACTIVE container instance of the EC2 instance in the cluster and returns it.
+func (f *fakeECS) addContainerInstance(clusterName, id, instanceID string) *ecs.ContainerInstance {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	f.addClusterLocked(clusterName)
+	containerInstance := &ecs.ContainerInstance{
+		AgentConnected:       aws.Bool(true),
+		ContainerInstanceArn: aws.String(testContainerInstanceArn(clusterName, id)),
+		Ec2InstanceId:        aws.String(instanceID),
+		Status:               aws.String(ecs.ContainerInstanceStatusActive),
+		VersionInfo:          &ecs.VersionInfo{AgentVersion: aws.String("1.70.0")},
+	}
+	f.containerInstances[clusterName] = append(f.containerInstances[clusterName], containerInstance)
+	return containerInstance
+}
+
+// addTask places a RUNNING task of the family on the container instance and returns it.
+func (f *fakeECS) addTask(clusterName, id string, containerInstance *ecs.ContainerInstance, family string) *ecs.Task {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	task := &ecs.Task{
+		ClusterArn:           aws.String(testClusterArn(clusterName)),
+		ContainerInstanceArn: containerInstance.ContainerInstanceArn,
+		DesiredStatus:        aws.String(ecs.DesiredStatusRunning),
+		Group:                aws.String("family:" + family),
+		LastStatus:           aws.String(ecs.DesiredStatusRunning),
+		LaunchType:           aws.String(ecs.LaunchTypeEc2),
+		TaskArn:              aws.String(testTaskArn(clusterName, id)),
+		TaskDefinitionArn:    aws.String(testTaskDefinitionArn(family)),
+	}
+	f.tasks[clusterName] = append(f.tasks[clusterName], task)
+	if _, ok := f.taskDefinitions[*task.TaskDefinitionArn]; !ok {
+		f.taskDefinitions[*task.TaskDefinitionArn] = &ecs.TaskDefinition{
+			Family:            aws.String(family),
+			TaskDefinitionArn: task.TaskDefinitionArn,
+		}
+	}
+	return task
+}
+
+// addService adds a service to the cluster and makes the tasks belong to it.
+func (f *fakeECS) addService(clusterName, name string, tasks ...*ecs.Task) *ecs.Service {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	service := &ecs.Service{
+		ClusterArn:  aws.String(testClusterArn(clusterName)),
+		ServiceArn:  aws.String(testServiceArn(clusterName, name)),
+		ServiceName: aws.String(name),
+		Status:      aws.String("ACTIVE"),
+	}
+	f.services[clusterName] = append(f.services[clusterName], service)
+	for _, task := range tasks {
+		task.Group = aws.String("service:" + name)
+	}
+	return service
+}
+
+// finishStopping moves the tasks desired to stop to STOPPED, as the agent does after they exit.
+func (f *fakeECS) finishStopping() {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	for _, tasks := range f.tasks {
+		for _, task := range tasks {
+			if aws.StringValue(task.DesiredStatus) == ecs.DesiredStatusStopped {
+				task.LastStatus = aws.String(ecs.DesiredStatusStopped)
+			}
+		}
+	}
+}
+
+// containerInstanceStatus returns the status of the container instance, or "" if it is not registered.
+func (f *fakeECS) containerInstanceStatus(arn string) string {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	if containerInstance := f.findContainerInstanceLocked(arn); containerInstance != nil {
+		return aws.StringValue(containerInstance.Status)
+	}
+	return ""
+}
+
+func (f *fakeECS) findContainerInstanceLocked(arnOrID string) *ecs.ContainerInstance {
+	for _, containerInstances := range f.containerInstances {
+		for _, containerInstance := range containerInstances {
+			arn := aws.StringValue(containerInstance.ContainerInstanceArn)
+			if arn == arnOrID || strings.HasSuffix(arn, "/"+arnOrID) {
+				return containerInstance
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fakeECS) page(arns []*string, nextToken *string) ([]*string, *string) {
+	if f.onPage != nil {
+		f.onPage()
+	}
+	size := f.pageSize
+	if size == 0 {
+		size = 100
+	}
+	var start int
+	if nextToken != nil {
+		fmt.Sscan(*nextToken, &start) // nolint:errcheck
+	}
+	end := start + size
+	if end >= len(arns) {
+		return arns[start:], nil
+	}
+	return arns[start:end], aws.String(fmt.Sprint(end))
+}
+
+func (f *fakeECS) DeleteAttributesWithContext(
+	_ aws.Context, input *ecs.DeleteAttributesInput, _ ...request.Option) (*ecs.DeleteAttributesOutput, error) {
+	if err := f.call("DeleteAttributes"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	for _, attribute := range input.Attributes {
+		delete(f.attributes[aws.StringValue(attribute.TargetId)], aws.StringValue(attribute.Name))
+	}
+	return &ecs.DeleteAttributesOutput{Attributes: input.Attributes}, nil
+}
+
+func (f *fakeECS) DeregisterContainerInstanceWithContext(_ aws.Context, input *ecs.DeregisterContainerInstanceInput,
+	_ ...request.Option) (*ecs.DeregisterContainerInstanceOutput, error) {
+	if err := f.call("DeregisterContainerInstance"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	clusterName := clusterNameFromARN(aws.StringValue(input.Cluster))
+	containerInstance := f.findContainerInstanceLocked(aws.StringValue(input.ContainerInstance))
+	if containerInstance == nil {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "container instance is not registered", nil)
+	}
+	var kept []*ecs.ContainerInstance
+	for _, other := range f.containerInstances[clusterName] {
+		if other != containerInstance {
+			kept = append(kept, other)
+		}
+	}
+	f.containerInstances[clusterName] = kept
+	containerInstance.Status = aws.String("INACTIVE")
+	f.deregistered = append(f.deregistered, aws.StringValue(containerInstance.ContainerInstanceArn))
+	return &ecs.DeregisterContainerInstanceOutput{ContainerInstance: containerInstance}, nil
+}
+
+func (f *fakeECS) DescribeClustersWithContext(
+	_ aws.Context, input *ecs.DescribeClustersInput, _ ...request.Option) (*ecs.DescribeClustersOutput, error) {
+	if err := f.call("DescribeClusters"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	output := &ecs.DescribeClustersOutput{}
+	for _, name := range input.Clusters {
+		if cluster, ok := f.clusters[clusterNameFromARN(aws.StringValue(name))]; ok {
+			output.Clusters = append(output.Clusters, cluster)
+		} else {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: name, Reason: aws.String("MISSING")})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeECS) DescribeContainerInstancesWithContext(_ aws.Context, input *ecs.DescribeContainerInstancesInput,
+	_ ...request.Option) (*ecs.DescribeContainerInstancesOutput, error) {
+	if err := f.call("DescribeContainerInstances"); err != nil {
+		return nil, err
+	}
+	if f.onDescribeContainerInstances != nil {
+		f.onDescribeContainerInstances()
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	output := &ecs.DescribeContainerInstancesOutput{}
+	for _, arn := range input.ContainerInstances {
+		containerInstance := f.findContainerInstanceLocked(aws.StringValue(arn))
+		if containerInstance == nil {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: arn, Reason: aws.String("MISSING")})
+			continue
+		}
+		described := *containerInstance
+		var running, pending int64
+		for _, task := range f.tasks[clusterNameFromARN(aws.StringValue(input.Cluster))] {
+			if aws.StringValue(task.ContainerInstanceArn) != aws.StringValue(containerInstance.ContainerInstanceArn) {
+				continue
+			}
+			switch aws.StringValue(task.LastStatus) {
+			case ecs.DesiredStatusRunning:
+				running++
+			case ecs.DesiredStatusPending:
+				pending++
+			}
+		}
+		described.RunningTasksCount, described.PendingTasksCount = &running, &pending
+		// The attributes put on the container instance are described with its own.
+		described.Attributes = append([]*ecs.Attribute(nil), containerInstance.Attributes...)
+		names := make([]string, 0, len(f.attributes[aws.StringValue(arn)]))
+		for name := range f.attributes[aws.StringValue(arn)] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			described.Attributes = append(described.Attributes, &ecs.Attribute{
+				Name:  aws.String(name),
+				Value: aws.String(f.attributes[aws.StringValue(arn)][name]),
+			})
+		}
+		output.ContainerInstances = append(output.ContainerInstances, &described)
+	}
+	return output, nil
+}
+
+func (f *fakeECS) DescribeTaskDefinitionWithContext(_ aws.Context, input *ecs.DescribeTaskDefinitionInput,
+	_ ...request.Option) (*ecs.DescribeTaskDefinitionOutput, error) {
+	if err := f.call("DescribeTaskDefinition"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	taskDefinition, ok := f.taskDefinitions[aws.StringValue(input.TaskDefinition)]
+	if !ok {
+		return nil, awserr.New(ecs.ErrCodeClientException, "Unable to describe task definition.", nil)
+	}
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: taskDefinition}, nil
+}
+
+func (f *fakeECS) DescribeServicesWithContext(
+	_ aws.Context, input *ecs.DescribeServicesInput, _ ...request.Option) (*ecs.DescribeServicesOutput, error) {
+	if err := f.call("DescribeServices"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	output := &ecs.DescribeServicesOutput{}
+	for _, name := range input.Services {
+		var found *ecs.Service
+		for _, service := range f.services[clusterNameFromARN(aws.StringValue(input.Cluster))] {
+			if aws.StringValue(service.ServiceArn) == aws.StringValue(name) ||
+				aws.StringValue(service.ServiceName) == aws.StringValue(name) {
+				found = service
+			}
+		}
+		if found != nil {
+			output.Services = append(output.Services, found)
+		} else {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: name, Reason: aws.String("MISSING")})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeECS) DescribeTasksWithContext(
+	_ aws.Context, input *ecs.DescribeTasksInput, _ ...request.Option) (*ecs.DescribeTasksOutput, error) {
+	if err := f.call("DescribeTasks"); err != nil {
+		return nil, err
+	}
+	if len(input.Tasks) > maxDescribeTasks {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "too many tasks", nil)
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	output := &ecs.DescribeTasksOutput{}
+	for _, arn := range input.Tasks {
+		var found *ecs.Task
+		for _, task := range f.tasks[clusterNameFromARN(aws.StringValue(input.Cluster))] {
+			if aws.StringValue(task.TaskArn) == aws.StringValue(arn) {
+				described := *task
+				// ECS returns the tags of the tasks only when asked to.
+				if !containsString(aws.StringValueSlice(input.Include), ecs.TaskFieldTags) {
+					described.Tags = nil
+				}
+				found = &described
+			}
+		}
+		if found != nil {
+			output.Tasks = append(output.Tasks, found)
+		} else {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: arn, Reason: aws.String("MISSING")})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeECS) GetTaskProtectionWithContext(
+	_ aws.Context, input *ecs.GetTaskProtectionInput, _ ...request.Option) (*ecs.GetTaskProtectionOutput, error) {
+	if err := f.call("GetTaskProtection"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	output := &ecs.GetTaskProtectionOutput{}
+	for _, arn := range input.Tasks {
+		output.ProtectedTasks = append(output.ProtectedTasks, &ecs.ProtectedTask{
+			ProtectionEnabled: aws.Bool(f.protectedTasks[aws.StringValue(arn)]),
+			TaskArn:           arn,
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeECS) ListClustersPagesWithContext(_ aws.Context, input *ecs.ListClustersInput,
+	fn func(*ecs.ListClustersOutput, bool) bool, _ ...request.Option) error {
+	if err := f.call("ListClusters"); err != nil {
+		return err
+	}
+	f.stateMu.Lock()
+	var arns []*string
+	for _, cluster := range f.clusters {
+		arns = append(arns, cluster.ClusterArn)
+	}
+	f.stateMu.Unlock()
+	sort.Slice(arns, func(i, j int) bool { return *arns[i] < *arns[j] })
+	for token := input.NextToken; ; {
+		var page []*string
+		page, token = f.page(arns, token)
+		if !fn(&ecs.ListClustersOutput{ClusterArns: page, NextToken: token}, token == nil) || token == nil {
+			return nil
+		}
+	}
+}
+
+func (f *fakeECS) ListContainerInstancesPagesWithContext(_ aws.Context, input *ecs.ListContainerInstancesInput,
+	fn func(*ecs.ListContainerInstancesOutput, bool) bool, _ ...request.Option) error {
+	if err := f.call("ListContainerInstances"); err != nil {
+		return err
+	}
+	f.stateMu.Lock()
+	var arns []*string
+	for _, containerInstance := range f.containerInstances[clusterNameFromARN(aws.StringValue(input.Cluster))] {
+		if (input.Status == nil || aws.StringValue(input.Status) == aws.StringValue(containerInstance.Status)) &&
+			matchesAttributeFilter(containerInstance, aws.StringValue(input.Filter)) {
+			arns = append(arns, containerInstance.ContainerInstanceArn)
+		}
+	}
+	f.stateMu.Unlock()
+	for token := input.NextToken; ; {
+		var page []*string
+		page, token = f.page(arns, token)
+		if !fn(&ecs.ListContainerInstancesOutput{ContainerInstanceArns: page, NextToken: token}, token == nil) ||
+			token == nil {
+			return nil
+		}
+	}
+}
+
+// matchesAttributeFilter reports whether the container instance matches a cluster query language filter of the form
+// `attribute:name == value`, the only one used, or the filter is empty.
+func matchesAttributeFilter(containerInstance *ecs.ContainerInstance, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(filter, "attribute:"), " == ", 2)
+	for _, attribute := range containerInstance.Attributes {
+		if len(parts) == 2 && aws.StringValue(attribute.Name) == parts[0] && aws.StringValue(attribute.Value) == parts[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeECS) ListServicesPagesWithContext(_ aws.Context, input *ecs.ListServicesInput,
+	fn func(*ecs.ListServicesOutput, bool) bool, _ ...request.Option) error {
+	if err := f.call("ListServices"); err != nil {
+		return err
+	}
+	f.stateMu.Lock()
+	var arns []*string
+	for _, service := range f.services[clusterNameFromARN(aws.StringValue(input.Cluster))] {
+		arns = append(arns, service.ServiceArn)
+	}
+	f.stateMu.Unlock()
+	for token := input.NextToken; ; {
+		var page []*string
+		page, token = f.page(arns, token)
+		if !fn(&ecs.ListServicesOutput{ServiceArns: page, NextToken: token}, token == nil) || token == nil {
+			return nil
+		}
+	}
+}
+
+func (f *fakeECS) ListTagsForResourceWithContext(
+	_ aws.Context, input *ecs.ListTagsForResourceInput, _ ...request.Option) (*ecs.ListTagsForResourceOutput, error) {
+	if err := f.call("ListTagsForResource"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	for _, cluster := range f.clusters {
+		if aws.StringValue(cluster.ClusterArn) == aws.StringValue(input.ResourceArn) {
+			return &ecs.ListTagsForResourceOutput{Tags: cluster.Tags}, nil
+		}
+	}
+	return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "The specified resource is not found.", nil)
+}
+
+func (f *fakeECS) ListTasksPagesWithContext(_ aws.Context, input *ecs.ListTasksInput,
+	fn func(*ecs.ListTasksOutput, bool) bool, _ ...request.Option) error {
+	if err := f.call("ListTasks"); err != nil {
+		return err
+	}
+	desiredStatus := ecs.DesiredStatusRunning
+	if input.DesiredStatus != nil {
+		desiredStatus = *input.DesiredStatus
+	}
+	// The service is named either by its name or by its ARN, which ends with the name.
+	serviceName := aws.StringValue(input.ServiceName)
+	serviceName = serviceName[strings.LastIndex(serviceName, "/")+1:]
+	f.stateMu.Lock()
+	var arns []*string
+	for _, task := range f.tasks[clusterNameFromARN(aws.StringValue(input.Cluster))] {
+		switch {
+		case aws.StringValue(task.DesiredStatus) != desiredStatus:
+		case input.ContainerInstance != nil &&
+			f.findContainerInstanceLocked(*input.ContainerInstance) == nil:
+		case input.ContainerInstance != nil && aws.StringValue(task.ContainerInstanceArn) !=
+			aws.StringValue(f.findContainerInstanceLocked(*input.ContainerInstance).ContainerInstanceArn):
+		case input.Family != nil && aws.StringValue(task.Group) != "family:"+*input.Family &&
+			!strings.Contains(aws.StringValue(task.TaskDefinitionArn), "/"+*input.Family+":"):
+		case input.ServiceName != nil && aws.StringValue(task.Group) != "service:"+serviceName:
+		case input.StartedBy != nil && aws.StringValue(task.StartedBy) != *input.StartedBy:
+		default:
+			arns = append(arns, task.TaskArn)
+		}
+	}
+	f.stateMu.Unlock()
+	token := input.NextToken
+	if f.emptyFirstTaskPage && token == nil {
+		token = aws.String("0")
+		if !fn(&ecs.ListTasksOutput{NextToken: token}, false) {
+			return nil
+		}
+	}
+	for {
+		var page []*string
+		page, token = f.page(arns, token)
+		if !fn(&ecs.ListTasksOutput{TaskArns: page, NextToken: token}, token == nil) || token == nil {
+			return nil
+		}
+	}
+}
+
+func (f *fakeECS) PutAttributesWithContext(
+	_ aws.Context, input *ecs.PutAttributesInput, _ ...request.Option) (*ecs.PutAttributesOutput, error) {
+	if err := f.call("PutAttributes"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	for _, attribute := range input.Attributes {
+		target := aws.StringValue(attribute.TargetId)
+		if f.attributes[target] == nil {
+			f.attributes[target] = make(map[string]string)
+		}
+		f.attributes[target][aws.StringValue(attribute.Name)] = aws.StringValue(attribute.Value)
+	}
+	return &ecs.PutAttributesOutput{Attributes: input.Attributes}, nil
+}
+
+func (f *fakeECS) StopTaskWithContext(
+	_ aws.Context, input *ecs.StopTaskInput, _ ...request.Option) (*ecs.StopTaskOutput, error) {
+	if err := f.call("StopTask"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	for _, task := range f.tasks[clusterNameFromARN(aws.StringValue(input.Cluster))] {
+		if aws.StringValue(task.TaskArn) == aws.StringValue(input.Task) {
+			task.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+			task.StoppedReason = input.Reason
+			f.stoppedTasks = append(f.stoppedTasks, aws.StringValue(task.TaskArn))
+			return &ecs.StopTaskOutput{Task: task}, nil
+		}
+	}
+	return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "The referenced task was not found.", nil)
+}
+
+func (f *fakeECS) UpdateContainerInstancesStateWithContext(_ aws.Context, input *ecs.UpdateContainerInstancesStateInput,
+	_ ...request.Option) (*ecs.UpdateContainerInstancesStateOutput, error) {
+	if err := f.call("UpdateContainerInstancesState"); err != nil {
+		return nil, err
+	}
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+	output := &ecs.UpdateContainerInstancesStateOutput{}
+	for _, arn := range input.ContainerInstances {
+		containerInstance := f.findContainerInstanceLocked(aws.StringValue(arn))
+		if containerInstance == nil {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: arn, Reason: aws.String("MISSING")})
+			continue
+		}
+		containerInstance.Status = input.Status
+		output.ContainerInstances = append(output.ContainerInstances, containerInstance)
+	}
+	return output, nil
+}
+
+// fakeEC2 is an in-memory EC2 with the instances, their UserData and tags.
+type fakeEC2 struct {
+	fakeCalls
+
+	mu        sync.Mutex
+	instances map[string]*ec2.Instance
+	userData  map[string]string
+	tags      map[string]map[string]string
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{
+		instances: make(map[string]*ec2.Instance),
+		userData:  make(map[string]string),
+		tags:      make(map[string]map[string]string),
+	}
+}
+
+// addInstance adds a running instance with the UserData, which is encoded as EC2 returns it.
+func (f *fakeEC2) addInstance(instanceID, userData string) *ec2.Instance {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance := &ec2.Instance{
+		InstanceId: aws.String(instanceID),
+		State:      &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+	}
+	f.instances[instanceID] = instance
+	if userData != "" {
+		f.userData[instanceID] = base64.StdEncoding.EncodeToString([]byte(userData))
+	}
+	return instance
+}
+
+func (f *fakeEC2) instanceNotFound(instanceID string) error {
+	return awserr.New("InvalidInstanceID.NotFound", fmt.Sprintf("The instance ID '%s' does not exist", instanceID), nil)
+}
+
+func (f *fakeEC2) CreateTagsWithContext(
+	_ aws.Context, input *ec2.CreateTagsInput, _ ...request.Option) (*ec2.CreateTagsOutput, error) {
+	if err := f.call("CreateTags"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, resource := range input.Resources {
+		if f.tags[*resource] == nil {
+			f.tags[*resource] = make(map[string]string)
+		}
+		for _, tag := range input.Tags {
+			f.tags[*resource][aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeInstanceAttributeWithContext(_ aws.Context, input *ec2.DescribeInstanceAttributeInput,
+	_ ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	if err := f.call("DescribeInstanceAttribute"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instanceID := aws.StringValue(input.InstanceId)
+	if _, ok := f.instances[instanceID]; !ok {
+		return nil, f.instanceNotFound(instanceID)
+	}
+	output := &ec2.DescribeInstanceAttributeOutput{InstanceId: input.InstanceId, UserData: &ec2.AttributeValue{}}
+	if userData, ok := f.userData[instanceID]; ok {
+		output.UserData.Value = aws.String(userData)
+	}
+	return output, nil
+}
+
+func (f *fakeEC2) DescribeInstancesWithContext(
+	_ aws.Context, input *ec2.DescribeInstancesInput, _ ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	if err := f.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reservation := &ec2.Reservation{}
+	for _, instanceID := range input.InstanceIds {
+		instance, ok := f.instances[*instanceID]
+		if !ok {
+			return nil, f.instanceNotFound(*instanceID)
+		}
+		reservation.Instances = append(reservation.Instances, instance)
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, nil
+}
+
+func (f *fakeEC2) DescribeInstanceStatusWithContext(_ aws.Context, input *ec2.DescribeInstanceStatusInput,
+	_ ...request.Option) (*ec2.DescribeInstanceStatusOutput, error) {
+	if err := f.call("DescribeInstanceStatus"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ec2.DescribeInstanceStatusOutput{}
+	for _, instanceID := range input.InstanceIds {
+		instance, ok := f.instances[*instanceID]
+		if !ok {
+			return nil, f.instanceNotFound(*instanceID)
+		}
+		output.InstanceStatuses = append(output.InstanceStatuses, &ec2.InstanceStatus{
+			InstanceId:    instance.InstanceId,
+			InstanceState: instance.State,
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeEC2) DescribeTagsWithContext(
+	_ aws.Context, input *ec2.DescribeTagsInput, _ ...request.Option) (*ec2.DescribeTagsOutput, error) {
+	if err := f.call("DescribeTags"); err != nil {
+		return nil, err
+	}
+	filters := make(map[string][]*string)
+	for _, filter := range input.Filters {
+		filters[aws.StringValue(filter.Name)] = filter.Values
+	}
+	matches := func(name, value string) bool {
+		values, ok := filters[name]
+		if !ok {
+			return true
+		}
+		for _, v := range values {
+			if aws.StringValue(v) == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &ec2.DescribeTagsOutput{}
+	for resource, tags := range f.tags {
+		for key, value := range tags {
+			if matches("resource-id", resource) && matches("key", key) {
+				output.Tags = append(output.Tags, &ec2.TagDescription{
+					Key:          aws.String(key),
+					ResourceId:   aws.String(resource),
+					ResourceType: aws.String(ec2.ResourceTypeInstance),
+					Value:        aws.String(value),
+				})
+			}
+		}
+	}
+	return output, nil
+}
+
+// fakeAutoscaling is an in-memory Auto Scaling with the lifecycle hooks and the lifecycle states of the instances.
+// It records the heartbeats and the completions it receives.
+type fakeAutoscaling struct {
+	fakeCalls
+
+	mu              sync.Mutex
+	hooks           map[string][]*autoscaling.LifecycleHook
+	lifecycleStates map[string]string
+	heartbeats      []*autoscaling.RecordLifecycleActionHeartbeatInput
+	completions     []*autoscaling.CompleteLifecycleActionInput
+}
+
+func newFakeAutoscaling() *fakeAutoscaling {
+	return &fakeAutoscaling{
+		hooks:           make(map[string][]*autoscaling.LifecycleHook),
+		lifecycleStates: make(map[string]string),
+	}
+}
+
+// addHook adds a terminating lifecycle hook to the group.
+func (f *fakeAutoscaling) addHook(asgName, hookName string, heartbeatTimeout int64, defaultResult string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hooks[asgName] = append(f.hooks[asgName], &autoscaling.LifecycleHook{
+		AutoScalingGroupName: aws.String(asgName),
+		DefaultResult:        aws.String(defaultResult),
+		HeartbeatTimeout:     aws.Int64(heartbeatTimeout),
+		LifecycleHookName:    aws.String(hookName),
+		LifecycleTransition:  aws.String(LifecycleTransitionTerminating),
+	})
+}
+
+// setLifecycleState puts the instance in the group in the lifecycle state.
+func (f *fakeAutoscaling) setLifecycleState(instanceID, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lifecycleStates[instanceID] = state
+}
+
+func (f *fakeAutoscaling) heartbeatCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.heartbeats)
+}
+
+// completedResults returns the results of the completions in order.
+func (f *fakeAutoscaling) completedResults() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var results []string
+	for _, input := range f.completions {
+		results = append(results, aws.StringValue(input.LifecycleActionResult))
+	}
+	return results
+}
+
+func (f *fakeAutoscaling) CompleteLifecycleActionWithContext(_ aws.Context,
+	input *autoscaling.CompleteLifecycleActionInput,
+	_ ...request.Option) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	if err := f.call("CompleteLifecycleAction"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completions = append(f.completions, input)
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (f *fakeAutoscaling) DescribeAutoScalingInstancesWithContext(_ aws.Context,
+	input *autoscaling.DescribeAutoScalingInstancesInput,
+	_ ...request.Option) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	if err := f.call("DescribeAutoScalingInstances"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &autoscaling.DescribeAutoScalingInstancesOutput{}
+	for _, instanceID := range input.InstanceIds {
+		if state, ok := f.lifecycleStates[*instanceID]; ok {
+			output.AutoScalingInstances = append(output.AutoScalingInstances, &autoscaling.InstanceDetails{
+				InstanceId:     instanceID,
+				LifecycleState: aws.String(state),
+			})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeAutoscaling) DescribeLifecycleHooksWithContext(_ aws.Context,
+	input *autoscaling.DescribeLifecycleHooksInput,
+	_ ...request.Option) (*autoscaling.DescribeLifecycleHooksOutput, error) {
+	if err := f.call("DescribeLifecycleHooks"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	output := &autoscaling.DescribeLifecycleHooksOutput{}
+	for _, hook := range f.hooks[aws.StringValue(input.AutoScalingGroupName)] {
+		if len(input.LifecycleHookNames) == 0 {
+			output.LifecycleHooks = append(output.LifecycleHooks, hook)
+			continue
+		}
+		for _, name := range input.LifecycleHookNames {
+			if aws.StringValue(name) == aws.StringValue(hook.LifecycleHookName) {
+				output.LifecycleHooks = append(output.LifecycleHooks, hook)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeAutoscaling) RecordLifecycleActionHeartbeatWithContext(_ aws.Context,
+	input *autoscaling.RecordLifecycleActionHeartbeatInput,
+	_ ...request.Option) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	if err := f.call("RecordLifecycleActionHeartbeat"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.heartbeats = append(f.heartbeats, input)
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
+
+// fakeELBv2 is an in-memory Elastic Load Balancing v2 with the target groups and the health of their targets.
+type fakeELBv2 struct {
+	fakeCalls
+
+	mu           sync.Mutex
+	targetGroups []*elbv2.TargetGroup
+	targets      map[string][]*elbv2.TargetHealthDescription
+}
+
+func newFakeELBv2() *fakeELBv2 {
+	return &fakeELBv2{targets: make(map[string][]*elbv2.TargetHealthDescription)}
+}
+
+// addTarget adds the instance to the instance target group in the state, adding the group if it is new.
+func (f *fakeELBv2) addTarget(targetGroupArn, instanceID, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.targets[targetGroupArn]; !ok {
+		f.targetGroups = append(f.targetGroups, &elbv2.TargetGroup{
+			TargetGroupArn: aws.String(targetGroupArn),
+			TargetType:     aws.String(elbv2.TargetTypeEnumInstance),
+		})
+	}
+	f.targets[targetGroupArn] = append(f.targets[targetGroupArn], &elbv2.TargetHealthDescription{
+		Target:       &elbv2.TargetDescription{Id: aws.String(instanceID)},
+		TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+	})
+}
+
+// removeTarget deregisters the instance from the target group.
+func (f *fakeELBv2) removeTarget(targetGroupArn, instanceID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var targets []*elbv2.TargetHealthDescription
+	for _, target := range f.targets[targetGroupArn] {
+		if aws.StringValue(target.Target.Id) != instanceID {
+			targets = append(targets, target)
+		}
+	}
+	f.targets[targetGroupArn] = targets
+}
+
+func (f *fakeELBv2) DescribeTargetGroupsPagesWithContext(_ aws.Context, _ *elbv2.DescribeTargetGroupsInput,
+	fn func(*elbv2.DescribeTargetGroupsOutput, bool) bool, _ ...request.Option) error {
+	if err := f.call("DescribeTargetGroups"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	targetGroups := f.targetGroups
+	f.mu.Unlock()
+	fn(&elbv2.DescribeTargetGroupsOutput{TargetGroups: targetGroups}, true)
+	return nil
+}
+
+func (f *fakeELBv2) DescribeTargetHealthWithContext(_ aws.Context, input *elbv2.DescribeTargetHealthInput,
+	_ ...request.Option) (*elbv2.DescribeTargetHealthOutput, error) {
+	if err := f.call("DescribeTargetHealth"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: f.targets[aws.StringValue(input.TargetGroupArn)],
+	}, nil
+}
+
+// fakeDynamoDB keeps the items of its tables in memory, keyed by the partition key of each table. It evaluates
+// the condition expressions of the drain, clauses joined by OR of `attribute_not_exists`, `=`, `<>` and `<`,
+// and the update expressions of a single SET or ADD.
+type fakeDynamoDB struct {
+	fakeCalls
+
+	mu     sync.Mutex
+	keys   map[string]string
+	tables map[string]map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		keys:   make(map[string]string),
+		tables: make(map[string]map[string]map[string]*dynamodb.AttributeValue),
+	}
+}
+
+// addTable adds an empty table whose partition key is the string attribute key.
+func (f *fakeDynamoDB) addTable(table, key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[table] = key
+	f.tables[table] = make(map[string]map[string]*dynamodb.AttributeValue)
+}
+
+// item returns the item of the key in the table, or nil.
+func (f *fakeDynamoDB) item(table, key string) map[string]*dynamodb.AttributeValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tables[table][key]
+}
+
+func (f *fakeDynamoDB) keyLocked(table string, key map[string]*dynamodb.AttributeValue) (string, error) {
+	if _, ok := f.tables[table]; !ok {
+		return "", awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found", nil)
+	}
+	value, ok := key[f.keys[table]]
+	if !ok || len(key) != 1 {
+		return "", awserr.New("ValidationException", "The provided key element does not match the schema", nil)
+	}
+	return aws.StringValue(value.S), nil
+}
+
+// checkLocked returns ConditionalCheckFailedException unless the item, nil when there is none, meets condition.
+func checkLocked(item map[string]*dynamodb.AttributeValue, condition *string, names map[string]*string,
+	values map[string]*dynamodb.AttributeValue) error {
+	if condition == nil {
+		return nil
+	}
+	for _, clause := range strings.Split(*condition, " OR ") {
+		if strings.HasPrefix(clause, "attribute_not_exists(") {
+			if item[expressionName(strings.TrimSuffix(strings.TrimPrefix(clause, "attribute_not_exists("), ")"),
+				names)] == nil {
+				return nil
+			}
+			continue
+		}
+		fields := strings.Fields(clause)
+		if len(fields) != 3 {
+			panic("fakeDynamoDB: unsupported condition " + clause)
+		}
+		attr, value := item[expressionName(fields[0], names)], values[fields[2]]
+		if attr == nil || value == nil {
+			continue
+		}
+		cmp := compareAttributeValues(attr, value)
+		if fields[1] == "=" && cmp == 0 || fields[1] == "<>" && cmp != 0 || fields[1] == "<" && cmp < 0 {
+			return nil
+		}
+	}
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+func expressionName(name string, names map[string]*string) string {
+	if n, ok := names[name]; ok {
+		return aws.StringValue(n)
+	}
+	return name
+}
+
+func compareAttributeValues(a, b *dynamodb.AttributeValue) int {
+	if a.N != nil && b.N != nil {
+		x, _ := strconv.ParseFloat(*a.N, 64)
+		y, _ := strconv.ParseFloat(*b.N, 64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(aws.StringValue(a.S), aws.StringValue(b.S))
+}
+
+func (f *fakeDynamoDB) DeleteItemWithContext(_ aws.Context, input *dynamodb.DeleteItemInput,
+	_ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if err := f.call("DeleteItem"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table := aws.StringValue(input.TableName)
+	key, err := f.keyLocked(table, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLocked(f.tables[table][key], input.ConditionExpression, input.ExpressionAttributeNames,
+		input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	delete(f.tables[table], key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) GetItemWithContext(_ aws.Context, input *dynamodb.GetItemInput,
+	_ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if err := f.call("GetItem"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table := aws.StringValue(input.TableName)
+	key, err := f.keyLocked(table, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: f.tables[table][key]}, nil
+}
+
+func (f *fakeDynamoDB) PutItemWithContext(_ aws.Context, input *dynamodb.PutItemInput,
+	_ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if err := f.call("PutItem"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table := aws.StringValue(input.TableName)
+	keyName := f.keys[table]
+	key, err := f.keyLocked(table, map[string]*dynamodb.AttributeValue{keyName: input.Item[keyName]})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLocked(f.tables[table][key], input.ConditionExpression, input.ExpressionAttributeNames,
+		input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	f.tables[table][key] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// UpdateItemWithContext creates the item if there is none, and returns all its attributes when asked for any.
+func (f *fakeDynamoDB) UpdateItemWithContext(_ aws.Context, input *dynamodb.UpdateItemInput,
+	_ ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if err := f.call("UpdateItem"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table := aws.StringValue(input.TableName)
+	key, err := f.keyLocked(table, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	current := f.tables[table][key]
+	if err := checkLocked(current, input.ConditionExpression, input.ExpressionAttributeNames,
+		input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	item := make(map[string]*dynamodb.AttributeValue, len(current)+2)
+	for name, value := range current {
+		item[name] = value
+	}
+	for name, value := range input.Key {
+		item[name] = value
+	}
+	expression := aws.StringValue(input.UpdateExpression)
+	switch {
+	case strings.HasPrefix(expression, "SET "):
+		for _, assignment := range strings.Split(strings.TrimPrefix(expression, "SET "), ", ") {
+			fields := strings.Fields(assignment)
+			item[expressionName(fields[0], input.ExpressionAttributeNames)] = input.ExpressionAttributeValues[fields[2]]
+		}
+	case strings.HasPrefix(expression, "ADD "):
+		fields := strings.Fields(expression)
+		name := expressionName(fields[1], input.ExpressionAttributeNames)
+		var sum float64
+		if item[name] != nil {
+			sum, _ = strconv.ParseFloat(aws.StringValue(item[name].N), 64)
+		}
+		add, _ := strconv.ParseFloat(aws.StringValue(input.ExpressionAttributeValues[fields[2]].N), 64)
+		item[name] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(sum+add, 'f', -1, 64))}
+	default:
+		panic("fakeDynamoDB: unsupported update " + expression)
+	}
+	f.tables[table][key] = item
+	output := &dynamodb.UpdateItemOutput{}
+	if input.ReturnValues != nil && *input.ReturnValues != dynamodb.ReturnValueNone {
+		output.Attributes = item
+	}
+	return output, nil
+}
+
+// fakeCloudTrail returns its `RegisterContainerInstance` events newest first, pageSize per page.
+type fakeCloudTrail struct {
+	fakeCalls
+
+	mu       sync.Mutex
+	pageSize int
+	events   []*cloudtrail.Event
+	inputs   []*cloudtrail.LookupEventsInput
+}
+
+func newFakeCloudTrail() *fakeCloudTrail {
+	return &fakeCloudTrail{pageSize: 50}
+}
+
+// addRegistration adds the registration of the instance to the cluster as the oldest event.
+func (f *fakeCloudTrail) addRegistration(instanceID, clusterArn string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, _ := json.Marshal(map[string]string{"instanceId": instanceID})
+	event, _ := json.Marshal(map[string]interface{}{
+		"eventName": eventNameRegisterContainerInstance,
+		"requestParameters": map[string]string{
+			"cluster":                  clusterArn,
+			"instanceIdentityDocument": string(doc),
+		},
+	})
+	f.events = append(f.events, &cloudtrail.Event{
+		EventName:       aws.String(eventNameRegisterContainerInstance),
+		CloudTrailEvent: aws.String(string(event)),
+	})
+}
+
+// LookupEventsPagesWithContext counts a LookupEvents call per page, as the SDK makes them.
+func (f *fakeCloudTrail) LookupEventsPagesWithContext(_ aws.Context, input *cloudtrail.LookupEventsInput,
+	fn func(*cloudtrail.LookupEventsOutput, bool) bool, _ ...request.Option) error {
+	f.mu.Lock()
+	f.inputs = append(f.inputs, input)
+	events, pageSize := f.events, f.pageSize
+	f.mu.Unlock()
+	for start := 0; ; start += pageSize {
+		if err := f.call("LookupEvents"); err != nil {
+			return err
+		}
+		end := start + pageSize
+		if end > len(events) {
+			end = len(events)
+		}
+		last := end == len(events)
+		if !fn(&cloudtrail.LookupEventsOutput{Events: events[start:end]}, last) || last {
+			return nil
+		}
+	}
+}
+
+// fakeTimestream records the records written to it.
+type fakeTimestream struct {
+	fakeCalls
+
+	mu     sync.Mutex
+	inputs []*timestreamwrite.WriteRecordsInput
+}
+
+func (f *fakeTimestream) WriteRecordsWithContext(_ aws.Context, input *timestreamwrite.WriteRecordsInput,
+	_ ...request.Option) (*timestreamwrite.WriteRecordsOutput, error) {
+	if err := f.call("WriteRecords"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, input)
+	return &timestreamwrite.WriteRecordsOutput{}, nil
+}
+
+// fakeCloudWatch records the metrics put to it.
+type fakeCloudWatch struct {
+	fakeCalls
+
+	mu         sync.Mutex
+	data       []*cloudwatch.MetricDatum
+	namespaces []string
+}
+
+// metrics returns the data put under the metric name.
+func (f *fakeCloudWatch) metrics(name string) []*cloudwatch.MetricDatum {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var data []*cloudwatch.MetricDatum
+	for _, datum := range f.data {
+		if aws.StringValue(datum.MetricName) == name {
+			data = append(data, datum)
+		}
+	}
+	return data
+}
+
+func (f *fakeCloudWatch) PutMetricDataWithContext(_ aws.Context, input *cloudwatch.PutMetricDataInput,
+	_ ...request.Option) (*cloudwatch.PutMetricDataOutput, error) {
+	if err := f.call("PutMetricData"); err != nil {
+		return nil, err
+	}
+	if len(input.MetricData) > maxMetricData {
+		return nil, awserr.New("InvalidParameterValue", "too many metrics", nil)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, input.MetricData...)
+	f.namespaces = append(f.namespaces, aws.StringValue(input.Namespace))
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// fakeS3 is an in-memory S3 of objects keyed by bucket and key.
+type fakeS3 struct {
+	fakeCalls
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+// object returns the body of the object, or nil if it does not exist.
+func (f *fakeS3) object(bucket, key string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[bucket+"/"+key]
+}
+
+// keys returns the sorted keys of the objects in bucket starting with prefix.
+func (f *fakeS3) keys(bucket, prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		if key := strings.TrimPrefix(k, bucket+"/"); key != k && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput,
+	_ ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := f.call("GetObject"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeS3) PutObjectWithContext(_ aws.Context, input *s3.PutObjectInput,
+	_ ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := f.call("PutObject"); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = body
+	return &s3.PutObjectOutput{}, nil
+}
+
+// fakeSecretsManager holds secret strings by their IDs.
+type fakeSecretsManager struct {
+	fakeCalls
+
+	secrets map[string]string
+}
+
+func (f *fakeSecretsManager) GetSecretValueWithContext(_ aws.Context, input *secretsmanager.GetSecretValueInput,
+	_ ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	if err := f.call("GetSecretValue"); err != nil {
+		return nil, err
+	}
+	secret, ok := f.secrets[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException,
+			"Secrets Manager can't find the specified secret.", nil)
+	}
+	return &secretsmanager.GetSecretValueOutput{Name: input.SecretId, SecretString: aws.String(secret)}, nil
+}
+
+// fakeSNS records the messages published to it.
+type fakeSNS struct {
+	fakeCalls
+
+	mu     sync.Mutex
+	inputs []*sns.PublishInput
+}
+
+func (f *fakeSNS) PublishWithContext(
+	_ aws.Context, input *sns.PublishInput, _ ...request.Option) (*sns.PublishOutput, error) {
+	if err := f.call("Publish"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, input)
+	return &sns.PublishOutput{MessageId: aws.String(strconv.Itoa(len(f.inputs)))}, nil
+}
+
+// fakeEventBridge records the entries put to it. The entries are rejected with failedEntryCode if it is set,
+// as PutEvents reports them in its output rather than as an error.
+type fakeEventBridge struct {
+	fakeCalls
+	failedEntryCode string
+
+	mu      sync.Mutex
+	entries []*eventbridge.PutEventsRequestEntry
+}
+
+func (f *fakeEventBridge) PutEventsWithContext(
+	_ aws.Context, input *eventbridge.PutEventsInput, _ ...request.Option) (*eventbridge.PutEventsOutput, error) {
+	if err := f.call("PutEvents"); err != nil {
+		return nil, err
+	}
+	output := &eventbridge.PutEventsOutput{FailedEntryCount: aws.Int64(0)}
+	for range input.Entries {
+		if f.failedEntryCode != "" {
+			output.Entries = append(output.Entries, &eventbridge.PutEventsResultEntry{
+				ErrorCode: aws.String(f.failedEntryCode), ErrorMessage: aws.String("rejected"),
+			})
+			*output.FailedEntryCount++
+			continue
+		}
+		output.Entries = append(output.Entries, &eventbridge.PutEventsResultEntry{EventId: aws.String("event")})
+	}
+	if f.failedEntryCode == "" {
+		f.mu.Lock()
+		f.entries = append(f.entries, input.Entries...)
+		f.mu.Unlock()
+	}
+	return output, nil
+}
+
+// The fakes implement the interfaces of the drain flow.
+var (
+	_ ecsAPI         = (*fakeECS)(nil)
+	_ ec2API         = (*fakeEC2)(nil)
+	_ autoscalingAPI = (*fakeAutoscaling)(nil)
+	_ elbv2API       = (*fakeELBv2)(nil)
+	_ dynamodbAPI    = (*fakeDynamoDB)(nil)
+	_ cloudtrailAPI  = (*fakeCloudTrail)(nil)
+	_ timestreamAPI  = (*fakeTimestream)(nil)
+	_ s3API          = (*fakeS3)(nil)
+	_ cloudwatchAPI  = (*fakeCloudWatch)(nil)
+
+	_ secretsmanagerAPI = (*fakeSecretsManager)(nil)
+	_ snsAPI            = (*fakeSNS)(nil)
+	_ eventbridgeAPI    = (*fakeEventBridge)(nil)
+)
+
+func TestFakeClientsDrainInstance(t *testing.T) {
+	ctx := context.Background()
+	ecsSvc := newFakeECS()
+	containerInstance := ecsSvc.addContainerInstance("default", "ci-1", "i-1")
+	ecsSvc.addContainerInstance("default", "ci-2", "i-2")
+	ecsSvc.addTask("default", "task-1", containerInstance, "web")
+	ec2Svc := newFakeEC2()
+	ec2Svc.addInstance("i-1", "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+	autoscalingSvc := newFakeAutoscaling()
+	clients := &awsClients{
+		ecs:         newECSClient(ecsSvc),
+		ec2:         ec2Svc,
+		autoscaling: autoscalingSvc,
+		elbv2:       newFakeELBv2(),
+	}
+	d, _ := newTestDrainer(t, clients)
+	detail := &CloudWatchEventDetail{
+		AutoScalingGroupName: "asg",
+		EC2InstanceId:        "i-1",
+		LifecycleActionToken: "token",
+		LifecycleHookName:    "hook",
+	}
+
+	userData, err := getUserData(ctx, clients.ec2, "i-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusterName, err := d.extractClusterName(userData)
+	if err != nil || clusterName != "default" {
+		t.Fatalf("extractClusterName() = %q, %v, want default", clusterName, err)
+	}
+
+	found, err := d.findContainerInstances(ctx, clients.ecs, clusterName, "i-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || aws.StringValue(found[0].ContainerInstanceArn) != *containerInstance.ContainerInstanceArn {
+		t.Fatalf("findContainerInstances() = %v, want %s", found, *containerInstance.ContainerInstanceArn)
+	}
+	if got := aws.Int64Value(found[0].RunningTasksCount); got != 1 {
+		t.Errorf("RunningTasksCount = %d, want 1", got)
+	}
+
+	if err := d.setStateDraining(ctx, clients.ecs, clusterName, containerInstance.ContainerInstanceArn); err != nil {
+		t.Fatal(err)
+	}
+	if got := ecsSvc.containerInstanceStatus(*containerInstance.ContainerInstanceArn); got != "DRAINING" {
+		t.Errorf("status = %q, want DRAINING", got)
+	}
+
+	count, err := d.countTasks(ctx, clients.ecs, clusterName, containerInstance.ContainerInstanceArn)
+	if err != nil || count != 1 {
+		t.Fatalf("countTasks() = %d, %v, want 1", count, err)
+	}
+	if err := d.heartbeat(ctx, clients.autoscaling, detail); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next poll is a new invocation, which describes the tasks again.
+	task := ecsSvc.tasks["default"][0]
+	task.DesiredStatus, task.LastStatus = aws.String(ecs.DesiredStatusStopped), aws.String(ecs.DesiredStatusStopped)
+	clients.ecs = newECSClient(ecsSvc)
+	count, err = d.countTasks(ctx, clients.ecs, clusterName, containerInstance.ContainerInstanceArn)
+	if err != nil || count != 0 {
+		t.Fatalf("countTasks() = %d, %v, want 0", count, err)
+	}
+	if err := d.complete(ctx, clients.autoscaling, detail, LifecycleActionResultContinue); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := autoscalingSvc.heartbeatCount(); got != 1 {
+		t.Errorf("heartbeats = %d, want 1", got)
+	}
+	if got := autoscalingSvc.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+		t.Errorf("completions = %v, want [CONTINUE]", got)
+	}
+}
+
+func TestFakeECSPagesListings(t *testing.T) {
+	ecsSvc := newFakeECS()
+	ecsSvc.pageSize = 2
+	for i := 0; i < 5; i++ {
+		ecsSvc.addContainerInstance("default", fmt.Sprintf("ci-%d", i), fmt.Sprintf("i-%d", i))
+	}
+	svc := newECSClient(ecsSvc)
+	d, _ := newTestDrainer(t, &awsClients{ecs: svc})
+
+	found, err := d.findContainerInstances(context.Background(), svc, "default", "i-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || aws.StringValue(found[0].Ec2InstanceId) != "i-4" {
+		t.Fatalf("findContainerInstances() = %v, want i-4", found)
+	}
+	if svc.scannedPages != 3 || svc.scannedArns != 5 {
+		t.Errorf("scanned %d pages and %d container instances, want 3 and 5", svc.scannedPages, svc.scannedArns)
+	}
+	if got := ecsSvc.count("DescribeContainerInstances"); got != 3 {
+		t.Errorf("DescribeContainerInstances calls = %d, want 3", got)
+	}
+}
@@ -0,0 +1,40 @@
+package drainer
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is where the timeouts, durations and TTLs read the time and wait, so that they can run on a fake time.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for the duration, returning the error of the context if it is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// elapsedSince is `time.Since` on the clock of the Drainer.
+func (d *Drainer) elapsedSince(t time.Time) time.Duration {
+	return d.clock.Now().Sub(t)
+}
+
+// remainingUntil is `time.Until` on the clock of the Drainer.
+func (d *Drainer) remainingUntil(t time.Time) time.Duration {
+	return t.Sub(d.clock.Now())
+}
@@ -0,0 +1,108 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const eventNameRegisterContainerInstance = "RegisterContainerInstance"
+
+// The lookup is bounded to the registrations of the last `cloudTrailLookback` and to `maxCloudTrailPages` pages
+// of them, so that a busy account does not page through its whole history within an invocation.
+const (
+	cloudTrailLookback = 7 * 24 * time.Hour
+	maxCloudTrailPages = 10
+)
+
+const cloudTrailClusterCacheTTL = time.Hour
+
+// Looking up CloudTrail is slow and rate limited, so resolved clusters are kept longer than clusterNames.
+var cloudTrailClusterNames = newClusterNameCache(cloudTrailClusterCacheTTL) // nolint:gochecknoglobals
+
+type registerContainerInstanceEvent struct {
+	RequestParameters struct {
+		Cluster                  string `json:"cluster"`
+		InstanceIdentityDocument string `json:"instanceIdentityDocument"`
+	} `json:"requestParameters"`
+}
+
+type instanceIdentityDocument struct {
+	InstanceID string `json:"instanceId"`
+}
+
+// getECSClusterNameFromCloudTrail finds the `RegisterContainerInstance` call made by the instance
+// and returns the cluster it registered to.
+func (d *Drainer) getECSClusterNameFromCloudTrail(ctx context.Context, svc cloudtrailAPI, instanceID string) (string,
+	error) {
+	now := d.clock.Now()
+	if clusterName := cloudTrailClusterNames.get(instanceID, now); clusterName != "" {
+		return clusterName, nil
+	}
+
+	input := &cloudtrail.LookupEventsInput{
+		LookupAttributes: []*cloudtrail.LookupAttribute{{
+			AttributeKey:   aws.String(cloudtrail.LookupAttributeKeyEventName),
+			AttributeValue: aws.String(eventNameRegisterContainerInstance),
+		}},
+		StartTime: aws.Time(now.Add(-cloudTrailLookback)),
+	}
+	var clusterName string
+	var parseErr error
+	var pages int
+	fn := func(output *cloudtrail.LookupEventsOutput, _ bool) bool {
+		pages++
+		for _, event := range output.Events {
+			if event.CloudTrailEvent == nil {
+				continue
+			}
+			var registered *registerContainerInstanceEvent
+			if parseErr = json.Unmarshal([]byte(*event.CloudTrailEvent), &registered); parseErr != nil {
+				return false
+			}
+			var doc *instanceIdentityDocument
+			if parseErr = json.Unmarshal([]byte(registered.RequestParameters.InstanceIdentityDocument), &doc); parseErr != nil {
+				return false
+			}
+			if doc.InstanceID == instanceID {
+				clusterName = clusterNameFromARN(registered.RequestParameters.Cluster)
+				return false
+			}
+		}
+		return pages < maxCloudTrailPages
+	}
+	if err := svc.LookupEventsPagesWithContext(ctx, input, fn); err != nil {
+		return "", err
+	}
+	if parseErr != nil {
+		return "", parseErr
+	}
+
+	if clusterName == "" {
+		return "", fmt.Errorf("CloudTrail does not have %s for %q in the last %s or %d pages",
+			eventNameRegisterContainerInstance, instanceID, cloudTrailLookback, maxCloudTrailPages)
+	}
+
+	cloudTrailClusterNames.set(instanceID, clusterName, now)
+	return clusterName, nil
+}
+
+// clusterNameFromARN returns the cluster name of `arn:<partition>:ecs:region:account:cluster/name`
+// in any partition. A value that is not an ARN is returned as is, and an empty one means the default cluster.
+func clusterNameFromARN(cluster string) string {
+	if cluster == "" {
+		return "default"
+	}
+	parsed, err := arn.Parse(cluster)
+	if err != nil || parsed.Service != ecs.ServiceName {
+		return cluster
+	}
+	return strings.TrimPrefix(parsed.Resource, "cluster/")
+}
@@ -0,0 +1,92 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// newTestCloudTrailDrainer returns a Drainer looking up clusters in a fake CloudTrail, with an empty cache for the
+// test.
+func newTestCloudTrailDrainer(t *testing.T) (*Drainer, *fakeCloudTrail, *fakeClock) {
+	cached := cloudTrailClusterNames
+	cloudTrailClusterNames = newClusterNameCache(cloudTrailClusterCacheTTL)
+	t.Cleanup(func() { cloudTrailClusterNames = cached })
+	svc := newFakeCloudTrail()
+	svc.pageSize = 2
+	d, _ := newTestDrainer(t, &awsClients{cloudtrail: svc})
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	return d.withClock(clock), svc, clock
+}
+
+func TestGetECSClusterNameFromCloudTrail(t *testing.T) {
+	d, svc, clock := newTestCloudTrailDrainer(t)
+	for i := 0; i < 3; i++ {
+		svc.addRegistration(fmt.Sprintf("i-other%d", i), testClusterArn("other"))
+	}
+	svc.addRegistration("i-trail", testClusterArn("web"))
+	ctx := context.Background()
+
+	clusterName, err := d.getECSClusterNameFromCloudTrail(ctx, svc, "i-trail")
+	if err != nil || clusterName != "web" {
+		t.Fatalf("getECSClusterNameFromCloudTrail() = %q, %v, want web", clusterName, err)
+	}
+	if got := svc.count("LookupEvents"); got != 2 {
+		t.Errorf("LookupEvents calls = %d, want the 2 pages up to the registration", got)
+	}
+	if start := aws.TimeValue(svc.inputs[0].StartTime); !start.Equal(clock.Now().Add(-cloudTrailLookback)) {
+		t.Errorf("StartTime = %v, want %s ago", start, cloudTrailLookback)
+	}
+
+	// The cluster is served from the cache until its TTL passes.
+	clock.advance(cloudTrailClusterCacheTTL - time.Second)
+	if clusterName, err := d.getECSClusterNameFromCloudTrail(ctx, svc, "i-trail"); err != nil || clusterName != "web" {
+		t.Fatalf("getECSClusterNameFromCloudTrail() = %q, %v, want web", clusterName, err)
+	}
+	if got := svc.count("LookupEvents"); got != 2 {
+		t.Errorf("LookupEvents calls = %d, want the cached cluster", got)
+	}
+	clock.advance(2 * time.Second)
+	if _, err := d.getECSClusterNameFromCloudTrail(ctx, svc, "i-trail"); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.count("LookupEvents"); got != 4 {
+		t.Errorf("LookupEvents calls = %d, want the expired cluster looked up again", got)
+	}
+}
+
+func TestGetECSClusterNameFromCloudTrailMaxPages(t *testing.T) {
+	d, svc, _ := newTestCloudTrailDrainer(t)
+	for i := 0; i < 2*maxCloudTrailPages; i++ {
+		svc.addRegistration(fmt.Sprintf("i-other%d", i), testClusterArn("other"))
+	}
+	svc.addRegistration("i-old", testClusterArn("web"))
+
+	if clusterName, err := d.getECSClusterNameFromCloudTrail(context.Background(), svc, "i-old"); err == nil {
+		t.Fatalf("getECSClusterNameFromCloudTrail() = %q, want an error past %d pages", clusterName,
+			maxCloudTrailPages)
+	}
+	if got := svc.count("LookupEvents"); got != maxCloudTrailPages {
+		t.Errorf("LookupEvents calls = %d, want %d", got, maxCloudTrailPages)
+	}
+}
+
+func TestClusterNameFromARN(t *testing.T) {
+	for _, tt := range []struct {
+		cluster string
+		want    string
+	}{
+		{"arn:aws:ecs:us-east-1:123456789012:cluster/web", "web"},
+		{"arn:aws-us-gov:ecs:us-gov-west-1:123456789012:cluster/web", "web"},
+		{"arn:aws-cn:ecs:cn-north-1:123456789012:cluster/web", "web"},
+		{"web", "web"},
+		{"", "default"},
+	} {
+		if got := clusterNameFromARN(tt.cluster); got != tt.want {
+			t.Errorf("clusterNameFromARN(%q) = %q, want %q", tt.cluster, got, tt.want)
+		}
+	}
+}
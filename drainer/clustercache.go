@@ -0,0 +1,54 @@
+package drainer
+
+import (
+	"sync"
+	"time"
+)
+
+const clusterNameCacheTTL = 5 * time.Minute
+
+var clusterNames = newClusterNameCache(clusterNameCacheTTL) // nolint:gochecknoglobals
+
+// clusterNameCache keeps the cluster names per instance so that warm containers skip resolving them again.
+// A name is forgotten after the TTL in case the instance is re-registered to another cluster.
+type clusterNameCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*clusterNameCacheEntry
+}
+
+type clusterNameCacheEntry struct {
+	clusterName string
+	expiresAt   time.Time
+}
+
+func newClusterNameCache(ttl time.Duration) *clusterNameCache {
+	return &clusterNameCache{ttl: ttl, entries: make(map[string]*clusterNameCacheEntry)}
+}
+
+func (c *clusterNameCache) get(instanceID string, now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[instanceID]
+	if !ok {
+		return ""
+	}
+	if now.After(entry.expiresAt) {
+		delete(c.entries, instanceID)
+		return ""
+	}
+	return entry.clusterName
+}
+
+func (c *clusterNameCache) set(instanceID, clusterName string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[instanceID] = &clusterNameCacheEntry{clusterName: clusterName, expiresAt: now.Add(c.ttl)}
+}
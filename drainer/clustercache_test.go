@@ -0,0 +1,67 @@
+package drainer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClusterNameCache(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := newClusterNameCache(time.Minute)
+
+	c.set("i-1", "default", now)
+	if got := c.get("i-1", now.Add(time.Minute)); got != "default" {
+		t.Errorf("get() = %q within the TTL, want default", got)
+	}
+	if got := c.get("i-1", now.Add(time.Minute+time.Second)); got != "" {
+		t.Errorf("get() = %q after the TTL, want the name forgotten", got)
+	}
+
+	// Expired entries are dropped when another name is cached.
+	c.set("i-2", "web", now)
+	c.set("i-3", "web", now.Add(2*time.Minute))
+	if len(c.entries) != 1 {
+		t.Errorf("entries = %d, want the expired ones dropped", len(c.entries))
+	}
+}
+
+func TestDrainerDrainReusesClusterName(t *testing.T) {
+	saved := clusterNames
+	clusterNames = newClusterNameCache(clusterNameCacheTTL)
+	t.Cleanup(func() { clusterNames = saved })
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.ClusterName != "default" {
+		t.Fatalf("ClusterName = %q, want the resolved name kept in the detail", detail.ClusterName)
+	}
+	if _, err := d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ec2.count("DescribeInstanceAttribute"); got != 1 {
+		t.Errorf("DescribeInstanceAttribute calls = %d, want the name of the detail reused", got)
+	}
+
+	// A warm container reuses the name for another event of the instance until the TTL.
+	if _, err := d.Drain(ctx, f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ec2.count("DescribeInstanceAttribute"); got != 1 {
+		t.Errorf("DescribeInstanceAttribute calls = %d, want the cached name reused", got)
+	}
+	clock.advance(clusterNameCacheTTL + time.Second)
+	if _, err := d.Drain(ctx, f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ec2.count("DescribeInstanceAttribute"); got != 2 {
+		t.Errorf("DescribeInstanceAttribute calls = %d, want the name resolved again after the TTL", got)
+	}
+}
@@ -0,0 +1,28 @@
+package drainer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// getECSClusterNameFromIndex looks up the `ClusterName` attribute of the item whose `EC2InstanceId` key is
+// the instance in the `CLUSTER_INDEX_TABLE` table. It returns an empty name when the item or attribute is missing.
+func getECSClusterNameFromIndex(
+	ctx context.Context, svc dynamodbAPI, table string, instanceID string) (string, error) {
+	output, err := svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: &table,
+		Key: map[string]*dynamodb.AttributeValue{
+			"EC2InstanceId": {S: &instanceID},
+		},
+		ProjectionExpression: aws.String("ClusterName"),
+	})
+	if err != nil {
+		return "", err
+	}
+	if clusterName, ok := output.Item["ClusterName"]; ok {
+		return aws.StringValue(clusterName.S), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,91 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	ClusterNameSourceEventResources = "event_resources"
+	ClusterNameSourceIndex          = "index"
+	ClusterNameSourceUserData       = "userdata"
+	ClusterNameSourceInstanceTag    = "instance_tag"
+	ClusterNameSourceCloudTrail     = "cloudtrail"
+	ClusterNameSourceDiscovery      = "discovery"
+)
+
+var clusterNameSources = []string{ // nolint:gochecknoglobals
+	ClusterNameSourceEventResources, ClusterNameSourceIndex, ClusterNameSourceUserData,
+	ClusterNameSourceInstanceTag, ClusterNameSourceCloudTrail, ClusterNameSourceDiscovery,
+}
+
+// validateClusterNameSources checks that `CLUSTER_NAME_SOURCES` only names known sources.
+func validateClusterNameSources(sources []string) error {
+	for _, source := range sources {
+		if !containsString(clusterNameSources, source) {
+			return fmt.Errorf("`CLUSTER_NAME_SOURCES` has %q, not one of %v", source, clusterNameSources)
+		}
+	}
+	return nil
+}
+
+// lookupECSClusterNameFromSources tries the sources of `CLUSTER_NAME_SOURCES` in order and returns the first
+// cluster name found, so that operators can put the cheapest reliable source of their setup first.
+// A source that has no name for the instance or fails is skipped, and the last failure is returned if none has.
+func (d *Drainer) lookupECSClusterNameFromSources(ctx context.Context, clients *awsClients, evt *events.CloudWatchEvent,
+	instanceID string, sources []string) (string, error) {
+	var lastErr error
+	for _, source := range sources {
+		clusterName, err := d.lookupECSClusterNameFromSource(ctx, clients, evt, instanceID, source)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", err
+			}
+			d.logger.warnf("cluster name source %q failed, skipping it: %v", source, err)
+			lastErr = err
+			continue
+		}
+		if clusterName != "" {
+			return clusterName, nil
+		}
+	}
+	if lastErr != nil {
+		return "", lastErr
+	}
+	return "", fmt.Errorf("no cluster name source of %v has %q: %w", sources, instanceID, ErrNoClusterInUserData)
+}
+
+func (d *Drainer) lookupECSClusterNameFromSource(ctx context.Context, clients *awsClients, evt *events.CloudWatchEvent,
+	instanceID string, source string) (string, error) {
+	switch source {
+	case ClusterNameSourceEventResources:
+		return getECSClusterNameFromEvent(evt), nil
+	case ClusterNameSourceIndex:
+		table := d.config.ClusterIndexTable
+		if table == "" {
+			return "", nil
+		}
+		return getECSClusterNameFromIndex(ctx, clients.clusterIndex, table, instanceID)
+	case ClusterNameSourceUserData:
+		userData, err := getUserData(ctx, clients.ec2, instanceID)
+		if errors.Is(err, ErrNoClusterInUserData) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return d.extractClusterName(userData)
+	case ClusterNameSourceInstanceTag:
+		return d.getECSClusterNameFromTag(ctx, clients.ec2, instanceID)
+	case ClusterNameSourceCloudTrail:
+		return d.getECSClusterNameFromCloudTrail(ctx, clients.cloudtrail, instanceID)
+	case ClusterNameSourceDiscovery:
+		clusterName, _, err := d.discoverCluster(ctx, clients.ecs, instanceID, "")
+		return clusterName, err
+	default:
+		return "", fmt.Errorf("`CLUSTER_NAME_SOURCES` has %q, not one of %v", source, clusterNameSources)
+	}
+}
@@ -0,0 +1,78 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestDrainerGetECSClusterNameSources(t *testing.T) {
+	denied := errors.New("UnauthorizedOperation")
+	for _, tt := range []struct {
+		name       string
+		sources    string
+		tag        string
+		tagErr     error
+		resources  []string
+		want       string
+		wantCalled []string
+	}{
+		{"tag first", "instance_tag,userdata", "tagged", nil, nil, "tagged", []string{"DescribeTags"}},
+		{"userdata first", "userdata,instance_tag", "tagged", nil, nil, "default",
+			[]string{"DescribeInstanceAttribute"}},
+		{"no tag", "instance_tag,userdata", "", nil, nil, "default",
+			[]string{"DescribeInstanceAttribute", "DescribeTags"}},
+		{"failed tag", "instance_tag,userdata", "tagged", denied, nil, "default",
+			[]string{"DescribeInstanceAttribute", "DescribeTags"}},
+		{"event resources", "event_resources,instance_tag", "tagged", nil, []string{testClusterArn("web")}, "web",
+			nil},
+		{"no event resources", "event_resources,instance_tag", "tagged", nil, nil, "tagged",
+			[]string{"DescribeTags"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := clusterNames
+			clusterNames = newClusterNameCache(clusterNameCacheTTL)
+			t.Cleanup(func() { clusterNames = saved })
+			t.Setenv("CLUSTER_NAME_SOURCES", tt.sources)
+			f := newTestDrainFixture()
+			if tt.tag != "" {
+				f.ec2.tags["i-1"] = map[string]string{defaultClusterNameTag: tt.tag}
+			}
+			if tt.tagErr != nil {
+				f.ec2.fail("DescribeTags", tt.tagErr)
+			}
+			d, _ := newTestDrainer(t, f.clients)
+
+			evt := &events.CloudWatchEvent{Resources: tt.resources, Detail: []byte("{}")}
+			got, err := d.getECSClusterName(context.Background(), f.clients, evt, "i-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("getECSClusterName() = %q, want %q", got, tt.want)
+			}
+			// The sources after the first success are not tried.
+			if called := f.ec2.operations(); fmt.Sprint(called) != fmt.Sprint(tt.wantCalled) {
+				t.Errorf("EC2 calls = %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+func TestDrainerGetECSClusterNameSourcesNone(t *testing.T) {
+	saved := clusterNames
+	clusterNames = newClusterNameCache(clusterNameCacheTTL)
+	t.Cleanup(func() { clusterNames = saved })
+	t.Setenv("CLUSTER_NAME_SOURCES", "instance_tag")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+
+	evt := &events.CloudWatchEvent{Detail: []byte("{}")}
+	if _, err := d.getECSClusterName(context.Background(), f.clients, evt, "i-1"); !errors.Is(err,
+		ErrNoClusterInUserData) {
+		t.Errorf("getECSClusterName() = %v, want ErrNoClusterInUserData without a source having the name", err)
+	}
+}
@@ -0,0 +1,360 @@
+package drainer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of a Drainer, parsed by loadConfig from the environment, the SSM parameters of
+// `CONFIG_SSM_PATH` and the AppConfig feature flags. The fields are named after their variables.
+type Config struct {
+	DryRun          bool
+	ObserverMode    bool
+	AuditLog        bool // ENABLE_AUDIT_LOG
+	AuditBucket     string
+	AuditTable      string
+	LogLevel        string
+	MaxLogBytes     int
+	XRay            bool // ENABLE_XRAY
+	Metrics         bool // ENABLE_METRICS
+	MetricNamespace string
+	GroupMetrics    bool // ENABLE_GROUP_METRICS
+	APICallMetrics  bool // ENABLE_API_CALL_METRICS
+
+	UseEventRegion bool
+	TargetRegion   string // AWS_TARGET_REGION
+	AssumeRoleArn  string
+	AssumeRoleName string
+
+	LifecycleActionResult        string
+	TimeoutLifecycleActionResult string
+	// ErrorLifecycleActionResult is "" when unset, so that the default of the hook can be used instead.
+	ErrorLifecycleActionResult string
+	// ResultSuccess and ResultForced are "" when unset, which keeps the result of the drain.
+	ResultSuccess string
+	ResultForced  string
+
+	InvocationMode       string
+	LoopMode             bool // LOOP_MODE, which POLL_MODE=true turns off as well
+	LoopInterval         time.Duration
+	PollInterval         time.Duration
+	LoopMaxWait          time.Duration
+	DeadlineMargin       time.Duration
+	CompleteOnError      bool
+	MaxFailedAttempts    int
+	StrictTransition     bool
+	HeartbeatOnly        bool
+	HookBehaviors        map[string]string // HOOK_BEHAVIOR_JSON
+	ValidateHook         bool
+	AbsorbFlapping       bool
+	HandleRebalance      bool   // HANDLE_REBALANCE_RECOMMENDATION
+	SkipTerminating      bool   // SKIP_TERMINATING_INSTANCES
+	SkipStopped          bool   // SKIP_STOPPED_INSTANCES
+	RespectManaged       string // RESPECT_MANAGED_TERMINATION
+	MinAgentVersion      string
+	DeregisterAfterDrain bool
+	TagDrainOutcome      bool
+	LogCompletionMarker  bool
+
+	ClusterNameSources       []string
+	ClusterNameRegexp        *regexp.Regexp // CLUSTER_NAME_REGEX
+	ClusterNameTag           string
+	ClusterIndexTable        string
+	CloudTrailResolver       bool // ENABLE_CLOUDTRAIL_RESOLVER
+	ClusterDiscoveryFallback bool
+	// ClusterDiscoveryTag is `CLUSTER_DISCOVERY_TAG` as key and value, which the searched clusters have to be tagged
+	// with.
+	ClusterDiscoveryTag  []string
+	ClusterAllowlist     []string
+	ClusterDenylist      []string
+	OnResolutionFailure  string
+	CompleteOnInactive   bool // COMPLETE_ON_INACTIVE_CLUSTER
+	CompleteOnNoInstance bool // COMPLETE_ON_NO_CONTAINER_INSTANCE
+	ScanWarningThreshold int
+	DescribeConcurrency  int
+	BatchConcurrency     int
+	DescribeBatchRetries int
+	MaxRetries           int
+	BaseDelayMS          int
+
+	StateTable            string
+	LeaseTable            string
+	LeaseDuration         time.Duration // LEASE_SECONDS
+	MaxConcurrentDraining int
+	MaxDrainingPerAZ      int
+	InitialDrainDelay     time.Duration
+
+	TaskStatuses              []string
+	TaskCheckStrategy         string
+	TaskFamilyFilter          []string
+	IgnoreDisconnectedTasks   bool
+	IgnoreDaemonTasks         bool
+	IgnoreStartedByPrefix     string
+	ContainerLevelStatus      bool // USE_CONTAINER_LEVEL_STATUS
+	FastPath                  string
+	FastTaskCountCheck        bool
+	MinRemainingTasks         int
+	RespectTaskProtection     bool
+	HeartbeatOnTaskCheckError bool
+	StuckStopping             time.Duration
+	StatefulFamilyRegexp      *regexp.Regexp // STATEFUL_FAMILY_PATTERN
+	StatefulMaxDrain          time.Duration
+	AbsoluteMaxDrain          time.Duration
+	PinnedTaskAction          string
+	WaitForServiceSteady      bool // WAIT_FOR_SERVICE_STEADY_STATE
+	RequireStopped            bool
+	WaitForTargets            bool // WAIT_FOR_TARGET_DEREGISTRATION
+	TargetGroupArns           []string
+	VerifyDraining            bool
+
+	ForceStopAfter          time.Duration
+	RespectTaskDrainTag     bool
+	MaxDrain                time.Duration
+	ForceStopOnDrainTimeout bool
+	PreviewForceStop        bool
+	CompleteDelay           time.Duration
+	EscalationThreshold     time.Duration
+	EscalationSNSTopicArn   string
+	EscalationWebhookURL    string
+
+	// NotifierDestinations are the values of the variables of notifierDestinations, by notifier.
+	Notifiers              []string
+	NotifierDestinations   map[string]string
+	WebhookSigningSecret   string
+	WebhookSigningSecretID string
+	DecisionLogBucket      string
+	TimestreamDatabase     string
+	TimestreamTable        string
+}
+
+// sessionConfigNames are the variables read when a session is built, which loadConfig only validates.
+var sessionConfigNames = []string{ // nolint:gochecknoglobals
+	"HTTP_CLIENT_TIMEOUT_MS", "HTTP_DIAL_TIMEOUT_MS", "SDK_MAX_RETRIES",
+}
+
+// enumConfigValues are the values allowed in the environment variables that select a behavior.
+var enumConfigValues = map[string][]string{ // nolint:gochecknoglobals
+	"FAST_PATH":                   {FastPathLatency},
+	"INVOCATION_MODE":             {InvocationModeStepFunctions, InvocationModeEventBridge},
+	"ON_RESOLUTION_FAILURE":       {"error", "continue", "abandon"},
+	"PINNED_TASK_ACTION":          {PinnedTaskActionWait, PinnedTaskActionStop, PinnedTaskActionAbandon},
+	"RESPECT_MANAGED_TERMINATION": {ManagedTerminationComplete, ManagedTerminationObserve},
+	"TASK_CHECK_STRATEGY":         {TaskCheckStrategyInstance, TaskCheckStrategyService},
+}
+
+// loadConfig parses the configuration once at cold start, so that a misconfiguration fails the deployment
+// instead of an invocation in the middle of a drain, and again when the AppConfig feature flags change.
+func loadConfig() (*Config, error) {
+	for name, allowed := range enumConfigValues {
+		if value := getenv(name); value != "" && !containsString(allowed, value) {
+			return nil, fmt.Errorf("`%s` is %q, not one of %s", name, value, strings.Join(allowed, ", "))
+		}
+	}
+	for _, name := range sessionConfigNames {
+		if _, err := getenvInt(name, 0); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := getenvSeconds("APPCONFIG_REFRESH_SECONDS"); err != nil {
+		return nil, err
+	}
+
+	c := &Config{
+		DryRun:          getenv("DRY_RUN") == "true",
+		ObserverMode:    getenv("OBSERVER_MODE") == "true",
+		AuditLog:        getenv("ENABLE_AUDIT_LOG") == "true",
+		AuditBucket:     getenv("AUDIT_BUCKET"),
+		AuditTable:      getenv("AUDIT_TABLE"),
+		LogLevel:        getLogLevel(),
+		XRay:            getenv("ENABLE_XRAY") == "true",
+		Metrics:         getenv("ENABLE_METRICS") == "true",
+		MetricNamespace: getenv("METRIC_NAMESPACE"),
+		GroupMetrics:    getenv("ENABLE_GROUP_METRICS") == "true",
+		APICallMetrics:  getenv("ENABLE_API_CALL_METRICS") == "true",
+
+		UseEventRegion: getenv("USE_EVENT_REGION") == "true",
+		TargetRegion:   getenv("AWS_TARGET_REGION"),
+		AssumeRoleArn:  getenv("ASSUME_ROLE_ARN"),
+		AssumeRoleName: getenv("ASSUME_ROLE_NAME"),
+
+		InvocationMode:       getenv("INVOCATION_MODE"),
+		LoopMode:             getenv("LOOP_MODE") != "false" && getenv("POLL_MODE") != "true",
+		CompleteOnError:      getenv("COMPLETE_ON_ERROR") == "true",
+		StrictTransition:     getenv("STRICT_TRANSITION") == "true",
+		HeartbeatOnly:        getenv("HEARTBEAT_ONLY") == "true",
+		ValidateHook:         getenv("VALIDATE_HOOK") == "true",
+		AbsorbFlapping:       getenv("ABSORB_FLAPPING") == "true",
+		HandleRebalance:      getenv("HANDLE_REBALANCE_RECOMMENDATION") == "true",
+		SkipTerminating:      getenv("SKIP_TERMINATING_INSTANCES") != "false",
+		SkipStopped:          getenv("SKIP_STOPPED_INSTANCES") == "true",
+		RespectManaged:       getenv("RESPECT_MANAGED_TERMINATION"),
+		MinAgentVersion:      getenv("MIN_AGENT_VERSION"),
+		DeregisterAfterDrain: getenv("DEREGISTER_AFTER_DRAIN") == "true",
+		TagDrainOutcome:      getenv("TAG_DRAIN_OUTCOME") == "true",
+		LogCompletionMarker:  getenv("LOG_COMPLETION_MARKER") == "true",
+
+		ClusterNameSources:       getenvList("CLUSTER_NAME_SOURCES"),
+		ClusterNameTag:           getenv("CLUSTER_NAME_TAG"),
+		ClusterIndexTable:        getenv("CLUSTER_INDEX_TABLE"),
+		CloudTrailResolver:       getenv("ENABLE_CLOUDTRAIL_RESOLVER") == "true",
+		ClusterDiscoveryFallback: getenv("CLUSTER_DISCOVERY_FALLBACK") == "true",
+		ClusterAllowlist:         getenvList("CLUSTER_ALLOWLIST"),
+		ClusterDenylist:          getenvList("CLUSTER_DENYLIST"),
+		OnResolutionFailure:      getenv("ON_RESOLUTION_FAILURE"),
+		CompleteOnInactive:       getenv("COMPLETE_ON_INACTIVE_CLUSTER") != "false",
+		CompleteOnNoInstance:     getenv("COMPLETE_ON_NO_CONTAINER_INSTANCE") != "false",
+
+		StateTable: getenv("STATE_TABLE"),
+		LeaseTable: getenv("LEASE_TABLE"),
+
+		TaskCheckStrategy:         getenv("TASK_CHECK_STRATEGY"),
+		TaskFamilyFilter:          getenvList("TASK_FAMILY_FILTER"),
+		IgnoreDisconnectedTasks:   getenv("IGNORE_DISCONNECTED_TASKS") == "true",
+		IgnoreDaemonTasks:         getenv("IGNORE_DAEMON_TASKS") != "false",
+		IgnoreStartedByPrefix:     getenv("IGNORE_STARTED_BY_PREFIX"),
+		ContainerLevelStatus:      getenv("USE_CONTAINER_LEVEL_STATUS") == "true",
+		FastPath:                  getenv("FAST_PATH"),
+		FastTaskCountCheck:        getenv("FAST_TASK_COUNT_CHECK") == "true",
+		RespectTaskProtection:     getenv("RESPECT_TASK_PROTECTION") == "true",
+		HeartbeatOnTaskCheckError: getenv("HEARTBEAT_ON_TASK_CHECK_ERROR") == "true",
+		PinnedTaskAction:          getenv("PINNED_TASK_ACTION"),
+		WaitForServiceSteady:      getenv("WAIT_FOR_SERVICE_STEADY_STATE") == "true",
+		RequireStopped:            getenv("REQUIRE_STOPPED") == "true",
+		WaitForTargets:            getenv("WAIT_FOR_TARGET_DEREGISTRATION") == "true",
+		TargetGroupArns:           getenvList("TARGET_GROUP_ARNS"),
+		VerifyDraining:            getenv("VERIFY_DRAINING") == "true",
+
+		RespectTaskDrainTag:     getenv("RESPECT_TASK_DRAIN_TAG") == "true",
+		ForceStopOnDrainTimeout: getenv("FORCE_STOP_ON_DRAIN_TIMEOUT") == "true",
+		PreviewForceStop:        getenv("PREVIEW_FORCE_STOP") == "true",
+		EscalationSNSTopicArn:   getenv("ESCALATION_SNS_TOPIC_ARN"),
+		EscalationWebhookURL:    getenv("ESCALATION_WEBHOOK_URL"),
+
+		Notifiers:              getenvList("NOTIFIERS"),
+		NotifierDestinations:   make(map[string]string, len(notifierDestinations)),
+		WebhookSigningSecret:   getenv("WEBHOOK_SIGNING_SECRET"),
+		WebhookSigningSecretID: getenv("WEBHOOK_SIGNING_SECRET_ID"),
+		DecisionLogBucket:      getenv("DECISION_LOG_BUCKET"),
+		TimestreamDatabase:     getenv("TIMESTREAM_DATABASE"),
+		TimestreamTable:        getenv("TIMESTREAM_TABLE"),
+	}
+	if c.MetricNamespace == "" {
+		c.MetricNamespace = defaultMetricNamespace
+	}
+	for name, destination := range notifierDestinations {
+		if value := getenv(destination); value != "" {
+			c.NotifierDestinations[name] = value
+		}
+	}
+
+	var err error
+	for _, result := range []struct {
+		name  string
+		value *string
+	}{
+		{"LIFECYCLE_ACTION_RESULT", &c.LifecycleActionResult},
+		{"TIMEOUT_LIFECYCLE_ACTION_RESULT", &c.TimeoutLifecycleActionResult},
+		{"ERROR_LIFECYCLE_ACTION_RESULT", &c.ErrorLifecycleActionResult},
+		{"RESULT_SUCCESS", &c.ResultSuccess},
+		{"RESULT_FORCED", &c.ResultForced},
+	} {
+		if *result.value, err = getLifecycleActionResult(result.name); err != nil {
+			return nil, err
+		}
+	}
+	if c.LifecycleActionResult == "" {
+		c.LifecycleActionResult = LifecycleActionResultContinue
+	}
+	if c.TimeoutLifecycleActionResult == "" {
+		c.TimeoutLifecycleActionResult = LifecycleActionResultContinue
+	}
+
+	for _, seconds := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"ABSOLUTE_MAX_DRAIN_SECONDS", &c.AbsoluteMaxDrain},
+		{"COMPLETE_DELAY_SECONDS", &c.CompleteDelay},
+		{"DEADLINE_MARGIN_SECONDS", &c.DeadlineMargin},
+		{"ESCALATION_THRESHOLD_SECONDS", &c.EscalationThreshold},
+		{"FORCE_STOP_AFTER_SECONDS", &c.ForceStopAfter},
+		{"INITIAL_DRAIN_DELAY_SECONDS", &c.InitialDrainDelay},
+		{"LEASE_SECONDS", &c.LeaseDuration},
+		{"LOOP_INTERVAL_SECONDS", &c.LoopInterval},
+		{"LOOP_MAX_WAIT_SECONDS", &c.LoopMaxWait},
+		{"MAX_DRAIN_SECONDS", &c.MaxDrain},
+		{"POLL_INTERVAL_SECONDS", &c.PollInterval},
+		{"STATEFUL_MAX_DRAIN_SECONDS", &c.StatefulMaxDrain},
+		{"STUCK_STOPPING_SECONDS", &c.StuckStopping},
+	} {
+		if *seconds.value, err = getenvSeconds(seconds.name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, integer := range []struct {
+		name         string
+		value        *int
+		defaultValue int
+	}{
+		{"BASE_DELAY_MS", &c.BaseDelayMS, defaultBaseDelayMS},
+		{"BATCH_CONCURRENCY", &c.BatchConcurrency, 1},
+		{"DESCRIBE_BATCH_RETRIES", &c.DescribeBatchRetries, defaultDescribeBatchRetries},
+		{"DESCRIBE_CONCURRENCY", &c.DescribeConcurrency, defaultDescribeConcurrency},
+		{"MAX_CONCURRENT_DRAINING", &c.MaxConcurrentDraining, 0},
+		{"MAX_DRAINING_PER_AZ", &c.MaxDrainingPerAZ, 0},
+		{"MAX_FAILED_ATTEMPTS", &c.MaxFailedAttempts, 0},
+		{"MAX_LOG_BYTES", &c.MaxLogBytes, defaultMaxLogBytes},
+		{"MAX_RETRIES", &c.MaxRetries, defaultMaxRetries},
+		{"MIN_REMAINING_TASKS", &c.MinRemainingTasks, 0},
+		{"SCAN_WARNING_THRESHOLD", &c.ScanWarningThreshold, defaultScanWarningThreshold},
+	} {
+		if *integer.value, err = getenvInt(integer.name, integer.defaultValue); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.TaskStatuses, err = getTaskStatuses(); err != nil {
+		return nil, err
+	}
+	if pattern := getenv("STATEFUL_FAMILY_PATTERN"); pattern != "" {
+		if c.StatefulFamilyRegexp, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("`STATEFUL_FAMILY_PATTERN` is invalid: %w", err)
+		}
+	}
+	if c.HookBehaviors, err = getHookBehaviors(); err != nil {
+		return nil, err
+	}
+	// The failed attempts are counted in the state table, since a failed invocation returns no detail to keep them.
+	if c.MaxFailedAttempts > 0 && c.StateTable == "" {
+		return nil, errors.New("`MAX_FAILED_ATTEMPTS` requires `STATE_TABLE`")
+	}
+	if err := c.validateNotifiers(); err != nil {
+		return nil, err
+	}
+	if err := validateClusterNameSources(c.ClusterNameSources); err != nil {
+		return nil, err
+	}
+	if c.ClusterNameRegexp, err = compileClusterNameRegexp(); err != nil {
+		return nil, err
+	}
+	if tag := getenv("CLUSTER_DISCOVERY_TAG"); tag != "" {
+		if c.ClusterDiscoveryTag = strings.SplitN(tag, "=", 2); len(c.ClusterDiscoveryTag) != 2 ||
+			c.ClusterDiscoveryTag[0] == "" {
+			return nil, fmt.Errorf("`CLUSTER_DISCOVERY_TAG` is %q, not Key=Value", tag)
+		}
+	}
+	return c, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
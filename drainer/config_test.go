@@ -0,0 +1,80 @@
+package drainer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("DRY_RUN", "true")
+	t.Setenv("LOOP_MODE", "false")
+	t.Setenv("MAX_DRAIN_SECONDS", "600")
+	t.Setenv("MIN_REMAINING_TASKS", "2")
+	t.Setenv("TARGET_GROUP_ARNS", "arn:a, arn:b")
+	t.Setenv("TIMEOUT_LIFECYCLE_ACTION_RESULT", "ABANDON")
+	t.Setenv("HOOK_BEHAVIOR_JSON", `{"hook":"skip"}`)
+
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.DryRun || c.LoopMode {
+		t.Errorf("DryRun, LoopMode = %v, %v, want true, false", c.DryRun, c.LoopMode)
+	}
+	if c.MaxDrain != 600*time.Second || c.MinRemainingTasks != 2 {
+		t.Errorf("MaxDrain, MinRemainingTasks = %v, %d, want 10m0s, 2", c.MaxDrain, c.MinRemainingTasks)
+	}
+	if len(c.TargetGroupArns) != 2 || c.TargetGroupArns[1] != "arn:b" {
+		t.Errorf("TargetGroupArns = %q, want [arn:a arn:b]", c.TargetGroupArns)
+	}
+	if c.LifecycleActionResult != LifecycleActionResultContinue ||
+		c.TimeoutLifecycleActionResult != LifecycleActionResultAbandon {
+		t.Errorf("results = %q, %q, want CONTINUE, ABANDON", c.LifecycleActionResult, c.TimeoutLifecycleActionResult)
+	}
+	if got := c.hookBehavior("hook"); got != HookBehaviorSkip {
+		t.Errorf("hookBehavior() = %q, want %q", got, HookBehaviorSkip)
+	}
+	if c.MetricNamespace != defaultMetricNamespace || c.DescribeConcurrency != defaultDescribeConcurrency {
+		t.Errorf("defaults = %q, %d", c.MetricNamespace, c.DescribeConcurrency)
+	}
+	if c.ClusterNameRegexp != ecsClusterRegexp {
+		t.Errorf("ClusterNameRegexp = %v, want the default", c.ClusterNameRegexp)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"seconds", map[string]string{"MAX_DRAIN_SECONDS": "ten"}, "MAX_DRAIN_SECONDS"},
+		{"negative int", map[string]string{"MIN_REMAINING_TASKS": "-1"}, "MIN_REMAINING_TASKS"},
+		{"session int", map[string]string{"HTTP_CLIENT_TIMEOUT_MS": "soon"}, "HTTP_CLIENT_TIMEOUT_MS"},
+		{"sdk retries", map[string]string{"SDK_MAX_RETRIES": "many"}, "SDK_MAX_RETRIES"},
+		{"enum", map[string]string{"FAST_PATH": "fastest"}, "FAST_PATH"},
+		{"invocation mode", map[string]string{"INVOCATION_MODE": "sqs"}, "INVOCATION_MODE"},
+		{"result", map[string]string{"LIFECYCLE_ACTION_RESULT": "RETRY"}, "LIFECYCLE_ACTION_RESULT"},
+		{"failed attempts", map[string]string{"MAX_FAILED_ATTEMPTS": "3"}, "STATE_TABLE"},
+		{"hook behavior", map[string]string{"HOOK_BEHAVIOR_JSON": "{"}, "HOOK_BEHAVIOR_JSON"},
+		{"unknown hook behavior", map[string]string{"HOOK_BEHAVIOR_JSON": `{"hook":"flush"}`}, "flush"},
+		{"cluster regexp", map[string]string{"CLUSTER_NAME_REGEX": "("}, "CLUSTER_NAME_REGEX"},
+		{"cluster regexp group", map[string]string{"CLUSTER_NAME_REGEX": "ECS_CLUSTER=web"}, "no capture group"},
+		{"stateful regexp", map[string]string{"STATEFUL_FAMILY_PATTERN": "["}, "STATEFUL_FAMILY_PATTERN"},
+		{"task statuses", map[string]string{"TASK_STATUSES": "RUNNING,DONE"}, "TASK_STATUSES"},
+		{"notifier", map[string]string{"NOTIFIERS": "pager"}, "pager"},
+		{"discovery tag", map[string]string{"CLUSTER_DISCOVERY_TAG": "ManagedBy"}, "CLUSTER_DISCOVERY_TAG"},
+		{"cluster name source", map[string]string{"CLUSTER_NAME_SOURCES": "userdata,ssm"}, "CLUSTER_NAME_SOURCES"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			c, err := loadConfig()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("loadConfig() = %+v, %v, want an error about %s", c, err, tt.want)
+			}
+		})
+	}
+}
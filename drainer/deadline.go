@@ -0,0 +1,26 @@
+package drainer
+
+import (
+	"context"
+	"time"
+)
+
+const defaultDeadlineMargin = 3 * time.Second
+
+// withDeadlineMargin returns a context that expires `DEADLINE_MARGIN_SECONDS` before the Lambda deadline,
+// so that a slow AWS call fails while there is still time to report it instead of being killed with
+// the invocation.
+func (d *Drainer) withDeadlineMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	margin := d.config.DeadlineMargin
+	if margin == 0 {
+		margin = defaultDeadlineMargin
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline.Add(-margin))
+	return ctx, cancel
+}
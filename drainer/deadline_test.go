@@ -0,0 +1,65 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainerWithDeadlineMargin(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	for _, tt := range []struct {
+		name   string
+		margin string
+		want   time.Time
+	}{
+		{"default", "", deadline.Add(-defaultDeadlineMargin)},
+		{"configured", "10", deadline.Add(-10 * time.Second)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEADLINE_MARGIN_SECONDS", tt.margin)
+			d, _ := newTestDrainer(t, &awsClients{})
+			lambdaCtx, cancelLambda := context.WithDeadline(context.Background(), deadline)
+			defer cancelLambda()
+
+			ctx, cancel := d.withDeadlineMargin(lambdaCtx)
+			defer cancel()
+			if got, ok := ctx.Deadline(); !ok || !got.Equal(tt.want) {
+				t.Errorf("Deadline() = %v, %t, want %v", got, ok, tt.want)
+			}
+		})
+	}
+
+	// Without a Lambda deadline, e.g. in local runs, the calls are not bounded.
+	d, _ := newTestDrainer(t, &awsClients{})
+	ctx, cancel := d.withDeadlineMargin(context.Background())
+	defer cancel()
+	if got, ok := ctx.Deadline(); ok {
+		t.Errorf("Deadline() = %v, want none", got)
+	}
+}
+
+func TestDrainerHandleEventCancelledMidPoll(t *testing.T) {
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The invocation runs out of time while the container instance is described.
+	f.ecs.onDescribeContainerInstances = cancel
+
+	if _, err := d.handleEvent(ctx, testEvent(t, f.detail)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("handleEvent() = %v, want the cancellation", err)
+	}
+	// The final heartbeat is sent with a fresh context, and the lifecycle action is not completed.
+	if got := f.autoscaling.heartbeatCount(); got != 1 {
+		t.Errorf("heartbeats = %d, want the final heartbeat", got)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 0 {
+		t.Errorf("completions = %v, want none", got)
+	}
+	if !strings.Contains(out.String(), "invocation ran out of time, sending a final heartbeat") {
+		t.Errorf("log = %q, want the reason of the final heartbeat", out.String())
+	}
+}
@@ -0,0 +1,49 @@
+package drainer
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	DecisionActionDrain     = "drain"
+	DecisionActionHeartbeat = "heartbeat"
+	DecisionActionComplete  = "complete"
+	DecisionActionAbandon   = "abandon"
+	// DecisionActionObserve is the completion left to another system in `OBSERVER_MODE`.
+	DecisionActionObserve = "observe"
+)
+
+// DecisionRecord describes what a single poll observed and which actions it took,
+// so that a drain can be replayed and analyzed afterwards.
+type DecisionRecord struct {
+	Time              time.Time
+	ClusterName       string
+	InstanceStatus    string
+	RunningTasksCount int64
+	PendingTasksCount int64
+	TaskExists        bool
+	// RemainingTasksCount is the number of tasks blocking draining, compared with `MIN_REMAINING_TASKS`.
+	RemainingTasksCount int64
+	ElapsedSeconds      int64
+	Actions             []string
+}
+
+func (d *Drainer) newDecisionRecord(
+	eventTime time.Time, clusterName string, containerInstance *ecs.ContainerInstance) *DecisionRecord {
+	now := d.clock.Now()
+	return &DecisionRecord{
+		Time:              now,
+		ClusterName:       clusterName,
+		InstanceStatus:    aws.StringValue(containerInstance.Status),
+		RunningTasksCount: aws.Int64Value(containerInstance.RunningTasksCount),
+		PendingTasksCount: aws.Int64Value(containerInstance.PendingTasksCount),
+		ElapsedSeconds:    int64(now.Sub(eventTime) / time.Second),
+	}
+}
+
+func (r *DecisionRecord) addAction(action string) {
+	r.Actions = append(r.Actions, action)
+}
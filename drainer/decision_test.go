@@ -0,0 +1,63 @@
+package drainer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainerDrainDecisionRecord(t *testing.T) {
+	t.Setenv("MAX_DRAIN_SECONDS", "600")
+	t.Setenv("TIMEOUT_LIFECYCLE_ACTION_RESULT", LifecycleActionResultAbandon)
+	for _, tt := range []struct {
+		name        string
+		stop        bool
+		elapsed     time.Duration
+		wantExists  bool
+		wantWait    bool
+		wantActions []string
+	}{
+		{"draining", false, 0, true, true, []string{DecisionActionDrain, DecisionActionHeartbeat}},
+		{"drained", true, 0, false, false, []string{DecisionActionDrain, DecisionActionComplete}},
+		// The tasks still exist when the drain times out, and the lifecycle action is abandoned regardless.
+		{"timed out", false, 601 * time.Second, true, false, []string{DecisionActionDrain, DecisionActionAbandon}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestDrainFixture()
+			d, out := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			if tt.stop {
+				f.stopTask()
+			}
+			if tt.elapsed > 0 {
+				started := clock.Now().Add(-tt.elapsed)
+				f.detail.DrainStartedAt = &started
+			}
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decision := detail.Decision
+			if decision == nil {
+				t.Fatal("Decision = nil, want the record of the poll")
+			}
+			if decision.ClusterName != "default" || decision.TaskExists != tt.wantExists ||
+				!decision.Time.Equal(clock.Now()) {
+				t.Errorf("Decision = %+v, want TaskExists %v in default at %v", decision, tt.wantExists, clock.Now())
+			}
+			if !reflect.DeepEqual(decision.Actions, tt.wantActions) {
+				t.Errorf("Actions = %q, want %q", decision.Actions, tt.wantActions)
+			}
+			if detail.Wait != tt.wantWait {
+				t.Errorf("Wait = %v, want %v for the actions taken", detail.Wait, tt.wantWait)
+			}
+			if !strings.Contains(out.String(), `"decision":{`) {
+				t.Errorf("log = %q, want the decision logged", out.String())
+			}
+		})
+	}
+}
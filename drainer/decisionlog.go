@@ -0,0 +1,58 @@
+package drainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// appendDecisionLog appends the decision record as a JSON line to
+// `s3://$DECISION_LOG_BUCKET/<EC2InstanceId>/<LifecycleActionToken>.jsonl`, so that every poll of a drain
+// ends up in one object. It is a no-op unless `DECISION_LOG_BUCKET` is set, and failures are only logged.
+func (d *Drainer) appendDecisionLog(
+	ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail, decision *DecisionRecord) {
+	bucket := d.config.DecisionLogBucket
+	if bucket == "" {
+		return
+	}
+	key := fmt.Sprintf("%s/%s.jsonl", detail.instanceKey(), detail.LifecycleActionToken)
+
+	if err := appendS3Line(ctx, clients.s3, bucket, key, decision); err != nil {
+		d.logger.warnf("failed to append the decision log to s3://%s/%s: %v", bucket, key, err)
+	}
+}
+
+// appendS3Line emulates an append by reading the current object and writing it back with one more line.
+// Polls of a drain are sequential, so there is no concurrent writer for the same key.
+func appendS3Line(ctx context.Context, svc s3API, bucket, key string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	output, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		if aerr, ok := asAWSError(err); !ok || aerr.Code() != s3.ErrCodeNoSuchKey {
+			return err
+		}
+	} else {
+		defer output.Body.Close()
+		if body, err = ioutil.ReadAll(output.Body); err != nil {
+			return err
+		}
+	}
+
+	body = append(body, line...)
+	body = append(body, '\n')
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
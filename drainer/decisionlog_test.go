@@ -0,0 +1,60 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDrainerDrainDecisionLog(t *testing.T) {
+	t.Setenv("DECISION_LOG_BUCKET", "decisions")
+	f := newTestDrainFixture()
+	svc := newFakeS3()
+	f.clients.s3 = svc
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.stopTask()
+	if _, err := d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+
+	body := svc.object("decisions", "i-1/token.jsonl")
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("s3://decisions/i-1/token.jsonl = %q, want a line per poll", body)
+	}
+	var records []DecisionRecord
+	for _, line := range lines {
+		var record DecisionRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if !records[0].TaskExists || records[1].TaskExists {
+		t.Errorf("TaskExists = %v, %v, want the task gone by the second poll", records[0].TaskExists,
+			records[1].TaskExists)
+	}
+	last := records[1].Actions
+	if len(last) == 0 || last[len(last)-1] != DecisionActionComplete {
+		t.Errorf("Actions = %q, want the completion last", last)
+	}
+
+	// Another lifecycle action of the instance has an object of its own.
+	f.detail.LifecycleActionToken = "token-2"
+	if _, err := d.Drain(ctx, f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.object("decisions", "i-1/token-2.jsonl"); strings.Count(string(got), "\n") != 1 {
+		t.Errorf("s3://decisions/i-1/token-2.jsonl = %q, want one line", got)
+	}
+	if got := svc.object("decisions", "i-1/token.jsonl"); string(got) != string(body) {
+		t.Errorf("s3://decisions/i-1/token.jsonl = %q, want it unchanged", got)
+	}
+}
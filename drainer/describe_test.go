@@ -0,0 +1,123 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDrainerFindContainerInstancesConcurrently(t *testing.T) {
+	t.Setenv("DESCRIBE_CONCURRENCY", "3")
+	svc := newFakeECS()
+	svc.pageSize = 10
+	for i := 0; i < 200; i++ {
+		svc.addContainerInstance("default", fmt.Sprintf("ci-%d", i), fmt.Sprintf("i-%d", i))
+	}
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	svc.onDescribeContainerInstances = func() {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}
+	d, _ := newTestDrainer(t, &awsClients{})
+
+	found, err := d.findContainerInstances(context.Background(), newECSClient(svc), "default", "i-157")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || aws.StringValue(found[0].ContainerInstanceArn) != testContainerInstanceArn("default", "ci-157") {
+		t.Errorf("findContainerInstances() = %v, want ci-157 of the 16th page", found)
+	}
+	if got := svc.count("DescribeContainerInstances"); got != 20 {
+		t.Errorf("DescribeContainerInstances calls = %d, want one per page", got)
+	}
+	if maxInFlight > 3 {
+		t.Errorf("concurrent descriptions = %d, want at most `DESCRIBE_CONCURRENCY`", maxInFlight)
+	}
+}
+
+func TestDrainerFindContainerInstancesError(t *testing.T) {
+	svc := newFakeECS()
+	svc.pageSize = 10
+	for i := 0; i < 50; i++ {
+		svc.addContainerInstance("default", fmt.Sprintf("ci-%d", i), fmt.Sprintf("i-%d", i))
+	}
+	denied := errors.New("AccessDeniedException")
+	svc.fail("DescribeContainerInstances", nil, denied)
+	d, _ := newTestDrainer(t, &awsClients{})
+
+	_, err := d.findContainerInstances(context.Background(), newECSClient(svc), "default", "i-1")
+	if !errors.Is(err, denied) {
+		t.Errorf("findContainerInstances() = %v, want the error of the failed page", err)
+	}
+}
+
+func TestDrainerFindContainerInstancesCancelled(t *testing.T) {
+	svc := newFakeECS()
+	svc.pageSize = 10
+	for i := 0; i < 50; i++ {
+		svc.addContainerInstance("default", fmt.Sprintf("ci-%d", i), fmt.Sprintf("i-%d", i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var pages int
+	svc.onPage = func() {
+		pages++
+		cancel()
+	}
+	d, _ := newTestDrainer(t, &awsClients{})
+
+	_, err := d.findContainerInstances(ctx, newECSClient(svc), "default", "i-49")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("findContainerInstances() = %v, want the error of the cancelled context", err)
+	}
+	if pages != 1 {
+		t.Errorf("pages = %d, want paging to stop once the context is done", pages)
+	}
+}
+
+func TestDrainerDrainScannedContainerInstances(t *testing.T) {
+	t.Setenv("ENABLE_METRICS", "true")
+	t.Setenv("SCAN_WARNING_THRESHOLD", "20")
+	f := newTestDrainFixture()
+	f.ecs.pageSize = 10
+	for i := 2; i <= 25; i++ {
+		f.ecs.addContainerInstance("default", fmt.Sprintf("ci-%d", i), fmt.Sprintf("i-%d", i))
+	}
+	svc := &fakeCloudWatch{}
+	f.clients.cloudwatch = svc
+	d, out := newTestDrainer(t, f.clients)
+
+	if _, err := d.Drain(context.Background(), f.detail); err != nil {
+		t.Fatal(err)
+	}
+	var decision map[string]interface{}
+	for _, line := range logLines(t, out) {
+		if line["msg"] == "made a drain decision" {
+			decision = line
+		}
+	}
+	if decision["scannedPages"] != float64(3) || decision["scannedContainerInstances"] != float64(25) {
+		t.Errorf("decision line = %v, want 25 container instances scanned in 3 pages", decision)
+	}
+	if got := svc.metrics("ContainerInstancesScanned"); len(got) != 1 || aws.Float64Value(got[0].Value) != 25 {
+		t.Errorf("ContainerInstancesScanned = %v, want 25", got)
+	}
+	if !strings.Contains(out.String(), `scanned 25 container instances in 3 pages of \"default\"`) {
+		t.Errorf("log = %q, want the scan over `SCAN_WARNING_THRESHOLD` warned", out.String())
+	}
+}
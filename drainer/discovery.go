@@ -0,0 +1,128 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// resolveContainerInstances returns the container instances of the EC2 instance in the resolved cluster.
+// When the instance is not there, e.g. because of a stale launch template, and `CLUSTER_DISCOVERY_FALLBACK`
+// is enabled, every cluster is searched and the cluster actually hosting the instance is returned.
+// There are no container instances if none is found.
+func (d *Drainer) resolveContainerInstances(ctx context.Context, svc *ecsClient, clusterName string, instanceID string,
+) (string, []*ecs.ContainerInstance, error) {
+	containerInstances, err := d.findContainerInstances(ctx, svc, clusterName, instanceID)
+	if err != nil || len(containerInstances) > 0 {
+		return clusterName, containerInstances, err
+	}
+	if !d.config.ClusterDiscoveryFallback {
+		return clusterName, nil, nil
+	}
+
+	d.logger.warnf("%q does not have %q, searching all clusters", clusterName, instanceID)
+	candidate, containerInstances, err := d.discoverCluster(ctx, svc, instanceID, clusterName)
+	if errors.Is(err, ErrNoClusters) {
+		d.logger.warnf("searching for %q: %v", instanceID, err)
+		return clusterName, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if len(containerInstances) == 0 {
+		return clusterName, nil, nil
+	}
+	d.logger.infof("found %q in %q instead of %q", instanceID, candidate, clusterName)
+	return candidate, containerInstances, nil
+}
+
+// discoverCluster searches every cluster but skip for the container instances of the EC2 instance and returns
+// the first cluster having them, or an empty name if none has. With `CLUSTER_DISCOVERY_TAG`, only the clusters
+// tagged with it are searched, which narrows the search in large accounts. An account without any cluster is
+// ErrNoClusters, which is told apart from an instance that is not in any cluster.
+func (d *Drainer) discoverCluster(ctx context.Context, svc *ecsClient, instanceID string, skip string,
+) (string, []*ecs.ContainerInstance, error) {
+	var clusterArns []*string
+	fn := func(output *ecs.ListClustersOutput, _ bool) bool {
+		clusterArns = append(clusterArns, output.ClusterArns...)
+		return ctx.Err() == nil
+	}
+	if err := pagesErr(ctx, svc.ListClustersPagesWithContext(ctx, &ecs.ListClustersInput{}, fn)); err != nil {
+		return "", nil, err
+	}
+	if len(clusterArns) == 0 {
+		return "", nil, ErrNoClusters
+	}
+
+	for _, clusterArn := range clusterArns {
+		candidate := clusterNameFromARN(*clusterArn)
+		if candidate == skip {
+			continue
+		}
+		if tag := d.config.ClusterDiscoveryTag; len(tag) == 2 {
+			tagged, err := hasClusterTag(ctx, svc, *clusterArn, tag[0], tag[1])
+			if err != nil {
+				return "", nil, err
+			}
+			if !tagged {
+				continue
+			}
+		}
+		containerInstances, err := d.findContainerInstances(ctx, svc, candidate, instanceID)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(containerInstances) > 0 {
+			return candidate, containerInstances, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// hasClusterTag reports whether the cluster is tagged with the key and the value.
+func hasClusterTag(ctx context.Context, svc *ecsClient, clusterArn, key, value string) (bool, error) {
+	output, err := svc.ListTagsForResourceWithContext(ctx, &ecs.ListTagsForResourceInput{ResourceArn: &clusterArn})
+	if err != nil {
+		return false, err
+	}
+	for _, tag := range output.Tags {
+		if aws.StringValue(tag.Key) == key && aws.StringValue(tag.Value) == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isClusterInactive reports whether the cluster is INACTIVE or missing, e.g. deleted while the instance scaled in,
+// in which case there is nothing to drain.
+func isClusterInactive(ctx context.Context, svc *ecsClient, clusterName string) (bool, error) {
+	output, err := svc.DescribeClustersWithContext(ctx, &ecs.DescribeClustersInput{
+		Clusters: []*string{&clusterName},
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, failure := range output.Failures {
+		if aws.StringValue(failure.Reason) == "MISSING" {
+			return true, nil
+		}
+	}
+	for _, cluster := range output.Clusters {
+		if aws.StringValue(cluster.Status) == "INACTIVE" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isClusterPermitted reports whether the function acts on the cluster: it is not in `CLUSTER_DENYLIST`,
+// and it is in `CLUSTER_ALLOWLIST` if that is set.
+func (d *Drainer) isClusterPermitted(clusterName string) bool {
+	if containsString(d.config.ClusterDenylist, clusterName) {
+		return false
+	}
+	allowlist := d.config.ClusterAllowlist
+	return len(allowlist) == 0 || containsString(allowlist, clusterName)
+}
@@ -0,0 +1,194 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerDiscoverCluster(t *testing.T) {
+	ctx := context.Background()
+	svc := newFakeECS()
+	d, _ := newTestDrainer(t, &awsClients{})
+
+	// An empty account is told apart from an instance that is in none of the clusters.
+	if _, _, err := d.discoverCluster(ctx, newECSClient(svc), "i-1", ""); !errors.Is(err, ErrNoClusters) {
+		t.Fatalf("discoverCluster() = %v in an empty account, want ErrNoClusters", err)
+	}
+	svc.addCluster("default")
+	svc.addContainerInstance("web", "ci-2", "i-2")
+	if name, _, err := d.discoverCluster(ctx, newECSClient(svc), "i-1", ""); name != "" || err != nil {
+		t.Fatalf("discoverCluster() = %q, %v, want no cluster for an unknown instance", name, err)
+	}
+	name, containerInstances, err := d.discoverCluster(ctx, newECSClient(svc), "i-2", "")
+	if name != "web" || len(containerInstances) != 1 || err != nil {
+		t.Errorf("discoverCluster() = %q, %v, %v, want the container instance in web", name, containerInstances, err)
+	}
+}
+
+func TestDrainerResolveContainerInstancesEmptyAccount(t *testing.T) {
+	t.Setenv("CLUSTER_DISCOVERY_FALLBACK", "true")
+	d, out := newTestDrainer(t, &awsClients{})
+
+	name, containerInstances, err := d.resolveContainerInstances(context.Background(), newECSClient(newFakeECS()),
+		"default", "i-1")
+	if name != "default" || len(containerInstances) != 0 || err != nil {
+		t.Errorf("resolveContainerInstances() = %q, %v, %v, want no container instance", name, containerInstances, err)
+	}
+	if !strings.Contains(out.String(), ErrNoClusters.Error()) {
+		t.Errorf("log = %q, want the empty account reported", out.String())
+	}
+}
+
+func TestDrainerDiscoverClusterTagged(t *testing.T) {
+	t.Setenv("CLUSTER_DISCOVERY_TAG", "ManagedBy=ecs-auto-draining")
+	ctx := context.Background()
+	svc := newFakeECS()
+	// The unmanaged cluster also has a container instance of the EC2 instance, e.g. registered by mistake.
+	svc.addContainerInstance("a-unmanaged", "ci-1", "i-1")
+	svc.addContainerInstance("b-other-value", "ci-2", "i-1")
+	svc.addContainerInstance("c-managed", "ci-3", "i-1")
+	svc.stateMu.Lock()
+	svc.clusters["b-other-value"].Tags = []*ecs.Tag{{Key: aws.String("ManagedBy"), Value: aws.String("terraform")}}
+	svc.clusters["c-managed"].Tags = []*ecs.Tag{{Key: aws.String("ManagedBy"), Value: aws.String("ecs-auto-draining")}}
+	svc.stateMu.Unlock()
+	d, _ := newTestDrainer(t, &awsClients{})
+
+	name, _, err := d.discoverCluster(ctx, newECSClient(svc), "i-1", "")
+	if name != "c-managed" || err != nil {
+		t.Fatalf("discoverCluster() = %q, %v, want the tagged cluster", name, err)
+	}
+	if got := svc.count("ListContainerInstances"); got != 1 {
+		t.Errorf("ListContainerInstances calls = %d, want only the tagged cluster searched", got)
+	}
+	if got := svc.count("ListTagsForResource"); got != 3 {
+		t.Errorf("ListTagsForResource calls = %d, want one per cluster", got)
+	}
+}
+
+func TestDrainerDrainClusterDiscoveryFallback(t *testing.T) {
+	// The stale launch template of the instance names default, but the agent registered it to web.
+	newFixture := func() *testDrainFixture {
+		f := newTestDrainFixture()
+		f.ecs.addContainerInstance("web", "ci-2", "i-stale")
+		f.ec2.addInstance("i-stale", "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+		f.detail.EC2InstanceId = "i-stale"
+		return f
+	}
+
+	f := newFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.DrainingSet || f.ecs.count("ListClusters") != 0 {
+		t.Errorf("Drain() = %+v, want no search without `CLUSTER_DISCOVERY_FALLBACK`", detail)
+	}
+
+	t.Setenv("CLUSTER_DISCOVERY_FALLBACK", "true")
+	f = newFixture()
+	d, _ = newTestDrainer(t, f.clients)
+	detail, err = d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.ClusterName != "web" || !detail.DrainingSet {
+		t.Errorf("Drain() = %+v, want the instance drained in web", detail)
+	}
+	if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("web", "ci-2")); got != "DRAINING" {
+		t.Errorf("status = %q, want DRAINING", got)
+	}
+}
+
+func TestDrainerDrainClusterPermissions(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		allowlist string
+		denylist  string
+		wantDrain bool
+	}{
+		{"no lists", "", "", true},
+		{"allowlisted", "web, default", "", true},
+		{"unlisted", "web", "", false},
+		{"denylisted", "default", "default", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CLUSTER_ALLOWLIST", tt.allowlist)
+			t.Setenv("CLUSTER_DENYLIST", tt.denylist)
+			f := newTestDrainFixture()
+			d, out := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := f.ecs.containerInstanceStatus(testContainerInstanceArn("default", "ci-1"))
+			if tt.wantDrain {
+				if !detail.Wait || status != "DRAINING" {
+					t.Errorf("Drain() = %+v with status %q, want the instance drained", detail, status)
+				}
+				return
+			}
+			if detail.Wait || status != "ACTIVE" {
+				t.Errorf("Drain() = %+v with status %q, want the drain done without draining", detail, status)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+				t.Errorf("completions = %v, want [CONTINUE]", got)
+			}
+			if !strings.Contains(out.String(), "is not managed by this function") {
+				t.Errorf("log = %q, want the cluster skipped", out.String())
+			}
+		})
+	}
+}
+
+func TestDrainerDrainInactiveCluster(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		env       string
+		prepare   func(*testDrainFixture)
+		wantDrain bool
+	}{
+		{"inactive", "", func(f *testDrainFixture) {
+			f.ecs.clusters["default"].Status = aws.String("INACTIVE")
+		}, false},
+		{"missing", "", func(f *testDrainFixture) { delete(f.ecs.clusters, "default") }, false},
+		{"disabled", "false", func(f *testDrainFixture) {
+			f.ecs.clusters["default"].Status = aws.String("INACTIVE")
+		}, true},
+		{"failed describe", "", func(f *testDrainFixture) {
+			f.ecs.fail("DescribeClusters", errors.New("AccessDeniedException"))
+		}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("COMPLETE_ON_INACTIVE_CLUSTER", tt.env)
+			f := newTestDrainFixture()
+			tt.prepare(f)
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			drained := f.ecs.count("UpdateContainerInstancesState") > 0
+			if drained != tt.wantDrain {
+				t.Errorf("drained = %v, want %v", drained, tt.wantDrain)
+			}
+			if tt.wantDrain {
+				return
+			}
+			got := f.autoscaling.completedResults()
+			if detail.Wait || len(got) != 1 || got[0] != LifecycleActionResultContinue {
+				t.Errorf("Drain() = %+v with completions %v, want to complete with CONTINUE at once", detail, got)
+			}
+			if got := f.ecs.count("ListContainerInstances"); got != 0 {
+				t.Errorf("ListContainerInstances calls = %d, want nothing looked up", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,782 @@
+package drainer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+type CloudWatchEventDetail struct {
+	AutoScalingGroupName string
+	EC2InstanceId        string // nolint:golint,stylecheck
+	LifecycleActionToken string
+	LifecycleHookName    string
+	LifecycleTransition  string
+	Wait                 bool
+	Decision             *DecisionRecord `json:",omitempty"`
+	FlappingDelayed      bool            `json:",omitempty"`
+	FlappingConfirmed    bool            `json:",omitempty"`
+	TrackedTaskArns      []string        `json:",omitempty"`
+	DrainingSet          bool            `json:",omitempty"`
+	DrainStartedAt       *time.Time      `json:",omitempty"`
+	ForceStopped         bool            `json:",omitempty"`
+	Escalated            bool            `json:",omitempty"`
+	Result               *DrainResult    `json:",omitempty"`
+	WaitSeconds          int             `json:",omitempty"`
+	ClusterName          string          `json:",omitempty"`
+	HeartbeatTimeout     int             `json:",omitempty"`
+	TasksSeen            bool            `json:",omitempty"`
+	AffectedServices     []string        `json:",omitempty"`
+	LeaseKey             string          `json:",omitempty"`
+	ContainerInstanceArn string          `json:",omitempty"`
+}
+
+// validate returns an error naming the first field the lifecycle action calls need but the detail lacks.
+// An external instance has `ContainerInstanceArn` instead of `EC2InstanceId`.
+func (d *CloudWatchEventDetail) validate() error {
+	for _, field := range []struct{ name, value string }{
+		{"AutoScalingGroupName", d.AutoScalingGroupName},
+		{"EC2InstanceId", d.instanceKey()},
+		{"LifecycleActionToken", d.LifecycleActionToken},
+		{"LifecycleHookName", d.LifecycleHookName},
+	} {
+		if field.value == "" {
+			return fmt.Errorf("`detail.%s` is empty: %w", field.name, ErrInvalidEventDetail)
+		}
+	}
+	return nil
+}
+
+const (
+	DetailTypeTerminateLifecycle   = "EC2 Instance-terminate Lifecycle Action"
+	DetailTypeLaunchLifecycle      = "EC2 Instance-launch Lifecycle Action"
+	LifecycleTransitionTerminating = "autoscaling:EC2_INSTANCE_TERMINATING"
+	CompletionMarker               = "DRAIN_COMPLETE"
+	LifecycleActionResultContinue  = "CONTINUE"
+	LifecycleActionResultAbandon   = "ABANDON"
+)
+
+const (
+	DrainPathFastComplete     = "FastComplete"
+	DrainPathDrainedWithTasks = "DrainedWithTasks"
+)
+
+const (
+	ManagedTerminationComplete = "complete"
+	ManagedTerminationObserve  = "observe"
+)
+
+const stateMachineWaitSeconds = 30
+
+// ecsClusterRegexp finds the cluster name in UserData as its first capture group, unless `CLUSTER_NAME_REGEX` is set.
+var ecsClusterRegexp = regexp.MustCompile(`\bECS_CLUSTER=["']?([-\w]+)`) // nolint:gochecknoglobals
+
+// finalCallTimeout bounds the last call made after the context of the invocation is done.
+const finalCallTimeout = 2 * time.Second
+
+// finalHeartbeat extends the lifecycle action when the invocation runs out of time in the middle of a poll,
+// so that the next invocation has time to finish the drain. The context of the invocation is already done,
+// so the call gets a fresh one.
+func (d *Drainer) finalHeartbeat(evt *events.CloudWatchEvent, drainErr error) {
+	var detail *CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil || detail == nil || detail.LifecycleActionToken == "" {
+		return
+	}
+	lg := d.logger.with(logFields{"instanceId": detail.EC2InstanceId, "asg": detail.AutoScalingGroupName})
+	lg.warnf("invocation ran out of time, sending a final heartbeat: %v", drainErr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), finalCallTimeout)
+	defer cancel()
+	clients := d.newClients(evt)
+	if err := d.heartbeat(ctx, clients.autoscaling, detail); err != nil {
+		lg.errorf("failed to send the final heartbeat: %v", err)
+	}
+}
+
+// completeOnError completes the lifecycle action with `ERROR_LIFECYCLE_ACTION_RESULT`, the hook's default or ABANDON,
+// so that the instance does not wait for the hook timeout after a failed drain.
+func (d *Drainer) completeOnError(evt *events.CloudWatchEvent, drainErr error) {
+	var detail *CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil || detail == nil || detail.LifecycleActionToken == "" {
+		return
+	}
+	result := d.getErrorLifecycleActionResult(detail)
+
+	clients := d.newClients(evt)
+	lg := d.logger.with(logFields{"instanceId": detail.EC2InstanceId, "asg": detail.AutoScalingGroupName})
+	lg.errorf("failed to drain, completing with %s: %v", result, drainErr)
+	// The context of the invocation may be done already.
+	ctx, cancel := context.WithTimeout(context.Background(), finalCallTimeout)
+	defer cancel()
+	if err := d.complete(ctx, clients.autoscaling, detail, result); err != nil {
+		lg.errorf("failed to complete the lifecycle action after the error: %v", err)
+		return
+	}
+	d.releaseDrainLease(ctx, clients, detail)
+}
+
+// getErrorLifecycleActionResult falls back to the `DefaultResult` of the hook when it has been described already,
+// as the instance would get it on the hook timeout anyway.
+func (d *Drainer) getErrorLifecycleActionResult(detail *CloudWatchEventDetail) string {
+	if d.config.ErrorLifecycleActionResult == "" {
+		if hook, ok := lifecycleHooks.get(detail.AutoScalingGroupName, detail.LifecycleHookName, d.clock.Now()); ok &&
+			hook.defaultResult != "" {
+			return hook.defaultResult
+		}
+		return LifecycleActionResultAbandon
+	}
+	return d.config.ErrorLifecycleActionResult
+}
+
+// handleResolutionFailure completes the lifecycle action as configured by `ON_RESOLUTION_FAILURE`
+// instead of waiting for the hook timeout.
+func (d *Drainer) handleResolutionFailure(ctx context.Context, lg *logger, clients *awsClients,
+	evt *events.CloudWatchEvent, detail *CloudWatchEventDetail, resolutionErr error) (*events.CloudWatchEvent, error) {
+	var result string
+	switch behavior := d.config.OnResolutionFailure; behavior {
+	case "", "error":
+		return nil, resolutionErr
+	case "continue":
+		result = LifecycleActionResultContinue
+	case "abandon":
+		result = LifecycleActionResultAbandon
+	default:
+		return nil, fmt.Errorf("`ON_RESOLUTION_FAILURE` is %q, not one of error, continue or abandon", behavior)
+	}
+
+	lg.errorf("failed to resolve the cluster, completing with %s: %v", result, resolutionErr)
+	return d.completeWithoutDraining(ctx, clients, evt, detail, result)
+}
+
+// getLifecycleActionResult returns the lifecycle action result in the environment variable, or "" if it is unset.
+func getLifecycleActionResult(name string) (string, error) {
+	switch result := getenv(name); result {
+	case "", LifecycleActionResultContinue, LifecycleActionResultAbandon:
+		return result, nil
+	default:
+		return "", fmt.Errorf("`%s` is %q, not one of %s or %s",
+			name, result, LifecycleActionResultContinue, LifecycleActionResultAbandon)
+	}
+}
+
+func (d *Drainer) completeWithoutDraining(ctx context.Context, clients *awsClients,
+	evt *events.CloudWatchEvent, detail *CloudWatchEventDetail, result string) (*events.CloudWatchEvent, error) {
+	if err := d.complete(ctx, clients.autoscaling, detail, result); err != nil {
+		return nil, err
+	}
+	d.releaseDrainLease(ctx, clients, detail)
+	detail.Wait = false
+	detail.Result = d.newDrainResult("", nil, detail, result)
+	return returnDetail(evt, detail)
+}
+
+// completeNonTerminating completes the lifecycle action of another transition, e.g. of a launch hook whose events
+// match the rule by mistake, with CONTINUE so as not to block the instance. `STRICT_TRANSITION` rejects them instead.
+func (d *Drainer) completeNonTerminating(ctx context.Context, lg *logger, evt *events.CloudWatchEvent,
+	detail *CloudWatchEventDetail) (*events.CloudWatchEvent, error) {
+	if err := detail.validate(); err != nil {
+		lg.warnf("`LifecycleTransition` is %q, not %q, and the lifecycle action cannot be completed: %v",
+			detail.LifecycleTransition, LifecycleTransitionTerminating, err)
+		detail.Wait = false
+		return returnDetail(evt, detail)
+	}
+	lg.warnf("`LifecycleTransition` is %q, not %q, completing with %s",
+		detail.LifecycleTransition, LifecycleTransitionTerminating, LifecycleActionResultContinue)
+	clients := d.newClients(evt)
+	return d.completeWithoutDraining(ctx, clients, evt, detail, LifecycleActionResultContinue)
+}
+
+// isDrainedByOthers reports whether the container instance was set to DRAINING by another actor.
+// The task counts of an instance whose agent is disconnected may be stale, so they are not trusted.
+func isDrainedByOthers(containerInstance *ecs.ContainerInstance, detail *CloudWatchEventDetail) bool {
+	return !detail.DrainingSet &&
+		aws.StringValue(containerInstance.Status) == ecs.ContainerInstanceStatusDraining &&
+		aws.BoolValue(containerInstance.AgentConnected)
+}
+
+func taskCounts(containerInstance *ecs.ContainerInstance) int64 {
+	return aws.Int64Value(containerInstance.RunningTasksCount) + aws.Int64Value(containerInstance.PendingTasksCount)
+}
+
+func returnDetail(evt *events.CloudWatchEvent, detail *CloudWatchEventDetail) (*events.CloudWatchEvent, error) {
+	// The state machine waits for `WaitSeconds`, jittered so that instances draining together do not
+	// heartbeat in lockstep.
+	detail.WaitSeconds = 0
+	if detail.Wait {
+		wait := int(heartbeatSafeInterval(detail, stateMachineWaitSeconds*time.Second) / time.Second)
+		detail.WaitSeconds = wait + rand.Intn(wait/loopJitterRatio+1) // nolint:gosec
+	}
+	var err error
+	if evt.Detail, err = json.Marshal(detail); err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
+
+func getInstanceIDFromResources(resources []string) (string, error) {
+	for _, resource := range resources {
+		parsed, err := arn.Parse(resource)
+		if err != nil || parsed.Service != ec2.ServiceName {
+			continue
+		}
+		if strings.HasPrefix(parsed.Resource, "instance/") {
+			return strings.TrimPrefix(parsed.Resource, "instance/"), nil
+		}
+	}
+	return "", errors.New("neither `EC2InstanceId` nor `resources` has an instance ID")
+}
+
+// logCompletionMarker writes a single line starting with `DRAIN_COMPLETE` so that a subscription filter
+// can forward only completions. It is written as is, without the time or the level of the other lines.
+func (d *Drainer) logCompletionMarker(detail *CloudWatchEventDetail, clusterName string) error {
+	marshaled, err := json.Marshal(map[string]string{
+		"AutoScalingGroupName": detail.AutoScalingGroupName,
+		"EC2InstanceId":        detail.EC2InstanceId,
+		"ClusterName":          clusterName,
+	})
+	if err != nil {
+		return err
+	}
+	d.logger.writeLine(CompletionMarker + " " + string(marshaled))
+	return nil
+}
+
+func newSession(region string) *session.Session {
+	config := aws.NewConfig()
+	if region != "" {
+		config.WithRegion(region)
+	}
+	if getenv("VERBOSE") == "true" || getenv("AWS_SAM_LOCAL") == "true" {
+		config.WithLogLevel(aws.LogDebugWithHTTPBody | aws.LogDebugWithRequestErrors | aws.LogDebugWithRequestRetries)
+	}
+	// The SDK's retryer already retries throttling and connection resets; `SDK_MAX_RETRIES` only bounds it.
+	// An invalid value is reported by loadConfig at cold start.
+	if maxRetries, err := getenvInt("SDK_MAX_RETRIES", aws.UseServiceDefaultRetries); err == nil {
+		config.WithMaxRetries(maxRetries)
+	}
+	if client := newHTTPClient(); client != nil {
+		config.WithHTTPClient(client)
+	}
+	return session.Must(session.NewSession(config))
+}
+
+// compileClusterNameRegexp returns `CLUSTER_NAME_REGEX` compiled, or ecsClusterRegexp if it is unset.
+func compileClusterNameRegexp() (*regexp.Regexp, error) {
+	pattern := getenv("CLUSTER_NAME_REGEX")
+	if pattern == "" {
+		return ecsClusterRegexp, nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("`CLUSTER_NAME_REGEX` is invalid: %w", err)
+	}
+	if compiled.NumSubexp() == 0 {
+		return nil, fmt.Errorf("`CLUSTER_NAME_REGEX` is %q, which has no capture group for the cluster name", pattern)
+	}
+	return compiled, nil
+}
+
+// getECSClusterNameFromEvent returns the cluster an enriching rule put in the `resources` or the detail of the event,
+// or "" if there is none.
+func getECSClusterNameFromEvent(evt *events.CloudWatchEvent) string {
+	for _, resource := range evt.Resources {
+		if clusterName := parseClusterArn(resource); clusterName != "" {
+			return clusterName
+		}
+	}
+
+	var detail struct {
+		ClusterArn  string
+		ClusterName string
+	}
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+		return ""
+	}
+	if clusterName := parseClusterArn(detail.ClusterArn); clusterName != "" {
+		return clusterName
+	}
+	if detail.ClusterName == "" {
+		return ""
+	}
+	return clusterNameFromARN(detail.ClusterName)
+}
+
+// parseClusterArn returns the name of the ECS cluster ARN, or "" if it is not one.
+func parseClusterArn(s string) string {
+	parsed, err := arn.Parse(s)
+	if err != nil || parsed.Service != ecs.ServiceName || !strings.HasPrefix(parsed.Resource, "cluster/") {
+		return ""
+	}
+	return strings.TrimPrefix(parsed.Resource, "cluster/")
+}
+
+// getECSClusterName resolves the cluster of the instance from the sources of `CLUSTER_NAME_SOURCES` in order,
+// or from the event, the cache and then lookupECSClusterName when it is unset.
+func (d *Drainer) getECSClusterName(
+	ctx context.Context, clients *awsClients, evt *events.CloudWatchEvent, instanceID string,
+) (string, error) {
+	sources := d.config.ClusterNameSources
+	if len(sources) == 0 {
+		if clusterName := getECSClusterNameFromEvent(evt); clusterName != "" {
+			return clusterName, nil
+		}
+	}
+	if clusterName := clusterNames.get(instanceID, d.clock.Now()); clusterName != "" {
+		return clusterName, nil
+	}
+
+	var clusterName string
+	var err error
+	if len(sources) > 0 {
+		clusterName, err = d.lookupECSClusterNameFromSources(ctx, clients, evt, instanceID, sources)
+	} else {
+		clusterName, err = d.lookupECSClusterName(ctx, clients, clients.ec2, instanceID)
+	}
+	if err != nil {
+		return "", err
+	}
+	// The index or the tag may hold the ARN, while the rest of the flow, e.g. the metric dimensions and
+	// `CLUSTER_ALLOWLIST`, uses the short name.
+	clusterName = clusterNameFromARN(clusterName)
+	clusterNames.set(instanceID, clusterName, d.clock.Now())
+	return clusterName, nil
+}
+
+func (d *Drainer) lookupECSClusterName(ctx context.Context, clients *awsClients, svc ec2API,
+	instanceID string) (string, error) {
+	if table := d.config.ClusterIndexTable; table != "" {
+		clusterName, err := getECSClusterNameFromIndex(ctx, clients.clusterIndex, table, instanceID)
+		if err != nil {
+			return "", err
+		}
+		if clusterName != "" {
+			return clusterName, nil
+		}
+	}
+
+	userData, err := getUserData(ctx, svc, instanceID)
+	if err != nil {
+		// Least-privilege deployments may omit `ec2:DescribeInstanceAttribute` and rely on the other resolvers.
+		switch {
+		case errors.Is(err, ErrNoClusterInUserData):
+		case isAccessDenied(err):
+			d.logger.warnf("EC2 access is unavailable, skipping UserData: %v", err)
+		default:
+			return "", err
+		}
+	}
+
+	clusterName, extractErr := d.extractClusterName(userData)
+	if extractErr != nil {
+		return "", extractErr
+	}
+	if clusterName != "" {
+		return clusterName, nil
+	}
+
+	clusterName, tagErr := d.getECSClusterNameFromTag(ctx, svc, instanceID)
+	if tagErr != nil && !isAccessDenied(tagErr) {
+		return "", tagErr
+	}
+	if clusterName != "" {
+		return clusterName, nil
+	}
+
+	if d.config.CloudTrailResolver {
+		return d.getECSClusterNameFromCloudTrail(ctx, clients.cloudtrail, instanceID)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("`UserData` does not have `ECS_CLUSTER=...`: %w", ErrNoClusterInUserData)
+}
+
+func isAccessDenied(err error) bool {
+	if aerr, ok := asAWSError(err); ok {
+		switch aerr.Code() {
+		case "UnauthorizedOperation", "AccessDenied", "AccessDeniedException":
+			return true
+		}
+	}
+	return false
+}
+
+func getUserData(ctx context.Context, svc ec2API, instanceID string) (string, error) {
+	output, err := svc.DescribeInstanceAttributeWithContext(ctx, &ec2.DescribeInstanceAttributeInput{
+		InstanceId: &instanceID,
+		Attribute:  aws.String(ec2.InstanceAttributeNameUserData),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get UserData of %q: %w", instanceID, err)
+	}
+
+	if output.UserData.Value == nil {
+		return "", fmt.Errorf("instance %q does not have UserData: %w", instanceID, ErrNoClusterInUserData)
+	}
+
+	userData, err := base64.StdEncoding.DecodeString(*output.UserData.Value)
+	if err != nil {
+		return "", err
+	}
+
+	return decodeUserData(userData)
+}
+
+// findContainerInstances returns the container instances of the EC2 instance in the cluster. There are more than
+// one when several agents registered the instance, and none if it never joined the cluster.
+func (d *Drainer) findContainerInstances(
+	ctx context.Context, svc *ecsClient, clusterName string, instanceID string) ([]*ecs.ContainerInstance, error) {
+	input := &ecs.ListContainerInstancesInput{Cluster: &clusterName}
+	var arrayOfArns [][]*string
+	var pages, scanned int
+	fn := func(output *ecs.ListContainerInstancesOutput, _ bool) bool {
+		pages++
+		scanned += len(output.ContainerInstanceArns)
+		if len(output.ContainerInstanceArns) > 0 {
+			arrayOfArns = append(arrayOfArns, output.ContainerInstanceArns)
+		}
+		return ctx.Err() == nil
+	}
+	err := d.withRetry(ctx, "ListContainerInstances", func() error {
+		arrayOfArns, pages, scanned = nil, 0, 0
+		return pagesErr(ctx, svc.ListContainerInstancesPagesWithContext(ctx, input, fn))
+	})
+	if err != nil {
+		return nil, err
+	}
+	svc.scannedPages += pages
+	svc.scannedArns += scanned
+	d.warnLargeScan(clusterName, pages, scanned)
+
+	return d.describeContainerInstancesConcurrently(ctx, svc, clusterName, instanceID, arrayOfArns)
+}
+
+const defaultScanWarningThreshold = 1000
+
+// warnLargeScan warns when finding the instance listed more than `SCAN_WARNING_THRESHOLD` container instances,
+// 1000 by default, which every poll pays for.
+func (d *Drainer) warnLargeScan(clusterName string, pages, scanned int) {
+	threshold := d.config.ScanWarningThreshold
+	if threshold <= 0 || scanned <= threshold {
+		return
+	}
+	d.logger.warnf("scanned %d container instances in %d pages of %q to find the instance; "+
+		"consider putting the cluster in the event or enabling `CLUSTER_NAME_SOURCES`", scanned, pages, clusterName)
+}
+
+const defaultDescribeConcurrency = 4
+
+// describeContainerInstancesConcurrently describes the pages of container instances with up to
+// `DESCRIBE_CONCURRENCY` workers and returns the container instances of the EC2 instance in the order of the pages.
+// The remaining pages are cancelled on an error.
+func (d *Drainer) describeContainerInstancesConcurrently(
+	ctx context.Context, svc *ecsClient, clusterName string, instanceID string, arrayOfArns [][]*string,
+) ([]*ecs.ContainerInstance, error) {
+	concurrency := d.config.DescribeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		found    = make([][]*ecs.ContainerInstance, len(arrayOfArns))
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	type batch struct {
+		index int
+		arns  []*string
+	}
+	batches := make(chan batch)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				arns := b.arns
+				var output *ecs.DescribeContainerInstancesOutput
+				err := d.withRetry(ctx, "DescribeContainerInstances", func() (err error) {
+					output, err = svc.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+						Cluster:            &clusterName,
+						ContainerInstances: arns,
+					})
+					return err
+				})
+
+				mu.Lock()
+				switch {
+				case firstErr != nil:
+					// The calls cancelled after the first error are ignored.
+				case err != nil:
+					firstErr = err
+					cancel()
+				default:
+					for _, containerInstance := range output.ContainerInstances {
+						if aws.StringValue(containerInstance.Ec2InstanceId) == instanceID {
+							found[b.index] = append(found[b.index], containerInstance)
+						}
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i, arns := range arrayOfArns {
+		select {
+		case batches <- batch{index: i, arns: arns}:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	// Not having looked at every page because of the deadline is not the same as not finding it.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var containerInstances []*ecs.ContainerInstance
+	for _, page := range found {
+		containerInstances = append(containerInstances, page...)
+	}
+	return containerInstances, nil
+}
+
+func (d *Drainer) setStateDraining(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) error {
+	_, err := svc.UpdateContainerInstancesStateWithContext(ctx, &ecs.UpdateContainerInstancesStateInput{
+		Cluster:            &clusterName,
+		ContainerInstances: []*string{containerInstanceArn},
+		Status:             aws.String(ecs.ContainerInstanceStatusDraining),
+	})
+	if err != nil {
+		return err
+	}
+	d.markDrained(ctx, svc, clusterName, containerInstanceArn)
+	if d.config.VerifyDraining {
+		d.verifyDraining(ctx, svc, clusterName, containerInstanceArn)
+	}
+	return nil
+}
+
+const (
+	verifyDrainingAttempts = 3
+	verifyDrainingInterval = time.Second
+)
+
+// verifyDraining describes the container instance again until it is DRAINING, and warns if it does not converge,
+// e.g. because a conflicting update set it back. It never fails the drain, which sets the state again on the
+// next poll.
+func (d *Drainer) verifyDraining(ctx context.Context, svc *ecsClient, clusterName string,
+	containerInstanceArn *string) {
+	var status string
+	for attempt := 0; attempt < verifyDrainingAttempts; attempt++ {
+		output, err := svc.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            &clusterName,
+			ContainerInstances: []*string{containerInstanceArn},
+		})
+		if err != nil {
+			d.logger.warnf("failed to verify that %q is DRAINING: %v", aws.StringValue(containerInstanceArn), err)
+			return
+		}
+		if len(output.ContainerInstances) > 0 {
+			status = aws.StringValue(output.ContainerInstances[0].Status)
+			if status == ecs.ContainerInstanceStatusDraining {
+				return
+			}
+		}
+		if err := d.clock.Sleep(ctx, verifyDrainingInterval); err != nil {
+			break
+		}
+	}
+	d.logger.warnf("%q is still %q after being set to DRAINING", aws.StringValue(containerInstanceArn), status)
+}
+
+// deregisterContainerInstance removes the drained container instance from the cluster so that it does not
+// linger until the agent's registration expires. It does not force, and failures, including an instance
+// that is already deregistered, are only logged.
+func (d *Drainer) deregisterContainerInstance(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) {
+	_, err := svc.DeregisterContainerInstanceWithContext(ctx, &ecs.DeregisterContainerInstanceInput{
+		Cluster:           &clusterName,
+		ContainerInstance: containerInstanceArn,
+		Force:             aws.Bool(false),
+	})
+	if err != nil {
+		d.logger.warnf("failed to deregister %q: %v", aws.StringValue(containerInstanceArn), err)
+	}
+}
+
+// FastPathLatency is the `FAST_PATH` that saves API calls on busy instances at the cost of an exact count.
+const FastPathLatency = "latency"
+
+// countTasks counts the tasks on the container instance that block draining, including the tasks
+// desired to stop that are still running.
+func (d *Drainer) countTasks(ctx context.Context, svc *ecsClient, clusterName string,
+	containerInstanceArn *string) (int, error) {
+	desiredStatuses, minRemaining := d.config.TaskStatuses, d.config.MinRemainingTasks
+	fast := d.config.FastPath == FastPathLatency && !d.filtersTasks()
+
+	var total int
+	var incompleteErr error
+	for _, desiredStatus := range desiredStatuses {
+		var arns []*string
+		err := d.withRetry(ctx, "ListTasks", func() (err error) {
+			arns, err = d.listCheckedTaskArns(ctx, svc, clusterName, containerInstanceArn, desiredStatus)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		// Optimizing for latency, RUNNING tasks over the threshold settle that draining goes on without describing
+		// them or listing the STOPPED ones. Desired RUNNING includes the PENDING tasks, so none is missed.
+		if fast && desiredStatus == ecs.DesiredStatusRunning && total+len(arns) > minRemaining {
+			return total + len(arns), incompleteErr
+		}
+		var count int
+		err = d.withRetry(ctx, "DescribeTasks", func() (err error) {
+			count, err = d.blockingTaskCount(ctx, svc, clusterName, arns)
+			return err
+		})
+		if errors.Is(err, ErrIncompleteTaskDescribe) {
+			incompleteErr, err = err, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += count
+
+		if desiredStatus == ecs.DesiredStatusStopped && count > 0 {
+			if err := d.warnStuckStoppingTasks(ctx, svc, clusterName, arns); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return total, incompleteErr
+}
+
+func (d *Drainer) heartbeat(ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail) error {
+	return d.traceSubsegment(ctx, "heartbeat", func(ctx context.Context) error {
+		// Instances draining together heartbeat together, so throttling is backed off instead of failing.
+		return d.withRetry(ctx, "RecordLifecycleActionHeartbeat", func() error {
+			err := d.withDiscoveredHook(ctx, svc, detail, func() error {
+				_, err := svc.RecordLifecycleActionHeartbeatWithContext(ctx, &autoscaling.RecordLifecycleActionHeartbeatInput{
+					AutoScalingGroupName: &detail.AutoScalingGroupName,
+					LifecycleActionToken: &detail.LifecycleActionToken,
+					LifecycleHookName:    &detail.LifecycleHookName,
+				})
+				return err
+			})
+			if isNoActiveLifecycleAction(err) {
+				return fmt.Errorf("%w: %v", ErrNoActiveLifecycleAction, err)
+			}
+			return err
+		})
+	})
+}
+
+// holdsDrainBack reports whether `MAX_CONCURRENT_DRAINING` or `MAX_DRAINING_PER_AZ` instances are already draining.
+// With `LEASE_TABLE`, the former is enforced by acquireDrainLease unless in `OBSERVER_MODE`.
+func (d *Drainer) holdsDrainBack(ctx context.Context, lg *logger, clients *awsClients, svc *ecsClient,
+	clusterName string, containerInstance *ecs.ContainerInstance, detail *CloudWatchEventDetail) (bool, error) {
+	maxPerZone := d.config.MaxDrainingPerAZ
+	if zone := availabilityZone(containerInstance); maxPerZone > 0 && zone != "" {
+		draining, err := d.countDrainingInstances(ctx, svc, clusterName, zone)
+		if err != nil {
+			return false, err
+		}
+		if draining >= maxPerZone {
+			lg.infof("%d instances in %s are already draining, waiting to drain", draining, zone)
+			return true, nil
+		}
+	}
+
+	// The zone is checked first so that a lease is not held while the zone holds the drain back.
+	// An observer takes no lease, since it never completes the lifecycle action that would release it.
+	maxDraining := d.config.MaxConcurrentDraining
+	if maxDraining > 0 && d.config.LeaseTable != "" && !d.isObserverMode() {
+		acquired, err := d.acquireDrainLease(ctx, clients, clusterName, maxDraining, detail)
+		if err != nil {
+			return false, err
+		}
+		if !acquired {
+			lg.infof("all %d drain leases of the cluster are held, waiting to drain", maxDraining)
+			return true, nil
+		}
+	} else if maxDraining > 0 {
+		draining, err := d.countDrainingInstances(ctx, svc, clusterName, "")
+		if err != nil {
+			return false, err
+		}
+		if draining >= maxDraining {
+			lg.infof("%d instances of the cluster are already draining, waiting to drain", draining)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// handleHeartbeatFailure stops waiting when the lifecycle action was already completed or abandoned elsewhere,
+// e.g. by an operator or a duplicate execution, since the drain has nothing left to keep alive.
+func handleHeartbeatFailure(lg *logger, evt *events.CloudWatchEvent, detail *CloudWatchEventDetail,
+	err error) (*events.CloudWatchEvent, error) {
+	if !errors.Is(err, ErrNoActiveLifecycleAction) {
+		return nil, err
+	}
+	lg.warnf("lifecycle action is no longer active, stopping the drain: %v", err)
+	detail.Wait = false
+	return returnDetail(evt, detail)
+}
+
+func (d *Drainer) complete(ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail,
+	result string) error {
+	return d.traceSubsegment(ctx, "complete", func(ctx context.Context) error {
+		// The completions of a large SQS batch share the rate limit of the group and may be throttled.
+		err := d.withDiscoveredHook(ctx, svc, detail, func() error {
+			return d.withRetry(ctx, "CompleteLifecycleAction", func() error {
+				_, err := svc.CompleteLifecycleActionWithContext(ctx, &autoscaling.CompleteLifecycleActionInput{
+					AutoScalingGroupName:  &detail.AutoScalingGroupName,
+					LifecycleActionResult: &result,
+					LifecycleActionToken:  &detail.LifecycleActionToken,
+					LifecycleHookName:     &detail.LifecycleHookName,
+				})
+				return err
+			})
+		})
+		// The hook was already resolved, e.g. by its timeout, and the instance is gone; retrying can never succeed.
+		if isNoActiveLifecycleAction(err) {
+			d.logger.warnf("lifecycle action of %q is no longer active, regarding it as completed: %v",
+				detail.EC2InstanceId, err)
+			return nil
+		}
+		return err
+	})
+}
+
+func isNoActiveLifecycleAction(err error) bool {
+	aerr, ok := asAWSError(err)
+	return ok && aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "No active Lifecycle Action found")
+}
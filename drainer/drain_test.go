@@ -0,0 +1,667 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestGetInstanceIDFromResources(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		resources []string
+		want      string
+		wantErr   bool
+	}{
+		{"instance", []string{"arn:aws:ec2:us-east-1:123456789012:instance/i-1"}, "i-1", false},
+		{"after the group", []string{
+			"arn:aws:autoscaling:us-east-1:123456789012:autoScalingGroup:uuid:autoScalingGroupName/asg",
+			"arn:aws:ec2:us-east-1:123456789012:instance/i-2",
+		}, "i-2", false},
+		{"GovCloud", []string{"arn:aws-us-gov:ec2:us-gov-west-1:123456789012:instance/i-4"}, "i-4", false},
+		{"China", []string{"arn:aws-cn:ec2:cn-north-1:123456789012:instance/i-5"}, "i-5", false},
+		{"not an ARN", []string{"i-3"}, "", true},
+		{"other EC2 resource", []string{"arn:aws:ec2:us-east-1:123456789012:volume/vol-1"}, "", true},
+		{"none", nil, "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getInstanceIDFromResources(tt.resources)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("getInstanceIDFromResources() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDrainerLookupECSClusterNameAccessDenied(t *testing.T) {
+	t.Setenv("ENABLE_CLOUDTRAIL_RESOLVER", "true")
+	for _, tt := range []struct {
+		name    string
+		err     error
+		want    string
+		wantErr bool
+	}{
+		{"unauthorized", awserr.New("UnauthorizedOperation", "not authorized", nil), "web", false},
+		{"access denied", awserr.New("AccessDenied", "denied", nil), "web", false},
+		{"transient", awserr.New("InternalError", "try again", nil), "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ec2Svc, cloudtrailSvc := newFakeEC2(), newFakeCloudTrail()
+			ec2Svc.addInstance("i-denied", "#!/bin/bash\necho ECS_CLUSTER=ignored >> /etc/ecs/ecs.config\n")
+			ec2Svc.fail("DescribeInstanceAttribute", tt.err)
+			cloudtrailSvc.addRegistration("i-denied", testClusterArn("web"))
+			clients := &awsClients{ec2: ec2Svc, cloudtrail: cloudtrailSvc}
+			d, out := newTestDrainer(t, clients)
+
+			got, err := d.lookupECSClusterName(context.Background(), clients, ec2Svc, "i-denied")
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Fatalf("lookupECSClusterName() = %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+			if logged := strings.Contains(out.String(), "EC2 access is unavailable"); logged == tt.wantErr {
+				t.Errorf("log = %q, want the unavailable EC2 access logged only when denied", out.String())
+			}
+		})
+	}
+}
+
+func TestDrainerDrainSkipStopped(t *testing.T) {
+	for _, tt := range []struct {
+		skip     string
+		state    string
+		wantWait bool
+	}{
+		{"true", ec2.InstanceStateNameStopped, false},
+		{"true", ec2.InstanceStateNameStopping, false},
+		{"true", ec2.InstanceStateNameRunning, true},
+		// The UserData of a stopped instance is still there, so that it drains by default.
+		{"false", ec2.InstanceStateNameStopped, true},
+	} {
+		t.Run(tt.skip+"/"+tt.state, func(t *testing.T) {
+			t.Setenv("SKIP_STOPPED_INSTANCES", tt.skip)
+			f := newTestDrainFixture()
+			f.ec2.instances["i-1"].State.Name = aws.String(tt.state)
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail.Wait != tt.wantWait {
+				t.Fatalf("Wait = %v, want %v", detail.Wait, tt.wantWait)
+			}
+			wantStatus, wantCompletions := ecs.ContainerInstanceStatusDraining, 0
+			if !tt.wantWait {
+				wantStatus, wantCompletions = ecs.ContainerInstanceStatusActive, 1
+			}
+			if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != wantStatus {
+				t.Errorf("status = %q, want %q", got, wantStatus)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != wantCompletions {
+				t.Errorf("completions = %v, want %d", got, wantCompletions)
+			}
+		})
+	}
+}
+
+func TestDrainerLookupECSClusterNameIndex(t *testing.T) {
+	t.Setenv("CLUSTER_INDEX_TABLE", "index")
+	ec2Svc, index := newFakeEC2(), newFakeDynamoDB()
+	index.addTable("index", "EC2InstanceId")
+	for instanceID, clusterName := range map[string]string{"i-indexed": "web", "i-unnamed": ""} {
+		item := map[string]*dynamodb.AttributeValue{"EC2InstanceId": {S: aws.String(instanceID)}}
+		if clusterName != "" {
+			item["ClusterName"] = &dynamodb.AttributeValue{S: aws.String(clusterName)}
+		}
+		if _, err := index.PutItemWithContext(context.Background(),
+			&dynamodb.PutItemInput{TableName: aws.String("index"), Item: item}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, instanceID := range []string{"i-indexed", "i-unnamed", "i-missing"} {
+		ec2Svc.addInstance(instanceID, "#!/bin/bash\necho ECS_CLUSTER=batch >> /etc/ecs/ecs.config\n")
+	}
+	clients := &awsClients{ec2: ec2Svc, clusterIndex: index}
+	d, _ := newTestDrainer(t, clients)
+
+	for _, tt := range []struct {
+		instanceID string
+		want       string
+	}{
+		{"i-indexed", "web"},
+		// The other resolvers answer for an item without the attribute and for a missing one.
+		{"i-unnamed", "batch"},
+		{"i-missing", "batch"},
+	} {
+		calls := ec2Svc.count("DescribeInstanceAttribute")
+		got, err := d.lookupECSClusterName(context.Background(), clients, ec2Svc, tt.instanceID)
+		if err != nil || got != tt.want {
+			t.Errorf("lookupECSClusterName(%s) = %q, %v, want %q", tt.instanceID, got, err, tt.want)
+		}
+		if scanned := ec2Svc.count("DescribeInstanceAttribute") > calls; scanned != (tt.want == "batch") {
+			t.Errorf("UserData of %s read = %v, want it read only on a miss", tt.instanceID, scanned)
+		}
+	}
+}
+
+func TestDrainerDrainInstanceGone(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		skipTerminating string
+		instanceID      string
+		state           string
+		ec2Err          error
+		wantLog         string
+		wantErr         bool
+	}{
+		{"status not found", "", "i-gone", "", nil, "already terminating", false},
+		{"status terminated", "", "i-terminated", ec2.InstanceStateNameTerminated, nil, "already terminating", false},
+		{"userdata not found", "false", "i-gone", "", nil, "instance is already gone, completing", false},
+		{"transient", "false", "i-flaky", ec2.InstanceStateNameRunning,
+			awserr.New("InternalError", "try again", nil), "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SKIP_TERMINATING_INSTANCES", tt.skipTerminating)
+			f := newTestDrainFixture()
+			if tt.state != "" {
+				f.ec2.addInstance(tt.instanceID, "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+				f.ec2.instances[tt.instanceID].State.Name = aws.String(tt.state)
+			}
+			if tt.ec2Err != nil {
+				f.ec2.fail("DescribeInstanceAttribute", tt.ec2Err)
+			}
+			f.detail.EC2InstanceId = tt.instanceID
+			d, out := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Drain() = %+v, %v, want error %v", detail, err, tt.wantErr)
+			}
+			wantCompletions := 1
+			if tt.wantErr {
+				wantCompletions = 0
+			} else if detail.Wait {
+				t.Errorf("Drain() = %+v, want the drain done", detail)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != wantCompletions {
+				t.Errorf("completions = %v, want %d", got, wantCompletions)
+			}
+			if !strings.Contains(out.String(), tt.wantLog) {
+				t.Errorf("log = %q, want %q", out.String(), tt.wantLog)
+			}
+			if tt.wantErr && strings.Contains(out.String(), "already gone") {
+				t.Errorf("log = %q, want the error not taken for a gone instance", out.String())
+			}
+		})
+	}
+}
+
+func TestDrainerDrainNoContainerInstance(t *testing.T) {
+	// The instance of a mixed Auto Scaling group never joined ECS.
+	newFixture := func() *testDrainFixture {
+		f := newTestDrainFixture()
+		f.ec2.addInstance("i-plain", "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+		f.detail.EC2InstanceId = "i-plain"
+		return f
+	}
+
+	f := newFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 || got[0] != LifecycleActionResultContinue {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed with CONTINUE", detail, got)
+	}
+
+	t.Setenv("COMPLETE_ON_NO_CONTAINER_INSTANCE", "false")
+	f = newFixture()
+	d, _ = newTestDrainer(t, f.clients)
+	if _, err := d.Drain(context.Background(), f.detail); !errors.Is(err, ErrNoContainerInstance) {
+		t.Errorf("Drain() = %v, want ErrNoContainerInstance", err)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 0 {
+		t.Errorf("completions = %v, want none", got)
+	}
+}
+
+func TestDrainerDrainDeregisterAfterDrain(t *testing.T) {
+	arn := testContainerInstanceArn("default", "ci-1")
+
+	f := newTestDrainFixture()
+	f.stopTask()
+	d, _ := newTestDrainer(t, f.clients)
+	if _, err := d.Drain(context.Background(), f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.count("DeregisterContainerInstance"); got != 0 {
+		t.Errorf("DeregisterContainerInstance calls = %d, want none without `DEREGISTER_AFTER_DRAIN`", got)
+	}
+
+	t.Setenv("DEREGISTER_AFTER_DRAIN", "true")
+	f = newTestDrainFixture()
+	d, _ = newTestDrainer(t, f.clients)
+	ctx := context.Background()
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.count("DeregisterContainerInstance"); got != 0 {
+		t.Errorf("DeregisterContainerInstance calls = %d, want none while the task runs", got)
+	}
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait || len(f.ecs.deregistered) != 1 || f.ecs.deregistered[0] != arn {
+		t.Errorf("Drain() = %+v with deregistered %v, want %s deregistered", detail, f.ecs.deregistered, arn)
+	}
+
+	// An instance that is already deregistered still completes.
+	f = newTestDrainFixture()
+	f.stopTask()
+	f.ecs.fail("DeregisterContainerInstance",
+		awserr.New(ecs.ErrCodeInvalidParameterException, "container instance is not registered", nil))
+	d, out := newTestDrainer(t, f.clients)
+	if detail, err = d.Drain(ctx, f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+	if !strings.Contains(out.String(), "failed to deregister") {
+		t.Errorf("log = %q, want the failure logged", out.String())
+	}
+}
+
+func TestDrainerHandleEventDeregisterAfterTimeout(t *testing.T) {
+	// A drain that timed out with tasks left does not deregister the container instance.
+	t.Setenv("DEREGISTER_AFTER_DRAIN", "true")
+	t.Setenv("MAX_DRAIN_SECONDS", "600")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	evt, err := d.handleEvent(ctx, testEvent(t, f.detail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(601 * time.Second)
+	if _, err = d.handleEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 {
+		t.Fatalf("completions = %v, want the timed out drain completed", got)
+	}
+	if got := f.ecs.count("DeregisterContainerInstance"); got != 0 {
+		t.Errorf("DeregisterContainerInstance calls = %d, want none with the task left", got)
+	}
+}
+
+func TestDrainerDrainRespectManagedTermination(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		mode         string
+		provider     string
+		wantDraining bool
+		wantWait     bool
+	}{
+		{"unmanaged", ManagedTerminationComplete, "", true, true},
+		{"managed, not respected", "", "asg-provider", true, true},
+		{"managed, completed", ManagedTerminationComplete, "asg-provider", false, false},
+		{"managed, observed", ManagedTerminationObserve, "asg-provider", false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RESPECT_MANAGED_TERMINATION", tt.mode)
+			f := newTestDrainFixture()
+			if tt.provider != "" {
+				f.containerInstance.CapacityProviderName = aws.String(tt.provider)
+			}
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.ecs.count("UpdateContainerInstancesState") > 0; got != tt.wantDraining {
+				t.Errorf("set DRAINING = %t, want %t", got, tt.wantDraining)
+			}
+			if detail.Wait != tt.wantWait {
+				t.Errorf("Wait = %t, want %t", detail.Wait, tt.wantWait)
+			}
+			if got := f.autoscaling.completedResults(); !tt.wantWait &&
+				(len(got) != 1 || got[0] != LifecycleActionResultContinue) {
+				t.Errorf("completions = %v, want [CONTINUE]", got)
+			}
+		})
+	}
+}
+
+func TestGetECSClusterNameFromEvent(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		resources []string
+		detail    string
+		want      string
+	}{
+		{"resources", []string{"arn:aws:autoscaling:us-east-1:123456789012:autoScalingGroup:1:autoScalingGroupName/asg",
+			testClusterArn("web")}, `{}`, "web"},
+		{"detail ARN", nil, `{"ClusterArn":"` + testClusterArn("web") + `"}`, "web"},
+		{"detail name", nil, `{"ClusterName":"web"}`, "web"},
+		{"none", []string{"arn:aws:ec2:us-east-1:123456789012:instance/i-1"}, `{}`, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			evt := &events.CloudWatchEvent{Resources: tt.resources, Detail: []byte(tt.detail)}
+			if got := getECSClusterNameFromEvent(evt); got != tt.want {
+				t.Errorf("getECSClusterNameFromEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainerHandleEventClusterInResources(t *testing.T) {
+	f := newTestDrainFixture()
+	// The UserData names another cluster, which is not looked up.
+	f.ec2.addInstance("i-enriched", "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+	f.ecs.addContainerInstance("web", "ci-2", "i-enriched")
+	f.detail.EC2InstanceId = "i-enriched"
+	d, _ := newTestDrainer(t, f.clients)
+
+	evt := testEvent(t, f.detail)
+	evt.Resources = []string{testClusterArn("web")}
+	if _, err := d.handleEvent(context.Background(), evt); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("web", "ci-2")); got != "DRAINING" {
+		t.Errorf("status = %q, want the instance drained in the cluster of the resources", got)
+	}
+	if got := f.ec2.count("DescribeInstanceAttribute"); got != 0 {
+		t.Errorf("DescribeInstanceAttribute calls = %d, want no UserData lookup", got)
+	}
+}
+
+func TestDrainerHandleEventInvalidDetail(t *testing.T) {
+	for _, tt := range []struct {
+		field string
+		clear func(*CloudWatchEventDetail)
+	}{
+		{"AutoScalingGroupName", func(detail *CloudWatchEventDetail) { detail.AutoScalingGroupName = "" }},
+		{"LifecycleActionToken", func(detail *CloudWatchEventDetail) { detail.LifecycleActionToken = "" }},
+		{"LifecycleHookName", func(detail *CloudWatchEventDetail) { detail.LifecycleHookName = "" }},
+	} {
+		t.Run(tt.field, func(t *testing.T) {
+			f := newTestDrainFixture()
+			tt.clear(f.detail)
+			d, _ := newTestDrainer(t, f.clients)
+
+			_, err := d.handleEvent(context.Background(), testEvent(t, f.detail))
+			if !errors.Is(err, ErrInvalidEventDetail) || err.Error() != "`detail."+tt.field+"` is empty: invalid event detail" {
+				t.Errorf("handleEvent() = %v, want the empty `detail.%s` named", err, tt.field)
+			}
+			if got := f.autoscaling.count("CompleteLifecycleAction") + f.ecs.count("ListContainerInstances"); got != 0 {
+				t.Errorf("API calls = %d, want none for a malformed detail", got)
+			}
+		})
+	}
+}
+
+func TestDrainerHandleEventLaunchingTransition(t *testing.T) {
+	f := newTestDrainFixture()
+	f.detail.LifecycleTransition = "autoscaling:EC2_INSTANCE_LAUNCHING"
+	d, out := newTestDrainer(t, f.clients)
+	newEvent := func() *events.CloudWatchEvent {
+		evt := testEvent(t, f.detail)
+		evt.DetailType = DetailTypeLaunchLifecycle
+		return evt
+	}
+
+	// The launch hook matched by mistake is continued rather than left to block the instance.
+	if _, err := d.handleEvent(context.Background(), newEvent()); err != nil {
+		t.Fatalf("handleEvent() = %v, want the launching transition handled gracefully", err)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+		t.Errorf("completions = %v, want [CONTINUE]", got)
+	}
+	if got := f.ecs.operations(); len(got) != 0 {
+		t.Errorf("ECS calls = %v, want the instance not drained", got)
+	}
+	if !strings.Contains(out.String(), "completing with CONTINUE") {
+		t.Errorf("log = %q, want the transition warned", out.String())
+	}
+
+	// Without a lifecycle token, there is nothing to complete.
+	f.detail.LifecycleActionToken = ""
+	if _, err := d.handleEvent(context.Background(), newEvent()); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 {
+		t.Errorf("completions = %v, want none without a token", got)
+	}
+}
+
+func TestDrainerDrainVerifyDraining(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		drainingAfter int
+		cancelled     bool
+		wantDescribes int
+		wantWarning   bool
+	}{
+		{"converged", 2, false, 2, false},
+		{"not converged", 0, false, verifyDrainingAttempts, true},
+		// The retries end with the invocation.
+		{"cancelled", 2, true, 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VERIFY_DRAINING", "true")
+			f := newTestDrainFixture()
+			d, out := newTestDrainer(t, f.clients)
+			d = d.withClock(newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+			arn := f.containerInstance.ContainerInstanceArn
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The update is not visible to the first descriptions, e.g. by eventual consistency.
+			var describes int
+			f.ecs.onDescribeContainerInstances = func() {
+				describes++
+				f.ecs.stateMu.Lock()
+				defer f.ecs.stateMu.Unlock()
+				f.containerInstance.Status = aws.String(ecs.ContainerInstanceStatusActive)
+				if tt.drainingAfter > 0 && describes >= tt.drainingAfter {
+					f.containerInstance.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+				}
+				if tt.cancelled {
+					cancel()
+				}
+			}
+			if err := d.setStateDraining(ctx, f.clients.ecs, "default", arn); err != nil {
+				t.Fatal(err)
+			}
+			if describes != tt.wantDescribes {
+				t.Errorf("DescribeContainerInstances calls = %d, want %d", describes, tt.wantDescribes)
+			}
+			if got := strings.Contains(out.String(), `is still \"ACTIVE\" after being set to DRAINING`); got != tt.wantWarning {
+				t.Errorf("log = %q, want the warning %v", out.String(), tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainSkipTerminatingInstances(t *testing.T) {
+	for _, tt := range []struct {
+		skipTerminating string
+		wantDrain       bool
+	}{
+		{"", false},
+		{"false", true},
+	} {
+		t.Run("SKIP_TERMINATING_INSTANCES="+tt.skipTerminating, func(t *testing.T) {
+			t.Setenv("SKIP_TERMINATING_INSTANCES", tt.skipTerminating)
+			f := newTestDrainFixture()
+			f.ec2.instances["i-1"].State.Name = aws.String(ec2.InstanceStateNameShuttingDown)
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantDrain {
+				if !detail.Wait || f.ecs.containerInstanceStatus(testContainerInstanceArn("default", "ci-1")) != "DRAINING" {
+					t.Errorf("Drain() = %+v, want the instance drained without the check", detail)
+				}
+				return
+			}
+			if detail.Wait {
+				t.Errorf("Drain() = %+v, want the drain done", detail)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != 1 {
+				t.Errorf("completions = %v, want 1", got)
+			}
+			if got := f.ecs.operations(); len(got) != 0 {
+				t.Errorf("ECS calls = %v, want none for a shutting-down instance", got)
+			}
+			if got := f.ec2.count("DescribeInstanceAttribute"); got != 0 {
+				t.Errorf("DescribeInstanceAttribute calls = %d, want no UserData lookup", got)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainSharedInstanceID(t *testing.T) {
+	// A second agent registered the same EC2 instance with a task of its own.
+	f := newTestDrainFixture()
+	extra := f.ecs.addContainerInstance("default", "ci-2", "i-1")
+	extraTask := f.ecs.addTask("default", "task-2", extra, "worker")
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"ci-1", "ci-2"} {
+		if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("default", id)); got != "DRAINING" {
+			t.Errorf("status of %s = %q, want DRAINING", id, got)
+		}
+	}
+
+	// The task of the other registration still keeps the drain going.
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the task of ci-2", detail)
+	}
+
+	f.ecs.stateMu.Lock()
+	extraTask.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	f.ecs.stateMu.Unlock()
+	f.ecs.finishStopping()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait {
+		t.Errorf("Drain() = %+v, want the drain done once both registrations are empty", detail)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 {
+		t.Errorf("completions = %v, want 1", got)
+	}
+}
+
+func TestDrainerDrainInitialDrainDelay(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		deadline time.Duration
+		min, max time.Duration
+	}{
+		{"no deadline", 0, 20 * time.Second, 20 * time.Second},
+		// Half of the time left before the 2s margin of the deadline is kept for the task check and the heartbeat.
+		{"capped by the deadline", 10 * time.Second, 3 * time.Second, 4 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("INITIAL_DRAIN_DELAY_SECONDS", "20")
+			t.Setenv("DEADLINE_MARGIN_SECONDS", "2")
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+			start := time.Now()
+			clock := newFakeClock(start)
+			d = d.withClock(clock)
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, start.Add(tt.deadline))
+				defer cancel()
+			}
+
+			detail, err := d.Drain(ctx, f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if waited := clock.Now().Sub(start); waited < tt.min || waited > tt.max {
+				t.Errorf("waited %s after setting DRAINING, want %s to %s", waited, tt.min, tt.max)
+			}
+			if got := f.ecs.count("ListTasks"); got == 0 {
+				t.Error("ListTasks calls = 0, want the tasks checked after the delay")
+			}
+
+			// The delay is only waited after setting DRAINING.
+			waited := clock.Now()
+			if _, err := d.Drain(ctx, detail); err != nil {
+				t.Fatal(err)
+			}
+			if got := clock.Now().Sub(waited); got != 0 {
+				t.Errorf("waited %s on the next poll, want no delay", got)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainClusterNameOrARN(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		instanceID  string
+		clusterName string
+		tag         string
+	}{
+		{"detail name", "i-named", "web", ""},
+		{"detail ARN", "i-arn", testClusterArn("web"), ""},
+		{"tag ARN", "i-tagged-arn", "", testClusterArn("web")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// `CLUSTER_ALLOWLIST` and the rest of the flow see the short name.
+			t.Setenv("CLUSTER_ALLOWLIST", "web")
+			f := newTestDrainFixture()
+			f.ec2.addInstance(tt.instanceID, "#!/bin/bash\n")
+			if tt.tag != "" {
+				f.ec2.tags[tt.instanceID] = map[string]string{defaultClusterNameTag: tt.tag}
+			}
+			f.ecs.addContainerInstance("web", "ci-2", tt.instanceID)
+			f.detail.EC2InstanceId, f.detail.ClusterName = tt.instanceID, tt.clusterName
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail.ClusterName != "web" {
+				t.Errorf("ClusterName = %q, want the short name", detail.ClusterName)
+			}
+			if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("web", "ci-2")); got != "DRAINING" {
+				t.Errorf("status = %q, want DRAINING", got)
+			}
+		})
+	}
+}
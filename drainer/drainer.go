@@ -0,0 +1,118 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Drainer drains the container instances of terminating lifecycle actions. It holds what the drain flow depends
+// on, so that the Lambda entrypoints and the tests share it with their own clients and log output.
+type Drainer struct {
+	config  *Config
+	clients ClientFactory
+	logger  *logger
+	clock   Clock
+}
+
+// NewDrainer returns a Drainer configured by config, making its calls with the clients of newClients and
+// logging to out.
+func NewDrainer(config *Config, newClients ClientFactory, out io.Writer) *Drainer {
+	return &Drainer{
+		config:  config,
+		clients: newClients,
+		logger:  newLogger(out).withLevel(config.LogLevel),
+		clock:   realClock{},
+	}
+}
+
+// withConfig returns a copy of the Drainer configured by config, sharing its clients, log output and clock.
+func (d *Drainer) withConfig(config *Config) *Drainer {
+	c := *d
+	c.config, c.logger = config, d.logger.withLevel(config.LogLevel)
+	return &c
+}
+
+// withClock returns a copy of the Drainer reading the time and waiting on clock, its log lines included.
+func (d *Drainer) withClock(clock Clock) *Drainer {
+	c := *d
+	c.clock, c.logger = clock, d.logger.withClock(clock)
+	return &c
+}
+
+// Drain makes one drain decision for the lifecycle action of detail, as an invocation of the Step Functions loop
+// does, and returns the detail to pass to the next decision while its `Wait` is true.
+func (d *Drainer) Drain(ctx context.Context, detail *CloudWatchEventDetail) (*CloudWatchEventDetail, error) {
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		return nil, err
+	}
+	evt := &events.CloudWatchEvent{
+		DetailType: DetailTypeTerminateLifecycle,
+		Source:     "aws.autoscaling",
+		Time:       d.clock.Now(),
+		Detail:     raw,
+	}
+
+	drainCtx, cancel := d.withDeadlineMargin(ctx)
+	defer cancel()
+	ret, err := d.recoverFailure(drainCtx, evt, d.poll)
+	if err != nil || ret == nil {
+		return nil, err
+	}
+	var next *CloudWatchEventDetail
+	if err := json.Unmarshal(ret.Detail, &next); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// handleEvent dispatches evt to the drain of its kind.
+func (d *Drainer) handleEvent(ctx context.Context, evt *events.CloudWatchEvent) (*events.CloudWatchEvent, error) {
+	// The final lifecycle action call on an error is made within the margin left by the drain deadline.
+	drainCtx, cancel := d.withDeadlineMargin(ctx)
+	defer cancel()
+
+	if evt.DetailType == DetailTypeSpotInterruption || evt.DetailType == DetailTypeRebalanceRecommendation {
+		return d.drainSpotInstance(drainCtx, evt)
+	}
+	if evt.DetailType == DetailTypeDrainCancelled {
+		return d.uncordonInstance(drainCtx, evt)
+	}
+
+	if d.isSynchronous() {
+		return d.recoverFailure(drainCtx, evt, d.drainSynchronously)
+	}
+	return d.recoverFailure(drainCtx, evt, d.poll)
+}
+
+// recoverFailure runs drain and, when it fails, completes the lifecycle action with `COMPLETE_ON_ERROR` or after
+// `MAX_FAILED_ATTEMPTS`, or sends a final heartbeat when the invocation ran out of time.
+func (d *Drainer) recoverFailure(ctx context.Context, evt *events.CloudWatchEvent,
+	drain func(context.Context, *events.CloudWatchEvent) (*events.CloudWatchEvent, error),
+) (*events.CloudWatchEvent, error) {
+	ret, err := drain(ctx, evt)
+	if err == nil {
+		return ret, nil
+	}
+	if errors.Is(err, ErrNotTerminateEvent) {
+		return nil, err
+	}
+	// A failed drain may return the event updated before the failure, e.g. with the lease it holds.
+	failed := evt
+	if ret != nil {
+		failed = ret
+	}
+	switch {
+	case d.config.CompleteOnError:
+		d.completeOnError(failed, err)
+	case d.breakCircuit(failed, err):
+		// The lifecycle action was completed after `MAX_FAILED_ATTEMPTS`.
+	case ctx.Err() != nil:
+		d.finalHeartbeat(failed, err)
+	}
+	return nil, err
+}
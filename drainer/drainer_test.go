@@ -0,0 +1,559 @@
+package drainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// newTestDrainer returns a Drainer configured by the environment of the test, making its calls with clients,
+// and the buffer it logs to.
+func newTestDrainer(t *testing.T, clients *awsClients) (*Drainer, *bytes.Buffer) {
+	t.Helper()
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	return NewDrainer(config, func(*Config, *events.CloudWatchEvent) *awsClients { return clients }, &out), &out
+}
+
+// testEvent returns the terminating lifecycle action event of detail.
+func testEvent(t *testing.T, detail *CloudWatchEventDetail) *events.CloudWatchEvent {
+	t.Helper()
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &events.CloudWatchEvent{DetailType: DetailTypeTerminateLifecycle, Source: "aws.autoscaling", Detail: raw}
+}
+
+// testDrainFixture is an instance of the default cluster running one task of web, with its terminating
+// lifecycle action.
+type testDrainFixture struct {
+	ecs               *fakeECS
+	ec2               *fakeEC2
+	autoscaling       *fakeAutoscaling
+	clients           *awsClients
+	containerInstance *ecs.ContainerInstance
+	task              *ecs.Task
+	detail            *CloudWatchEventDetail
+}
+
+func newTestDrainFixture() *testDrainFixture {
+	f := &testDrainFixture{ecs: newFakeECS(), ec2: newFakeEC2(), autoscaling: newFakeAutoscaling()}
+	f.containerInstance = f.ecs.addContainerInstance("default", "ci-1", "i-1")
+	f.task = f.ecs.addTask("default", "task-1", f.containerInstance, "web")
+	f.ec2.addInstance("i-1", "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+	f.autoscaling.addHook("asg", "hook", 300, LifecycleActionResultContinue)
+	f.clients = &awsClients{
+		ecs:         newECSClient(f.ecs),
+		ec2:         f.ec2,
+		autoscaling: f.autoscaling,
+		elbv2:       newFakeELBv2(),
+	}
+	f.detail = &CloudWatchEventDetail{
+		AutoScalingGroupName: "asg",
+		EC2InstanceId:        "i-1",
+		LifecycleActionToken: "token",
+		LifecycleHookName:    "hook",
+		LifecycleTransition:  LifecycleTransitionTerminating,
+	}
+	return f
+}
+
+// stopTask stops the task as ECS does for a draining instance.
+func (f *testDrainFixture) stopTask() {
+	f.ecs.stateMu.Lock()
+	f.task.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	f.ecs.stateMu.Unlock()
+	f.ecs.finishStopping()
+}
+
+func TestDrainerDrain(t *testing.T) {
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || !detail.DrainingSet || detail.ClusterName != "default" {
+		t.Fatalf("Drain() = %+v, want to wait for the draining instance of default", detail)
+	}
+	if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != "DRAINING" {
+		t.Errorf("status = %q, want DRAINING", got)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 0 {
+		t.Errorf("completions = %v, want none while the task runs", got)
+	}
+
+	f.stopTask()
+	detail, err = d.Drain(ctx, detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait {
+		t.Fatalf("Drain() = %+v, want the drain to be done", detail)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+		t.Errorf("completions = %v, want [CONTINUE]", got)
+	}
+	if !strings.Contains(out.String(), `"instanceId":"i-1"`) {
+		t.Errorf("log = %q, want the lines of i-1", out.String())
+	}
+}
+
+func TestDrainerDrainTimeout(t *testing.T) {
+	t.Setenv("MAX_DRAIN_SECONDS", "600")
+	t.Setenv("TIMEOUT_LIFECYCLE_ACTION_RESULT", LifecycleActionResultAbandon)
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.DrainStartedAt == nil || !detail.DrainStartedAt.Equal(clock.Now()) {
+		t.Fatalf("DrainStartedAt = %v, want %v", detail.DrainStartedAt, clock.Now())
+	}
+
+	clock.advance(599 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(f.autoscaling.completedResults()) != 0 {
+		t.Fatalf("Drain() = %+v, want to keep waiting within `MAX_DRAIN_SECONDS`", detail)
+	}
+
+	clock.advance(2 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait {
+		t.Fatalf("Drain() = %+v, want the drain to time out", detail)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultAbandon {
+		t.Errorf("completions = %v, want [ABANDON]", got)
+	}
+	if !strings.Contains(out.String(), `"time":"2020-01-02T03:14:06Z"`) {
+		t.Errorf("log = %q, want the lines stamped with the fake time", out.String())
+	}
+}
+
+func TestDrainerDrainMinRemainingTasks(t *testing.T) {
+	for _, tt := range []struct {
+		minRemaining string
+		wantWait     bool
+	}{
+		{"0", true},
+		{"2", false},
+	} {
+		t.Run(tt.minRemaining, func(t *testing.T) {
+			t.Setenv("MIN_REMAINING_TASKS", tt.minRemaining)
+			f := newTestDrainFixture()
+			f.ecs.addTask("default", "task-2", f.containerInstance, "web")
+			d, out := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail.Wait != tt.wantWait {
+				t.Fatalf("Drain() = %+v, want Wait %v with 2 tasks left", detail, tt.wantWait)
+			}
+			if detail.Result == nil || detail.Result.RemainingTasks != 2 {
+				t.Errorf("Result = %+v, want 2 remaining tasks", detail.Result)
+			}
+			wantCompletions := 1
+			if tt.wantWait {
+				wantCompletions = 0
+			}
+			if got := f.autoscaling.completedResults(); len(got) != wantCompletions {
+				t.Errorf("completions = %v, want %d", got, wantCompletions)
+			}
+			if !strings.Contains(out.String(), `"taskCount":2`) {
+				t.Errorf("log = %q, want the task count", out.String())
+			}
+		})
+	}
+}
+
+func TestDrainerDrainHeartbeatOnTaskCheckError(t *testing.T) {
+	for _, tt := range []struct {
+		enabled        string
+		wantHeartbeats int
+	}{
+		{"false", 0},
+		{"true", 1},
+	} {
+		t.Run(tt.enabled, func(t *testing.T) {
+			t.Setenv("HEARTBEAT_ON_TASK_CHECK_ERROR", tt.enabled)
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+
+			f.ecs.fail("ListTasks", errors.New("internal error"))
+			if _, err := d.Drain(context.Background(), f.detail); err == nil {
+				t.Fatal("Drain() = nil, want the task check error")
+			}
+			if got := f.autoscaling.heartbeatCount(); got != tt.wantHeartbeats {
+				t.Errorf("heartbeats = %d, want %d", got, tt.wantHeartbeats)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainHeartbeatOnly(t *testing.T) {
+	t.Setenv("HEARTBEAT_ONLY", "true")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || f.autoscaling.heartbeatCount() != 1 {
+		t.Fatalf("Drain() = %+v, want a heartbeat while waiting for the task", detail)
+	}
+	if got := f.ecs.count("UpdateContainerInstancesState"); got != 0 {
+		t.Errorf("UpdateContainerInstancesState calls = %d, want none", got)
+	}
+	if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != "ACTIVE" {
+		t.Errorf("status = %q, want ACTIVE", got)
+	}
+
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+}
+
+func TestDrainerDrainCompletionMarker(t *testing.T) {
+	t.Setenv("LOG_COMPLETION_MARKER", "true")
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), CompletionMarker) {
+		t.Fatalf("log = %q, want no marker while draining", out.String())
+	}
+
+	f.stopTask()
+	if _, err := d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	var markers []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, CompletionMarker+" ") {
+			markers = append(markers, line)
+		}
+	}
+	want := CompletionMarker + ` {"AutoScalingGroupName":"asg","ClusterName":"default","EC2InstanceId":"i-1"}`
+	if len(markers) != 1 || markers[0] != want {
+		t.Errorf("markers = %q, want exactly [%s]", markers, want)
+	}
+}
+
+func TestDrainerDrainOnResolutionFailure(t *testing.T) {
+	for _, tt := range []struct {
+		behavior        string
+		wantErr         bool
+		wantCompletions []string
+	}{
+		{"", true, nil},
+		{"error", true, nil},
+		{"continue", false, []string{LifecycleActionResultContinue}},
+		{"abandon", false, []string{LifecycleActionResultAbandon}},
+	} {
+		t.Run(tt.behavior, func(t *testing.T) {
+			t.Setenv("ON_RESOLUTION_FAILURE", tt.behavior)
+			f := newTestDrainFixture()
+			// The UserData of the instance does not name its cluster, which is not cached for another test either.
+			f.ec2.addInstance("i-unresolved", "#!/bin/bash\n")
+			f.detail.EC2InstanceId = "i-unresolved"
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Drain() = %+v, %v, want error %v", detail, err, tt.wantErr)
+			}
+			if got := f.autoscaling.completedResults(); !reflect.DeepEqual(got, tt.wantCompletions) {
+				t.Errorf("completions = %v, want %v", got, tt.wantCompletions)
+			}
+			if !tt.wantErr && detail.Wait {
+				t.Errorf("Drain() = %+v, want the drain done", detail)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainDrainedByOthers(t *testing.T) {
+	t.Setenv("IGNORE_DAEMON_TASKS", "false")
+	f := newTestDrainFixture()
+	// Another actor has set the instance to DRAINING.
+	f.containerInstance.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || detail.DrainingSet {
+		t.Fatalf("Drain() = %+v, want to wait for the running task without setting DRAINING", detail)
+	}
+
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+	if got := f.ecs.count("ListTasks"); got != 0 {
+		t.Errorf("ListTasks calls = %d, want the counts of the container instance used", got)
+	}
+
+	// The counts are not trusted once the agent is disconnected.
+	g := newTestDrainFixture()
+	g.containerInstance.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	g.containerInstance.AgentConnected = aws.Bool(false)
+	d, _ = newTestDrainer(t, g.clients)
+	if _, err := d.Drain(ctx, g.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.ecs.count("ListTasks"); got == 0 {
+		t.Error("ListTasks calls = 0, want the tasks of the disconnected instance listed")
+	}
+}
+
+func TestDrainerDrainCompleteDelay(t *testing.T) {
+	for _, tt := range []struct {
+		delay string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+	} {
+		t.Run(tt.delay, func(t *testing.T) {
+			t.Setenv("COMPLETE_DELAY_SECONDS", tt.delay)
+			f := newTestDrainFixture()
+			f.stopTask()
+			d, _ := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			start := clock.Now()
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+				t.Fatalf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+			}
+			if got := clock.Now().Sub(start); got != tt.want {
+				t.Errorf("slept %v before completing, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The lifecycle action is left for a retry if the invocation ends during the delay.
+	t.Setenv("COMPLETE_DELAY_SECONDS", "5")
+	f := newTestDrainFixture()
+	f.stopTask()
+	d, _ := newTestDrainer(t, f.clients)
+	d = d.withClock(&cancelingClock{fakeClock: newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))})
+	if _, err := d.Drain(context.Background(), f.detail); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Drain() = %v, want context.Canceled", err)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 0 {
+		t.Errorf("completions = %v, want none", got)
+	}
+}
+
+// cancelingClock fails every sleep as if the invocation ended meanwhile.
+type cancelingClock struct {
+	*fakeClock
+}
+
+func (c *cancelingClock) Sleep(context.Context, time.Duration) error {
+	return context.Canceled
+}
+
+func TestDrainerDrainFastTaskCountCheck(t *testing.T) {
+	t.Setenv("FAST_TASK_COUNT_CHECK", "true")
+	t.Setenv("IGNORE_DAEMON_TASKS", "false")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	// The running task settles it without the detailed check.
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the running task", detail)
+	}
+	if got := f.ecs.count("ListTasks"); got != 0 {
+		t.Errorf("ListTasks calls = %d, want none while the counts block draining", got)
+	}
+
+	// A completion is confirmed by the detailed check.
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+	if got := f.ecs.count("ListTasks"); got == 0 {
+		t.Error("ListTasks calls = 0, want the tasks listed before completing")
+	}
+}
+
+func TestDrainerDrainAbsoluteMaxDrain(t *testing.T) {
+	t.Setenv("ENABLE_METRICS", "true")
+	t.Setenv("STATE_TABLE", "state")
+	t.Setenv("ABSOLUTE_MAX_DRAIN_SECONDS", "600")
+	f := newTestDrainFixture()
+	cw := &fakeCloudWatch{}
+	f.clients.cloudwatch = cw
+	table := newFakeDynamoDB()
+	table.addTable("state", "EC2InstanceId")
+	f.clients.dynamodb = table
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(599 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(cw.metrics("DrainTimedOut")) != 0 {
+		t.Fatalf("Drain() = %+v, want to keep waiting within `ABSOLUTE_MAX_DRAIN_SECONDS`", detail)
+	}
+
+	// The start is restored from the state table even if the detail lost it.
+	clock.advance(2 * time.Second)
+	if detail, err = d.Drain(ctx, f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait {
+		t.Fatalf("Drain() = %+v, want the drain ceiling to end the drain", detail)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultAbandon {
+		t.Errorf("completions = %v, want [ABANDON]", got)
+	}
+	if got := cw.metrics("DrainTimedOut"); len(got) != 1 {
+		t.Errorf("DrainTimedOut metrics = %d, want 1", len(got))
+	}
+}
+
+func TestDrainerHandleEventDrainTimeoutForceStop(t *testing.T) {
+	t.Setenv("MAX_DRAIN_SECONDS", "600")
+	t.Setenv("FORCE_STOP_ON_DRAIN_TIMEOUT", "true")
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	// The start time is stamped only into the detail of the returned event, which the next invocation gets.
+	evt, err := d.handleEvent(ctx, testEvent(t, f.detail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(601 * time.Second)
+	if evt, err = d.handleEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	var detail CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait || !detail.ForceStopped {
+		t.Fatalf("detail = %+v, want the timed out drain done after stopping the task", detail)
+	}
+	if len(f.ecs.stoppedTasks) != 1 {
+		t.Errorf("stopped tasks = %v, want task-1", f.ecs.stoppedTasks)
+	}
+	want := "ecs-auto-draining: ASG scale-in of i-1 in asg timed out after 10m0s"
+	if reason := aws.StringValue(f.task.StoppedReason); reason != want {
+		t.Errorf("reason = %q, want %q", reason, want)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+		t.Errorf("completions = %v, want [CONTINUE] by default", got)
+	}
+	if got := f.autoscaling.heartbeatCount(); got != 1 {
+		t.Errorf("heartbeats = %d, want none after the timeout", got)
+	}
+	if !strings.Contains(out.String(), "exceeding `MAX_DRAIN_SECONDS`") {
+		t.Errorf("log = %q, want the timeout warned", out.String())
+	}
+}
+
+func TestDrainerDrainCompleteOnError(t *testing.T) {
+	// The default result of a hook described by another test is not used.
+	cached := lifecycleHooks
+	lifecycleHooks = newLifecycleHookCache(lifecycleHookCacheTTL)
+	t.Cleanup(func() { lifecycleHooks = cached })
+
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{"disabled", nil, nil},
+		{"default result", map[string]string{"COMPLETE_ON_ERROR": "true"}, []string{LifecycleActionResultAbandon}},
+		{"configured result", map[string]string{
+			"COMPLETE_ON_ERROR":             "true",
+			"ERROR_LIFECYCLE_ACTION_RESULT": LifecycleActionResultContinue,
+		}, []string{LifecycleActionResultContinue}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			f := newTestDrainFixture()
+			denied := awserr.New("AccessDeniedException", "not authorized to update the container instance", nil)
+			f.ecs.fail("UpdateContainerInstancesState", denied)
+			d, _ := newTestDrainer(t, f.clients)
+
+			// The error is still returned for observability.
+			if _, err := d.Drain(context.Background(), f.detail); !errors.Is(err, denied) {
+				t.Fatalf("Drain() = %v, want the error of setting DRAINING", err)
+			}
+			if got := f.autoscaling.completedResults(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("completions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
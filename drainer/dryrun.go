@@ -0,0 +1,85 @@
+package drainer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// isDryRun reports whether `DRY_RUN` is enabled, in which case the calls changing the instance, its tasks
+// or its lifecycle action are only logged.
+func (d *Drainer) isDryRun() bool {
+	return d.config.DryRun
+}
+
+type dryRunECS struct {
+	ecsAPI
+	logger *logger
+}
+
+func (c dryRunECS) DeleteAttributesWithContext(
+	_ aws.Context, input *ecs.DeleteAttributesInput, _ ...request.Option) (*ecs.DeleteAttributesOutput, error) {
+	c.logger.infof("dry run: would delete %d attributes in %q", len(input.Attributes), aws.StringValue(input.Cluster))
+	return &ecs.DeleteAttributesOutput{}, nil
+}
+
+func (c dryRunECS) DeregisterContainerInstanceWithContext(_ aws.Context, input *ecs.DeregisterContainerInstanceInput,
+	_ ...request.Option) (*ecs.DeregisterContainerInstanceOutput, error) {
+	c.logger.infof("dry run: would deregister %q", aws.StringValue(input.ContainerInstance))
+	return &ecs.DeregisterContainerInstanceOutput{}, nil
+}
+
+func (c dryRunECS) PutAttributesWithContext(
+	_ aws.Context, input *ecs.PutAttributesInput, _ ...request.Option) (*ecs.PutAttributesOutput, error) {
+	c.logger.infof("dry run: would put %d attributes in %q", len(input.Attributes), aws.StringValue(input.Cluster))
+	return &ecs.PutAttributesOutput{}, nil
+}
+
+func (c dryRunECS) StopTaskWithContext(
+	_ aws.Context, input *ecs.StopTaskInput, _ ...request.Option) (*ecs.StopTaskOutput, error) {
+	c.logger.infof("dry run: would stop %q: %s", aws.StringValue(input.Task), aws.StringValue(input.Reason))
+	return &ecs.StopTaskOutput{}, nil
+}
+
+func (c dryRunECS) UpdateContainerInstancesStateWithContext(_ aws.Context,
+	input *ecs.UpdateContainerInstancesStateInput, _ ...request.Option) (*ecs.UpdateContainerInstancesStateOutput, error) {
+	c.logger.infof("dry run: would set %q in %q to %s",
+		aws.StringValueSlice(input.ContainerInstances), aws.StringValue(input.Cluster), aws.StringValue(input.Status))
+	return &ecs.UpdateContainerInstancesStateOutput{}, nil
+}
+
+type dryRunEC2 struct {
+	ec2API
+	logger *logger
+}
+
+func (c dryRunEC2) CreateTagsWithContext(
+	_ aws.Context, input *ec2.CreateTagsInput, _ ...request.Option) (*ec2.CreateTagsOutput, error) {
+	c.logger.infof("dry run: would tag %q", aws.StringValueSlice(input.Resources))
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+type dryRunAutoscaling struct {
+	autoscalingAPI
+	logger *logger
+}
+
+func (c dryRunAutoscaling) CompleteLifecycleActionWithContext(_ aws.Context,
+	input *autoscaling.CompleteLifecycleActionInput, _ ...request.Option,
+) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	c.logger.infof("dry run: would complete the lifecycle action %q of %q in %q with %s",
+		aws.StringValue(input.LifecycleActionToken), aws.StringValue(input.LifecycleHookName),
+		aws.StringValue(input.AutoScalingGroupName), aws.StringValue(input.LifecycleActionResult))
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (c dryRunAutoscaling) RecordLifecycleActionHeartbeatWithContext(_ aws.Context,
+	input *autoscaling.RecordLifecycleActionHeartbeatInput, _ ...request.Option,
+) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	c.logger.infof("dry run: would record a heartbeat of the lifecycle action %q of %q in %q",
+		aws.StringValue(input.LifecycleActionToken), aws.StringValue(input.LifecycleHookName),
+		aws.StringValue(input.AutoScalingGroupName))
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
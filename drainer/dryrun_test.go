@@ -0,0 +1,100 @@
+package drainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDrainerDrainDryRun(t *testing.T) {
+	t.Setenv("DRY_RUN", "true")
+	f := newTestDrainFixture()
+	f.stopTask()
+	d, out := newTestDrainer(t, f.clients)
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait || detail.Result == nil || !detail.Result.DryRun || !detail.Result.Completed {
+		t.Errorf("Drain() = %+v, want the dry run reported as completed", detail)
+	}
+	for _, op := range []string{"UpdateContainerInstancesState", "PutAttributes"} {
+		if got := f.ecs.count(op); got != 0 {
+			t.Errorf("%s calls = %d, want none in a dry run", op, got)
+		}
+	}
+	if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != "ACTIVE" {
+		t.Errorf("status = %q, want ACTIVE kept", got)
+	}
+	if got := f.autoscaling.count("CompleteLifecycleAction"); got != 0 {
+		t.Errorf("CompleteLifecycleAction calls = %d, want none in a dry run", got)
+	}
+	for _, want := range []string{"dry run: would set", "dry run: would complete the lifecycle action"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log = %q, want %q", out.String(), want)
+		}
+	}
+}
+
+func TestLocalDetail(t *testing.T) {
+	if detail := localDetail(); detail != nil {
+		t.Fatalf("localDetail() = %+v, want nil without `LOCAL_INSTANCE_ID`", detail)
+	}
+
+	t.Setenv("LOCAL_INSTANCE_ID", "i-1")
+	t.Setenv("LOCAL_ASG", "asg")
+	detail := localDetail()
+	if detail == nil || detail.EC2InstanceId != "i-1" || detail.AutoScalingGroupName != "asg" ||
+		detail.LifecycleTransition != LifecycleTransitionTerminating {
+		t.Errorf("localDetail() = %+v, want the terminating lifecycle action of i-1 in asg", detail)
+	}
+}
+
+func TestDrainerDrainDryRunWaiting(t *testing.T) {
+	t.Setenv("DRY_RUN", "true")
+	t.Setenv("DEREGISTER_AFTER_DRAIN", "true")
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || !detail.Result.DryRun {
+		t.Fatalf("Drain() = %+v, want the dry run to wait for the task", detail)
+	}
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait {
+		t.Fatalf("Drain() = %+v, want the dry run done", detail)
+	}
+
+	// The decision is made from the read-only calls, while none of the mutating ones reach AWS.
+	if f.ecs.count("DescribeContainerInstances") == 0 || f.ecs.count("ListTasks") == 0 {
+		t.Error("the read-only ECS calls were skipped in a dry run")
+	}
+	for _, op := range []string{
+		"UpdateContainerInstancesState", "PutAttributes", "DeleteAttributes", "StopTask", "DeregisterContainerInstance",
+	} {
+		if got := f.ecs.count(op); got != 0 {
+			t.Errorf("%s calls = %d, want none in a dry run", op, got)
+		}
+	}
+	if got := f.ec2.count("CreateTags"); got != 0 {
+		t.Errorf("CreateTags calls = %d, want none in a dry run", got)
+	}
+	for _, op := range []string{"RecordLifecycleActionHeartbeat", "CompleteLifecycleAction"} {
+		if got := f.autoscaling.count(op); got != 0 {
+			t.Errorf("%s calls = %d, want none in a dry run", op, got)
+		}
+	}
+	for _, want := range []string{"dry run: would record a heartbeat", "dry run: would deregister"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log = %q, want %q", out.String(), want)
+		}
+	}
+}
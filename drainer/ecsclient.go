@@ -0,0 +1,160 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// ecsClient is an ECS client for a single invocation. It caches described tasks and task definitions
+// so that the features needing task details do not describe the same tasks repeatedly.
+type ecsClient struct {
+	ecsAPI
+	tasks           map[string]*ecs.Task
+	taskDefinitions map[string]*ecs.TaskDefinition
+	services        map[string]*ecs.Service
+	protectedTasks  map[string]bool
+	// scannedPages and scannedArns count the pages and the container instances listed to find the instance.
+	scannedPages int
+	scannedArns  int
+	// describeBatchRetries is `DESCRIBE_BATCH_RETRIES`.
+	describeBatchRetries int
+	// clock waits between the retries of a batch.
+	clock Clock
+	// includeTags describes the tasks with their tags, for `RESPECT_TASK_DRAIN_TAG`.
+	includeTags bool
+}
+
+func newECSClient(svc ecsAPI) *ecsClient {
+	return &ecsClient{
+		ecsAPI:          svc,
+		tasks:           make(map[string]*ecs.Task),
+		taskDefinitions: make(map[string]*ecs.TaskDefinition),
+		services:        make(map[string]*ecs.Service),
+
+		describeBatchRetries: defaultDescribeBatchRetries,
+		clock:                realClock{},
+	}
+}
+
+// describeTasks describes tasks that are not cached yet in batches of maxDescribeTasks and returns them
+// in the order of arns. Tasks that ECS does not return are omitted. When batches still fail after
+// `DESCRIBE_BATCH_RETRIES`, it returns the tasks it described with ErrIncompleteTaskDescribe.
+func (c *ecsClient) describeTasks(ctx context.Context, clusterName string, arns []*string) ([]*ecs.Task, error) {
+	var uncached []*string
+	for _, arn := range arns {
+		if _, ok := c.tasks[*arn]; !ok {
+			uncached = append(uncached, arn)
+		}
+	}
+
+	batches := chunkArns(uncached, maxDescribeTasks)
+	var failed int
+	var lastErr error
+	for _, batch := range batches {
+		output, err := c.describeTaskBatch(ctx, clusterName, batch, c.describeBatchRetries)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			failed, lastErr = failed+1, err
+			continue
+		}
+		for _, task := range output.Tasks {
+			c.tasks[aws.StringValue(task.TaskArn)] = task
+		}
+	}
+
+	tasks := make([]*ecs.Task, 0, len(arns))
+	for _, arn := range arns {
+		if task, ok := c.tasks[*arn]; ok {
+			tasks = append(tasks, task)
+		}
+	}
+	if failed > 0 {
+		return tasks, fmt.Errorf("%w: %d of %d batches failed, the last with %v",
+			ErrIncompleteTaskDescribe, failed, len(batches), lastErr)
+	}
+	return tasks, nil
+}
+
+const (
+	defaultDescribeBatchRetries = 2
+	describeBatchRetryDelay     = 200 * time.Millisecond
+)
+
+// describeTaskBatch describes a batch of tasks, retrying any failure up to retries times.
+func (c *ecsClient) describeTaskBatch(
+	ctx context.Context, clusterName string, batch []*string, retries int) (*ecs.DescribeTasksOutput, error) {
+	for attempt := 0; ; attempt++ {
+		input := &ecs.DescribeTasksInput{
+			Cluster: &clusterName,
+			Tasks:   batch,
+		}
+		if c.includeTags {
+			input.Include = aws.StringSlice([]string{ecs.TaskFieldTags})
+		}
+		output, err := c.DescribeTasksWithContext(ctx, input)
+		if err == nil || attempt >= retries {
+			return output, err
+		}
+		if err := c.clock.Sleep(ctx, time.Duration(attempt+1)*describeBatchRetryDelay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *ecsClient) describeTaskDefinition(ctx context.Context, arn string) (*ecs.TaskDefinition, error) {
+	if taskDefinition, ok := c.taskDefinitions[arn]; ok {
+		return taskDefinition, nil
+	}
+	output, err := c.DescribeTaskDefinitionWithContext(ctx, &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: &arn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.taskDefinitions[arn] = output.TaskDefinition
+	return output.TaskDefinition, nil
+}
+
+// describeService returns the service, or nil when it no longer exists.
+func (c *ecsClient) describeService(ctx context.Context, clusterName, serviceName string) (*ecs.Service, error) {
+	if service, ok := c.services[serviceName]; ok {
+		return service, nil
+	}
+	output, err := c.DescribeServicesWithContext(ctx, &ecs.DescribeServicesInput{
+		Cluster:  &clusterName,
+		Services: []*string{&serviceName},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var service *ecs.Service
+	if len(output.Services) > 0 {
+		service = output.Services[0]
+	}
+	c.services[serviceName] = service
+	return service, nil
+}
+
+// forgetTask drops the cached task after it is changed, e.g. stopped.
+func (c *ecsClient) forgetTask(arn string) {
+	delete(c.tasks, arn)
+}
+
+// chunkArns splits arns into batches of at most size arns.
+func chunkArns(arns []*string, size int) [][]*string {
+	var batches [][]*string
+	for len(arns) > size {
+		batches = append(batches, arns[:size])
+		arns = arns[size:]
+	}
+	if len(arns) > 0 {
+		batches = append(batches, arns)
+	}
+	return batches
+}
@@ -0,0 +1,146 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestECSClientDescribeTasksBatches(t *testing.T) {
+	svc := newFakeECS()
+	containerInstance := svc.addContainerInstance("default", "ci-1", "i-1")
+	var arns []*string
+	for i := 0; i < 150; i++ {
+		task := svc.addTask("default", fmt.Sprintf("task-%d", i), containerInstance, "web")
+		arns = append(arns, task.TaskArn)
+	}
+	c := newECSClient(svc)
+	ctx := context.Background()
+
+	tasks, err := c.describeTasks(ctx, "default", arns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 150 || aws.StringValue(tasks[149].TaskArn) != aws.StringValue(arns[149]) {
+		t.Fatalf("describeTasks() = %d tasks, want the 150 tasks in order", len(tasks))
+	}
+	if got := svc.count("DescribeTasks"); got != 2 {
+		t.Errorf("DescribeTasks calls = %d, want 2", got)
+	}
+
+	// Described tasks are cached.
+	if _, err := c.describeTasks(ctx, "default", arns); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.count("DescribeTasks"); got != 2 {
+		t.Errorf("DescribeTasks calls = %d, want the cached tasks not to be described again", got)
+	}
+}
+
+func TestECSClientDescribeTasksIncomplete(t *testing.T) {
+	svc := newFakeECS()
+	containerInstance := svc.addContainerInstance("default", "ci-1", "i-1")
+	var arns []*string
+	for i := 0; i < 150; i++ {
+		task := svc.addTask("default", fmt.Sprintf("task-%d", i), containerInstance, "web")
+		arns = append(arns, task.TaskArn)
+	}
+	c := newECSClient(svc)
+	c.describeBatchRetries = 1
+	c.clock = newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	// The first batch fails once and is retried; the second one still fails after its retry.
+	svc.fail("DescribeTasks", errors.New("internal error"), nil, errors.New("internal error"),
+		errors.New("internal error"))
+	tasks, err := c.describeTasks(context.Background(), "default", arns)
+	if !errors.Is(err, ErrIncompleteTaskDescribe) {
+		t.Fatalf("describeTasks() = %v, want ErrIncompleteTaskDescribe", err)
+	}
+	if len(tasks) != maxDescribeTasks {
+		t.Errorf("describeTasks() = %d tasks, want the %d tasks of the batch described", len(tasks), maxDescribeTasks)
+	}
+	if got := svc.count("DescribeTasks"); got != 4 {
+		t.Errorf("DescribeTasks calls = %d, want 4", got)
+	}
+}
+
+func TestDrainerDrainDescribesTasksOnce(t *testing.T) {
+	// The stateful check describes the tasks and their definitions after the task check did.
+	t.Setenv("ABSOLUTE_MAX_DRAIN_SECONDS", "600")
+	t.Setenv("STATEFUL_MAX_DRAIN_SECONDS", "3600")
+	t.Setenv("STATEFUL_FAMILY_PATTERN", "^db$")
+	f := newTestDrainFixture()
+	f.ecs.addTask("default", "task-2", f.containerInstance, "web")
+	d, _ := newTestDrainer(t, f.clients)
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the tasks", detail)
+	}
+	if got := f.ecs.count("DescribeTasks"); got != 1 {
+		t.Errorf("DescribeTasks calls = %d, want 1", got)
+	}
+	if got := f.ecs.count("DescribeTaskDefinition"); got != 1 {
+		t.Errorf("DescribeTaskDefinition calls = %d, want the shared definition described once", got)
+	}
+
+	// Another invocation does not reuse the cache.
+	if _, err := d.Drain(context.Background(), detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.count("DescribeTasks"); got != 2 {
+		t.Errorf("DescribeTasks calls = %d, want 2 after the second invocation", got)
+	}
+}
+
+func TestDrainerDrainIncompleteTaskDescribe(t *testing.T) {
+	t.Setenv("IGNORE_STARTED_BY_PREFIX", "pipeline/")
+	t.Setenv("DESCRIBE_BATCH_RETRIES", "1")
+	newFixture := func() *testDrainFixture {
+		f := newTestDrainFixture()
+		for i := 2; i <= 150; i++ {
+			task := f.ecs.addTask("default", fmt.Sprintf("task-%d", i), f.containerInstance, "web")
+			// The tasks of the second batch do not block draining.
+			if i > maxDescribeTasks {
+				task.StartedBy = aws.String("pipeline/nightly")
+			}
+		}
+		return f
+	}
+	internal := errors.New("internal error")
+
+	// The described tasks of the first batch already block draining, whatever the second one holds.
+	f := newFixture()
+	f.ecs.fail("DescribeTasks", nil, internal, internal)
+	d, out := newTestDrainer(t, f.clients)
+	d = d.withClock(newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatalf("Drain() = %v, want to decide on the described tasks", err)
+	}
+	if !detail.Wait || !strings.Contains(out.String(), "deciding on the described tasks") {
+		t.Errorf("Drain() = %+v with log %q, want to wait for the described tasks", detail, out.String())
+	}
+
+	// Without a blocking task described, the state cannot be told and the node keeps draining.
+	t.Setenv("HEARTBEAT_ON_TASK_CHECK_ERROR", "true")
+	f = newFixture()
+	f.ecs.fail("DescribeTasks", internal, internal)
+	d, _ = newTestDrainer(t, f.clients)
+	d = d.withClock(newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+	if _, err := d.Drain(context.Background(), f.detail); !errors.Is(err, ErrIncompleteTaskDescribe) {
+		t.Fatalf("Drain() = %v, want ErrIncompleteTaskDescribe", err)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 0 || f.autoscaling.heartbeatCount() != 1 {
+		t.Errorf("completions = %v, heartbeats = %d, want the lifecycle action kept alive", got,
+			f.autoscaling.heartbeatCount())
+	}
+}
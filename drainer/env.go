@@ -0,0 +1,59 @@
+package drainer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getenv returns the feature flag from AppConfig if any, the environment variable, or the parameter
+// from SSM Parameter Store, in that order.
+func getenv(name string) string {
+	if value, ok := featureFlags.lookup(name); ok {
+		return value
+	}
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	value, _ := ssmConfig.lookup(name)
+	return value
+}
+
+// getenvSeconds returns the number of seconds in the environment variable as a duration, or 0 when it is unset.
+func getenvSeconds(name string) (time.Duration, error) {
+	value := getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("`%s` is %q, not a non-negative integer", name, value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// getenvInt returns the non-negative integer in the environment variable, or defaultValue when it is unset.
+func getenvInt(name string, defaultValue int) (int, error) {
+	value := getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("`%s` is %q, not a non-negative integer", name, value)
+	}
+	return n, nil
+}
+
+// getenvList returns the non-empty values in the environment variable separated by commas.
+func getenvList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
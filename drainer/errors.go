@@ -0,0 +1,39 @@
+package drainer
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Sentinel errors of the drain flow, which callers match with errors.Is.
+var (
+	ErrNotTerminateEvent       = errors.New("not a terminate lifecycle action") // nolint:gochecknoglobals
+	ErrNoClusterInUserData     = errors.New("no cluster name in UserData")      // nolint:gochecknoglobals
+	ErrNoContainerInstance     = errors.New("no container instance")            // nolint:gochecknoglobals
+	ErrInvalidEventDetail      = errors.New("invalid event detail")             // nolint:gochecknoglobals
+	ErrNoActiveLifecycleAction = errors.New("no active lifecycle action")       // nolint:gochecknoglobals
+	ErrIncompleteTaskDescribe  = errors.New("tasks are partially described")    // nolint:gochecknoglobals
+	ErrNoClusters              = errors.New("no ECS clusters found")            // nolint:gochecknoglobals
+)
+
+// asAWSError returns the AWS error in the chain of err, if any.
+func asAWSError(err error) (awserr.Error, bool) {
+	var aerr awserr.Error
+	ok := errors.As(err, &aerr)
+	return aerr, ok
+}
+
+// isContainerInstanceDeregistered reports whether ECS rejected the call because the container instance was
+// deregistered after it was found, e.g. when the agent stopped with the instance.
+func isContainerInstanceDeregistered(err error) bool {
+	aerr, ok := asAWSError(err)
+	if !ok || (aerr.Code() != "ClientException" && aerr.Code() != "InvalidParameterException") {
+		return false
+	}
+	message := strings.ToLower(aerr.Message())
+	return strings.Contains(message, "container instance") &&
+		(strings.Contains(message, "not registered") || strings.Contains(message, "not active") ||
+			strings.Contains(message, "not found"))
+}
@@ -0,0 +1,133 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestDrainerSentinelErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		run  func(*Drainer, *testDrainFixture) error
+		want error
+	}{
+		{"not terminate event", nil, func(d *Drainer, f *testDrainFixture) error {
+			evt := testEvent(t, f.detail)
+			evt.DetailType = "EC2 Instance State-change Notification"
+			_, err := d.poll(ctx, evt)
+			return err
+		}, ErrNotTerminateEvent},
+		{"not terminating", map[string]string{"STRICT_TRANSITION": "true"}, func(d *Drainer, f *testDrainFixture) error {
+			f.detail.LifecycleTransition = "autoscaling:EC2_INSTANCE_LAUNCHING"
+			evt := testEvent(t, f.detail)
+			evt.DetailType = DetailTypeLaunchLifecycle
+			_, err := d.poll(ctx, evt)
+			return err
+		}, ErrNotTerminateEvent},
+		{"empty detail", nil, func(d *Drainer, _ *testDrainFixture) error {
+			_, err := d.poll(ctx, &events.CloudWatchEvent{DetailType: DetailTypeTerminateLifecycle, Detail: []byte("null")})
+			return err
+		}, ErrInvalidEventDetail},
+		{"no cluster in UserData", nil, func(d *Drainer, f *testDrainFixture) error {
+			f.ec2.addInstance("i-sentinel", "#!/bin/bash\nyum update -y\n")
+			f.detail.EC2InstanceId = "i-sentinel"
+			_, err := d.Drain(ctx, f.detail)
+			return err
+		}, ErrNoClusterInUserData},
+		{"no container instance", map[string]string{"COMPLETE_ON_NO_CONTAINER_INSTANCE": "false"},
+			func(d *Drainer, f *testDrainFixture) error {
+				f.ec2.addInstance("i-sentinel-plain", "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+				f.detail.EC2InstanceId = "i-sentinel-plain"
+				_, err := d.Drain(ctx, f.detail)
+				return err
+			}, ErrNoContainerInstance},
+		{"no active lifecycle action", nil, func(d *Drainer, f *testDrainFixture) error {
+			f.autoscaling.fail("RecordLifecycleActionHeartbeat", awserr.New("ValidationError",
+				"No active Lifecycle Action found with instance ID i-1", nil))
+			return d.heartbeat(ctx, f.autoscaling, f.detail)
+		}, ErrNoActiveLifecycleAction},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+			if err := tt.run(d, f); !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetUserDataWrapsAWSError(t *testing.T) {
+	svc := newFakeEC2()
+	svc.fail("DescribeInstanceAttribute", awserr.New("RequestLimitExceeded", "slow down", nil))
+
+	_, err := getUserData(context.Background(), svc, "i-1")
+	if aerr, ok := asAWSError(err); !ok || aerr.Code() != "RequestLimitExceeded" {
+		t.Errorf("getUserData() = %v, want the AWS error wrapped", err)
+	}
+}
+
+func TestIsContainerInstanceDeregistered(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{awserr.New("ClientException", "The referenced container instance is not registered.", nil), true},
+		{awserr.New("InvalidParameterException", "Container instance not found in cluster default.", nil), true},
+		{awserr.New("ClientException", "The referenced cluster was inactive.", nil), false},
+		{awserr.New("ThrottlingException", "The container instance is not registered.", nil), false},
+		{errors.New("container instance is not registered"), false},
+		{nil, false},
+	} {
+		if got := isContainerInstanceDeregistered(tt.err); got != tt.want {
+			t.Errorf("isContainerInstanceDeregistered(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDrainerDrainDeregisteredContainerInstance(t *testing.T) {
+	deregistered := func() error {
+		return awserr.New("ClientException", "The referenced container instance is not registered.", nil)
+	}
+	for _, tt := range []struct {
+		name      string
+		operation string
+		passes    int
+	}{
+		// The agent deregisters between the listing and setting DRAINING, or while the tasks are drained.
+		{"setting DRAINING", "UpdateContainerInstancesState", 1},
+		{"checking tasks", "ListTasks", 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+			ctx := context.Background()
+
+			detail := f.detail
+			for pass := 1; pass <= tt.passes; pass++ {
+				if pass == tt.passes {
+					f.ecs.fail(tt.operation, deregistered())
+				}
+				var err error
+				if detail, err = d.Drain(ctx, detail); err != nil {
+					t.Fatalf("Drain() pass %d = %v, want the deregistration taken for a finished drain", pass, err)
+				}
+			}
+			if detail.Wait {
+				t.Errorf("Drain() = %+v, want the drain done", detail)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+				t.Errorf("completions = %v, want [CONTINUE]", got)
+			}
+		})
+	}
+}
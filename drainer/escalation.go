@@ -0,0 +1,91 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// EscalationPayload tells on-call which tasks keep a drain from completing.
+type EscalationPayload struct {
+	ClusterName          string
+	AutoScalingGroupName string
+	EC2InstanceId        string // nolint:golint,stylecheck
+	DrainDurationSeconds int64
+	Tasks                []*StuckTask
+}
+
+// StuckTask is a task still running on the instance being drained.
+type StuckTask struct {
+	TaskArn    string
+	Group      string
+	LastStatus string
+}
+
+// escalate notifies `ESCALATION_SNS_TOPIC_ARN` and `ESCALATION_WEBHOOK_URL` once per drain when it takes longer than
+// `ESCALATION_THRESHOLD_SECONDS`. The detail remembers that it fired across re-invocations.
+func (d *Drainer) escalate(ctx context.Context, clients *awsClients, svc *ecsClient, clusterName string,
+	containerInstanceArn *string, detail *CloudWatchEventDetail) error {
+	threshold := d.config.EscalationThreshold
+	if threshold == 0 || detail.Escalated {
+		return nil
+	}
+	elapsed := d.elapsedSince(*detail.DrainStartedAt)
+	if elapsed < threshold {
+		return nil
+	}
+
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return err
+	}
+
+	payload := &EscalationPayload{
+		ClusterName:          clusterName,
+		AutoScalingGroupName: detail.AutoScalingGroupName,
+		EC2InstanceId:        detail.EC2InstanceId,
+		DrainDurationSeconds: int64(elapsed / time.Second),
+		Tasks:                make([]*StuckTask, 0, len(tasks)),
+	}
+	for _, task := range tasks {
+		payload.Tasks = append(payload.Tasks, &StuckTask{
+			TaskArn:    aws.StringValue(task.TaskArn),
+			Group:      aws.StringValue(task.Group),
+			LastStatus: aws.StringValue(task.LastStatus),
+		})
+	}
+
+	d.logger.warnf("draining %q has taken %s, escalating", detail.EC2InstanceId, elapsed)
+	if topicArn := d.config.EscalationSNSTopicArn; topicArn != "" {
+		if err := publishSNS(ctx, clients.sns, topicArn, payload); err != nil {
+			d.logger.warnf("failed to publish the escalation: %v", err)
+		}
+	}
+	if url := d.config.EscalationWebhookURL; url != "" {
+		if err := d.postWebhook(ctx, clients, url, payload); err != nil {
+			d.logger.warnf("failed to post the escalation webhook: %v", err)
+		}
+	}
+	detail.Escalated = true
+	return nil
+}
+
+func publishSNS(ctx context.Context, svc snsAPI, topicArn string, payload interface{}) error {
+	message, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: &topicArn,
+		Message:  aws.String(string(message)),
+	})
+	return err
+}
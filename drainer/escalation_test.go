@@ -0,0 +1,59 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDrainerDrainEscalation(t *testing.T) {
+	t.Setenv("ESCALATION_THRESHOLD_SECONDS", "600")
+	t.Setenv("ESCALATION_SNS_TOPIC_ARN", "arn:aws:sns:us-east-1:123456789012:on-call")
+	f := newTestDrainFixture()
+	topic := &fakeSNS{}
+	f.clients.sns = topic
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(599 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(topic.inputs) != 0 || detail.Escalated {
+		t.Fatalf("published %d escalations below the threshold, want none", len(topic.inputs))
+	}
+
+	clock.advance(2 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(topic.inputs) != 1 || !detail.Escalated {
+		t.Fatalf("published %d escalations, want one over the threshold", len(topic.inputs))
+	}
+	var payload EscalationPayload
+	if err := json.Unmarshal([]byte(aws.StringValue(topic.inputs[0].Message)), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.EC2InstanceId != "i-1" || payload.DrainDurationSeconds != 601 || len(payload.Tasks) != 1 ||
+		payload.Tasks[0].TaskArn != aws.StringValue(f.task.TaskArn) {
+		t.Errorf("escalation = %+v, want the stuck task of i-1 after 601 seconds", payload)
+	}
+
+	// The escalation fires once per drain.
+	clock.advance(time.Minute)
+	if _, err := d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(topic.inputs) != 1 {
+		t.Errorf("published %d escalations, want still one", len(topic.inputs))
+	}
+}
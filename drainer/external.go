@@ -0,0 +1,62 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// isExternal reports whether the detail names an ECS Anywhere container instance by `ContainerInstanceArn`
+// instead of an EC2 instance, whose drain skips every EC2 call.
+func (d *CloudWatchEventDetail) isExternal() bool {
+	return d.EC2InstanceId == "" && d.ContainerInstanceArn != ""
+}
+
+// instanceKey identifies the instance in the state kept outside the detail, e.g. `STATE_TABLE`.
+func (d *CloudWatchEventDetail) instanceKey() string {
+	if d.isExternal() {
+		return d.ContainerInstanceArn
+	}
+	return d.EC2InstanceId
+}
+
+// clusterNameFromContainerInstanceArn returns the cluster of
+// `arn:<partition>:ecs:region:account:container-instance/cluster/id`, or "" for the ARN format without it.
+func clusterNameFromContainerInstanceArn(containerInstanceArn string) string {
+	parsed, err := arn.Parse(containerInstanceArn)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(parsed.Resource, "/")
+	if len(parts) != 3 || parts[0] != "container-instance" {
+		return ""
+	}
+	return parts[1]
+}
+
+// describeExternalContainerInstance describes the container instance named by the detail in the cluster, which is
+// `ClusterName` of the detail or the one in the ARN.
+func (d *Drainer) describeExternalContainerInstance(ctx context.Context, svc *ecsClient, clusterName string,
+	detail *CloudWatchEventDetail) ([]*ecs.ContainerInstance, error) {
+	if clusterName == "" {
+		return nil, fmt.Errorf("`detail.ClusterName` is required for %q: %w",
+			detail.ContainerInstanceArn, ErrInvalidEventDetail)
+	}
+
+	var output *ecs.DescribeContainerInstancesOutput
+	err := d.withRetry(ctx, "DescribeContainerInstances", func() (err error) {
+		output, err = svc.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            &clusterName,
+			ContainerInstances: []*string{aws.String(detail.ContainerInstanceArn)},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.ContainerInstances, nil
+}
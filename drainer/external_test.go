@@ -0,0 +1,58 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerDrainExternalInstance(t *testing.T) {
+	f := newTestDrainFixture()
+	external := f.ecs.addContainerInstance("default", "ci-ext", "")
+	external.Ec2InstanceId = nil
+	task := f.ecs.addTask("default", "task-ext", external, "web")
+	arn := testContainerInstanceArn("default", "ci-ext")
+	f.detail.EC2InstanceId, f.detail.ContainerInstanceArn = "", arn
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || detail.ClusterName != "default" || f.ecs.containerInstanceStatus(arn) != "DRAINING" {
+		t.Fatalf("Drain() = %+v, want the external instance of the ARN draining", detail)
+	}
+	f.ecs.stateMu.Lock()
+	task.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	f.ecs.stateMu.Unlock()
+	f.ecs.finishStopping()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the drain completed", detail, got)
+	}
+	// The instance with an EC2 ID is left alone, and nothing is asked of EC2.
+	if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("default", "ci-1")); got != "ACTIVE" {
+		t.Errorf("status of ci-1 = %q, want ACTIVE", got)
+	}
+	if got := f.ec2.operations(); len(got) != 0 {
+		t.Errorf("EC2 calls = %v, want none for an external instance", got)
+	}
+}
+
+func TestDrainerDrainExternalInstanceWithoutCluster(t *testing.T) {
+	f := newTestDrainFixture()
+	// The ARN format without the cluster does not tell where the instance is registered.
+	f.detail.EC2InstanceId = ""
+	f.detail.ContainerInstanceArn = "arn:aws:ecs:us-east-1:123456789012:container-instance/ci-ext"
+	d, _ := newTestDrainer(t, f.clients)
+
+	if _, err := d.Drain(context.Background(), f.detail); !errors.Is(err, ErrInvalidEventDetail) {
+		t.Errorf("Drain() = %v, want ErrInvalidEventDetail without `ClusterName`", err)
+	}
+}
@@ -0,0 +1,95 @@
+package drainer
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// maxDrainDuration returns the drain ceiling. When `STATEFUL_MAX_DRAIN_SECONDS` is set, it applies only to
+// instances hosting stateful tasks and `ABSOLUTE_MAX_DRAIN_SECONDS` applies to the others.
+// Zero means no ceiling.
+func (d *Drainer) maxDrainDuration(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) (time.Duration, error) {
+	maxDrain, statefulMaxDrain := d.config.AbsoluteMaxDrain, d.config.StatefulMaxDrain
+	if statefulMaxDrain == 0 {
+		return maxDrain, nil
+	}
+
+	stateful, err := d.hostsStatefulTasks(ctx, svc, clusterName, containerInstanceArn)
+	if err != nil {
+		return 0, err
+	}
+	if stateful {
+		return statefulMaxDrain, nil
+	}
+	return maxDrain, nil
+}
+
+// hostsStatefulTasks reports whether any running task has volumes or belongs to a family matching
+// `STATEFUL_FAMILY_PATTERN`.
+func (d *Drainer) hostsStatefulTasks(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) (bool, error) {
+	familyRegexp := d.config.StatefulFamilyRegexp
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return false, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return false, err
+	}
+	taskDefinitions, err := describeTaskDefinitions(ctx, svc, tasks)
+	if err != nil {
+		return false, err
+	}
+
+	for _, taskDefinition := range taskDefinitions {
+		if len(taskDefinition.Volumes) > 0 {
+			return true, nil
+		}
+		if familyRegexp != nil && familyRegexp.MatchString(aws.StringValue(taskDefinition.Family)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// taskDrainGraceTag is the task tag declaring, in seconds, how long the task may keep draining before it is
+// force stopped.
+const taskDrainGraceTag = "ecs-auto-draining:drain-grace-seconds"
+
+// taskDrainGrace returns the longest drain grace declared by the running tasks with taskDrainGraceTag, or zero
+// if none declares one. An invalid tag value is ignored.
+func (d *Drainer) taskDrainGrace(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) (time.Duration, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return 0, err
+	}
+	var grace time.Duration
+	for _, task := range tasks {
+		for _, tag := range task.Tags {
+			if aws.StringValue(tag.Key) != taskDrainGraceTag {
+				continue
+			}
+			seconds, err := strconv.Atoi(aws.StringValue(tag.Value))
+			if err != nil || seconds < 0 {
+				d.logger.warnf("task %q has an invalid %s tag %q", aws.StringValue(task.TaskArn), taskDrainGraceTag,
+					aws.StringValue(tag.Value))
+				continue
+			}
+			if g := time.Duration(seconds) * time.Second; g > grace {
+				grace = g
+			}
+		}
+	}
+	return grace, nil
+}
@@ -0,0 +1,46 @@
+package drainer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerMaxDrainDuration(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		statefulMax   string
+		familyPattern string
+		volumes       bool
+		want          time.Duration
+	}{
+		{"no stateful ceiling", "", "", true, 600 * time.Second},
+		{"stateless", "3600", "", false, 600 * time.Second},
+		{"volumes", "3600", "", true, 3600 * time.Second},
+		{"family", "3600", "^web$", false, 3600 * time.Second},
+		{"other family", "3600", "^db$", false, 600 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ABSOLUTE_MAX_DRAIN_SECONDS", "600")
+			t.Setenv("STATEFUL_MAX_DRAIN_SECONDS", tt.statefulMax)
+			t.Setenv("STATEFUL_FAMILY_PATTERN", tt.familyPattern)
+			f := newTestDrainFixture()
+			if tt.volumes {
+				f.ecs.taskDefinitions[*f.task.TaskDefinitionArn].Volumes = []*ecs.Volume{{Name: aws.String("data")}}
+			}
+			d, _ := newTestDrainer(t, f.clients)
+
+			got, err := d.maxDrainDuration(context.Background(), f.clients.ecs, "default",
+				f.containerInstance.ContainerInstanceArn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("maxDrainDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package drainer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const lifecycleHookCacheTTL = 10 * time.Minute
+
+var lifecycleHooks = newLifecycleHookCache(lifecycleHookCacheTTL) // nolint:gochecknoglobals
+
+// lifecycleHookInfo is the part of a lifecycle hook the drain needs. The transition is empty when the Auto Scaling
+// group does not have the hook.
+type lifecycleHookInfo struct {
+	transition       string
+	heartbeatTimeout int
+	defaultResult    string
+}
+
+// lifecycleHookCache keeps the lifecycle hooks per Auto Scaling group and hook name so that warm containers
+// draining many instances of the same group describe each hook once.
+type lifecycleHookCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*lifecycleHookCacheEntry
+}
+
+type lifecycleHookCacheEntry struct {
+	info      lifecycleHookInfo
+	expiresAt time.Time
+}
+
+func newLifecycleHookCache(ttl time.Duration) *lifecycleHookCache {
+	return &lifecycleHookCache{ttl: ttl, entries: make(map[string]*lifecycleHookCacheEntry)}
+}
+
+func lifecycleHookCacheKey(asgName, hookName string) string {
+	return asgName + "/" + hookName
+}
+
+func (c *lifecycleHookCache) get(asgName, hookName string, now time.Time) (lifecycleHookInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := lifecycleHookCacheKey(asgName, hookName)
+	entry, ok := c.entries[key]
+	if !ok {
+		return lifecycleHookInfo{}, false
+	}
+	if now.After(entry.expiresAt) {
+		delete(c.entries, key)
+		return lifecycleHookInfo{}, false
+	}
+	return entry.info, true
+}
+
+func (c *lifecycleHookCache) set(asgName, hookName string, info lifecycleHookInfo, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[lifecycleHookCacheKey(asgName, hookName)] = &lifecycleHookCacheEntry{
+		info:      info,
+		expiresAt: now.Add(c.ttl),
+	}
+}
+
+// describeLifecycleHook returns the lifecycle hook of the detail, describing it only on a cache miss.
+func (d *Drainer) describeLifecycleHook(
+	ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail) (lifecycleHookInfo, error) {
+	if info, ok := lifecycleHooks.get(detail.AutoScalingGroupName, detail.LifecycleHookName, d.clock.Now()); ok {
+		return info, nil
+	}
+	output, err := svc.DescribeLifecycleHooksWithContext(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: &detail.AutoScalingGroupName,
+		LifecycleHookNames:   []*string{&detail.LifecycleHookName},
+	})
+	if err != nil {
+		return lifecycleHookInfo{}, err
+	}
+	var info lifecycleHookInfo
+	for _, hook := range output.LifecycleHooks {
+		if aws.StringValue(hook.LifecycleHookName) == detail.LifecycleHookName {
+			info = lifecycleHookInfo{
+				transition:       aws.StringValue(hook.LifecycleTransition),
+				heartbeatTimeout: int(aws.Int64Value(hook.HeartbeatTimeout)),
+				defaultResult:    aws.StringValue(hook.DefaultResult),
+			}
+			lifecycleHooks.set(detail.AutoScalingGroupName, detail.LifecycleHookName, info, d.clock.Now())
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,51 @@
+package drainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDescribeLifecycleHookCached(t *testing.T) {
+	cached := lifecycleHooks
+	lifecycleHooks = newLifecycleHookCache(lifecycleHookCacheTTL)
+	t.Cleanup(func() { lifecycleHooks = cached })
+	svc := newFakeAutoscaling()
+	svc.addHook("asg-cached", "hook", 300, LifecycleActionResultAbandon)
+	d, _ := newTestDrainer(t, &awsClients{autoscaling: svc})
+	ctx := context.Background()
+	detail := &CloudWatchEventDetail{
+		AutoScalingGroupName: "asg-cached",
+		LifecycleHookName:    "hook",
+		LifecycleTransition:  LifecycleTransitionTerminating,
+	}
+
+	if err := d.validateLifecycleHook(ctx, svc, detail); err != nil {
+		t.Fatal(err)
+	}
+	d.resolveHeartbeatTimeout(ctx, svc, detail)
+	if detail.HeartbeatTimeout != 300 {
+		t.Errorf("HeartbeatTimeout = %d, want 300", detail.HeartbeatTimeout)
+	}
+	if got := d.getErrorLifecycleActionResult(detail); got != LifecycleActionResultAbandon {
+		t.Errorf("getErrorLifecycleActionResult() = %q, want the default result of the hook", got)
+	}
+	if got := svc.count("DescribeLifecycleHooks"); got != 1 {
+		t.Errorf("DescribeLifecycleHooks calls = %d, want the second lookup served by the cache", got)
+	}
+
+	launch := *detail
+	launch.LifecycleTransition = "autoscaling:EC2_INSTANCE_LAUNCHING"
+	if err := d.validateLifecycleHook(ctx, svc, &launch); err == nil || !strings.Contains(err.Error(), "is for") {
+		t.Errorf("validateLifecycleHook() = %v, want the transition of the cached hook rejected", err)
+	}
+	missing := *detail
+	missing.LifecycleHookName = "other"
+	if err := d.validateLifecycleHook(ctx, svc, &missing); err == nil ||
+		!strings.Contains(err.Error(), "does not have") {
+		t.Errorf("validateLifecycleHook() = %v, want the missing hook rejected", err)
+	}
+	if got := svc.count("DescribeLifecycleHooks"); got != 2 {
+		t.Errorf("DescribeLifecycleHooks calls = %d, want only the missing hook described", got)
+	}
+}
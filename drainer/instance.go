@@ -0,0 +1,86 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func getInstanceState(ctx context.Context, svc ec2API, instanceID string) (string, error) {
+	output, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{&instanceID},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.StringValue(instance.InstanceId) == instanceID && instance.State != nil {
+				return aws.StringValue(instance.State.Name), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("instance %q is not found", instanceID)
+}
+
+// getInstanceStatusState returns the state of the instance from its status, which includes states that
+// `DescribeInstances` may no longer list shortly after termination.
+func getInstanceStatusState(ctx context.Context, svc ec2API, instanceID string) (string, error) {
+	output, err := svc.DescribeInstanceStatusWithContext(ctx, &ec2.DescribeInstanceStatusInput{
+		InstanceIds:         []*string{&instanceID},
+		IncludeAllInstances: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, status := range output.InstanceStatuses {
+		if aws.StringValue(status.InstanceId) == instanceID && status.InstanceState != nil {
+			return aws.StringValue(status.InstanceState.Name), nil
+		}
+	}
+	return "", fmt.Errorf("status of instance %q is not found", instanceID)
+}
+
+// isTerminating reports whether EC2 is already shutting down or has terminated the instance.
+func isTerminating(state string) bool {
+	return state == ec2.InstanceStateNameShuttingDown || state == ec2.InstanceStateNameTerminated
+}
+
+func isInstanceNotFound(err error) bool {
+	aerr, ok := asAWSError(err)
+	return ok && aerr.Code() == "InvalidInstanceID.NotFound"
+}
+
+// isStopped reports whether the instance is stopping or stopped, in which case it runs no tasks.
+func isStopped(state string) bool {
+	return state == ec2.InstanceStateNameStopping || state == ec2.InstanceStateNameStopped
+}
+
+const defaultClusterNameTag = "ECSClusterName"
+
+// getECSClusterNameFromTag returns the value of the instance tag named by `CLUSTER_NAME_TAG`,
+// or an empty name when the instance does not have the tag.
+func (d *Drainer) getECSClusterNameFromTag(ctx context.Context, svc ec2API, instanceID string) (string, error) {
+	key := d.config.ClusterNameTag
+	if key == "" {
+		key = defaultClusterNameTag
+	}
+
+	output, err := svc.DescribeTagsWithContext(ctx, &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: []*string{&instanceID}},
+			{Name: aws.String("key"), Values: []*string{&key}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range output.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), nil
+		}
+	}
+	return "", nil
+}
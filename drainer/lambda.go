@@ -0,0 +1,102 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	InvocationModeStepFunctions = "stepfunctions"
+	InvocationModeEventBridge   = "eventbridge"
+)
+
+// LambdaHandler adapts the Drainer to the Lambda entrypoints, refreshing the feature flags of AppConfig
+// with sess before each invocation and reloading the configuration when they change.
+type LambdaHandler struct {
+	drainer *Drainer
+	sess    *session.Session
+}
+
+// NewLambdaHandler loads the configuration, overlaid with the parameters under `CONFIG_SSM_PATH`, and returns
+// the handler of a Drainer logging to out with the clients of the function's own sessions.
+func NewLambdaHandler(ctx context.Context, out io.Writer) (*LambdaHandler, error) {
+	factory := newAWSClientFactory(realClock{})
+	sess, err := factory.loadSSMConfig(ctx, newSession(""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the configuration from SSM: %w", err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return &LambdaHandler{drainer: NewDrainer(config, factory.newClients, out), sess: sess}, nil
+}
+
+// Handler returns the entrypoint to start the Lambda with: that of `MODE`, or of `INVOCATION_MODE` for
+// the lifecycle actions.
+func (h *LambdaHandler) Handler() interface{} {
+	switch getenv("MODE") {
+	case "list-draining":
+		return h.drainer.listDrainingHandler
+	case "sqs":
+		return h.HandleSQS
+	}
+	if getenv("INVOCATION_MODE") == InvocationModeEventBridge {
+		return h.HandleEventBridge
+	}
+	return h.Handle
+}
+
+// RunLocal drains the instance of `LOCAL_INSTANCE_ID` once, as runLocal does, and reports whether it is set.
+func (h *LambdaHandler) RunLocal() (bool, error) {
+	local := localDetail()
+	if local == nil {
+		return false, nil
+	}
+	return true, h.drainer.runLocal(local, os.Getenv("AWS_REGION"))
+}
+
+// Handle is the entrypoint of the Step Functions loop, returning the event to pass to the next iteration.
+func (h *LambdaHandler) Handle(ctx context.Context, evt *events.CloudWatchEvent) (*events.CloudWatchEvent, error) {
+	h.refresh(ctx)
+	return h.drainer.handleEvent(ctx, evt)
+}
+
+// refresh reloads the configuration after the feature flags changed. An invalid one is ignored, keeping
+// the configuration the container started with or last reloaded.
+func (h *LambdaHandler) refresh(ctx context.Context) {
+	if !featureFlags.refresh(ctx, h.sess, h.drainer.logger, h.drainer.clock.Now()) {
+		return
+	}
+	config, err := loadConfig()
+	if err != nil {
+		h.drainer.logger.warnf("ignoring the feature flags, they make the configuration invalid: %v", err)
+		return
+	}
+	h.drainer = h.drainer.withConfig(config)
+}
+
+// HandleEventBridge is the entrypoint of `INVOCATION_MODE=eventbridge`, where the function is a direct target of
+// the rule and nothing consumes the returned event. It returns only the error of the drain.
+func (h *LambdaHandler) HandleEventBridge(ctx context.Context, evt *events.CloudWatchEvent) error {
+	_, err := h.Handle(ctx, evt)
+	return err
+}
+
+// HandleSQS is the entrypoint of `MODE=sqs`, draining the lifecycle actions of a batch of messages.
+func (h *LambdaHandler) HandleSQS(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	h.refresh(ctx)
+	return h.drainer.sqsHandler(ctx, sqsEvent)
+}
+
+// LogError writes err to w as a log line at the error level, for the failures before there is a handler to log
+// them, e.g. of NewLambdaHandler.
+func LogError(w io.Writer, err error) {
+	newLogger(w).errorf("%v", err)
+}
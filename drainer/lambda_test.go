@@ -0,0 +1,65 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestLambdaHandlerHandler(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"step functions", nil, "Handle"},
+		{"eventbridge", map[string]string{"INVOCATION_MODE": InvocationModeEventBridge}, "HandleEventBridge"},
+		{"sqs", map[string]string{"MODE": "sqs"}, "HandleSQS"},
+		{"list draining", map[string]string{"MODE": "list-draining"}, "listDrainingHandler"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			d, _ := newTestDrainer(t, &awsClients{})
+			h := &LambdaHandler{drainer: d}
+
+			var got string
+			switch h.Handler().(type) {
+			case func(context.Context, *events.CloudWatchEvent) (*events.CloudWatchEvent, error):
+				got = "Handle"
+			case func(context.Context, *events.CloudWatchEvent) error:
+				got = "HandleEventBridge"
+			case func(context.Context, events.SQSEvent) (events.SQSEventResponse, error):
+				got = "HandleSQS"
+			case func(context.Context) ([]*DrainingInstance, error):
+				got = "listDrainingHandler"
+			}
+			if got != tt.want {
+				t.Errorf("Handler() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLambdaHandlerHandleEventBridge(t *testing.T) {
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	h := &LambdaHandler{drainer: d}
+
+	// The event is drained as by the Step Functions entrypoint, only nothing is returned but the error.
+	if err := h.HandleEventBridge(context.Background(), testEvent(t, f.detail)); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("default", "ci-1")); got != "DRAINING" {
+		t.Errorf("status = %q, want DRAINING", got)
+	}
+
+	f.detail.LifecycleActionToken = ""
+	if err := h.HandleEventBridge(context.Background(), testEvent(t, f.detail)); !errors.Is(err,
+		ErrInvalidEventDetail) {
+		t.Errorf("HandleEventBridge() = %v, want ErrInvalidEventDetail", err)
+	}
+}
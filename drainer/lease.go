@@ -0,0 +1,111 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const defaultLeaseDuration = time.Hour
+
+// acquireDrainLease takes one of the `MAX_CONCURRENT_DRAINING` slots of the cluster in `LEASE_TABLE`, keyed by
+// `LeaseKey`, and keeps it in the detail. Unlike counting the draining instances, the conditional writes leave
+// no window for invocations to drain more instances at once. A slot held longer than `LEASE_SECONDS`, 1 hour by
+// default, without a renewal is regarded as abandoned. The slot held already is renewed, and another one is taken
+// when it was lost. It reports false when every slot is held.
+func (d *Drainer) acquireDrainLease(ctx context.Context, clients *awsClients, clusterName string, maxDraining int,
+	detail *CloudWatchEventDetail) (bool, error) {
+	if detail.LeaseKey != "" {
+		if held, err := d.renewDrainLease(ctx, clients, detail); err != nil || held {
+			return held, err
+		}
+	}
+	for slot := 0; slot < maxDraining; slot++ {
+		key := fmt.Sprintf("%s#%d", clusterName, slot)
+		err := d.putDrainLease(ctx, clients, key, detail)
+		if isConditionalCheckFailed(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		detail.LeaseKey = key
+		return true, nil
+	}
+	return false, nil
+}
+
+// renewDrainLease extends the slot held by the detail while the instance drains. When the slot expired and was
+// taken over by another instance, it clears `LeaseKey` and reports false.
+func (d *Drainer) renewDrainLease(ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail) (bool,
+	error) {
+	err := d.putDrainLease(ctx, clients, detail.LeaseKey, detail)
+	if isConditionalCheckFailed(err) {
+		d.logger.warnf("lease %q expired and was taken over by another instance", detail.LeaseKey)
+		detail.LeaseKey = ""
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// keepDrainLease keeps a slot for the draining instance on every poll, renewing its own or taking another one
+// after a takeover, so that it goes on counting against `MAX_CONCURRENT_DRAINING`. The instance is draining
+// already, so it is not held back when every slot is held; the next poll tries again.
+func (d *Drainer) keepDrainLease(ctx context.Context, lg *logger, clients *awsClients, clusterName string,
+	detail *CloudWatchEventDetail) error {
+	maxDraining := d.config.MaxConcurrentDraining
+	if maxDraining <= 0 || d.config.LeaseTable == "" || d.isObserverMode() {
+		return nil
+	}
+	acquired, err := d.acquireDrainLease(ctx, clients, clusterName, maxDraining, detail)
+	if err == nil && !acquired {
+		lg.warnf("all %d drain leases of the cluster are held by others, draining on without one", maxDraining)
+	}
+	return err
+}
+
+func (d *Drainer) putDrainLease(ctx context.Context, clients *awsClients, key string,
+	detail *CloudWatchEventDetail) error {
+	duration := d.config.LeaseDuration
+	if duration == 0 {
+		duration = defaultLeaseDuration
+	}
+	now := d.clock.Now()
+	_, err := clients.dynamodb.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.config.LeaseTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LeaseKey":  {S: &key},
+			"Holder":    {S: aws.String(detail.instanceKey())},
+			"ExpiresAt": {N: aws.String(strconv.FormatInt(now.Add(duration).Unix(), 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(LeaseKey) OR Holder = :holder OR ExpiresAt < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":holder": {S: aws.String(detail.instanceKey())},
+			":now":    {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	})
+	return err
+}
+
+// releaseDrainLease frees the slot held by the detail after the lifecycle action is completed.
+// It is best-effort, since an unreleased slot expires anyway.
+func (d *Drainer) releaseDrainLease(ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail) {
+	if detail.LeaseKey == "" {
+		return
+	}
+	_, err := clients.dynamodb.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(d.config.LeaseTable),
+		Key:                       map[string]*dynamodb.AttributeValue{"LeaseKey": {S: &detail.LeaseKey}},
+		ConditionExpression:       aws.String("Holder = :holder"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":holder": {S: aws.String(detail.instanceKey())}},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		d.logger.warnf("failed to release lease %q: %v", detail.LeaseKey, err)
+		return
+	}
+	detail.LeaseKey = ""
+}
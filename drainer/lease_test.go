@@ -0,0 +1,196 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const testLeaseTable = "leases"
+
+// newTestLeaseDrainer returns a Drainer with `MAX_CONCURRENT_DRAINING` leases in a fake `LEASE_TABLE`.
+func newTestLeaseDrainer(t *testing.T, maxDraining string) (*Drainer, *fakeDynamoDB, *awsClients, *fakeClock) {
+	t.Setenv("LEASE_TABLE", testLeaseTable)
+	t.Setenv("MAX_CONCURRENT_DRAINING", maxDraining)
+	t.Setenv("LEASE_SECONDS", "60")
+	svc := newFakeDynamoDB()
+	svc.addTable(testLeaseTable, "LeaseKey")
+	clients := &awsClients{dynamodb: svc}
+	d, _ := newTestDrainer(t, clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	return d.withClock(clock), svc, clients, clock
+}
+
+func testLeaseDetail(instanceID string) *CloudWatchEventDetail {
+	return &CloudWatchEventDetail{EC2InstanceId: instanceID}
+}
+
+func TestAcquireDrainLease(t *testing.T) {
+	d, svc, clients, _ := newTestLeaseDrainer(t, "2")
+	ctx := context.Background()
+
+	first, second := testLeaseDetail("i-1"), testLeaseDetail("i-2")
+	for _, detail := range []*CloudWatchEventDetail{first, second} {
+		acquired, err := d.acquireDrainLease(ctx, clients, "default", 2, detail)
+		if err != nil || !acquired {
+			t.Fatalf("acquireDrainLease(%s) = %v, %v, want a lease", detail.EC2InstanceId, acquired, err)
+		}
+	}
+	if first.LeaseKey != "default#0" || second.LeaseKey != "default#1" {
+		t.Errorf("LeaseKeys = %q, %q, want default#0, default#1", first.LeaseKey, second.LeaseKey)
+	}
+	if holder := svc.item(testLeaseTable, "default#1")["Holder"]; aws.StringValue(holder.S) != "i-2" {
+		t.Errorf("Holder = %v, want i-2", holder)
+	}
+
+	// Acquiring again renews the slot held.
+	if acquired, err := d.acquireDrainLease(ctx, clients, "default", 2, first); err != nil || !acquired ||
+		first.LeaseKey != "default#0" {
+		t.Errorf("acquireDrainLease() = %v, %v, %q, want default#0 renewed", acquired, err, first.LeaseKey)
+	}
+}
+
+func TestAcquireDrainLeaseFull(t *testing.T) {
+	d, _, clients, clock := newTestLeaseDrainer(t, "1")
+	ctx := context.Background()
+
+	if acquired, err := d.acquireDrainLease(ctx, clients, "default", 1, testLeaseDetail("i-1")); err != nil ||
+		!acquired {
+		t.Fatalf("acquireDrainLease() = %v, %v, want a lease", acquired, err)
+	}
+	third := testLeaseDetail("i-3")
+	acquired, err := d.acquireDrainLease(ctx, clients, "default", 1, third)
+	if err != nil || acquired || third.LeaseKey != "" {
+		t.Fatalf("acquireDrainLease() = %v, %v, %q, want every slot held", acquired, err, third.LeaseKey)
+	}
+
+	// A slot not renewed within `LEASE_SECONDS` is taken over.
+	clock.advance(61 * time.Second)
+	if acquired, err := d.acquireDrainLease(ctx, clients, "default", 1, third); err != nil || !acquired {
+		t.Fatalf("acquireDrainLease() = %v, %v, want the expired slot", acquired, err)
+	}
+}
+
+func TestRenewDrainLeaseTakenOver(t *testing.T) {
+	d, _, clients, clock := newTestLeaseDrainer(t, "1")
+	ctx := context.Background()
+
+	first, second := testLeaseDetail("i-1"), testLeaseDetail("i-2")
+	if _, err := d.acquireDrainLease(ctx, clients, "default", 1, first); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(61 * time.Second)
+	if _, err := d.acquireDrainLease(ctx, clients, "default", 1, second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The draining instance gives up the slot taken over instead of believing it still holds it.
+	if err := d.keepDrainLease(ctx, d.logger, clients, "default", first); err != nil {
+		t.Fatal(err)
+	}
+	if first.LeaseKey != "" {
+		t.Errorf("LeaseKey = %q, want it cleared after the takeover", first.LeaseKey)
+	}
+
+	// It takes a slot again once one is free.
+	d.releaseDrainLease(ctx, clients, second)
+	if err := d.keepDrainLease(ctx, d.logger, clients, "default", first); err != nil {
+		t.Fatal(err)
+	}
+	if first.LeaseKey != "default#0" {
+		t.Errorf("LeaseKey = %q, want default#0 re-acquired", first.LeaseKey)
+	}
+}
+
+func TestReleaseDrainLease(t *testing.T) {
+	d, svc, clients, clock := newTestLeaseDrainer(t, "1")
+	ctx := context.Background()
+
+	first, second := testLeaseDetail("i-1"), testLeaseDetail("i-2")
+	if _, err := d.acquireDrainLease(ctx, clients, "default", 1, first); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(61 * time.Second)
+	if _, err := d.acquireDrainLease(ctx, clients, "default", 1, second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing the slot taken over leaves the lease of its new holder.
+	d.releaseDrainLease(ctx, clients, first)
+	if first.LeaseKey != "" || svc.item(testLeaseTable, "default#0") == nil {
+		t.Fatalf("LeaseKey = %q, item = %v, want the lease of i-2 kept", first.LeaseKey,
+			svc.item(testLeaseTable, "default#0"))
+	}
+
+	d.releaseDrainLease(ctx, clients, second)
+	if second.LeaseKey != "" || svc.item(testLeaseTable, "default#0") != nil {
+		t.Errorf("LeaseKey = %q, want the lease released", second.LeaseKey)
+	}
+}
+
+func TestCompleteWithoutDrainingReleasesLease(t *testing.T) {
+	d, svc, clients, _ := newTestLeaseDrainer(t, "1")
+	autoscalingSvc := newFakeAutoscaling()
+	clients.autoscaling = autoscalingSvc
+	ctx := context.Background()
+
+	detail := testLeaseDetail("i-1")
+	detail.AutoScalingGroupName, detail.LifecycleHookName, detail.LifecycleActionToken = "asg", "hook", "token"
+	if _, err := d.acquireDrainLease(ctx, clients, "default", 1, detail); err != nil {
+		t.Fatal(err)
+	}
+	evt, err := d.completeWithoutDraining(ctx, clients, testEvent(t, detail), detail, LifecycleActionResultContinue)
+	if err != nil || evt == nil {
+		t.Fatalf("completeWithoutDraining() = %v, %v", evt, err)
+	}
+	if got := autoscalingSvc.completedResults(); len(got) != 1 {
+		t.Errorf("completions = %v, want one", got)
+	}
+	if svc.item(testLeaseTable, "default#0") != nil {
+		t.Error("lease is held after the completion, want it released")
+	}
+}
+
+func TestDrainerDrainReleasesLeaseOnError(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+	}{
+		{"complete on error", map[string]string{"COMPLETE_ON_ERROR": "true"}},
+		{"circuit broken", map[string]string{"STATE_TABLE": "state", "MAX_FAILED_ATTEMPTS": "1"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			t.Setenv("LEASE_TABLE", testLeaseTable)
+			t.Setenv("MAX_CONCURRENT_DRAINING", "1")
+			f := newTestDrainFixture()
+			svc := newFakeDynamoDB()
+			svc.addTable(testLeaseTable, "LeaseKey")
+			svc.addTable("state", "EC2InstanceId")
+			f.clients.dynamodb = svc
+			// The lease is taken before setting DRAINING, which fails.
+			denied := awserr.New("AccessDeniedException", "not authorized to update the container instance", nil)
+			f.ecs.fail("UpdateContainerInstancesState", denied)
+			d, _ := newTestDrainer(t, f.clients)
+
+			if _, err := d.Drain(context.Background(), f.detail); !errors.Is(err, denied) {
+				t.Fatalf("Drain() = %v, want the error of setting DRAINING", err)
+			}
+			if svc.count("PutItem") == 0 {
+				t.Fatal("no lease was taken")
+			}
+			if got := f.autoscaling.completedResults(); len(got) != 1 {
+				t.Errorf("completions = %v, want one", got)
+			}
+			if svc.item(testLeaseTable, "default#0") != nil {
+				t.Error("lease is held after completing on the error, want it released")
+			}
+		})
+	}
+}
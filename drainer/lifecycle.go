@@ -0,0 +1,192 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+func getLifecycleState(ctx context.Context, svc autoscalingAPI, instanceID string) (string, error) {
+	output, err := svc.DescribeAutoScalingInstancesWithContext(ctx,
+		&autoscaling.DescribeAutoScalingInstancesInput{InstanceIds: []*string{&instanceID}})
+	if err != nil {
+		return "", err
+	}
+	if len(output.AutoScalingInstances) == 0 {
+		return "", fmt.Errorf("instance %q does not belong to an Auto Scaling group", instanceID)
+	}
+	return aws.StringValue(output.AutoScalingInstances[0].LifecycleState), nil
+}
+
+// absorbFlapping delays the first DRAINING by one poll and then rechecks that the instance is still terminating.
+// It returns true when the handler should not drain in this poll.
+func (d *Drainer) absorbFlapping(ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail) (bool, error) {
+	if detail.FlappingConfirmed {
+		return false, nil
+	}
+
+	if !detail.FlappingDelayed {
+		detail.FlappingDelayed = true
+		detail.Wait = true
+		return true, nil
+	}
+
+	state, err := getLifecycleState(ctx, svc, detail.EC2InstanceId)
+	if err != nil {
+		return false, err
+	}
+	if state != autoscaling.LifecycleStateTerminatingWait {
+		d.logger.infof("instance %q is %q, not %q; skipping draining",
+			detail.EC2InstanceId, state, autoscaling.LifecycleStateTerminatingWait)
+		detail.Wait = false
+		return true, nil
+	}
+
+	detail.FlappingConfirmed = true
+	return false, nil
+}
+
+// heartbeatTimeoutFraction is the fraction of the hook's `HeartbeatTimeout` that the interval between
+// heartbeats does not exceed, leaving room for a few failed polls.
+const heartbeatTimeoutFraction = 3
+
+// resolveHeartbeatTimeout reads the `HeartbeatTimeout` of the lifecycle hook once and keeps it in the detail.
+// On a failure, the interval stays at its default.
+func (d *Drainer) resolveHeartbeatTimeout(ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail) {
+	if detail.HeartbeatTimeout > 0 {
+		return
+	}
+	hook, err := d.describeLifecycleHook(ctx, svc, detail)
+	if err != nil {
+		d.logger.warnf("failed to describe lifecycle hook %q: %v", detail.LifecycleHookName, err)
+		return
+	}
+	detail.HeartbeatTimeout = hook.heartbeatTimeout
+}
+
+// heartbeatSafeInterval returns the interval, shortened to a fraction of the hook's `HeartbeatTimeout` if known.
+func heartbeatSafeInterval(detail *CloudWatchEventDetail, interval time.Duration) time.Duration {
+	if detail.HeartbeatTimeout <= 0 {
+		return interval
+	}
+	if safe := time.Duration(detail.HeartbeatTimeout) * time.Second / heartbeatTimeoutFraction; safe < interval {
+		return safe
+	}
+	return interval
+}
+
+// validateLifecycleHook rejects events whose hook is not configured on the Auto Scaling group
+// for the transition the event claims.
+func (d *Drainer) validateLifecycleHook(ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail) error {
+	hook, err := d.describeLifecycleHook(ctx, svc, detail)
+	if err != nil {
+		return err
+	}
+	if hook.transition == "" {
+		return fmt.Errorf("%q does not have lifecycle hook %q", detail.AutoScalingGroupName, detail.LifecycleHookName)
+	}
+	if hook.transition != detail.LifecycleTransition {
+		return fmt.Errorf("lifecycle hook %q is for %q, not %q",
+			detail.LifecycleHookName, hook.transition, detail.LifecycleTransition)
+	}
+	return nil
+}
+
+// withDiscoveredHook calls fn, and when it fails because the event names a hook the Auto Scaling group
+// does not have, e.g. from a misconfigured rule, calls it again with the group's only hook for the transition.
+// The discovered name is kept in the detail so that the later polls use it.
+func (d *Drainer) withDiscoveredHook(ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail,
+	fn func() error) error {
+	err := fn()
+	if !isLifecycleHookMismatch(err) {
+		return err
+	}
+	hookName, derr := discoverLifecycleHook(ctx, svc, detail)
+	if derr != nil {
+		d.logger.warnf("failed to discover the lifecycle hook of %q: %v", detail.AutoScalingGroupName, derr)
+		return err
+	}
+	if hookName == "" || hookName == detail.LifecycleHookName {
+		return err
+	}
+	d.logger.warnf("%q does not match lifecycle hook %q of %q, retrying with it",
+		detail.LifecycleHookName, hookName, detail.AutoScalingGroupName)
+	detail.LifecycleHookName = hookName
+	return fn()
+}
+
+// discoverLifecycleHook returns the name of the hook of the Auto Scaling group for the transition of the detail,
+// or an empty string unless there is exactly one.
+func discoverLifecycleHook(ctx context.Context, svc autoscalingAPI, detail *CloudWatchEventDetail) (string, error) {
+	output, err := svc.DescribeLifecycleHooksWithContext(ctx, &autoscaling.DescribeLifecycleHooksInput{
+		AutoScalingGroupName: &detail.AutoScalingGroupName,
+	})
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, hook := range output.LifecycleHooks {
+		if aws.StringValue(hook.LifecycleTransition) == detail.LifecycleTransition {
+			names = append(names, aws.StringValue(hook.LifecycleHookName))
+		}
+	}
+	if len(names) != 1 {
+		return "", nil
+	}
+	return names[0], nil
+}
+
+// isLifecycleHookMismatch reports whether err may come from a hook name the Auto Scaling group does not have,
+// which the API reports like an action that is no longer active.
+func isLifecycleHookMismatch(err error) bool {
+	if isNoActiveLifecycleAction(err) {
+		return true
+	}
+	aerr, ok := asAWSError(err)
+	return ok && aerr.Code() == "ValidationError" && strings.Contains(strings.ToLower(aerr.Message()), "lifecycle hook")
+}
+
+const (
+	HookBehaviorDrain         = "drain"
+	HookBehaviorHeartbeatOnly = "heartbeat-only"
+	HookBehaviorSkip          = "skip"
+)
+
+// getHookBehaviors returns the behaviors of the lifecycle hooks configured in `HOOK_BEHAVIOR_JSON`,
+// e.g. `{"log-flush-hook": "skip"}`.
+func getHookBehaviors() (map[string]string, error) {
+	value := getenv("HOOK_BEHAVIOR_JSON")
+	if value == "" {
+		return nil, nil
+	}
+	var behaviors map[string]string
+	if err := json.Unmarshal([]byte(value), &behaviors); err != nil {
+		return nil, fmt.Errorf("`HOOK_BEHAVIOR_JSON` is invalid: %w", err)
+	}
+	for hookName, behavior := range behaviors {
+		switch behavior {
+		case HookBehaviorDrain, HookBehaviorHeartbeatOnly, HookBehaviorSkip:
+		default:
+			return nil, fmt.Errorf("behavior of lifecycle hook %q is %q, not one of drain, heartbeat-only or skip",
+				hookName, behavior)
+		}
+	}
+	return behaviors, nil
+}
+
+// hookBehavior returns the behavior configured for the lifecycle hook. Hooks that are not listed in
+// `HOOK_BEHAVIOR_JSON` follow `HEARTBEAT_ONLY`.
+func (c *Config) hookBehavior(hookName string) string {
+	if behavior, ok := c.HookBehaviors[hookName]; ok {
+		return behavior
+	}
+	if c.HeartbeatOnly {
+		return HookBehaviorHeartbeatOnly
+	}
+	return HookBehaviorDrain
+}
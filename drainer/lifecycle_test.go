@@ -0,0 +1,311 @@
+package drainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerDrainAbsorbFlapping(t *testing.T) {
+	for _, tt := range []struct {
+		state        string
+		wantDraining bool
+	}{
+		{autoscaling.LifecycleStateTerminatingWait, true},
+		{autoscaling.LifecycleStateInService, false},
+	} {
+		t.Run(tt.state, func(t *testing.T) {
+			t.Setenv("ABSORB_FLAPPING", "true")
+			f := newTestDrainFixture()
+			f.autoscaling.setLifecycleState("i-1", tt.state)
+			d, _ := newTestDrainer(t, f.clients)
+			ctx := context.Background()
+
+			// The first poll only delays.
+			detail, err := d.Drain(ctx, f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !detail.Wait || !detail.FlappingDelayed || detail.DrainingSet {
+				t.Fatalf("Drain() = %+v, want to wait once without draining", detail)
+			}
+			if got := f.autoscaling.count("DescribeAutoScalingInstances"); got != 0 {
+				t.Errorf("DescribeAutoScalingInstances calls = %d, want the recheck left to the next poll", got)
+			}
+
+			detail, err = d.Drain(ctx, detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail.DrainingSet != tt.wantDraining || detail.FlappingConfirmed != tt.wantDraining ||
+				detail.Wait != tt.wantDraining {
+				t.Errorf("Drain() = %+v, want draining %v after the recheck", detail, tt.wantDraining)
+			}
+			want := "ACTIVE"
+			if tt.wantDraining {
+				want = "DRAINING"
+			}
+			if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != want {
+				t.Errorf("status = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainValidateHook(t *testing.T) {
+	for _, tt := range []struct {
+		hookName string
+		wantErr  bool
+	}{
+		{"hook", false},
+		{"spoofed", true},
+	} {
+		t.Run(tt.hookName, func(t *testing.T) {
+			t.Setenv("VALIDATE_HOOK", "true")
+			f := newTestDrainFixture()
+			f.detail.LifecycleHookName = tt.hookName
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Drain() = %+v, %v, want error %v", detail, err, tt.wantErr)
+			}
+			want := "DRAINING"
+			if tt.wantErr {
+				want = "ACTIVE"
+			}
+			if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != want {
+				t.Errorf("status = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainCompleteAlreadyTerminated(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"no active lifecycle action", awserr.New("ValidationError",
+			"No active Lifecycle Action found with instance ID i-1", nil), false},
+		{"transient", awserr.New("InternalFailure", "try again", nil), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestDrainFixture()
+			f.stopTask()
+			f.autoscaling.fail("CompleteLifecycleAction", tt.err)
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Drain() = %+v, %v, want error %v", detail, err, tt.wantErr)
+			}
+			if !tt.wantErr && detail.Wait {
+				t.Errorf("Drain() = %+v, want the drain done without another poll", detail)
+			}
+			if got := f.autoscaling.count("CompleteLifecycleAction"); got != 1 {
+				t.Errorf("CompleteLifecycleAction calls = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainHookBehavior(t *testing.T) {
+	t.Setenv("HOOK_BEHAVIOR_JSON", `{"ecs-drain":"drain","log-flush":"heartbeat-only","notify":"skip"}`)
+	for _, tt := range []struct {
+		hookName   string
+		wantWait   bool
+		wantStatus string
+		wantCalls  bool
+	}{
+		{"ecs-drain", true, ecs.ContainerInstanceStatusDraining, true},
+		{"log-flush", true, ecs.ContainerInstanceStatusActive, true},
+		{"notify", false, ecs.ContainerInstanceStatusActive, false},
+		// A hook that is not listed drains.
+		{"hook", true, ecs.ContainerInstanceStatusDraining, true},
+	} {
+		t.Run(tt.hookName, func(t *testing.T) {
+			f := newTestDrainFixture()
+			f.autoscaling.addHook("asg", tt.hookName, 300, LifecycleActionResultContinue)
+			f.detail.LifecycleHookName = tt.hookName
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail.Wait != tt.wantWait {
+				t.Errorf("Wait = %v, want %v", detail.Wait, tt.wantWait)
+			}
+			if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got, tt.wantStatus)
+			}
+			if got := f.ecs.count("DescribeContainerInstances") > 0; got != tt.wantCalls {
+				t.Errorf("container instance described = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestHeartbeatSafeInterval(t *testing.T) {
+	for _, tt := range []struct {
+		heartbeatTimeout int
+		want             time.Duration
+	}{
+		{0, 30 * time.Second},
+		{300, 30 * time.Second},
+		{45, 15 * time.Second},
+	} {
+		detail := &CloudWatchEventDetail{HeartbeatTimeout: tt.heartbeatTimeout}
+		if got := heartbeatSafeInterval(detail, 30*time.Second); got != tt.want {
+			t.Errorf("heartbeatSafeInterval() with HeartbeatTimeout %d = %s, want %s", tt.heartbeatTimeout, got, tt.want)
+		}
+	}
+}
+
+func TestDrainerDrainHeartbeatTimeoutInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		fail     bool
+		wantWait int
+	}{
+		{"described", false, 15},
+		{"describe failed", true, stateMachineWaitSeconds},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cached := lifecycleHooks
+			lifecycleHooks = newLifecycleHookCache(lifecycleHookCacheTTL)
+			t.Cleanup(func() { lifecycleHooks = cached })
+			f := newTestDrainFixture()
+			f.autoscaling.addHook("asg", "short", 45, LifecycleActionResultContinue)
+			f.detail.LifecycleHookName = "short"
+			if tt.fail {
+				f.autoscaling.fail("DescribeLifecycleHooks", awserr.New("AccessDenied", "not authorized", nil))
+			}
+			d, _ := newTestDrainer(t, f.clients)
+			ctx := context.Background()
+
+			detail, err := d.Drain(ctx, f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The poll interval is a third of the 45s `HeartbeatTimeout`, plus jitter.
+			if detail.WaitSeconds < tt.wantWait || detail.WaitSeconds > tt.wantWait+tt.wantWait/loopJitterRatio {
+				t.Errorf("WaitSeconds = %d, want %d plus jitter", detail.WaitSeconds, tt.wantWait)
+			}
+			if tt.fail {
+				return
+			}
+			if detail.HeartbeatTimeout != 45 {
+				t.Errorf("HeartbeatTimeout = %d, want 45 kept in the detail", detail.HeartbeatTimeout)
+			}
+
+			// The timeout kept in the detail is not described again.
+			lifecycleHooks = newLifecycleHookCache(lifecycleHookCacheTTL)
+			calls := f.autoscaling.count("DescribeLifecycleHooks")
+			if _, err := d.Drain(ctx, detail); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.autoscaling.count("DescribeLifecycleHooks"); got != calls {
+				t.Errorf("DescribeLifecycleHooks calls = %d, want %d", got, calls)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainLifecycleActionResolvedElsewhere(t *testing.T) {
+	noActive := func() error {
+		return awserr.New("ValidationError", "No active Lifecycle Action found with instance ID i-1", nil)
+	}
+	for _, tt := range []struct {
+		name      string
+		operation string
+		stopped   bool
+		err       error
+		wantLog   string
+		wantErr   bool
+	}{
+		{"completion", "CompleteLifecycleAction", true, noActive(), "regarding it as completed", false},
+		{"heartbeat", "RecordLifecycleActionHeartbeat", false, noActive(), "stopping the drain", false},
+		{"other validation error", "CompleteLifecycleAction", true,
+			awserr.New("ValidationError", "Unable to complete the lifecycle action", nil), "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestDrainFixture()
+			if tt.stopped {
+				f.stopTask()
+			}
+			f.autoscaling.fail(tt.operation, tt.err)
+			d, out := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Drain() = %+v, want the error", detail)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Drain() = %v, want the resolved lifecycle action taken for done", err)
+			}
+			if detail.Wait {
+				t.Errorf("Drain() = %+v, want nothing left to wait for", detail)
+			}
+			if !strings.Contains(out.String(), tt.wantLog) {
+				t.Errorf("log = %q, want %q", out.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestDrainerDiscoveredLifecycleHook(t *testing.T) {
+	unknownHook := func() error {
+		return awserr.New("ValidationError", "No Lifecycle Hook found with name wrong", nil)
+	}
+	ctx := context.Background()
+
+	f := newTestDrainFixture()
+	f.detail.LifecycleHookName = "wrong"
+	d, out := newTestDrainer(t, f.clients)
+	f.autoscaling.fail("CompleteLifecycleAction", unknownHook())
+	if err := d.complete(ctx, f.autoscaling, f.detail, LifecycleActionResultContinue); err != nil {
+		t.Fatalf("complete() = %v, want the call retried with the discovered hook", err)
+	}
+	if got := f.autoscaling.completions; len(got) != 1 || aws.StringValue(got[0].LifecycleHookName) != "hook" {
+		t.Errorf("completions = %v, want one with the hook of the group", got)
+	}
+	if f.detail.LifecycleHookName != "hook" || !strings.Contains(out.String(), "does not match lifecycle hook") {
+		t.Errorf("hook = %q with log %q, want the discovered hook kept and warned", f.detail.LifecycleHookName,
+			out.String())
+	}
+
+	// The heartbeat is fixed the same way.
+	f.detail.LifecycleHookName = "wrong"
+	f.autoscaling.fail("RecordLifecycleActionHeartbeat", unknownHook())
+	if err := d.heartbeat(ctx, f.autoscaling, f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.heartbeats; len(got) != 1 || aws.StringValue(got[0].LifecycleHookName) != "hook" {
+		t.Errorf("heartbeats = %v, want one with the hook of the group", got)
+	}
+
+	// With several terminating hooks, the right one cannot be told and the error is kept.
+	f = newTestDrainFixture()
+	f.autoscaling.addHook("asg", "other", 300, LifecycleActionResultContinue)
+	f.detail.LifecycleHookName = "wrong"
+	d, _ = newTestDrainer(t, f.clients)
+	f.autoscaling.fail("CompleteLifecycleAction", unknownHook())
+	if err := d.complete(ctx, f.autoscaling, f.detail, LifecycleActionResultContinue); err == nil {
+		t.Error("complete() = nil, want the error with an ambiguous hook")
+	}
+	if f.detail.LifecycleHookName != "wrong" || f.autoscaling.count("CompleteLifecycleAction") != 1 {
+		t.Errorf("hook = %q, want the call not retried", f.detail.LifecycleHookName)
+	}
+}
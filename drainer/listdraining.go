@@ -0,0 +1,119 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// DrainingInstance is a container instance currently in DRAINING, returned by `MODE=list-draining`.
+type DrainingInstance struct {
+	ClusterName          string
+	ContainerInstanceArn string
+	EC2InstanceId        string // nolint:golint,stylecheck
+	RunningTasksCount    int64
+	PendingTasksCount    int64
+}
+
+// listDrainingHandler returns every DRAINING container instance across the clusters of the account,
+// for operator dashboards.
+func (d *Drainer) listDrainingHandler(ctx context.Context) ([]*DrainingInstance, error) {
+	svc := d.newClients(&events.CloudWatchEvent{}).ecs.ecsAPI
+
+	var clusterArns []*string
+	fn := func(output *ecs.ListClustersOutput, _ bool) bool {
+		clusterArns = append(clusterArns, output.ClusterArns...)
+		return ctx.Err() == nil
+	}
+	if err := pagesErr(ctx, svc.ListClustersPagesWithContext(ctx, &ecs.ListClustersInput{}, fn)); err != nil {
+		return nil, err
+	}
+
+	drainingInstances := []*DrainingInstance{}
+	for _, clusterArn := range clusterArns {
+		clusterName := clusterNameFromARN(*clusterArn)
+		instances, err := listDrainingInstances(ctx, svc, clusterName)
+		if err != nil {
+			return nil, err
+		}
+		drainingInstances = append(drainingInstances, instances...)
+	}
+	return drainingInstances, nil
+}
+
+func listDrainingInstances(ctx context.Context, svc ecsAPI, clusterName string) ([]*DrainingInstance, error) {
+	input := &ecs.ListContainerInstancesInput{
+		Cluster: &clusterName,
+		Status:  aws.String(ecs.ContainerInstanceStatusDraining),
+	}
+	var arrayOfArns [][]*string
+	fn := func(output *ecs.ListContainerInstancesOutput, _ bool) bool {
+		if len(output.ContainerInstanceArns) > 0 {
+			arrayOfArns = append(arrayOfArns, output.ContainerInstanceArns)
+		}
+		return ctx.Err() == nil
+	}
+	if err := pagesErr(ctx, svc.ListContainerInstancesPagesWithContext(ctx, input, fn)); err != nil {
+		return nil, err
+	}
+
+	var drainingInstances []*DrainingInstance
+	for _, arns := range arrayOfArns {
+		output, err := svc.DescribeContainerInstancesWithContext(ctx, &ecs.DescribeContainerInstancesInput{
+			Cluster:            &clusterName,
+			ContainerInstances: arns,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, containerInstance := range output.ContainerInstances {
+			drainingInstances = append(drainingInstances, &DrainingInstance{
+				ClusterName:          clusterName,
+				ContainerInstanceArn: aws.StringValue(containerInstance.ContainerInstanceArn),
+				EC2InstanceId:        aws.StringValue(containerInstance.Ec2InstanceId),
+				RunningTasksCount:    aws.Int64Value(containerInstance.RunningTasksCount),
+				PendingTasksCount:    aws.Int64Value(containerInstance.PendingTasksCount),
+			})
+		}
+	}
+	return drainingInstances, nil
+}
+
+// availabilityZoneAttribute is the attribute the ECS agent sets to the availability zone of the container instance.
+const availabilityZoneAttribute = "ecs.availability-zone"
+
+// availabilityZone returns the availability zone of the container instance, or "" if it is not known.
+func availabilityZone(containerInstance *ecs.ContainerInstance) string {
+	for _, attribute := range containerInstance.Attributes {
+		if aws.StringValue(attribute.Name) == availabilityZoneAttribute {
+			return aws.StringValue(attribute.Value)
+		}
+	}
+	return ""
+}
+
+// countDrainingInstances counts the container instances of the cluster in DRAINING, only those in the availability
+// zone if it is not empty.
+func (d *Drainer) countDrainingInstances(ctx context.Context, svc ecsAPI, clusterName string, zone string) (int,
+	error) {
+	input := &ecs.ListContainerInstancesInput{
+		Cluster: &clusterName,
+		Status:  aws.String(ecs.ContainerInstanceStatusDraining),
+	}
+	if zone != "" {
+		input.Filter = aws.String(fmt.Sprintf("attribute:%s == %s", availabilityZoneAttribute, zone))
+	}
+	var count int
+	fn := func(output *ecs.ListContainerInstancesOutput, _ bool) bool {
+		count += len(output.ContainerInstanceArns)
+		return ctx.Err() == nil
+	}
+	err := d.withRetry(ctx, "ListContainerInstances", func() error {
+		count = 0
+		return pagesErr(ctx, svc.ListContainerInstancesPagesWithContext(ctx, input, fn))
+	})
+	return count, err
+}
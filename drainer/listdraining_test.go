@@ -0,0 +1,120 @@
+package drainer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerListDrainingHandler(t *testing.T) {
+	svc := newFakeECS()
+	svc.pageSize = 1
+	draining := svc.addContainerInstance("default", "ci-1", "i-1")
+	draining.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	svc.addTask("default", "task-1", draining, "web")
+	svc.addContainerInstance("default", "ci-2", "i-2")
+	other := svc.addContainerInstance("batch", "ci-3", "i-3")
+	other.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	svc.addCluster("empty")
+	d, _ := newTestDrainer(t, &awsClients{ecs: newECSClient(svc)})
+
+	got, err := d.listDrainingHandler(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*DrainingInstance{
+		{ClusterName: "batch", ContainerInstanceArn: testContainerInstanceArn("batch", "ci-3"), EC2InstanceId: "i-3"},
+		{ClusterName: "default", ContainerInstanceArn: testContainerInstanceArn("default", "ci-1"), EC2InstanceId: "i-1",
+			RunningTasksCount: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, instance := range got {
+			t.Logf("listed %+v", *instance)
+		}
+		t.Errorf("listDrainingHandler() = %d instances, want i-3 of batch and i-1 of default", len(got))
+	}
+}
+
+func TestDrainerDrainMaxConcurrentDraining(t *testing.T) {
+	t.Setenv("MAX_CONCURRENT_DRAINING", "1")
+	f := newTestDrainFixture()
+	other := f.ecs.addContainerInstance("default", "ci-2", "i-2")
+	other.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	// The cluster is already at the limit, so the instance waits without draining.
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || detail.DrainingSet {
+		t.Fatalf("Drain() = %+v, want to wait to drain", detail)
+	}
+	if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("default", "ci-1")); got != "ACTIVE" {
+		t.Errorf("status = %q, want ACTIVE while the cluster is at the limit", got)
+	}
+	if got := f.autoscaling.heartbeatCount(); got != 1 {
+		t.Errorf("heartbeats = %d, want 1", got)
+	}
+
+	// The limit is evaluated again on the next poll, once the other instance is done.
+	f.ecs.stateMu.Lock()
+	other.Status = aws.String(ecs.ContainerInstanceStatusActive)
+	f.ecs.stateMu.Unlock()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.DrainingSet {
+		t.Errorf("Drain() = %+v, want the instance drained", detail)
+	}
+	if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("default", "ci-1")); got != "DRAINING" {
+		t.Errorf("status = %q, want DRAINING", got)
+	}
+}
+
+func TestDrainerDrainMaxDrainingPerAZ(t *testing.T) {
+	t.Setenv("MAX_DRAINING_PER_AZ", "1")
+	inZone := func(containerInstance *ecs.ContainerInstance, zone string) {
+		containerInstance.Attributes = append(containerInstance.Attributes,
+			&ecs.Attribute{Name: aws.String(availabilityZoneAttribute), Value: aws.String(zone)})
+	}
+	f := newTestDrainFixture()
+	inZone(f.containerInstance, "us-east-1a")
+	sameZone := f.ecs.addContainerInstance("default", "ci-2", "i-2")
+	inZone(sameZone, "us-east-1a")
+	sameZone.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	otherZone := f.ecs.addContainerInstance("default", "ci-3", "i-3")
+	inZone(otherZone, "us-east-1b")
+	otherZone.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	d, out := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	// The zone of the instance is at its limit, so the instance heartbeats without draining.
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || detail.DrainingSet || f.autoscaling.heartbeatCount() != 1 {
+		t.Fatalf("Drain() = %+v, want to wait to drain", detail)
+	}
+	if !strings.Contains(out.String(), "1 instances in us-east-1a are already draining") {
+		t.Errorf("log = %q, want the zone at its limit", out.String())
+	}
+
+	// The instance draining in another zone does not count.
+	f.ecs.stateMu.Lock()
+	sameZone.Status = aws.String(ecs.ContainerInstanceStatusActive)
+	f.ecs.stateMu.Unlock()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.containerInstanceStatus(testContainerInstanceArn("default", "ci-1")); !detail.DrainingSet ||
+		got != "DRAINING" {
+		t.Errorf("Drain() = %+v with status %q, want the instance drained", detail, got)
+	}
+}
@@ -0,0 +1,51 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// localDetail returns the lifecycle action of `LOCAL_INSTANCE_ID` in `LOCAL_ASG`, or nil when it is unset.
+func localDetail() *CloudWatchEventDetail {
+	instanceID := getenv("LOCAL_INSTANCE_ID")
+	if instanceID == "" {
+		return nil
+	}
+	return &CloudWatchEventDetail{
+		AutoScalingGroupName: getenv("LOCAL_ASG"),
+		EC2InstanceId:        instanceID,
+		LifecycleActionToken: getenv("LOCAL_LIFECYCLE_ACTION_TOKEN"),
+		LifecycleHookName:    getenv("LOCAL_LIFECYCLE_HOOK_NAME"),
+		LifecycleTransition:  LifecycleTransitionTerminating,
+	}
+}
+
+// runLocal runs the handler once for the lifecycle action of localDetail in region with the ambient AWS profile
+// and prints the resulting event, so that the drain logic can be tried against a real cluster without deploying.
+// Combine it with `DRY_RUN` to only report what would happen.
+func (d *Drainer) runLocal(local *CloudWatchEventDetail, region string) error {
+	detail, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+
+	evt, err := d.handleEvent(context.Background(), &events.CloudWatchEvent{
+		DetailType: DetailTypeTerminateLifecycle,
+		Source:     "aws.autoscaling",
+		Time:       d.clock.Now(),
+		Region:     region,
+		Detail:     detail,
+	})
+	if err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(evt, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
@@ -0,0 +1,163 @@
+package drainer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logLevelSeverities = map[string]int{ // nolint:gochecknoglobals
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+type logFields map[string]interface{}
+
+// logger writes one JSON object per line with the level, the message and its fields, so that the logs can be
+// queried with CloudWatch Logs Insights. Messages below `LOG_LEVEL`, info by default, are dropped.
+type logger struct {
+	out    *logOutput
+	level  string
+	clock  Clock
+	fields logFields
+}
+
+// logOutput serializes the lines of the loggers sharing a writer.
+type logOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newLogger returns a logger without fields writing to w at the info level.
+func newLogger(w io.Writer) *logger {
+	return &logger{out: &logOutput{w: w}, level: LogLevelInfo, clock: realClock{}}
+}
+
+// withLevel returns a logger that drops the messages of l below level.
+func (l *logger) withLevel(level string) *logger {
+	c := *l
+	c.level = level
+	return &c
+}
+
+// withClock returns a logger that stamps the lines of l with the time of clock.
+func (l *logger) withClock(clock Clock) *logger {
+	c := *l
+	c.clock = clock
+	return &c
+}
+
+// with returns a logger that adds the fields to those of l.
+func (l *logger) with(fields logFields) *logger {
+	merged := make(logFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	c := *l
+	c.fields = merged
+	return &c
+}
+
+func (l *logger) infof(format string, args ...interface{}) {
+	l.log(LogLevelInfo, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *logger) warnf(format string, args ...interface{}) {
+	l.log(LogLevelWarn, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *logger) errorf(format string, args ...interface{}) {
+	l.log(LogLevelError, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *logger) log(level, msg string, fields logFields) {
+	if logLevelSeverities[level] < logLevelSeverities[l.level] {
+		return
+	}
+
+	entry := make(logFields, len(l.fields)+len(fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = l.clock.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(logFields{"level": LogLevelError, "msg": msg, "error": err.Error()})
+	}
+	l.writeLine(string(line))
+}
+
+// writeLine writes line as is, regardless of the level.
+func (l *logger) writeLine(line string) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	_, _ = io.WriteString(l.out.w, line+"\n")
+}
+
+// defaultMaxLogBytes caps the event detail in the debug dump, since batched or enriched events can be large.
+const defaultMaxLogBytes = 8192
+
+// truncatedMarker ends a detail cut at `MAX_LOG_BYTES`.
+const truncatedMarker = "...(truncated)"
+
+// logEvent logs a summary of evt and, at the debug level, the event itself with the detail cut at `MAX_LOG_BYTES`.
+func (d *Drainer) logEvent(evt *events.CloudWatchEvent) {
+	var summary struct {
+		EC2InstanceId       string // nolint:golint,stylecheck
+		InstanceID          string `json:"instance-id"`
+		LifecycleTransition string
+	}
+	_ = json.Unmarshal(evt.Detail, &summary)
+	instanceID := summary.EC2InstanceId
+	if instanceID == "" {
+		instanceID = summary.InstanceID
+	}
+	d.logger.log(LogLevelInfo, "received the event", logFields{
+		"detailType":          evt.DetailType,
+		"instanceId":          instanceID,
+		"lifecycleTransition": summary.LifecycleTransition,
+	})
+
+	if d.config.LogLevel != LogLevelDebug {
+		return
+	}
+	maxBytes := d.config.MaxLogBytes
+	fields := logFields{"event": evt}
+	if maxBytes > 0 && len(evt.Detail) > maxBytes {
+		dump := *evt
+		dump.Detail = nil
+		fields = logFields{"event": &dump, "detail": string(evt.Detail[:maxBytes]) + truncatedMarker}
+	}
+	d.logger.log(LogLevelDebug, "event dump", fields)
+}
+
+func getLogLevel() string {
+	if level := getenv("LOG_LEVEL"); level != "" {
+		if _, ok := logLevelSeverities[level]; ok {
+			return level
+		}
+	}
+	return LogLevelInfo
+}
@@ -0,0 +1,142 @@
+package drainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// logLines returns the JSON objects of the lines of out.
+func logLines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	lg := newLogger(&out).withLevel(LogLevelWarn).withClock(clock).with(logFields{"instanceId": "i-1"})
+
+	lg.log(LogLevelDebug, "dropped", nil)
+	lg.infof("dropped %d", 1)
+	lg.with(logFields{"cluster": "default"}).warnf("tasks remain: %d", 2)
+	lg.errorf("failed")
+
+	lines := logLines(t, &out)
+	if len(lines) != 2 {
+		t.Fatalf("lines = %v, want the messages below `LOG_LEVEL` dropped", lines)
+	}
+	want := map[string]interface{}{
+		"time":       "2020-01-02T03:04:05Z",
+		"level":      LogLevelWarn,
+		"msg":        "tasks remain: 2",
+		"instanceId": "i-1",
+		"cluster":    "default",
+	}
+	if len(lines[0]) != len(want) {
+		t.Errorf("line = %v, want %v", lines[0], want)
+	}
+	for k, v := range want {
+		if lines[0][k] != v {
+			t.Errorf("%s = %v, want %v", k, lines[0][k], v)
+		}
+	}
+	if got := lines[1]; got["level"] != LogLevelError || got["cluster"] != nil || got["instanceId"] != "i-1" {
+		t.Errorf("line = %v, want an error with the fields of its logger only", got)
+	}
+}
+
+func TestGetLogLevel(t *testing.T) {
+	for env, want := range map[string]string{
+		"":      LogLevelInfo,
+		"debug": LogLevelDebug,
+		"error": LogLevelError,
+		"trace": LogLevelInfo,
+	} {
+		t.Setenv("LOG_LEVEL", env)
+		if got := getLogLevel(); got != want {
+			t.Errorf("getLogLevel() with LOG_LEVEL=%q = %q, want %q", env, got, want)
+		}
+	}
+}
+
+func TestDrainerDrainLogFields(t *testing.T) {
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+
+	if _, err := d.handleEvent(context.Background(), testEvent(t, f.detail)); err != nil {
+		t.Fatal(err)
+	}
+	var decision map[string]interface{}
+	for _, line := range logLines(t, out) {
+		if line["msg"] == "made a drain decision" {
+			decision = line
+		}
+		if line["level"] == LogLevelDebug {
+			t.Errorf("line = %v, want no debug line at the info level", line)
+		}
+	}
+	if decision == nil {
+		t.Fatalf("log = %q, want the drain decision", out.String())
+	}
+	if decision["level"] != LogLevelInfo || decision["instanceId"] != "i-1" || decision["asg"] != "asg" ||
+		decision["cluster"] != "default" || decision["taskCount"] != float64(1) {
+		t.Errorf("decision line = %v, want the instance, group, cluster and task count", decision)
+	}
+
+	// The event is dumped at the debug level only.
+	t.Setenv("LOG_LEVEL", LogLevelDebug)
+	d, out = newTestDrainer(t, f.clients)
+	d.logEvent(testEvent(t, f.detail))
+	if lines := logLines(t, out); len(lines) != 2 || lines[1]["msg"] != "event dump" || lines[1]["event"] == nil {
+		t.Errorf("lines = %v, want the summary and the event dump", lines)
+	}
+}
+
+func TestDrainerLogEventTruncated(t *testing.T) {
+	t.Setenv("LOG_LEVEL", LogLevelDebug)
+	t.Setenv("MAX_LOG_BYTES", "32")
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	detail := `{"EC2InstanceId":"i-1","LifecycleTransition":"autoscaling:EC2_INSTANCE_TERMINATING"}`
+	evt := &events.CloudWatchEvent{DetailType: "EC2 Instance-terminate Lifecycle Action", Detail: json.RawMessage(detail)}
+
+	d.logEvent(evt)
+	lines := logLines(t, out)
+	if len(lines) != 2 {
+		t.Fatalf("lines = %v, want the summary and the event dump", lines)
+	}
+	if got := lines[0]; got["instanceId"] != "i-1" || got["detailType"] != evt.DetailType ||
+		got["lifecycleTransition"] != "autoscaling:EC2_INSTANCE_TERMINATING" {
+		t.Errorf("summary = %v, want the whole detail summarized", got)
+	}
+	if got, want := lines[1]["detail"], detail[:32]+truncatedMarker; got != want {
+		t.Errorf("detail = %v, want %q", got, want)
+	}
+	if dump, _ := lines[1]["event"].(map[string]interface{}); dump == nil || dump["detail"] != nil {
+		t.Errorf("event = %v, want the event without its detail", lines[1]["event"])
+	}
+
+	// A detail within the limit is dumped whole.
+	t.Setenv("MAX_LOG_BYTES", "1024")
+	d, out = newTestDrainer(t, f.clients)
+	d.logEvent(evt)
+	lines = logLines(t, out)
+	dump, _ := lines[len(lines)-1]["event"].(map[string]interface{})
+	if _, cut := lines[len(lines)-1]["detail"]; cut || dump == nil || dump["detail"] == nil {
+		t.Errorf("dump = %v, want the whole event", lines[len(lines)-1])
+	}
+}
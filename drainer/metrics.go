@@ -0,0 +1,57 @@
+package drainer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+const defaultMetricNamespace = "ECSAutoDraining"
+
+// metricDimensions returns the dimensions of the drain metrics of an instance.
+func metricDimensions(clusterName, autoScalingGroupName string) []*cloudwatch.Dimension {
+	dimensions := []*cloudwatch.Dimension{{Name: aws.String("ClusterName"), Value: aws.String(clusterName)}}
+	if autoScalingGroupName != "" {
+		dimensions = append(dimensions,
+			&cloudwatch.Dimension{Name: aws.String("AutoScalingGroupName"), Value: aws.String(autoScalingGroupName)})
+	}
+	return dimensions
+}
+
+// putMetric publishes a metric when `ENABLE_METRICS` is enabled.
+// Metrics are best-effort, so failures are only logged.
+func (d *Drainer) putMetric(ctx context.Context, clients *awsClients,
+	dimensions []*cloudwatch.Dimension, name string, value float64, unit string) {
+	d.putMetricData(ctx, clients.cloudwatch, []*cloudwatch.MetricDatum{{
+		MetricName: &name,
+		Dimensions: dimensions,
+		Unit:       &unit,
+		Value:      &value,
+	}})
+}
+
+// maxMetricData is the maximum number of metrics that a single `PutMetricData` call accepts.
+const maxMetricData = 20
+
+func (d *Drainer) putMetricData(ctx context.Context, svc cloudwatchAPI, data []*cloudwatch.MetricDatum) {
+	if !d.config.Metrics || len(data) == 0 {
+		return
+	}
+
+	namespace := d.config.MetricNamespace
+
+	for start := 0; start < len(data); start += maxMetricData {
+		end := start + maxMetricData
+		if end > len(data) {
+			end = len(data)
+		}
+		_, err := svc.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			Namespace:  &namespace,
+			MetricData: data[start:end],
+		})
+		if err != nil {
+			d.logger.warnf("failed to put metrics: %v", err)
+		}
+	}
+}
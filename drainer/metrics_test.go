@@ -0,0 +1,187 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestDrainerDrainHeartbeatsMetric(t *testing.T) {
+	t.Setenv("ENABLE_METRICS", "true")
+	f := newTestDrainFixture()
+	svc := &fakeCloudWatch{}
+	f.clients.cloudwatch = svc
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail := f.detail
+	for i := 1; i <= 3; i++ {
+		var err error
+		if detail, err = d.Drain(ctx, detail); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(svc.metrics("Heartbeats")); got != i || f.autoscaling.heartbeatCount() != i {
+			t.Fatalf("Heartbeats metrics = %d after %d heartbeats, want one per heartbeat", got,
+				f.autoscaling.heartbeatCount())
+		}
+	}
+	datum := svc.metrics("Heartbeats")[0]
+	if aws.Float64Value(datum.Value) != 1 || len(datum.Dimensions) == 0 ||
+		aws.StringValue(datum.Dimensions[0].Name) != "ClusterName" ||
+		aws.StringValue(datum.Dimensions[0].Value) != "default" {
+		t.Errorf("Heartbeats = %v, want a count of 1 by the cluster", datum)
+	}
+
+	f.stopTask()
+	if _, err := d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(svc.metrics("Heartbeats")); got != 3 {
+		t.Errorf("Heartbeats metrics = %d, want none for the completion", got)
+	}
+}
+
+func TestDrainerDrainMetrics(t *testing.T) {
+	for _, tt := range []struct {
+		namespace string
+		want      string
+	}{
+		{"", "ECSAutoDraining"},
+		{"Custom/Draining", "Custom/Draining"},
+	} {
+		t.Run(tt.want, func(t *testing.T) {
+			t.Setenv("ENABLE_METRICS", "true")
+			t.Setenv("METRIC_NAMESPACE", tt.namespace)
+			f := newTestDrainFixture()
+			svc := &fakeCloudWatch{}
+			f.clients.cloudwatch = svc
+			d, _ := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			ctx := context.Background()
+
+			// The drain duration counts from the time of the lifecycle event, which every invocation gets.
+			evt := testEvent(t, f.detail)
+			evt.Time = clock.Now()
+			evt, err := d.handleEvent(ctx, evt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			running := svc.metrics("RunningTasks")
+			if len(running) != 1 || aws.Float64Value(running[0].Value) != 1 {
+				t.Fatalf("RunningTasks = %v, want the running task counted", running)
+			}
+			dimensions := map[string]string{}
+			for _, dimension := range running[0].Dimensions {
+				dimensions[aws.StringValue(dimension.Name)] = aws.StringValue(dimension.Value)
+			}
+			if len(dimensions) != 2 || dimensions["ClusterName"] != "default" || dimensions["AutoScalingGroupName"] != "asg" {
+				t.Errorf("dimensions = %v, want the cluster and the Auto Scaling group", dimensions)
+			}
+
+			clock.advance(90 * time.Second)
+			f.stopTask()
+			if _, err := d.handleEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+			duration := svc.metrics("DrainDurationSeconds")
+			if len(duration) != 1 || aws.Float64Value(duration[0].Value) != 90 ||
+				aws.StringValue(duration[0].Unit) != cloudwatch.StandardUnitSeconds {
+				t.Errorf("DrainDurationSeconds = %v, want 90 seconds", duration)
+			}
+			for _, namespace := range svc.namespaces {
+				if namespace != tt.want {
+					t.Errorf("namespace = %q, want %q", namespace, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDrainerDrainMetricsFailure(t *testing.T) {
+	t.Setenv("ENABLE_METRICS", "true")
+	f := newTestDrainFixture()
+	f.stopTask()
+	svc := &fakeCloudWatch{}
+	var errs []error
+	for i := 0; i < 20; i++ {
+		errs = append(errs, errors.New("internal error"))
+	}
+	svc.fail("PutMetricData", errs...)
+	f.clients.cloudwatch = svc
+	d, out := newTestDrainer(t, f.clients)
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the metrics failure not to block completing", detail, got)
+	}
+	if !strings.Contains(out.String(), "failed to put metrics") {
+		t.Errorf("log = %q, want the failure logged", out.String())
+	}
+}
+
+func TestDrainerDrainPathMetric(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		withTasks bool
+		want      string
+	}{
+		{"idle instance", false, DrainPathFastComplete},
+		{"drained tasks", true, DrainPathDrainedWithTasks},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ENABLE_METRICS", "true")
+			f := newTestDrainFixture()
+			svc := &fakeCloudWatch{}
+			f.clients.cloudwatch = svc
+			if !tt.withTasks {
+				f.stopTask()
+			}
+			d, out := newTestDrainer(t, f.clients)
+			ctx := context.Background()
+
+			detail, err := d.Drain(ctx, f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.withTasks {
+				f.stopTask()
+				if detail, err = d.Drain(ctx, detail); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if detail.Wait {
+				t.Fatalf("Drain() = %+v, want the drain done", detail)
+			}
+			if got := svc.metrics(tt.want); len(got) != 1 || aws.Float64Value(got[0].Value) != 1 {
+				t.Errorf("%s metrics = %v, want 1", tt.want, got)
+			}
+			other := DrainPathDrainedWithTasks
+			if tt.withTasks {
+				other = DrainPathFastComplete
+			}
+			if got := svc.metrics(other); len(got) != 0 {
+				t.Errorf("%s metrics = %v, want none", other, got)
+			}
+
+			var paths []interface{}
+			for _, line := range logLines(t, out) {
+				if line["msg"] == "made a drain decision" {
+					paths = append(paths, line["drainPath"])
+				}
+			}
+			// Only the decision that completes the drain has the path.
+			if got := paths[len(paths)-1]; got != tt.want || (tt.withTasks && paths[0] != nil) {
+				t.Errorf("drainPath of the decisions = %v, want %s on the last one only", paths, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	NotifierLog         = "log"
+	NotifierSNS         = "sns"
+	NotifierEventBridge = "eventbridge"
+	NotifierWebhook     = "webhook"
+	NotifierChat        = "chat"
+)
+
+// notifierDestinations are the variables naming where each notifier sends to.
+var notifierDestinations = map[string]string{ // nolint:gochecknoglobals
+	NotifierSNS:         "NOTIFY_SNS_TOPIC_ARN",
+	NotifierEventBridge: "EVENT_BUS_NAME",
+	NotifierWebhook:     "COMPLETION_WEBHOOK_URL",
+	NotifierChat:        "SLACK_WEBHOOK_URL",
+}
+
+// Notifier sends a drain event to a sink.
+type Notifier interface {
+	Notify(ctx context.Context, payload *CompletionPayload) error
+}
+
+type logNotifier struct {
+	logger *logger
+}
+
+func (n logNotifier) Notify(_ context.Context, payload *CompletionPayload) error {
+	n.logger.log(LogLevelInfo, "drain event", logFields{"notification": payload})
+	return nil
+}
+
+type snsNotifier struct {
+	svc      snsAPI
+	topicArn string
+}
+
+func (n snsNotifier) Notify(ctx context.Context, payload *CompletionPayload) error {
+	return publishSNS(ctx, n.svc, n.topicArn, payload)
+}
+
+type eventBridgeNotifier struct {
+	svc     eventbridgeAPI
+	busName string
+}
+
+func (n eventBridgeNotifier) Notify(ctx context.Context, payload *CompletionPayload) error {
+	return putEvent(ctx, n.svc, n.busName, payload)
+}
+
+// webhookNotifier posts the payload, signed with HMAC-SHA256 in the `X-Signature-256: sha256=<hex>` header
+// when a signing secret is configured.
+type webhookNotifier struct {
+	d       *Drainer
+	clients *awsClients
+	url     string
+}
+
+func (n webhookNotifier) Notify(ctx context.Context, payload *CompletionPayload) error {
+	return n.d.postWebhook(ctx, n.clients, n.url, payload)
+}
+
+type chatNotifier struct {
+	url string
+}
+
+func (n chatNotifier) Notify(ctx context.Context, payload *CompletionPayload) error {
+	return postChatMessage(ctx, n.url, payload)
+}
+
+// multiNotifier sends to every notifier, so that a failing sink does not keep the event from the others.
+type multiNotifier map[string]Notifier
+
+func (n multiNotifier) Notify(ctx context.Context, payload *CompletionPayload) error {
+	var failures []string
+	for name, notifier := range n {
+		if err := notifier.Notify(ctx, payload); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to notify %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// newNotifier returns the notifiers of `NOTIFIERS`, separated by commas, or those whose destination is set.
+func (d *Drainer) newNotifier(clients *awsClients) multiNotifier {
+	names := d.config.Notifiers
+	if len(names) == 0 {
+		for name := range d.config.NotifierDestinations {
+			names = append(names, name)
+		}
+	}
+
+	notifiers := make(multiNotifier, len(names))
+	for _, name := range names {
+		destination := d.config.NotifierDestinations[name]
+		switch name {
+		case NotifierLog:
+			notifiers[name] = logNotifier{logger: d.logger}
+		case NotifierSNS:
+			notifiers[name] = snsNotifier{svc: clients.sns, topicArn: destination}
+		case NotifierEventBridge:
+			notifiers[name] = eventBridgeNotifier{svc: clients.eventbridge, busName: destination}
+		case NotifierWebhook:
+			notifiers[name] = webhookNotifier{d: d, clients: clients, url: destination}
+		case NotifierChat:
+			notifiers[name] = chatNotifier{url: destination}
+		}
+	}
+	return notifiers
+}
+
+// validateNotifiers checks that `NOTIFIERS` only names known notifiers whose destinations are set.
+func (c *Config) validateNotifiers() error {
+	for _, name := range c.Notifiers {
+		destination, ok := notifierDestinations[name]
+		switch {
+		case name == NotifierLog:
+		case !ok:
+			return fmt.Errorf("`NOTIFIERS` has %q, not one of log, sns, eventbridge, webhook or chat", name)
+		case c.NotifierDestinations[name] == "":
+			return fmt.Errorf("`NOTIFIERS` has %q, which requires `%s`", name, destination)
+		}
+	}
+	return nil
+}
+
+// notifyDrain sends the drain event to the notifiers. Started drains are only sent when `NOTIFIERS` is set,
+// and notifications are best-effort, so failures are only logged.
+func (d *Drainer) notifyDrain(ctx context.Context, clients *awsClients, payload *CompletionPayload) {
+	if payload.Type == CompletionTypeStarted && len(d.config.Notifiers) == 0 {
+		return
+	}
+	if err := d.newNotifier(clients).Notify(ctx, payload); err != nil {
+		d.logger.warnf("%v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const testTopicArn = "arn:aws:sns:us-east-1:123456789012:drains"
+
+// publishedPayloads returns the completion payloads published to the topic.
+func publishedPayloads(t *testing.T, topic *fakeSNS) []CompletionPayload {
+	t.Helper()
+	topic.mu.Lock()
+	defer topic.mu.Unlock()
+	var payloads []CompletionPayload
+	for _, input := range topic.inputs {
+		if got := aws.StringValue(input.TopicArn); got != testTopicArn {
+			t.Errorf("TopicArn = %q, want %q", got, testTopicArn)
+		}
+		var payload CompletionPayload
+		if err := json.Unmarshal([]byte(aws.StringValue(input.Message)), &payload); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+func TestDrainerDrainNotifySNS(t *testing.T) {
+	t.Setenv("NOTIFY_SNS_TOPIC_ARN", testTopicArn)
+	f := newTestDrainFixture()
+	topic := &fakeSNS{}
+	f.clients.sns = topic
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := publishedPayloads(t, topic); len(got) != 0 {
+		t.Fatalf("payloads = %+v, want none while draining", got)
+	}
+
+	clock.advance(time.Minute)
+	f.stopTask()
+	if _, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	got := publishedPayloads(t, topic)
+	want := CompletionPayload{
+		Type:                 CompletionTypeDrained,
+		ClusterName:          "default",
+		AutoScalingGroupName: "asg",
+		EC2InstanceId:        "i-1",
+		Outcome:              drainOutcome(detail, LifecycleActionResultContinue),
+		DrainDurationSeconds: 60,
+	}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("payloads = %+v, want %+v", got, want)
+	}
+}
+
+func TestDrainerHandleEventNotifySNSTimedOut(t *testing.T) {
+	t.Setenv("NOTIFY_SNS_TOPIC_ARN", testTopicArn)
+	t.Setenv("MAX_DRAIN_SECONDS", "600")
+	f := newTestDrainFixture()
+	topic := &fakeSNS{}
+	f.clients.sns = topic
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	evt, err := d.handleEvent(ctx, testEvent(t, f.detail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(601 * time.Second)
+	if _, err = d.handleEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	got := publishedPayloads(t, topic)
+	if len(got) != 1 || got[0].Type != CompletionTypeTimedOut || got[0].RunningTasksCount != 1 {
+		t.Errorf("payloads = %+v, want a timed out drain with its running task", got)
+	}
+}
+
+func TestDrainerDrainNotifySNSFailure(t *testing.T) {
+	t.Setenv("NOTIFY_SNS_TOPIC_ARN", testTopicArn)
+	f := newTestDrainFixture()
+	topic := &fakeSNS{}
+	topic.fail("Publish", errors.New("AuthorizationError"))
+	f.clients.sns = topic
+	f.stopTask()
+	d, out := newTestDrainer(t, f.clients)
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+	if !strings.Contains(out.String(), "AuthorizationError") {
+		t.Errorf("log = %q, want the failed notification logged", out.String())
+	}
+}
+
+func TestDrainerHandleEventPutEvents(t *testing.T) {
+	t.Setenv("EVENT_BUS_NAME", "drains")
+	t.Setenv("MAX_DRAIN_SECONDS", "600")
+	ctx := context.Background()
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	for _, tt := range []struct {
+		name     string
+		stop     bool
+		wantType string
+	}{
+		{"completed", true, CompletionTypeDrained},
+		{"timed out", false, CompletionTypeTimedOut},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestDrainFixture()
+			bus := &fakeEventBridge{}
+			f.clients.eventbridge = bus
+			d, _ := newTestDrainer(t, f.clients)
+			d = d.withClock(clock)
+
+			evt, err := d.handleEvent(ctx, testEvent(t, f.detail))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock.advance(601 * time.Second)
+			if tt.stop {
+				f.stopTask()
+			}
+			if _, err = d.handleEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(bus.entries) != 1 {
+				t.Fatalf("entries = %v, want one", bus.entries)
+			}
+			entry := bus.entries[0]
+			if aws.StringValue(entry.EventBusName) != "drains" || aws.StringValue(entry.Source) != CompletionEventSource ||
+				aws.StringValue(entry.DetailType) != CompletionEventDetailType {
+				t.Errorf("entry = %v, want a %q event on drains", entry, CompletionEventDetailType)
+			}
+			var payload CompletionPayload
+			if err := json.Unmarshal([]byte(aws.StringValue(entry.Detail)), &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Type != tt.wantType || payload.ClusterName != "default" || payload.EC2InstanceId != "i-1" ||
+				payload.AutoScalingGroupName != "asg" || payload.Outcome == "" || payload.DrainDurationSeconds != 601 {
+				t.Errorf("detail = %+v, want the %s drain of i-1 after 601 seconds", payload, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainPutEventsFailure(t *testing.T) {
+	t.Setenv("EVENT_BUS_NAME", "drains")
+	f := newTestDrainFixture()
+	f.clients.eventbridge = &fakeEventBridge{failedEntryCode: "ThrottlingException"}
+	f.stopTask()
+	d, out := newTestDrainer(t, f.clients)
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+	if !strings.Contains(out.String(), "ThrottlingException") {
+		t.Errorf("log = %q, want the failed entry logged", out.String())
+	}
+}
+
+// fakeNotifier records the payloads it is sent and fails with err.
+type fakeNotifier struct {
+	payloads []*CompletionPayload
+	err      error
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, payload *CompletionPayload) error {
+	n.payloads = append(n.payloads, payload)
+	return n.err
+}
+
+func TestMultiNotifier(t *testing.T) {
+	first, failing, last := &fakeNotifier{}, &fakeNotifier{err: errors.New("webhook responded 500")}, &fakeNotifier{}
+	notifier := multiNotifier{"first": first, "failing": failing, "last": last}
+	payload := &CompletionPayload{Type: CompletionTypeDrained}
+
+	err := notifier.Notify(context.Background(), payload)
+	if err == nil || err.Error() != "failed to notify failing: webhook responded 500" {
+		t.Errorf("Notify() = %v, want the failing sink named", err)
+	}
+	// The failing sink does not keep the event from the others.
+	for name, n := range map[string]*fakeNotifier{"first": first, "failing": failing, "last": last} {
+		if len(n.payloads) != 1 || n.payloads[0] != payload {
+			t.Errorf("%s payloads = %v, want the event", name, n.payloads)
+		}
+	}
+}
+
+func TestDrainerDrainNotifiers(t *testing.T) {
+	t.Setenv("NOTIFIERS", "log,sns")
+	t.Setenv("NOTIFY_SNS_TOPIC_ARN", testTopicArn)
+	f := newTestDrainFixture()
+	topic := &fakeSNS{}
+	f.clients.sns = topic
+	d, out := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	// With `NOTIFIERS`, the started drain is sent to every sink as well.
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.stopTask()
+	topic.fail("Publish", errors.New("AuthorizationError"))
+	if _, err := d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := publishedPayloads(t, topic); len(got) != 1 || got[0].Type != CompletionTypeStarted {
+		t.Errorf("published = %+v, want the started drain only", got)
+	}
+	var logged []string
+	for _, line := range logLines(t, out) {
+		if line["msg"] == "drain event" {
+			notification, _ := line["notification"].(map[string]interface{})
+			logged = append(logged, fmt.Sprint(notification["Type"]))
+		}
+	}
+	if want := []string{CompletionTypeStarted, CompletionTypeDrained}; fmt.Sprint(logged) != fmt.Sprint(want) {
+		t.Errorf("logged events = %v, want %v despite the failed SNS notification", logged, want)
+	}
+	if !strings.Contains(out.String(), "failed to notify sns: AuthorizationError") {
+		t.Errorf("log = %q, want the failed sink logged", out.String())
+	}
+}
@@ -0,0 +1,36 @@
+package drainer
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// isObserverMode reports whether `OBSERVER_MODE` is enabled, in which case the instance is drained as usual
+// but the lifecycle action is left to another system, e.g. the one being migrated off.
+func (d *Drainer) isObserverMode() bool {
+	return d.config.ObserverMode
+}
+
+type observerAutoscaling struct {
+	autoscalingAPI
+	logger *logger
+}
+
+func (c observerAutoscaling) CompleteLifecycleActionWithContext(_ aws.Context,
+	input *autoscaling.CompleteLifecycleActionInput, _ ...request.Option,
+) (*autoscaling.CompleteLifecycleActionOutput, error) {
+	c.logger.infof("observer: would complete the lifecycle action %q of %q in %q with %s",
+		aws.StringValue(input.LifecycleActionToken), aws.StringValue(input.LifecycleHookName),
+		aws.StringValue(input.AutoScalingGroupName), aws.StringValue(input.LifecycleActionResult))
+	return &autoscaling.CompleteLifecycleActionOutput{}, nil
+}
+
+func (c observerAutoscaling) RecordLifecycleActionHeartbeatWithContext(_ aws.Context,
+	input *autoscaling.RecordLifecycleActionHeartbeatInput, _ ...request.Option,
+) (*autoscaling.RecordLifecycleActionHeartbeatOutput, error) {
+	c.logger.infof("observer: would record a heartbeat of the lifecycle action %q of %q in %q",
+		aws.StringValue(input.LifecycleActionToken), aws.StringValue(input.LifecycleHookName),
+		aws.StringValue(input.AutoScalingGroupName))
+	return &autoscaling.RecordLifecycleActionHeartbeatOutput{}, nil
+}
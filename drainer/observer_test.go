@@ -0,0 +1,50 @@
+package drainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDrainerObserverMode(t *testing.T) {
+	t.Setenv("OBSERVER_MODE", "true")
+	t.Setenv("ENABLE_AUDIT_LOG", "true")
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the draining instance", detail)
+	}
+	if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != "DRAINING" {
+		t.Errorf("status = %q, want the instance drained as usual", got)
+	}
+
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait || !detail.Result.Observer {
+		t.Fatalf("Drain() = %+v, want an observed completion", detail)
+	}
+	for _, operation := range []string{"CompleteLifecycleAction", "RecordLifecycleActionHeartbeat"} {
+		if got := f.autoscaling.count(operation); got != 0 {
+			t.Errorf("%s calls = %d, want none in observer mode", operation, got)
+		}
+	}
+	if actions := detail.Decision.Actions; len(actions) == 0 || actions[len(actions)-1] != DecisionActionObserve {
+		t.Errorf("actions = %q, want to end with %q", actions, DecisionActionObserve)
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, "audit: autoscaling:") && !strings.Contains(line, `"Observer":true`) {
+			t.Errorf("audit line = %s, want the suppressed call marked as observed", line)
+		}
+	}
+	if !strings.Contains(out.String(), "audit: autoscaling:CompleteLifecycleAction") {
+		t.Errorf("log = %q, want the suppressed completion audited", out.String())
+	}
+}
@@ -0,0 +1,79 @@
+package drainer
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	DrainOutcomeComplete  = "complete"
+	DrainOutcomeAbandoned = "abandoned"
+	DrainOutcomeForced    = "forced"
+)
+
+func drainOutcome(detail *CloudWatchEventDetail, result string) string {
+	switch {
+	case result == LifecycleActionResultAbandon:
+		return DrainOutcomeAbandoned
+	case detail.ForceStopped:
+		return DrainOutcomeForced
+	default:
+		return DrainOutcomeComplete
+	}
+}
+
+// outcomeResult returns the lifecycle action result for how the drain ended: `RESULT_FORCED` for a drain that
+// timed out or stopped tasks, and `RESULT_SUCCESS` for the others. When the variable is unset, result is kept.
+func (d *Drainer) outcomeResult(detail *CloudWatchEventDetail, result string, timedOut bool) string {
+	override := d.config.ResultSuccess
+	if timedOut || detail.ForceStopped {
+		override = d.config.ResultForced
+	}
+	if override == "" {
+		return result
+	}
+	return override
+}
+
+// alertAbandoned sends the completion of an abandoned drain to the escalation destinations as well,
+// because the instance was terminated without its tasks moving off. Alerts are best-effort.
+func (d *Drainer) alertAbandoned(ctx context.Context, clients *awsClients, payload *CompletionPayload) {
+	d.logger.errorf("drain of %q in %q was abandoned", payload.EC2InstanceId, payload.ClusterName)
+	if topicArn := d.config.EscalationSNSTopicArn; topicArn != "" {
+		if err := publishSNS(ctx, clients.sns, topicArn, payload); err != nil {
+			d.logger.warnf("failed to publish the abandoned drain: %v", err)
+		}
+	}
+	if url := d.config.EscalationWebhookURL; url != "" {
+		if err := d.postWebhook(ctx, clients, url, payload); err != nil {
+			d.logger.warnf("failed to post the abandoned drain webhook: %v", err)
+		}
+	}
+}
+
+// tagDrainOutcome tags the instance with how, when and how long it was drained for post-hoc analysis.
+// The instance may already be gone, so failures are only logged, and the call is bounded by finalCallTimeout
+// so as not to hold the completion back.
+func (d *Drainer) tagDrainOutcome(ctx context.Context, svc ec2API, detail *CloudWatchEventDetail, result string) {
+	ctx, cancel := context.WithTimeout(ctx, finalCallTimeout)
+	defer cancel()
+	now := d.clock.Now()
+	duration := now.Sub(*detail.DrainStartedAt)
+	_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{&detail.EC2InstanceId},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("DrainOutcome"), Value: aws.String(drainOutcome(detail, result))},
+			{Key: aws.String("DrainCompletedAt"), Value: aws.String(now.UTC().Format(time.RFC3339))},
+			{Key: aws.String("DrainDurationSeconds"), Value: aws.String(strconv.Itoa(int(duration.Seconds())))},
+		},
+	})
+	if isInstanceNotFound(err) {
+		d.logger.infof("instance %q is already gone, skipping the drain outcome tags", detail.EC2InstanceId)
+	} else if err != nil {
+		d.logger.warnf("failed to tag the drain outcome: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package drainer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainerTagDrainOutcome(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		result       string
+		forceStopped bool
+		want         string
+	}{
+		{"complete", LifecycleActionResultContinue, false, DrainOutcomeComplete},
+		{"forced", LifecycleActionResultContinue, true, DrainOutcomeForced},
+		{"abandoned", LifecycleActionResultAbandon, true, DrainOutcomeAbandoned},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			startedAt := clock.Now()
+			f.detail.DrainStartedAt = &startedAt
+			f.detail.ForceStopped = tt.forceStopped
+			clock.advance(90 * time.Second)
+
+			d.tagDrainOutcome(context.Background(), f.ec2, f.detail, tt.result)
+			tags := f.ec2.tags["i-1"]
+			if got := tags["DrainOutcome"]; got != tt.want {
+				t.Errorf("DrainOutcome = %q, want %q", got, tt.want)
+			}
+			if got := tags["DrainDurationSeconds"]; got != "90" {
+				t.Errorf("DrainDurationSeconds = %q, want 90", got)
+			}
+			if got := tags["DrainCompletedAt"]; got != "2020-01-02T03:05:35Z" {
+				t.Errorf("DrainCompletedAt = %q, want the time of the completion", got)
+			}
+		})
+	}
+}
+
+func TestDrainerTagDrainOutcomeInstanceGone(t *testing.T) {
+	t.Setenv("TAG_DRAIN_OUTCOME", "true")
+	f := newTestDrainFixture()
+	f.stopTask()
+	f.ec2.fail("CreateTags", f.ec2.instanceNotFound("i-1"))
+	d, out := newTestDrainer(t, f.clients)
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Fatalf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+	if !strings.Contains(out.String(), "already gone") || strings.Contains(out.String(), "failed to tag") {
+		t.Errorf("log = %q, want the gone instance skipped without a warning", out.String())
+	}
+}
+
+func TestDrainerHandleEventOutcomeResult(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		forced bool
+		want   string
+	}{
+		{"success", false, LifecycleActionResultContinue},
+		{"forced", true, LifecycleActionResultAbandon},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RESULT_SUCCESS", LifecycleActionResultContinue)
+			t.Setenv("RESULT_FORCED", LifecycleActionResultAbandon)
+			t.Setenv("MAX_DRAIN_SECONDS", "600")
+			t.Setenv("FORCE_STOP_ON_DRAIN_TIMEOUT", "true")
+			t.Setenv("ENABLE_METRICS", "true")
+			t.Setenv("ESCALATION_SNS_TOPIC_ARN", testTopicArn)
+			f := newTestDrainFixture()
+			cw, topic := &fakeCloudWatch{}, &fakeSNS{}
+			f.clients.cloudwatch, f.clients.sns = cw, topic
+			d, out := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			ctx := context.Background()
+
+			evt, err := d.handleEvent(ctx, testEvent(t, f.detail))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.forced {
+				clock.advance(601 * time.Second)
+			} else {
+				f.stopTask()
+			}
+			if _, err = d.handleEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("completions = %v, want [%s]", got, tt.want)
+			}
+
+			// Only the abandoned drain is alerted.
+			abandoned := len(cw.metrics("DrainAbandoned"))
+			alerts := publishedPayloads(t, topic)
+			logged := strings.Contains(out.String(), "was abandoned")
+			if tt.forced {
+				if abandoned != 1 || len(alerts) != 1 || alerts[0].Outcome != DrainOutcomeAbandoned || !logged {
+					t.Errorf("DrainAbandoned metrics = %d, alerts = %+v, logged = %v, want the abandoned drain alerted",
+						abandoned, alerts, logged)
+				}
+			} else if abandoned != 0 || len(alerts) != 0 || logged {
+				t.Errorf("DrainAbandoned metrics = %d, alerts = %+v, logged = %v, want no alert", abandoned, alerts, logged)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainTagDrainOutcomeOption(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"true", map[string]string{
+			"DrainOutcome":         DrainOutcomeComplete,
+			"DrainCompletedAt":     "2020-01-02T03:05:05Z",
+			"DrainDurationSeconds": "60",
+		}},
+	} {
+		t.Run("TAG_DRAIN_OUTCOME="+tt.env, func(t *testing.T) {
+			t.Setenv("TAG_DRAIN_OUTCOME", tt.env)
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			ctx := context.Background()
+
+			detail, err := d.Drain(ctx, f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock.advance(time.Minute)
+			f.stopTask()
+			if _, err := d.Drain(ctx, detail); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for key, value := range f.ec2.tags["i-1"] {
+				if strings.HasPrefix(key, "Drain") {
+					got[key] = value
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
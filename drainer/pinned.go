@@ -0,0 +1,88 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	PinnedTaskActionWait    = "wait"
+	PinnedTaskActionStop    = "stop"
+	PinnedTaskActionAbandon = "abandon"
+)
+
+// handlePinnedTasks applies `PINNED_TASK_ACTION` to running tasks that a `memberOf` placement constraint ties to
+// the instance, because ECS can never reschedule them elsewhere. It returns true when the lifecycle action
+// should be abandoned.
+func (d *Drainer) handlePinnedTasks(ctx context.Context, svc *ecsClient, clusterName string,
+	containerInstanceArn *string,
+	detail *CloudWatchEventDetail, action string) (bool, error) {
+	switch action {
+	case PinnedTaskActionWait, PinnedTaskActionStop, PinnedTaskActionAbandon:
+	default:
+		return false, fmt.Errorf("`PINNED_TASK_ACTION` is %q, not one of wait, stop or abandon", action)
+	}
+
+	instanceID := detail.EC2InstanceId
+	pinned, err := findPinnedTasks(ctx, svc, clusterName, containerInstanceArn, instanceID)
+	if err != nil || len(pinned) == 0 {
+		return false, err
+	}
+
+	for _, task := range pinned {
+		d.logger.warnf("task %q is pinned to %q by a memberOf placement constraint; action is %s",
+			aws.StringValue(task.TaskArn), instanceID, action)
+		if action != PinnedTaskActionStop {
+			continue
+		}
+		reason := fmt.Sprintf("ecs-auto-draining: task is pinned to %s which is terminating", instanceID)
+		stopped, err := d.stopTask(ctx, svc, clusterName, task, reason)
+		if err != nil {
+			return false, err
+		}
+		if stopped {
+			detail.ForceStopped = true
+		}
+	}
+	return action == PinnedTaskActionAbandon, nil
+}
+
+func findPinnedTasks(ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string,
+	instanceID string) ([]*ecs.Task, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return nil, err
+	}
+
+	taskDefinitions, err := describeTaskDefinitions(ctx, svc, tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	var pinned []*ecs.Task
+	for _, task := range tasks {
+		taskDefinition := taskDefinitions[aws.StringValue(task.TaskDefinitionArn)]
+		if isPinnedTo(taskDefinition.PlacementConstraints, instanceID) {
+			pinned = append(pinned, task)
+		}
+	}
+	return pinned, nil
+}
+
+func isPinnedTo(constraints []*ecs.TaskDefinitionPlacementConstraint, instanceID string) bool {
+	for _, constraint := range constraints {
+		if aws.StringValue(constraint.Type) == ecs.TaskDefinitionPlacementConstraintTypeMemberOf &&
+			strings.Contains(aws.StringValue(constraint.Expression), instanceID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package drainer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerDrainPinnedTask(t *testing.T) {
+	for _, tt := range []struct {
+		action          string
+		wantStopped     int
+		wantWait        bool
+		wantCompletions []string
+	}{
+		{PinnedTaskActionWait, 0, true, nil},
+		{PinnedTaskActionStop, 1, true, nil},
+		{PinnedTaskActionAbandon, 0, false, []string{LifecycleActionResultAbandon}},
+	} {
+		t.Run(tt.action, func(t *testing.T) {
+			t.Setenv("PINNED_TASK_ACTION", tt.action)
+			f := newTestDrainFixture()
+			f.ecs.addTask("default", "task-2", f.containerInstance, "free")
+			f.ecs.stateMu.Lock()
+			f.ecs.taskDefinitions[testTaskDefinitionArn("web")].PlacementConstraints = []*ecs.TaskDefinitionPlacementConstraint{{
+				Type:       aws.String(ecs.TaskDefinitionPlacementConstraintTypeMemberOf),
+				Expression: aws.String("ec2InstanceId == i-1"),
+			}}
+			f.ecs.stateMu.Unlock()
+			d, out := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.ecs.count("StopTask"); got != tt.wantStopped {
+				t.Errorf("StopTask calls = %d, want %d of the pinned task", got, tt.wantStopped)
+			}
+			if detail.Wait != tt.wantWait {
+				t.Errorf("Wait = %v, want %v", detail.Wait, tt.wantWait)
+			}
+			if got := f.autoscaling.completedResults(); !reflect.DeepEqual(got, tt.wantCompletions) {
+				t.Errorf("completions = %v, want %v", got, tt.wantCompletions)
+			}
+			if got := strings.Count(out.String(), "memberOf placement constraint"); got != 1 {
+				t.Errorf("log = %q, want only the pinned task logged with its constraint", out.String())
+			}
+		})
+	}
+}
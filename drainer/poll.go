@@ -0,0 +1,807 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// poll makes one drain decision and returns the event with `detail.Wait` for the Step Functions loop. When it fails
+// holding a drain lease, it also returns the event with the `LeaseKey` of the lease.
+func (d *Drainer) poll(ctx context.Context, evt *events.CloudWatchEvent) (*events.CloudWatchEvent, error) {
+	d.logEvent(evt)
+
+	strict := d.config.StrictTransition
+	if evt.DetailType != DetailTypeTerminateLifecycle && (strict || evt.DetailType != DetailTypeLaunchLifecycle) {
+		return nil, fmt.Errorf("`detail-type` is %q, not %q: %w",
+			evt.DetailType, DetailTypeTerminateLifecycle, ErrNotTerminateEvent)
+	}
+
+	var evtDetail *CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &evtDetail); err != nil {
+		return nil, err
+	}
+	if evtDetail == nil {
+		return nil, fmt.Errorf("`detail` is empty: %w", ErrInvalidEventDetail)
+	}
+
+	if evtDetail.EC2InstanceId == "" && evtDetail.ContainerInstanceArn == "" {
+		instanceID, err := getInstanceIDFromResources(evt.Resources)
+		if err != nil {
+			return nil, err
+		}
+		evtDetail.EC2InstanceId = instanceID
+	}
+
+	ret, err := d.pollDetail(ctx, evt, evtDetail)
+	if err != nil && evtDetail.LeaseKey != "" {
+		// The updated detail goes along with the error, so that the lease taken before the failure is released
+		// when the lifecycle action is completed on the error.
+		failed := *evt
+		if raw, merr := json.Marshal(evtDetail); merr == nil {
+			failed.Detail = raw
+			return &failed, err
+		}
+	}
+	return ret, err
+}
+
+// pollDetail makes the drain decision of poll for the parsed detail of evt.
+func (d *Drainer) pollDetail(ctx context.Context, evt *events.CloudWatchEvent,
+	evtDetail *CloudWatchEventDetail) (*events.CloudWatchEvent, error) {
+	lg := d.logger.with(logFields{"instanceId": evtDetail.instanceKey(), "asg": evtDetail.AutoScalingGroupName})
+
+	if evtDetail.LifecycleTransition != LifecycleTransitionTerminating {
+		if d.config.StrictTransition {
+			return nil, fmt.Errorf("`LifecycleTransition` is %q, not %q: %w",
+				evtDetail.LifecycleTransition, LifecycleTransitionTerminating, ErrNotTerminateEvent)
+		}
+		return d.completeNonTerminating(ctx, lg, evt, evtDetail)
+	}
+	if err := evtDetail.validate(); err != nil {
+		return nil, err
+	}
+
+	behavior := d.config.hookBehavior(evtDetail.LifecycleHookName)
+	if behavior == HookBehaviorSkip {
+		lg.infof("lifecycle hook %q is configured to be skipped", evtDetail.LifecycleHookName)
+		evtDetail.Wait = false
+		return returnDetail(evt, evtDetail)
+	}
+
+	clients := d.newClients(evt)
+	if clients.apiCalls != nil {
+		defer d.emitAPICalls(ctx, clients.apiCalls)
+	}
+
+	p := &drainPoll{
+		d:        d,
+		lg:       lg,
+		clients:  clients,
+		evt:      evt,
+		detail:   evtDetail,
+		behavior: behavior,
+		timings:  phaseTimings{},
+		result:   d.config.LifecycleActionResult,
+	}
+	for _, step := range []func(context.Context) (*events.CloudWatchEvent, error){
+		p.checkInstance,
+		p.resolveCluster,
+		p.resolveContainerInstance,
+		p.resumeDrainState,
+		p.startDraining,
+		p.countRemainingTasks,
+		p.decide,
+	} {
+		if ret, err := step(ctx); ret != nil || err != nil {
+			return ret, err
+		}
+	}
+	return p.finish(ctx)
+}
+
+// drainPoll is the state of one drain decision, which its steps build up in order. A step returning an event or
+// an error ends the poll with it, e.g. after completing the lifecycle action without draining.
+type drainPoll struct {
+	d        *Drainer
+	lg       *logger
+	clients  *awsClients
+	evt      *events.CloudWatchEvent
+	detail   *CloudWatchEventDetail
+	behavior string
+	timings  phaseTimings
+
+	clusterName string
+	ecsSvc      *ecsClient
+	// containerInstance drives the decision; extraContainerInstances, left by extra agents, are only drained
+	// and their task counts added.
+	containerInstance       *ecs.ContainerInstance
+	extraContainerInstances []*ecs.ContainerInstance
+	dimensions              []*cloudwatch.Dimension
+	decision                *DecisionRecord
+
+	protected int64
+	remaining int64
+	exists    bool
+	result    string
+	timedOut  bool
+	drainPath string
+}
+
+func (p *drainPoll) completeWithoutDraining(ctx context.Context) (*events.CloudWatchEvent, error) {
+	return p.d.completeWithoutDraining(ctx, p.clients, p.evt, p.detail, LifecycleActionResultContinue)
+}
+
+func (p *drainPoll) putMetric(ctx context.Context, name string, value float64, unit string) {
+	p.d.putMetric(ctx, p.clients, p.dimensions, name, value, unit)
+}
+
+// checkInstance validates the hook and skips the instances that flap or are already terminating or stopped.
+func (p *drainPoll) checkInstance(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail := p.d, p.detail
+	if d.config.ValidateHook {
+		if err := d.validateLifecycleHook(ctx, p.clients.autoscaling, detail); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.config.AbsorbFlapping && !detail.isExternal() {
+		skip, err := d.absorbFlapping(ctx, p.clients.autoscaling, detail)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return returnDetail(p.evt, detail)
+		}
+	}
+
+	// Looking up an instance that EC2 is already terminating is pointless; its tasks are gone with it.
+	if d.config.SkipTerminating && !detail.isExternal() {
+		state, err := getInstanceStatusState(ctx, p.clients.ec2, detail.EC2InstanceId)
+		switch {
+		case isInstanceNotFound(err), err == nil && isTerminating(state):
+			p.lg.infof("instance is already terminating (%s), completing without draining", state)
+			return p.completeWithoutDraining(ctx)
+		case isAccessDenied(err):
+			p.lg.warnf("EC2 access is unavailable, skipping the instance status: %v", err)
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	if d.config.SkipStopped && !detail.isExternal() {
+		state, err := getInstanceState(ctx, p.clients.ec2, detail.EC2InstanceId)
+		if err != nil {
+			return nil, err
+		}
+		if isStopped(state) {
+			p.lg.infof("instance is %s, completing without draining", state)
+			return p.completeWithoutDraining(ctx)
+		}
+	}
+	return nil, nil
+}
+
+// resolveCluster finds the cluster of the instance, completing without draining when it is not one to drain.
+func (p *drainPoll) resolveCluster(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail := p.d, p.detail
+	start := d.clock.Now()
+	// The cluster resolved by a previous iteration, or given in the detail as a name or an ARN, is reused.
+	// That of an external instance is also in its container instance ARN.
+	switch {
+	case detail.ClusterName != "":
+		p.clusterName = clusterNameFromARN(detail.ClusterName)
+	case detail.isExternal():
+		p.clusterName = clusterNameFromContainerInstanceArn(detail.ContainerInstanceArn)
+	default:
+		err := d.traceSubsegment(ctx, "getECSClusterName", func(ctx context.Context) (err error) {
+			p.clusterName, err = d.getECSClusterName(ctx, p.clients, p.evt, detail.EC2InstanceId)
+			return err
+		})
+		if isInstanceNotFound(err) {
+			p.lg.warnf("instance is already gone, completing: %v", err)
+			return p.completeWithoutDraining(ctx)
+		}
+		if err != nil {
+			return d.handleResolutionFailure(ctx, p.lg, p.clients, p.evt, detail, err)
+		}
+	}
+	p.timings.add(PhaseClusterResolution, d.elapsedSince(start))
+	if !d.isClusterPermitted(p.clusterName) {
+		p.lg.infof("cluster %q is not managed by this function, completing without draining", p.clusterName)
+		return p.completeWithoutDraining(ctx)
+	}
+
+	p.ecsSvc = p.clients.ecs
+	// A cluster being deleted fails the ECS calls, which would leave the instance waiting for the hook timeout.
+	if d.config.CompleteOnInactive {
+		inactive, err := isClusterInactive(ctx, p.ecsSvc, p.clusterName)
+		switch {
+		case err != nil:
+			p.lg.warnf("failed to describe cluster %q, draining anyway: %v", p.clusterName, err)
+		case inactive:
+			p.lg.infof("cluster %q is inactive, completing without draining", p.clusterName)
+			return p.completeWithoutDraining(ctx)
+		}
+	}
+	return nil, nil
+}
+
+// resolveContainerInstance finds the container instances of the instance in the cluster.
+func (p *drainPoll) resolveContainerInstance(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail := p.d, p.detail
+	var containerInstances []*ecs.ContainerInstance
+	start := d.clock.Now()
+	err := d.traceSubsegment(ctx, "getContainerInstance", func(ctx context.Context) (err error) {
+		if detail.isExternal() {
+			containerInstances, err = d.describeExternalContainerInstance(ctx, p.ecsSvc, p.clusterName, detail)
+			return err
+		}
+		p.clusterName, containerInstances, err = d.resolveContainerInstances(
+			ctx, p.ecsSvc, p.clusterName, detail.EC2InstanceId)
+		return err
+	})
+	p.timings.add(PhaseContainerInstance, d.elapsedSince(start))
+	if err != nil {
+		return nil, err
+	}
+	detail.ClusterName = p.clusterName
+	// The instance may never have joined ECS, e.g. in an Auto Scaling group mixing ECS and other instances.
+	if len(containerInstances) == 0 {
+		if !d.config.CompleteOnNoInstance {
+			return nil, fmt.Errorf("%q does not have %q: %w",
+				p.clusterName, detail.instanceKey(), ErrNoContainerInstance)
+		}
+		p.lg.infof("%q does not have the instance, completing without draining", p.clusterName)
+		return p.completeWithoutDraining(ctx)
+	}
+	p.containerInstance, p.extraContainerInstances = containerInstances[0], containerInstances[1:]
+	p.lg = p.lg.with(logFields{"cluster": p.clusterName})
+	p.dimensions = metricDimensions(p.clusterName, detail.AutoScalingGroupName)
+	if p.ecsSvc.scannedPages > 0 {
+		p.putMetric(ctx, "ContainerInstancesScanned", float64(p.ecsSvc.scannedArns), cloudwatch.StandardUnitCount)
+	}
+
+	// Capacity providers with managed termination protection drain their instances themselves.
+	if provider := aws.StringValue(p.containerInstance.CapacityProviderName); provider != "" {
+		switch mode := d.config.RespectManaged; mode {
+		case "":
+		case ManagedTerminationComplete:
+			p.lg.infof("instance is managed by capacity provider %q, completing without draining", provider)
+			return p.completeWithoutDraining(ctx)
+		case ManagedTerminationObserve:
+			p.behavior = HookBehaviorHeartbeatOnly
+		default:
+			return nil, fmt.Errorf("`RESPECT_MANAGED_TERMINATION` is %q, not one of %s or %s",
+				mode, ManagedTerminationComplete, ManagedTerminationObserve)
+		}
+	}
+
+	p.decision = d.newDecisionRecord(p.evt.Time, p.clusterName, p.containerInstance)
+	return nil, nil
+}
+
+// resumeDrainState starts the drain, or resumes it from `STATE_TABLE`, unless another invocation completed it.
+func (p *drainPoll) resumeDrainState(ctx context.Context) (*events.CloudWatchEvent, error) {
+	// The start time survives re-invocations through the event detail.
+	if p.detail.DrainStartedAt == nil {
+		now := p.d.clock.Now()
+		p.detail.DrainStartedAt = &now
+	}
+
+	status, err := p.d.resumeDrainState(ctx, p.clients, p.detail)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case DrainStatusCompleted:
+		p.lg.infof("lifecycle action was already completed by another invocation")
+		p.detail.Wait = false
+		return returnDetail(p.evt, p.detail)
+	case DrainStatusSuperseded:
+		// Unlike ABANDON, CONTINUE leaves the hook of the recent lifecycle action waiting for its drain.
+		p.lg.warnf("lifecycle action is superseded by a more recent one of the instance, completing it with %s",
+			LifecycleActionResultContinue)
+		return p.completeWithoutDraining(ctx)
+	}
+	return nil, nil
+}
+
+// startDraining sets the container instances to DRAINING, unless the drain is held back.
+func (p *drainPoll) startDraining(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail := p.d, p.detail
+	// With heartbeat-only, draining is left to capacity provider managed draining.
+	if aws.StringValue(p.containerInstance.Status) != ecs.ContainerInstanceStatusDraining &&
+		p.behavior != HookBehaviorHeartbeatOnly {
+		// With `MAX_CONCURRENT_DRAINING`, the drain is held back while too many instances of the cluster are
+		// draining, and with `MAX_DRAINING_PER_AZ`, while too many of its availability zone are, which is evaluated
+		// again on every poll.
+		held, err := d.holdsDrainBack(ctx, p.lg, p.clients, p.ecsSvc, p.clusterName, p.containerInstance, detail)
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			if err := d.heartbeat(ctx, p.clients.autoscaling, detail); err != nil {
+				return handleHeartbeatFailure(p.lg, p.evt, detail, err)
+			}
+			p.decision.addAction(DecisionActionHeartbeat)
+			detail.Wait = true
+			return returnDetail(p.evt, detail)
+		}
+
+		if ret, err := p.setDraining(ctx); ret != nil || err != nil {
+			return ret, err
+		}
+	}
+	for _, extra := range p.extraContainerInstances {
+		if *extra.Status != ecs.ContainerInstanceStatusDraining && p.behavior != HookBehaviorHeartbeatOnly {
+			p.lg.warnf("instance is also registered as %q, draining it too", aws.StringValue(extra.ContainerInstanceArn))
+			if err := d.setStateDraining(ctx, p.ecsSvc, p.clusterName, extra.ContainerInstanceArn); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// setDraining sets the container instance to DRAINING and gives ECS a moment to start stopping its tasks.
+func (p *drainPoll) setDraining(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail := p.d, p.detail
+	err := d.setStateDraining(ctx, p.ecsSvc, p.clusterName, p.containerInstance.ContainerInstanceArn)
+	if isContainerInstanceDeregistered(err) {
+		p.lg.infof("container instance was deregistered in the meantime, completing: %v", err)
+		return p.completeWithoutDraining(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.decision.addAction(DecisionActionDrain)
+	detail.DrainingSet = true
+	d.notifyDrain(ctx, p.clients, &CompletionPayload{
+		Type:                 CompletionTypeStarted,
+		ClusterName:          p.clusterName,
+		AutoScalingGroupName: detail.AutoScalingGroupName,
+		EC2InstanceId:        detail.EC2InstanceId,
+		RunningTasksCount:    aws.Int64Value(p.containerInstance.RunningTasksCount),
+	})
+
+	// ECS needs a moment to start stopping the tasks, so checking them right away would only see them running.
+	initialDelay := d.config.InitialDrainDelay
+	if deadline, ok := ctx.Deadline(); ok && d.remainingUntil(deadline)/2 < initialDelay {
+		initialDelay = d.remainingUntil(deadline) / 2
+	}
+	return nil, d.clock.Sleep(ctx, initialDelay)
+}
+
+// countRemainingTasks counts the tasks left on the container instances and decides whether they block the drain.
+func (p *drainPoll) countRemainingTasks(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d := p.d
+	arn := p.containerInstance.ContainerInstanceArn
+	// Tasks protected from scale-in are never stopped, and they keep the drain going until the protection ends.
+	if d.respectsTaskProtection() {
+		protected, err := d.checkTaskProtection(ctx, p.ecsSvc, p.clusterName, arn)
+		if err != nil {
+			return nil, err
+		}
+		p.protected = int64(protected)
+	}
+	if err := p.stopTasksOfOldAgent(ctx); err != nil {
+		return nil, err
+	}
+
+	// Draining goes on while more than `MIN_REMAINING_TASKS` tasks remain, so that a few low-priority tasks
+	// can be left behind.
+	minRemaining := int64(d.config.MinRemainingTasks)
+	var err error
+	switch {
+	case isDrainedByOthers(p.containerInstance, p.detail) && !d.filtersTasks():
+		// The counts of an instance that another actor drained are already fetched and need no extra `ListTasks`.
+		p.remaining = taskCounts(p.containerInstance)
+	case d.config.FastTaskCountCheck && !d.filtersTasks() && taskCounts(p.containerInstance) > minRemaining:
+		// Counts over the threshold mean the drain cannot complete yet; only a completion is confirmed by
+		// the detailed check.
+		p.remaining = taskCounts(p.containerInstance)
+	default:
+		start := d.clock.Now()
+		err = d.traceSubsegment(ctx, "taskExists", func(ctx context.Context) error {
+			count, err := d.checkTaskCount(ctx, p.ecsSvc, p.clusterName, arn)
+			p.remaining = int64(count)
+			return err
+		})
+		p.timings.add(PhaseTaskCheck, d.elapsedSince(start))
+		// A deregistered container instance has no tasks left to wait for.
+		if isContainerInstanceDeregistered(err) {
+			p.lg.infof("container instance was deregistered in the meantime: %v", err)
+			p.remaining, err = 0, nil
+		}
+	}
+	for _, extra := range p.extraContainerInstances {
+		p.remaining += taskCounts(extra)
+	}
+	// The tasks described are a lower bound, which settles the decision only if it already blocks draining.
+	if errors.Is(err, ErrIncompleteTaskDescribe) && p.remaining > minRemaining {
+		p.lg.warnf("deciding on the described tasks, which already block draining: %v", err)
+		err = nil
+	}
+	p.exists = p.remaining > minRemaining
+	if err != nil {
+		p.heartbeatOnTaskCheckError(ctx)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// heartbeatOnTaskCheckError keeps the lifecycle action alive with `HEARTBEAT_ON_TASK_CHECK_ERROR`, so that
+// a transient failure does not let the hook time out.
+func (p *drainPoll) heartbeatOnTaskCheckError(ctx context.Context) {
+	if !p.d.config.HeartbeatOnTaskCheckError {
+		return
+	}
+	if err := p.d.heartbeat(ctx, p.clients.autoscaling, p.detail); err != nil {
+		p.lg.errorf("heartbeat after task check failure failed: %v", err)
+		return
+	}
+	p.putMetric(ctx, "Heartbeats", 1, cloudwatch.StandardUnitCount)
+}
+
+// stopTasksOfOldAgent stops the tasks of very old agents, which do not honor DRAINING well.
+func (p *drainPoll) stopTasksOfOldAgent(ctx context.Context) error {
+	minVersion := p.d.config.MinAgentVersion
+	if minVersion == "" {
+		return nil
+	}
+	tooOld, err := isAgentOlderThan(p.containerInstance, minVersion)
+	if err != nil || !tooOld {
+		return err
+	}
+	reason := fmt.Sprintf("%s: ECS agent is older than %s", stopReason(p.detail), minVersion)
+	stopped, err := p.d.stopRunningTasks(ctx, p.ecsSvc, p.clusterName, p.containerInstance.ContainerInstanceArn, reason)
+	if err != nil {
+		return err
+	}
+	if stopped > 0 {
+		p.detail.ForceStopped = true
+	}
+	return nil
+}
+
+// waitForDependents keeps the drain going for what still depends on the instance once its tasks are gone.
+func (p *drainPoll) waitForDependents(ctx context.Context) error {
+	d, detail := p.d, p.detail
+	arn := p.containerInstance.ContainerInstanceArn
+	var err error
+	// With `WAIT_FOR_SERVICE_STEADY_STATE`, the drain completes only after the services that had tasks on the
+	// instance run them elsewhere, so that a lack of capacity does not leave them short.
+	if d.config.WaitForServiceSteady {
+		if p.remaining > 0 {
+			if detail.AffectedServices, err = collectAffectedServices(
+				ctx, p.ecsSvc, p.clusterName, arn, detail.AffectedServices); err != nil {
+				return err
+			}
+		}
+		if !p.exists {
+			steady, err := d.servicesSteady(ctx, p.ecsSvc, p.clusterName, detail.AffectedServices)
+			if err != nil {
+				return err
+			}
+			p.exists = !steady
+		}
+	}
+
+	// With `REQUIRE_STOPPED`, the drain completes only after every task seen on the instance has stopped.
+	if !p.exists && d.config.RequireStopped {
+		if detail.TrackedTaskArns, err = trackTasks(
+			ctx, p.ecsSvc, p.clusterName, arn, detail.TrackedTaskArns); err != nil {
+			return err
+		}
+		stopped, err := allTasksStopped(ctx, p.ecsSvc, p.clusterName, detail.TrackedTaskArns)
+		if err != nil {
+			return err
+		}
+		p.exists = !stopped
+	}
+
+	// Connections to the instance's targets may still be draining at the load balancer after the tasks are gone.
+	if !p.exists && d.config.WaitForTargets && !detail.isExternal() {
+		if p.exists, err = d.targetsDraining(ctx, p.clients.elbv2, detail.EC2InstanceId); err != nil {
+			return err
+		}
+	}
+	if p.remaining > 0 {
+		detail.TasksSeen = true
+	}
+	p.decision.TaskExists = p.exists
+	p.decision.RemainingTasksCount = p.remaining
+	p.putMetric(ctx, "RemainingTasks", float64(p.remaining), cloudwatch.StandardUnitCount)
+	p.putMetric(ctx, "RunningTasks",
+		float64(aws.Int64Value(p.containerInstance.RunningTasksCount)), cloudwatch.StandardUnitCount)
+	return nil
+}
+
+// handleBlockingTasks deals with the tasks blocking the drain: pinned ones, and after `FORCE_STOP_AFTER_SECONDS`
+// all of them, which are stopped so that the next poll sees them gone.
+func (p *drainPoll) handleBlockingTasks(ctx context.Context) error {
+	if !p.exists {
+		return nil
+	}
+	d, detail := p.d, p.detail
+	arn := p.containerInstance.ContainerInstanceArn
+	if action := d.config.PinnedTaskAction; action != "" {
+		abandon, err := d.handlePinnedTasks(ctx, p.ecsSvc, p.clusterName, arn, detail, action)
+		if err != nil {
+			return err
+		}
+		if abandon {
+			p.exists, p.result = false, LifecycleActionResultAbandon
+			return nil
+		}
+	}
+
+	if d.config.PreviewForceStop {
+		preview, err := d.previewForceStop(ctx, p.ecsSvc, p.clusterName, arn)
+		if err != nil {
+			return err
+		}
+		p.lg.log(LogLevelInfo, "previewed the tasks a force stop would stop", logFields{"tasks": preview})
+	}
+
+	forceStopAfter := d.config.ForceStopAfter
+	elapsed := d.elapsedSince(*detail.DrainStartedAt)
+	if forceStopAfter <= 0 || elapsed <= forceStopAfter {
+		return nil
+	}
+	// With `RESPECT_TASK_DRAIN_TAG`, the tasks get the longest drain grace they declare before being stopped.
+	if d.config.RespectTaskDrainTag {
+		grace, err := d.taskDrainGrace(ctx, p.ecsSvc, p.clusterName, arn)
+		if err != nil {
+			return err
+		}
+		if grace > forceStopAfter {
+			p.lg.infof("respecting the drain grace %s of the tasks before stopping them", grace)
+			if forceStopAfter = grace; elapsed <= forceStopAfter {
+				return nil
+			}
+		}
+	}
+	reason := fmt.Sprintf("%s did not drain within %s", stopReason(detail), forceStopAfter)
+	stopped, err := d.stopBlockingTasks(ctx, p.ecsSvc, p.clusterName, arn, reason)
+	if err != nil {
+		return err
+	}
+	if stopped > 0 {
+		p.lg.warnf("stopped %d tasks after draining for %s", stopped, elapsed)
+		detail.ForceStopped = true
+	}
+	return nil
+}
+
+// applyDrainLimits completes a drain that took too long, unless protected tasks or the `stopTimeout` of the tasks
+// stopped on the timeout keep it going.
+func (p *drainPoll) applyDrainLimits(ctx context.Context) error {
+	if err := p.applyDrainCeiling(ctx); err != nil {
+		return err
+	}
+	if err := p.applyDrainTimeout(ctx); err != nil {
+		return err
+	}
+
+	if p.protected > 0 && !p.exists {
+		p.lg.infof("%d tasks are protected from scale-in, keeping the drain going", p.protected)
+		p.exists = true
+	}
+
+	// Tasks stopped on the timeout still get their `stopTimeout` to shut down before the instance goes.
+	if p.timedOut {
+		grace, err := p.d.remainingStopTimeout(ctx, p.ecsSvc, p.clusterName, p.containerInstance.ContainerInstanceArn)
+		if err != nil {
+			return err
+		}
+		if grace > 0 {
+			p.lg.infof("waiting %s more for the stopping tasks to reach their stopTimeout", grace)
+			p.exists = true
+		}
+	}
+	return nil
+}
+
+// applyDrainCeiling abandons a drain that took longer than the drain ceiling.
+func (p *drainPoll) applyDrainCeiling(ctx context.Context) error {
+	if !p.exists {
+		return nil
+	}
+	maxDrain, err := p.d.maxDrainDuration(ctx, p.ecsSvc, p.clusterName, p.containerInstance.ContainerInstanceArn)
+	if err != nil {
+		return err
+	}
+	if elapsed := p.d.elapsedSince(*p.detail.DrainStartedAt); maxDrain > 0 && elapsed > maxDrain {
+		p.lg.warnf("draining has taken %s, exceeding the drain ceiling %s; abandoning", elapsed, maxDrain)
+		p.putMetric(ctx, "DrainTimedOut", 1, cloudwatch.StandardUnitCount)
+		p.timedOut = true
+		p.exists, p.result = false, LifecycleActionResultAbandon
+	}
+	return nil
+}
+
+// applyDrainTimeout completes a drain that took longer than `MAX_DRAIN_SECONDS`. Unlike the drain ceiling, it
+// completes with `TIMEOUT_LIFECYCLE_ACTION_RESULT`, CONTINUE by default.
+func (p *drainPoll) applyDrainTimeout(ctx context.Context) error {
+	d, detail := p.d, p.detail
+	drainTimeout := d.config.MaxDrain
+	if !p.exists || drainTimeout <= 0 {
+		return nil
+	}
+	elapsed := d.elapsedSince(*detail.DrainStartedAt)
+	if elapsed <= drainTimeout {
+		return nil
+	}
+	p.lg.warnf("draining has taken %s, exceeding `MAX_DRAIN_SECONDS` %s; completing", elapsed, drainTimeout)
+	if d.config.ForceStopOnDrainTimeout {
+		reason := fmt.Sprintf("%s timed out after %s", stopReason(detail), drainTimeout)
+		stopped, err := d.stopRunningTasks(ctx, p.ecsSvc, p.clusterName, p.containerInstance.ContainerInstanceArn, reason)
+		if err != nil {
+			return err
+		}
+		if stopped > 0 {
+			detail.ForceStopped = true
+		}
+	}
+	p.putMetric(ctx, "DrainTimedOut", 1, cloudwatch.StandardUnitCount)
+	p.timedOut = true
+	p.result = d.config.TimeoutLifecycleActionResult
+	p.exists = false
+	return nil
+}
+
+// decide keeps waiting for the drain or completes it, after weighing what else than the tasks holds it.
+func (p *drainPoll) decide(ctx context.Context) (*events.CloudWatchEvent, error) {
+	for _, step := range []func(context.Context) error{
+		p.waitForDependents,
+		p.handleBlockingTasks,
+		p.applyDrainLimits,
+	} {
+		if err := step(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if p.exists {
+		return p.keepWaiting(ctx)
+	}
+	return p.completeDrain(ctx)
+}
+
+// keepWaiting keeps the lifecycle action alive while the tasks drain.
+func (p *drainPoll) keepWaiting(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail := p.d, p.detail
+	arn := p.containerInstance.ContainerInstanceArn
+	d.resolveHeartbeatTimeout(ctx, p.clients.autoscaling, detail)
+	d.reportRemainingTasks(ctx, p.lg, p.clients, p.dimensions, p.ecsSvc, arn)
+	if err := d.escalate(ctx, p.clients, p.ecsSvc, p.clusterName, arn, detail); err != nil {
+		return nil, err
+	}
+	if err := d.keepDrainLease(ctx, p.lg, p.clients, p.clusterName, detail); err != nil {
+		return nil, err
+	}
+	start := d.clock.Now()
+	err := d.heartbeat(ctx, p.clients.autoscaling, detail)
+	p.timings.add(PhaseHeartbeat, d.elapsedSince(start))
+	if err != nil {
+		return handleHeartbeatFailure(p.lg, p.evt, detail, err)
+	}
+	p.putMetric(ctx, "Heartbeats", 1, cloudwatch.StandardUnitCount)
+	p.decision.addAction(DecisionActionHeartbeat)
+	detail.Wait = true
+	return nil, nil
+}
+
+// completeDrain completes the lifecycle action of the drained instance, unless another invocation does.
+func (p *drainPoll) completeDrain(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail := p.d, p.detail
+	first, err := d.markDrainCompleted(ctx, p.clients, detail)
+	if err != nil {
+		return nil, err
+	}
+	if !first {
+		p.lg.infof("lifecycle action is being completed by another invocation")
+		detail.Wait = false
+		return returnDetail(p.evt, detail)
+	}
+
+	p.putMetric(ctx, "DrainDurationSeconds", float64(p.decision.ElapsedSeconds), cloudwatch.StandardUnitSeconds)
+	// An instance that never had tasks to wait for was over-provisioned rather than drained.
+	p.drainPath = DrainPathFastComplete
+	if detail.TasksSeen {
+		p.drainPath = DrainPathDrainedWithTasks
+	}
+	p.putMetric(ctx, p.drainPath, 1, cloudwatch.StandardUnitCount)
+
+	// Give the metrics a moment to settle before the instance disappears.
+	if err := d.clock.Sleep(ctx, d.config.CompleteDelay); err != nil {
+		d.unmarkDrainCompleted(ctx, p.clients, detail)
+		return nil, err
+	}
+
+	p.result = d.outcomeResult(detail, p.result, p.timedOut)
+
+	if d.config.TagDrainOutcome && !detail.isExternal() {
+		d.tagDrainOutcome(ctx, p.clients.ec2, detail, p.result)
+	}
+
+	start := d.clock.Now()
+	err = d.complete(ctx, p.clients.autoscaling, detail, p.result)
+	p.timings.add(PhaseComplete, d.elapsedSince(start))
+	if err != nil {
+		d.unmarkDrainCompleted(ctx, p.clients, detail)
+		return nil, err
+	}
+	d.releaseDrainLease(ctx, p.clients, detail)
+	switch {
+	case d.isObserverMode():
+		p.decision.addAction(DecisionActionObserve)
+	case p.result == LifecycleActionResultAbandon:
+		p.decision.addAction(DecisionActionAbandon)
+	default:
+		p.decision.addAction(DecisionActionComplete)
+	}
+	detail.Wait = false
+	return nil, p.afterComplete(ctx)
+}
+
+// afterComplete deregisters the drained container instance and reports the completion.
+func (p *drainPoll) afterComplete(ctx context.Context) error {
+	d, detail := p.d, p.detail
+	if d.config.DeregisterAfterDrain && !p.decision.TaskExists {
+		d.deregisterContainerInstance(ctx, p.ecsSvc, p.clusterName, p.containerInstance.ContainerInstanceArn)
+	}
+
+	payload := d.newCompletionPayload(detail, p.clusterName, p.result)
+	payload.RunningTasksCount = p.decision.RunningTasksCount
+	if p.timedOut {
+		payload.Type = CompletionTypeTimedOut
+	}
+	d.notifyDrain(ctx, p.clients, payload)
+	if p.result == LifecycleActionResultAbandon {
+		p.putMetric(ctx, "DrainAbandoned", 1, cloudwatch.StandardUnitCount)
+		d.alertAbandoned(ctx, p.clients, payload)
+	}
+
+	if d.config.LogCompletionMarker {
+		return d.logCompletionMarker(detail, p.clusterName)
+	}
+	return nil
+}
+
+// finish records the decision in the detail, the log and the configured sinks, and returns the event to loop on.
+func (p *drainPoll) finish(ctx context.Context) (*events.CloudWatchEvent, error) {
+	d, detail, decision := p.d, p.detail, p.decision
+	completedResult := ""
+	if !detail.Wait {
+		completedResult = p.result
+	}
+	detail.Result = d.newDrainResult(p.clusterName, p.containerInstance, detail, completedResult)
+	detail.Result.RemainingTasks = p.remaining
+	detail.Result.TimingsMS = p.timings
+
+	fields := logFields{"taskCount": decision.RemainingTasksCount, "decision": decision, "timingsMs": p.timings}
+	if p.ecsSvc.scannedPages > 0 {
+		fields["scannedPages"], fields["scannedContainerInstances"] = p.ecsSvc.scannedPages, p.ecsSvc.scannedArns
+	}
+	if p.drainPath != "" {
+		fields["drainPath"] = p.drainPath
+	}
+	if detail.Result.Completed && detail.DrainStartedAt != nil {
+		fields["drainDurationSeconds"] = detail.Result.DrainDurationSeconds
+	}
+	p.lg.log(LogLevelInfo, "made a drain decision", fields)
+	detail.Decision = decision
+
+	d.writeTimestreamRecords(ctx, p.clients, detail, decision)
+	d.appendDecisionLog(ctx, p.clients, detail, decision)
+
+	return returnDetail(p.evt, detail)
+}
@@ -0,0 +1,53 @@
+package drainer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// maxGetTaskProtection is the maximum number of tasks that a GetTaskProtection call accepts.
+const maxGetTaskProtection = 10
+
+func (d *Drainer) respectsTaskProtection() bool {
+	return d.config.RespectTaskProtection
+}
+
+// checkTaskProtection records which running tasks on the container instance are protected from scale-in
+// and returns how many there are. Protection expires, so it is checked again on every poll.
+func (d *Drainer) checkTaskProtection(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) (int, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+
+	svc.protectedTasks = make(map[string]bool)
+	for _, chunk := range chunkArns(arns, maxGetTaskProtection) {
+		var output *ecs.GetTaskProtectionOutput
+		err := d.withRetry(ctx, "GetTaskProtection", func() (err error) {
+			output, err = svc.GetTaskProtectionWithContext(ctx, &ecs.GetTaskProtectionInput{
+				Cluster: &clusterName,
+				Tasks:   chunk,
+			})
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, task := range output.ProtectedTasks {
+			if d.isProtected(task) {
+				svc.protectedTasks[aws.StringValue(task.TaskArn)] = true
+			}
+		}
+	}
+	return len(svc.protectedTasks), nil
+}
+
+func (d *Drainer) isProtected(task *ecs.ProtectedTask) bool {
+	if !aws.BoolValue(task.ProtectionEnabled) {
+		return false
+	}
+	return task.ExpirationDate == nil || task.ExpirationDate.After(d.clock.Now())
+}
@@ -0,0 +1,81 @@
+package drainer
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerDrainRespectTaskProtection(t *testing.T) {
+	t.Setenv("RESPECT_TASK_PROTECTION", "true")
+	t.Setenv("FORCE_STOP_AFTER_SECONDS", "300")
+	f := newTestDrainFixture()
+	protected := f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+	f.ecs.protectedTasks[aws.StringValue(protected.TaskArn)] = true
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(301 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	// Only the unprotected task is stopped, and the protected one keeps the drain going.
+	if want := []string{aws.StringValue(f.task.TaskArn)}; fmt.Sprint(f.ecs.stoppedTasks) != fmt.Sprint(want) {
+		t.Errorf("stopped tasks = %v, want %v", f.ecs.stoppedTasks, want)
+	}
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(f.ecs.stoppedTasks) != 1 {
+		t.Fatalf("Drain() = %+v, stopped tasks = %v, want the protected task kept draining", detail,
+			f.ecs.stoppedTasks)
+	}
+
+	// Protection is checked again on every poll, so the task is stopped once it ends.
+	f.ecs.stateMu.Lock()
+	delete(f.ecs.protectedTasks, aws.StringValue(protected.TaskArn))
+	f.ecs.stateMu.Unlock()
+	if _, err := d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(f.ecs.stoppedTasks); got != 2 {
+		t.Errorf("stopped tasks = %v, want the task stopped after its protection ended", f.ecs.stoppedTasks)
+	}
+	if got := f.ecs.count("GetTaskProtection"); got != 4 {
+		t.Errorf("GetTaskProtection calls = %d, want one per poll", got)
+	}
+}
+
+func TestDrainerIsProtected(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	d, _ := newTestDrainer(t, newTestDrainFixture().clients)
+	d = d.withClock(newFakeClock(now))
+
+	for _, tt := range []struct {
+		name string
+		task *ecs.ProtectedTask
+		want bool
+	}{
+		{"disabled", &ecs.ProtectedTask{ProtectionEnabled: aws.Bool(false)}, false},
+		{"no expiration", &ecs.ProtectedTask{ProtectionEnabled: aws.Bool(true)}, true},
+		{"not expired", &ecs.ProtectedTask{ProtectionEnabled: aws.Bool(true),
+			ExpirationDate: aws.Time(now.Add(time.Minute))}, true},
+		{"expired", &ecs.ProtectedTask{ProtectionEnabled: aws.Bool(true),
+			ExpirationDate: aws.Time(now.Add(-time.Minute))}, false},
+	} {
+		if got := d.isProtected(tt.task); got != tt.want {
+			t.Errorf("isProtected(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package drainer
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// DrainResult is the outcome of a poll in `detail.Result` for consumers outside the Step Functions loop.
+// `Wait` mirrors `detail.Wait`, which the state machine keeps relying on. `DrainDurationSeconds` is set once completed.
+type DrainResult struct {
+	Cluster               string `json:",omitempty"`
+	ContainerInstanceArn  string `json:",omitempty"`
+	RunningTasks          int64
+	RemainingTasks        int64
+	Draining              bool
+	Wait                  bool
+	Completed             bool
+	LifecycleActionResult string `json:",omitempty"`
+	DrainDurationSeconds  int64  `json:",omitempty"`
+	DryRun                bool   `json:",omitempty"`
+	// Observer is set when the lifecycle action was left alone and `LifecycleActionResult` is what it would get.
+	Observer bool `json:",omitempty"`
+	// TimingsMS are the durations of the phases of the poll in milliseconds.
+	TimingsMS map[string]int64 `json:",omitempty"`
+}
+
+func (d *Drainer) newDrainResult(
+	clusterName string, containerInstance *ecs.ContainerInstance, detail *CloudWatchEventDetail, result string,
+) *DrainResult {
+	drainResult := &DrainResult{
+		Cluster:  clusterName,
+		Wait:     detail.Wait,
+		DryRun:   d.isDryRun(),
+		Observer: d.isObserverMode(),
+	}
+	if containerInstance != nil {
+		drainResult.ContainerInstanceArn = aws.StringValue(containerInstance.ContainerInstanceArn)
+		drainResult.RunningTasks = aws.Int64Value(containerInstance.RunningTasksCount)
+		drainResult.Draining = detail.DrainingSet ||
+			aws.StringValue(containerInstance.Status) == ecs.ContainerInstanceStatusDraining
+	}
+	if result != "" {
+		drainResult.Completed = true
+		drainResult.LifecycleActionResult = result
+		// `DrainStartedAt` round-trips through every iteration, so this covers the whole drain.
+		if detail.DrainStartedAt != nil {
+			drainResult.DrainDurationSeconds = int64(d.elapsedSince(*detail.DrainStartedAt) / time.Second)
+		}
+	}
+	return drainResult
+}
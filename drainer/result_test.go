@@ -0,0 +1,150 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDrainerDrainResult(t *testing.T) {
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+	arn := testContainerInstanceArn("default", "ci-1")
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DrainResult{
+		Cluster:              "default",
+		ContainerInstanceArn: arn,
+		RunningTasks:         1,
+		RemainingTasks:       1,
+		Draining:             true,
+		Wait:                 true,
+	}
+	if got := detail.Result; got == nil || got.TimingsMS == nil {
+		t.Fatalf("Result = %+v, want the result of the poll", got)
+	}
+	detail.Result.TimingsMS = nil
+	if !reflect.DeepEqual(*detail.Result, want) {
+		t.Errorf("Result = %+v, want %+v", *detail.Result, want)
+	}
+
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	detail.Result.TimingsMS = nil
+	want = DrainResult{
+		Cluster:               "default",
+		ContainerInstanceArn:  arn,
+		Draining:              true,
+		Completed:             true,
+		LifecycleActionResult: LifecycleActionResultContinue,
+	}
+	if !reflect.DeepEqual(*detail.Result, want) {
+		t.Errorf("Result = %+v, want %+v", *detail.Result, want)
+	}
+
+	// `Wait` is still in the detail for the state machine.
+	var raw map[string]interface{}
+	b, err := json.Marshal(detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if wait, ok := raw["Wait"]; !ok || wait != false {
+		t.Errorf("detail = %s, want Wait kept next to the result", b)
+	}
+}
+
+func TestDrainerHandleEventDrainDuration(t *testing.T) {
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	start := clock.Now()
+	ctx := context.Background()
+
+	// `DrainStartedAt` survives the round-trips of the detail through the state machine.
+	evt, err := d.handleEvent(ctx, testEvent(t, f.detail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(30 * time.Second)
+	if evt, err = d.handleEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(45 * time.Second)
+	f.stopTask()
+	if evt, err = d.handleEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+
+	var detail CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.DrainStartedAt == nil || !detail.DrainStartedAt.Equal(start) {
+		t.Errorf("DrainStartedAt = %v, want the start of the first pass %v", detail.DrainStartedAt, start)
+	}
+	if detail.Wait || detail.Result == nil || detail.Result.DrainDurationSeconds != 75 {
+		t.Fatalf("Result = %+v, want the drain completed after 75s", detail.Result)
+	}
+	var durations []interface{}
+	for _, line := range logLines(t, out) {
+		if line["msg"] == "made a drain decision" {
+			durations = append(durations, line["drainDurationSeconds"])
+		}
+	}
+	if want := []interface{}{nil, nil, float64(75)}; !reflect.DeepEqual(durations, want) {
+		t.Errorf("drainDurationSeconds of the decisions = %v, want %v", durations, want)
+	}
+}
+
+func TestDrainerDrainTimings(t *testing.T) {
+	f := newTestDrainFixture()
+	d, out := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	f.ecs.onDescribeContainerInstances = func() { clock.advance(1500 * time.Millisecond) }
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := detail.Result.TimingsMS
+	for _, phase := range []string{PhaseClusterResolution, PhaseContainerInstance, PhaseTaskCheck, PhaseHeartbeat} {
+		if v, ok := got[phase]; !ok || v < 0 {
+			t.Errorf("timing of %s = %d, %v, want a non-negative duration", phase, v, ok)
+		}
+	}
+	if got[PhaseContainerInstance] != 1500 {
+		t.Errorf("timing of %s = %d, want 1500", PhaseContainerInstance, got[PhaseContainerInstance])
+	}
+	var logged map[string]interface{}
+	for _, line := range logLines(t, out) {
+		if line["msg"] == "made a drain decision" {
+			logged, _ = line["timingsMs"].(map[string]interface{})
+		}
+	}
+	if logged[PhaseContainerInstance] != float64(1500) {
+		t.Errorf("logged timings = %v, want those of the result", logged)
+	}
+
+	// The completion is timed once the tasks are gone.
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := detail.Result.TimingsMS[PhaseComplete]; !ok || v < 0 {
+		t.Errorf("timings = %v, want the completion timed", detail.Result.TimingsMS)
+	}
+}
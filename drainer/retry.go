@@ -0,0 +1,45 @@
+package drainer
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	defaultMaxRetries  = 3
+	defaultBaseDelayMS = 200
+)
+
+// withRetry calls fn until it succeeds or fails with an error other than throttling, retrying up to `MAX_RETRIES`
+// times with exponential backoff from `BASE_DELAY_MS` plus full jitter. The last error is returned once the
+// retries are exhausted or the context would expire before the next attempt.
+func (d *Drainer) withRetry(ctx context.Context, name string, fn func() error) error {
+	maxRetries, baseDelayMS := d.config.MaxRetries, d.config.BaseDelayMS
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !request.IsErrorThrottle(err) || attempt >= maxRetries {
+			return err
+		}
+		delay := time.Duration(rand.Int63n(int64(baseDelayMS)<<uint(attempt)+1)) * time.Millisecond // nolint:gosec
+		if deadline, ok := ctx.Deadline(); ok && d.remainingUntil(deadline) < delay {
+			return err
+		}
+		d.logger.warnf("%s was throttled, retrying in %s (%d/%d): %v", name, delay, attempt+1, maxRetries, err)
+		if err := d.clock.Sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// pagesErr returns the error of a paginated call, or the error of ctx when the page callbacks stopped paging
+// because ctx is done, which the SDK reports as success.
+func pagesErr(ctx context.Context, err error) error {
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,108 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestWithRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"success", nil, 1, false},
+		{"throttled twice", []error{throttlingError(), throttlingError()}, 3, false},
+		{"throttled past MAX_RETRIES", []error{
+			throttlingError(), throttlingError(), throttlingError(), throttlingError(), throttlingError(),
+		}, 4, true},
+		{"not throttling", []error{errors.New("access denied")}, 1, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_RETRIES", "3")
+			d, _ := newTestDrainer(t, &awsClients{})
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			start := clock.Now()
+
+			var attempts int
+			err := d.withRetry(context.Background(), "Test", func() error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr || attempts != tt.wantAttempts {
+				t.Errorf("withRetry() = %v after %d attempts, want error %v after %d", err, attempts, tt.wantErr,
+					tt.wantAttempts)
+			}
+			if tt.wantErr && len(tt.errs) > 1 && !request.IsErrorThrottle(err) {
+				t.Errorf("withRetry() = %v, want the last throttling error", err)
+			}
+			maxWait := time.Duration(defaultBaseDelayMS*(1+2+4)) * time.Millisecond
+			if waited := clock.Now().Sub(start); waited > maxWait {
+				t.Errorf("waited %s, want at most %s of backoff", waited, maxWait)
+			}
+		})
+	}
+}
+
+func TestCountTasksThrottled(t *testing.T) {
+	t.Setenv("MAX_RETRIES", "2")
+	t.Setenv("TASK_STATUSES", "RUNNING")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	d = d.withClock(newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+	ctx := context.Background()
+
+	f.ecs.fail("ListTasks", throttlingError(), throttlingError())
+	count, err := d.countTasks(ctx, f.clients.ecs, "default", f.containerInstance.ContainerInstanceArn)
+	if err != nil || count != 1 {
+		t.Fatalf("countTasks() = %d, %v, want the task counted after the retries", count, err)
+	}
+	if got := f.ecs.count("ListTasks"); got != 3 {
+		t.Errorf("ListTasks calls = %d, want 3", got)
+	}
+
+	// Throttling past the retries is an error, not an instance without tasks.
+	f.ecs.fail("ListTasks", throttlingError(), throttlingError(), throttlingError())
+	count, err = d.countTasks(ctx, f.clients.ecs, "default", f.containerInstance.ContainerInstanceArn)
+	if err == nil || !request.IsErrorThrottle(err) {
+		t.Fatalf("countTasks() = %d, %v, want the throttling error", count, err)
+	}
+}
+
+func TestDrainerDrainHeartbeatThrottled(t *testing.T) {
+	t.Setenv("MAX_RETRIES", "2")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	d = d.withClock(newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	// Instances draining together throttle the heartbeat, which is backed off instead of failing the drain.
+	f.autoscaling.fail("RecordLifecycleActionHeartbeat", throttlingError())
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the task", detail)
+	}
+	if got := f.autoscaling.count("RecordLifecycleActionHeartbeat"); got != 2 {
+		t.Errorf("RecordLifecycleActionHeartbeat calls = %d, want the throttled one retried", got)
+	}
+	if got := f.autoscaling.heartbeatCount(); got != 1 {
+		t.Errorf("heartbeats = %d, want 1", got)
+	}
+
+	// The state machine waits for a jittered interval.
+	if detail.WaitSeconds < stateMachineWaitSeconds ||
+		detail.WaitSeconds > stateMachineWaitSeconds+stateMachineWaitSeconds/loopJitterRatio {
+		t.Errorf("WaitSeconds = %d, want %d plus jitter", detail.WaitSeconds, stateMachineWaitSeconds)
+	}
+}
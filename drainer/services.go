@@ -0,0 +1,60 @@
+package drainer
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// collectAffectedServices adds the services of the running tasks on the container instance to known,
+// so that they are still known after the tasks are gone.
+func collectAffectedServices(ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string,
+	known []string) ([]string, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return nil, err
+	}
+	services := known
+	for _, task := range tasks {
+		group := aws.StringValue(task.Group)
+		if !strings.HasPrefix(group, "service:") {
+			continue
+		}
+		if name := strings.TrimPrefix(group, "service:"); !containsString(services, name) {
+			services = append(services, name)
+		}
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// servicesSteady reports whether every service has rescheduled its tasks elsewhere, i.e. runs its desired count
+// with a single deployment that is not rolling out. Services that no longer exist are regarded as steady.
+func (d *Drainer) servicesSteady(ctx context.Context, svc *ecsClient, clusterName string, services []string) (bool,
+	error) {
+	for _, name := range services {
+		service, err := svc.describeService(ctx, clusterName, name)
+		if err != nil {
+			return false, err
+		}
+		if service == nil {
+			continue
+		}
+		running, desired := aws.Int64Value(service.RunningCount), aws.Int64Value(service.DesiredCount)
+		if running < desired || len(service.Deployments) > 1 ||
+			(len(service.Deployments) == 1 &&
+				aws.StringValue(service.Deployments[0].RolloutState) == ecs.DeploymentRolloutStateInProgress) {
+			d.logger.infof("service %q is not steady yet with %d of %d tasks running in %d deployments",
+				name, running, desired, len(service.Deployments))
+			return false, nil
+		}
+	}
+	return true, nil
+}
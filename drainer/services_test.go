@@ -0,0 +1,54 @@
+package drainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerDrainWaitForServiceSteadyState(t *testing.T) {
+	t.Setenv("WAIT_FOR_SERVICE_STEADY_STATE", "true")
+	f := newTestDrainFixture()
+	service := f.ecs.addService("default", "web", f.task)
+	service.DesiredCount, service.RunningCount = aws.Int64(2), aws.Int64(2)
+	d, out := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(detail.AffectedServices) != 1 || detail.AffectedServices[0] != "web" {
+		t.Fatalf("Drain() = %+v, want to wait with the service of the task affected", detail)
+	}
+
+	// The task is gone, but the service has yet to run its replacement elsewhere.
+	f.stopTask()
+	f.ecs.stateMu.Lock()
+	service.RunningCount = aws.Int64(1)
+	service.Deployments = []*ecs.Deployment{{RolloutState: aws.String(ecs.DeploymentRolloutStateInProgress)}}
+	f.ecs.stateMu.Unlock()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(f.autoscaling.completedResults()) != 0 {
+		t.Fatalf("Drain() = %+v, want to keep waiting for the service", detail)
+	}
+	if !strings.Contains(out.String(), `service \"web\" is not steady yet with 1 of 2 tasks running`) {
+		t.Errorf("log = %q, want the unsteady service", out.String())
+	}
+
+	f.ecs.stateMu.Lock()
+	service.RunningCount = aws.Int64(2)
+	service.Deployments[0].RolloutState = aws.String(ecs.DeploymentRolloutStateCompleted)
+	f.ecs.stateMu.Unlock()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want to complete once the service is steady", detail, got)
+	}
+}
@@ -0,0 +1,126 @@
+package drainer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const maxCachedSessions = 16
+
+// awsClientFactory builds the clients of the SDK. It keeps the sessions and the assumed credentials so that warm
+// containers reuse them.
+type awsClientFactory struct {
+	sessions *sessionCache
+	// assumedCredentials keeps the credentials per role until they expire.
+	assumedCredentials sync.Map
+}
+
+func newAWSClientFactory(clock Clock) *awsClientFactory {
+	return &awsClientFactory{sessions: newSessionCache(maxCachedSessions, clock)}
+}
+
+// sessionCache keeps sessions per region so that warm containers reuse them.
+// When the cache is full, the least recently used session is evicted.
+type sessionCache struct {
+	mu      sync.Mutex
+	size    int
+	clock   Clock
+	entries map[string]*sessionCacheEntry
+}
+
+type sessionCacheEntry struct {
+	sess     *session.Session
+	lastUsed time.Time
+}
+
+func newSessionCache(size int, clock Clock) *sessionCache {
+	return &sessionCache{size: size, clock: clock, entries: make(map[string]*sessionCacheEntry)}
+}
+
+func (c *sessionCache) get(region string) *session.Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[region]; ok {
+		entry.lastUsed = c.clock.Now()
+		return entry.sess
+	}
+
+	if len(c.entries) >= c.size {
+		c.evictOldest()
+	}
+
+	entry := &sessionCacheEntry{sess: newSession(region), lastUsed: c.clock.Now()}
+	c.entries[region] = entry
+	return entry.sess
+}
+
+func (c *sessionCache) evictOldest() {
+	var oldestRegion string
+	var oldest *sessionCacheEntry
+	for region, entry := range c.entries {
+		if oldest == nil || entry.lastUsed.Before(oldest.lastUsed) {
+			oldestRegion, oldest = region, entry
+		}
+	}
+	delete(c.entries, oldestRegion)
+}
+
+// targetSession returns the session for the clients acting on the instance, which may be in another region
+// or account. `AWS_TARGET_REGION` overrides the region, and the role `ASSUME_ROLE_ARN`, or `ASSUME_ROLE_NAME`
+// in the account of the event, is assumed with the credentials of sess.
+func (f *awsClientFactory) targetSession(config *Config, sess *session.Session,
+	evt *events.CloudWatchEvent) *session.Session {
+	target := aws.NewConfig()
+	if region := config.TargetRegion; region != "" {
+		target.WithRegion(region)
+	}
+
+	roleArn := config.AssumeRoleArn
+	if name := config.AssumeRoleName; roleArn == "" && name != "" && evt.AccountID != "" {
+		partition := endpoints.AwsPartitionID
+		if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), evt.Region); ok {
+			partition = p.ID()
+		}
+		roleArn = fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, evt.AccountID, name)
+	}
+	if roleArn != "" {
+		creds, _ := f.assumedCredentials.LoadOrStore(roleArn, stscreds.NewCredentials(sess, roleArn))
+		target.WithCredentials(creds.(*credentials.Credentials))
+	}
+
+	return sess.Copy(target)
+}
+
+// newHTTPClient returns an HTTP client bounding a request by `HTTP_CLIENT_TIMEOUT_MS` and a connection attempt
+// by `HTTP_DIAL_TIMEOUT_MS`, so that a hung connection through a flaky NAT fails and is retried instead of
+// using up the invocation. It returns nil to keep the SDK default when neither is set.
+func newHTTPClient() *http.Client {
+	// Invalid values are reported by loadConfig at cold start.
+	timeoutMS, _ := getenvInt("HTTP_CLIENT_TIMEOUT_MS", 0)
+	dialTimeoutMS, _ := getenvInt("HTTP_DIAL_TIMEOUT_MS", 0)
+	if timeoutMS <= 0 && dialTimeoutMS <= 0 {
+		return nil
+	}
+
+	client := &http.Client{Timeout: time.Duration(timeoutMS) * time.Millisecond}
+	if dialTimeoutMS > 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(dialTimeoutMS) * time.Millisecond,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		client.Transport = transport
+	}
+	return client
+}
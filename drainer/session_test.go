@@ -0,0 +1,172 @@
+package drainer
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestSessionCache(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	c := newSessionCache(2, clock)
+
+	east := c.get("us-east-1")
+	if got := aws.StringValue(east.Config.Region); got != "us-east-1" {
+		t.Fatalf("Region = %q, want us-east-1", got)
+	}
+	clock.advance(time.Second)
+	if c.get("us-east-1") != east {
+		t.Error("get(us-east-1) built a new session, want the cached one")
+	}
+	clock.advance(time.Second)
+	west := c.get("us-west-2")
+	if west == east {
+		t.Fatal("get(us-west-2) returned the session of us-east-1")
+	}
+
+	// us-east-1 is used more recently than us-west-2, which is evicted for a third region.
+	clock.advance(time.Second)
+	c.get("us-east-1")
+	clock.advance(time.Second)
+	c.get("eu-west-1")
+	if len(c.entries) != 2 {
+		t.Errorf("entries = %d, want at most 2", len(c.entries))
+	}
+	if c.get("us-east-1") != east {
+		t.Error("get(us-east-1) built a new session, want the recently used one kept")
+	}
+	if c.get("us-west-2") == west {
+		t.Error("get(us-west-2) returned the evicted session")
+	}
+}
+
+func TestSessionCacheConcurrent(t *testing.T) {
+	c := newSessionCache(maxCachedSessions, realClock{})
+	regions := []string{"us-east-1", "us-west-2", "eu-west-1"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(region string) {
+			defer wg.Done()
+			c.get(region)
+		}(regions[i%len(regions)])
+	}
+	wg.Wait()
+
+	for _, region := range regions {
+		first := c.get(region)
+		if c.get(region) != first || aws.StringValue(first.Config.Region) != region {
+			t.Errorf("get(%s) = a session of %q, want one cached session of the region", region,
+				aws.StringValue(first.Config.Region))
+		}
+	}
+	if len(c.entries) != len(regions) {
+		t.Errorf("entries = %d, want %d", len(c.entries), len(regions))
+	}
+}
+
+func TestAWSClientFactoryTargetSession(t *testing.T) {
+	f := newAWSClientFactory(realClock{})
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	evt := &events.CloudWatchEvent{AccountID: "123456789012", Region: "us-east-1"}
+
+	// Without a role, the default region and credentials are kept.
+	target := f.targetSession(&Config{}, sess, evt)
+	if got := aws.StringValue(target.Config.Region); got != "us-east-1" {
+		t.Errorf("Region = %q, want us-east-1", got)
+	}
+	if target.Config.Credentials != sess.Config.Credentials {
+		t.Error("Credentials are not the default ones without a role")
+	}
+
+	target = f.targetSession(&Config{TargetRegion: "eu-west-1", AssumeRoleArn: "arn:aws:iam::210987654321:role/drain"},
+		sess, evt)
+	if got := aws.StringValue(target.Config.Region); got != "eu-west-1" {
+		t.Errorf("Region = %q, want `AWS_TARGET_REGION`", got)
+	}
+	assumed, ok := f.assumedCredentials.Load("arn:aws:iam::210987654321:role/drain")
+	if !ok || target.Config.Credentials != assumed.(*credentials.Credentials) {
+		t.Error("Credentials are not the assumed ones of `ASSUME_ROLE_ARN`")
+	}
+	again := f.targetSession(&Config{AssumeRoleArn: "arn:aws:iam::210987654321:role/drain"}, sess, evt)
+	if again.Config.Credentials != target.Config.Credentials {
+		t.Error("the credentials of the role were not reused")
+	}
+
+	// `ASSUME_ROLE_NAME` is assumed in the account of the event.
+	target = f.targetSession(&Config{AssumeRoleName: "drain"}, sess, evt)
+	assumed, ok = f.assumedCredentials.Load("arn:aws:iam::123456789012:role/drain")
+	if !ok || target.Config.Credentials != assumed.(*credentials.Credentials) {
+		t.Error("Credentials are not the assumed ones of `ASSUME_ROLE_NAME` in the account of the event")
+	}
+}
+
+func TestNewSessionMaxRetries(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		want int
+	}{
+		{"", aws.UseServiceDefaultRetries},
+		{"5", 5},
+		{"0", 0},
+		// An invalid value is reported by loadConfig instead.
+		{"many", aws.UseServiceDefaultRetries},
+	} {
+		t.Setenv("SDK_MAX_RETRIES", tt.env)
+		if got := aws.IntValue(newSession("us-east-1").Config.MaxRetries); got != tt.want {
+			t.Errorf("MaxRetries with SDK_MAX_RETRIES=%q = %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestNewSessionHTTPClient(t *testing.T) {
+	// The SDK default is kept when neither timeout is set.
+	if got := newSession("us-east-1").Config.HTTPClient; got != http.DefaultClient {
+		t.Errorf("HTTPClient = %v, want the SDK default", got)
+	}
+
+	t.Setenv("HTTP_CLIENT_TIMEOUT_MS", "5000")
+	client := newSession("us-east-1").Config.HTTPClient
+	if client == http.DefaultClient || client.Timeout != 5*time.Second {
+		t.Errorf("HTTPClient = %+v, want a custom client timing out after 5s", client)
+	}
+
+	t.Setenv("HTTP_DIAL_TIMEOUT_MS", "1000")
+	client = newSession("us-east-1").Config.HTTPClient
+	if transport, ok := client.Transport.(*http.Transport); !ok || transport == http.DefaultTransport ||
+		transport.DialContext == nil || client.Timeout != 5*time.Second {
+		t.Errorf("HTTPClient = %+v, want a transport of its own bounding the dial", client)
+	}
+}
+
+func TestAWSClientFactoryNewClientsTraced(t *testing.T) {
+	f := newAWSClientFactory(realClock{})
+	config := &Config{XRay: true, APICallMetrics: true}
+	evt := &events.CloudWatchEvent{Region: "us-east-1"}
+	cached := f.sessions.get("")
+	sendHandlers := cached.Handlers.Send.Len()
+	completeHandlers := cached.Handlers.Complete.Len()
+
+	// Warm invocations trace copies, so the handlers of the cached session do not pile up.
+	f.newClients(config, evt)
+	f.newClients(config, evt)
+	if f.sessions.get("") != cached {
+		t.Fatal("newClients() built a new session, want the cached one")
+	}
+	if got := cached.Handlers.Send.Len(); got != sendHandlers {
+		t.Errorf("Send handlers = %d, want %d", got, sendHandlers)
+	}
+	if got := cached.Handlers.Complete.Len(); got != completeHandlers {
+		t.Errorf("Complete handlers = %d, want %d", got, completeHandlers)
+	}
+}
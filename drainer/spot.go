@@ -0,0 +1,88 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	DetailTypeSpotInterruption        = "EC2 Spot Instance Interruption Warning"
+	DetailTypeRebalanceRecommendation = "EC2 Instance Rebalance Recommendation"
+)
+
+type SpotInterruptionDetail struct {
+	InstanceID     string `json:"instance-id"`
+	InstanceAction string `json:"instance-action"`
+	Wait           bool
+}
+
+// drainSpotInstance sets the container instance to DRAINING on a Spot interruption warning, or on a rebalance
+// recommendation that comes ahead of it when `HANDLE_REBALANCE_RECOMMENDATION` is enabled. There is no lifecycle
+// action to keep alive, so the instance is drained once on a best-effort basis before it is reclaimed.
+func (d *Drainer) drainSpotInstance(ctx context.Context, evt *events.CloudWatchEvent) (*events.CloudWatchEvent, error) {
+	d.logEvent(evt)
+
+	var detail *SpotInterruptionDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+		return nil, err
+	}
+	if detail.InstanceID == "" {
+		return nil, errors.New("`instance-id` is empty")
+	}
+	if evt.DetailType == DetailTypeRebalanceRecommendation && !d.config.HandleRebalance {
+		d.logger.infof("ignoring the rebalance recommendation for %q", detail.InstanceID)
+		return returnSpotDetail(evt, detail)
+	}
+
+	clients := d.newClients(evt)
+
+	clusterName, err := d.getECSClusterName(ctx, clients, evt, detail.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if !d.isClusterPermitted(clusterName) {
+		d.logger.infof("cluster %q is not managed by this function, skipping spot instance %q",
+			clusterName, detail.InstanceID)
+		return returnSpotDetail(evt, detail)
+	}
+
+	clusterName, containerInstances, err := d.resolveContainerInstances(ctx, clients.ecs, clusterName, detail.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(containerInstances) == 0 {
+		d.logger.infof("%q does not have spot instance %q, skipping draining", clusterName, detail.InstanceID)
+		return returnSpotDetail(evt, detail)
+	}
+
+	for _, containerInstance := range containerInstances {
+		if aws.StringValue(containerInstance.Status) == ecs.ContainerInstanceStatusDraining {
+			continue
+		}
+		if err := d.setStateDraining(ctx, clients.ecs, clusterName, containerInstance.ContainerInstanceArn); err != nil {
+			return nil, err
+		}
+	}
+	reason := detail.InstanceAction
+	if reason == "" {
+		reason = evt.DetailType
+	}
+	d.logger.infof("spot instance %q in %q is draining before it is reclaimed (%s)",
+		detail.InstanceID, clusterName, reason)
+
+	return returnSpotDetail(evt, detail)
+}
+
+func returnSpotDetail(evt *events.CloudWatchEvent, detail *SpotInterruptionDetail) (*events.CloudWatchEvent, error) {
+	detail.Wait = false
+	var err error
+	if evt.Detail, err = json.Marshal(detail); err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
@@ -0,0 +1,104 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerHandleEventSpotInterruption(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		detailType string
+		wantStatus string
+	}{
+		{"interruption", DetailTypeSpotInterruption, ecs.ContainerInstanceStatusDraining},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+			evt := &events.CloudWatchEvent{
+				DetailType: tt.detailType,
+				Source:     "aws.ec2",
+				Detail:     json.RawMessage(`{"instance-id":"i-1","instance-action":"terminate"}`),
+			}
+
+			ret, err := d.handleEvent(context.Background(), evt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var detail SpotInterruptionDetail
+			if err := json.Unmarshal(ret.Detail, &detail); err != nil {
+				t.Fatal(err)
+			}
+			if detail.Wait {
+				t.Errorf("detail = %+v, want nothing to wait for", detail)
+			}
+			if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got, tt.wantStatus)
+			}
+			// There is no lifecycle action to keep alive or complete.
+			if f.autoscaling.heartbeatCount() != 0 || len(f.autoscaling.completedResults()) != 0 {
+				t.Errorf("heartbeats = %d and completions = %v, want none", f.autoscaling.heartbeatCount(),
+					f.autoscaling.completedResults())
+			}
+		})
+	}
+}
+
+func TestDrainerHandleEventRebalanceRecommendation(t *testing.T) {
+	for _, tt := range []struct {
+		rebalance  string
+		wantStatus string
+	}{
+		{"", ecs.ContainerInstanceStatusActive},
+		{"true", ecs.ContainerInstanceStatusDraining},
+	} {
+		t.Run("HANDLE_REBALANCE_RECOMMENDATION="+tt.rebalance, func(t *testing.T) {
+			t.Setenv("HANDLE_REBALANCE_RECOMMENDATION", tt.rebalance)
+			f := newTestDrainFixture()
+			d, out := newTestDrainer(t, f.clients)
+			// The recommendation has no `instance-action` and no lifecycle action token.
+			newEvent := func() *events.CloudWatchEvent {
+				return &events.CloudWatchEvent{
+					DetailType: DetailTypeRebalanceRecommendation,
+					Source:     "aws.ec2",
+					Detail:     json.RawMessage(`{"instance-id":"i-1"}`),
+				}
+			}
+
+			if _, err := d.handleEvent(context.Background(), newEvent()); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.ecs.containerInstanceStatus(*f.containerInstance.ContainerInstanceArn); got != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got, tt.wantStatus)
+			}
+			if f.autoscaling.heartbeatCount() != 0 || len(f.autoscaling.completedResults()) != 0 {
+				t.Errorf("heartbeats = %d and completions = %v, want none", f.autoscaling.heartbeatCount(),
+					f.autoscaling.completedResults())
+			}
+			if tt.rebalance == "" {
+				if got := append(f.ecs.operations(), f.ec2.operations()...); len(got) != 0 {
+					t.Errorf("calls = %v, want none for an ignored recommendation", got)
+				}
+				return
+			}
+			if !strings.Contains(out.String(), "is draining before it is reclaimed ("+
+				DetailTypeRebalanceRecommendation+")") {
+				t.Errorf("log = %q, want the recommendation as the reason", out.String())
+			}
+
+			// A repeated recommendation leaves the DRAINING instance alone.
+			if _, err := d.handleEvent(context.Background(), newEvent()); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.ecs.count("UpdateContainerInstancesState"); got != 1 {
+				t.Errorf("UpdateContainerInstancesState calls = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package drainer
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// ssmConfig holds the parameters under `CONFIG_SSM_PATH`, named after environment variables,
+// e.g. `/ecs-auto-draining/MAX_DRAIN_SECONDS`. They are loaded once at cold start and apply only to
+// environment variables that are not set, so that a function can still override them.
+var ssmConfig = &ssmConfigStore{} // nolint:gochecknoglobals
+
+type ssmConfigStore struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+func (s *ssmConfigStore) lookup(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[name]
+	return value, ok
+}
+
+// load reads the parameters under `CONFIG_SSM_PATH`, decrypting SecureStrings. It is a no-op when it is unset.
+func (s *ssmConfigStore) load(ctx context.Context, sess *session.Session) error {
+	configPath := getenv("CONFIG_SSM_PATH")
+	if configPath == "" {
+		return nil
+	}
+
+	values := make(map[string]string)
+	fn := func(output *ssm.GetParametersByPathOutput, _ bool) bool {
+		for _, parameter := range output.Parameters {
+			values[path.Base(aws.StringValue(parameter.Name))] = aws.StringValue(parameter.Value)
+		}
+		return true
+	}
+	err := ssm.New(sess).GetParametersByPathPagesWithContext(ctx, &ssm.GetParametersByPathInput{
+		Path:           &configPath,
+		WithDecryption: aws.Bool(true),
+	}, fn)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = values
+	return nil
+}
+
+// loadSSMConfig loads the parameters with sess, a session of its own, and only then returns the cached session of
+// the function's region, so that the SDK settings among them, e.g. `SDK_MAX_RETRIES` and the `HTTP_*` timeouts,
+// apply to it.
+func (f *awsClientFactory) loadSSMConfig(ctx context.Context, sess *session.Session) (*session.Session, error) {
+	if err := ssmConfig.load(ctx, sess); err != nil {
+		return nil, err
+	}
+	return f.sessions.get(""), nil
+}
@@ -0,0 +1,134 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// fakeSSM serves the parameters of GetParametersByPath as SSM does, one per page.
+type fakeSSM struct {
+	mu         sync.Mutex
+	parameters map[string]string
+	names      []string
+	requests   int
+}
+
+func (f *fakeSSM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	var input struct {
+		Path           string
+		WithDecryption bool
+		NextToken      string
+	}
+	if r.Header.Get("X-Amz-Target") != "AmazonSSM.GetParametersByPath" ||
+		json.NewDecoder(r.Body).Decode(&input) != nil || input.Path != "/ecs-auto-draining" || !input.WithDecryption {
+		http.Error(w, `{"__type":"ValidationException"}`, http.StatusBadRequest)
+		return
+	}
+
+	type parameter struct{ Name, Value string }
+	var output struct {
+		Parameters []parameter
+		NextToken  string `json:",omitempty"`
+	}
+	for i, name := range f.names {
+		if input.NextToken == "" || name == input.NextToken {
+			output.Parameters = []parameter{{Name: input.Path + "/" + name, Value: f.parameters[name]}}
+			if i+1 < len(f.names) {
+				output.NextToken = f.names[i+1]
+			}
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(output)
+}
+
+func TestSSMConfigStoreLoad(t *testing.T) {
+	svc := &fakeSSM{
+		parameters: map[string]string{"MAX_DRAIN_SECONDS": "600", "MIN_REMAINING_TASKS": "2"},
+		names:      []string{"MAX_DRAIN_SECONDS", "MIN_REMAINING_TASKS"},
+	}
+	server := httptest.NewServer(svc)
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String(testRegion),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	saved := ssmConfig
+	ssmConfig = &ssmConfigStore{}
+	t.Cleanup(func() { ssmConfig = saved })
+
+	// Nothing is loaded without `CONFIG_SSM_PATH`.
+	if err := ssmConfig.load(context.Background(), sess); err != nil || svc.requests != 0 {
+		t.Fatalf("load() = %v with %d requests, want a no-op", err, svc.requests)
+	}
+
+	t.Setenv("CONFIG_SSM_PATH", "/ecs-auto-draining")
+	t.Setenv("MAX_DRAIN_SECONDS", "")
+	t.Setenv("MIN_REMAINING_TASKS", "1")
+	if err := ssmConfig.load(context.Background(), sess); err != nil {
+		t.Fatal(err)
+	}
+	if svc.requests != 2 {
+		t.Errorf("requests = %d, want one per page", svc.requests)
+	}
+
+	// The parameters apply to the unset variables, and the environment still wins. They are kept for the warm
+	// invocations, which do not load them again.
+	for i := 0; i < 2; i++ {
+		c, err := loadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.MaxDrain != 600*time.Second || c.MinRemainingTasks != 1 {
+			t.Errorf("MaxDrain, MinRemainingTasks = %v, %d, want 10m0s from SSM and 1 from the environment",
+				c.MaxDrain, c.MinRemainingTasks)
+		}
+	}
+	if svc.requests != 2 {
+		t.Errorf("requests = %d, want the parameters loaded once", svc.requests)
+	}
+}
+
+func TestAWSClientFactoryLoadSSMConfig(t *testing.T) {
+	svc := &fakeSSM{parameters: map[string]string{"SDK_MAX_RETRIES": "7"}, names: []string{"SDK_MAX_RETRIES"}}
+	server := httptest.NewServer(svc)
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String(testRegion),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	saved := ssmConfig
+	ssmConfig = &ssmConfigStore{}
+	t.Cleanup(func() { ssmConfig = saved })
+	t.Setenv("CONFIG_SSM_PATH", "/ecs-auto-draining")
+	t.Setenv("SDK_MAX_RETRIES", "")
+	t.Setenv("AWS_REGION", testRegion)
+
+	// The cached session is built after the parameters are loaded, so it gets the retries from SSM.
+	f := newAWSClientFactory(realClock{})
+	cached, err := f.loadSSMConfig(context.Background(), sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.IntValue(cached.Config.MaxRetries); got != 7 {
+		t.Errorf("MaxRetries = %d, want 7 from SSM", got)
+	}
+	if cached != f.sessions.get("") {
+		t.Error("loadSSMConfig() did not return the cached session")
+	}
+}
@@ -0,0 +1,139 @@
+package drainer
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	DrainStatusDraining   = "draining"
+	DrainStatusCompleted  = "completed"
+	DrainStatusSuperseded = "superseded"
+)
+
+// resumeDrainState records the drain of the lifecycle action in `STATE_TABLE`, keyed by `EC2InstanceId`,
+// and returns its status. Duplicate invocations share the stored start time, so the earliest one applies to
+// the timeouts. A lifecycle action of the instance whose drain started later, e.g. after its hooks were
+// reconfigured, supersedes this one. It returns an empty status when the table is not configured.
+func (d *Drainer) resumeDrainState(ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail) (string,
+	error) {
+	table := d.config.StateTable
+	if table == "" {
+		return "", nil
+	}
+	svc := clients.dynamodb
+
+	output, err := svc.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      &table,
+		Key:            drainStateKey(detail),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if item := output.Item; item != nil && aws.StringValue(item["LifecycleActionToken"].S) == detail.LifecycleActionToken {
+		if item["DrainStartedAt"] != nil {
+			startedAt, err := time.Parse(time.RFC3339Nano, aws.StringValue(item["DrainStartedAt"].S))
+			if err != nil {
+				return "", err
+			}
+			if detail.DrainStartedAt == nil || startedAt.Before(*detail.DrainStartedAt) {
+				detail.DrainStartedAt = &startedAt
+			}
+		}
+		return aws.StringValue(item["Status"].S), nil
+	}
+
+	// A stored item of an earlier lifecycle action is stale and is replaced.
+	startedAt := d.clock.Now()
+	if detail.DrainStartedAt != nil {
+		startedAt = *detail.DrainStartedAt
+	}
+	if item := output.Item; item != nil && item["DrainStartedAt"] != nil {
+		storedStartedAt, err := time.Parse(time.RFC3339Nano, aws.StringValue(item["DrainStartedAt"].S))
+		if err != nil {
+			return "", err
+		}
+		if storedStartedAt.After(startedAt) {
+			return DrainStatusSuperseded, nil
+		}
+	}
+	_, err = svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: &table,
+		Item: map[string]*dynamodb.AttributeValue{
+			"EC2InstanceId":        {S: aws.String(detail.instanceKey())},
+			"LifecycleActionToken": {S: &detail.LifecycleActionToken},
+			"DrainStartedAt":       {S: aws.String(startedAt.UTC().Format(time.RFC3339Nano))},
+			"Status":               {S: aws.String(DrainStatusDraining)},
+		},
+		ConditionExpression:       aws.String("attribute_not_exists(EC2InstanceId) OR LifecycleActionToken <> :token"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":token": {S: &detail.LifecycleActionToken}},
+	})
+	if isConditionalCheckFailed(err) {
+		// Another invocation recorded it first.
+		return d.resumeDrainState(ctx, clients, detail)
+	}
+	if err != nil {
+		return "", err
+	}
+	return DrainStatusDraining, nil
+}
+
+// markDrainCompleted changes the status in `STATE_TABLE` to completed and reports whether this invocation did it,
+// which is always the case when the table is not configured. In `OBSERVER_MODE` the status is left as is, since
+// the lifecycle action is completed elsewhere.
+func (d *Drainer) markDrainCompleted(ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail) (bool,
+	error) {
+	if d.isObserverMode() {
+		return true, nil
+	}
+	err := d.updateDrainStatus(ctx, clients, detail, DrainStatusCompleted)
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unmarkDrainCompleted reverts markDrainCompleted when completing the lifecycle action failed, so that
+// the next invocation tries again. It is best-effort and only logs failures.
+func (d *Drainer) unmarkDrainCompleted(ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail) {
+	if d.isObserverMode() {
+		return
+	}
+	if err := d.updateDrainStatus(ctx, clients, detail, DrainStatusDraining); err != nil {
+		d.logger.warnf("failed to revert the drain state of %q: %v", detail.EC2InstanceId, err)
+	}
+}
+
+func (d *Drainer) updateDrainStatus(ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail,
+	status string) error {
+	table := d.config.StateTable
+	if table == "" {
+		return nil
+	}
+	_, err := clients.dynamodb.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        &table,
+		Key:              drainStateKey(detail),
+		UpdateExpression: aws.String("SET LifecycleActionToken = :token, #status = :status"),
+		ConditionExpression: aws.String(
+			"attribute_not_exists(#status) OR LifecycleActionToken <> :token OR #status <> :status"),
+		ExpressionAttributeNames: map[string]*string{"#status": aws.String("Status")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token":  {S: &detail.LifecycleActionToken},
+			":status": {S: &status},
+		},
+	})
+	return err
+}
+
+func drainStateKey(detail *CloudWatchEventDetail) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"EC2InstanceId": {S: aws.String(detail.instanceKey())}}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := asAWSError(err)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
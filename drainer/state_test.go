@@ -0,0 +1,150 @@
+package drainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestDrainerDrainSupersededToken(t *testing.T) {
+	t.Setenv("STATE_TABLE", "state")
+	f := newTestDrainFixture()
+	table := newFakeDynamoDB()
+	table.addTable("state", "EC2InstanceId")
+	f.clients.dynamodb = table
+	d, out := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	stale, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook is reconfigured, and a new lifecycle action of the instance starts draining.
+	clock.advance(time.Minute)
+	recent := *f.detail
+	recent.LifecycleActionToken = "token-2"
+	next, err := d.Drain(ctx, &recent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Wait {
+		t.Fatalf("Drain() = %+v, want the recent lifecycle action to wait", next)
+	}
+	if got := aws.StringValue(table.item("state", "i-1")["LifecycleActionToken"].S); got != "token-2" {
+		t.Fatalf("stored token = %q, want token-2", got)
+	}
+
+	// The stale lifecycle action is completed without taking the record over.
+	clock.advance(time.Minute)
+	if stale, err = d.Drain(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale.Wait {
+		t.Errorf("Drain() = %+v, want the stale lifecycle action done", stale)
+	}
+	if len(f.autoscaling.completions) != 1 ||
+		aws.StringValue(f.autoscaling.completions[0].LifecycleActionToken) != "token" ||
+		aws.StringValue(f.autoscaling.completions[0].LifecycleActionResult) != LifecycleActionResultContinue {
+		t.Errorf("completions = %v, want the stale token completed with CONTINUE", f.autoscaling.completions)
+	}
+	if got := aws.StringValue(table.item("state", "i-1")["LifecycleActionToken"].S); got != "token-2" {
+		t.Errorf("stored token = %q, want token-2 kept", got)
+	}
+
+	// The recent one goes on draining and completes.
+	f.stopTask()
+	if next, err = d.Drain(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if next.Wait || len(f.autoscaling.completions) != 2 ||
+		aws.StringValue(f.autoscaling.completions[1].LifecycleActionToken) != "token-2" {
+		t.Errorf("Drain() = %+v with completions %v, want token-2 completed", next, f.autoscaling.completions)
+	}
+	if !strings.Contains(out.String(), "superseded") {
+		t.Errorf("log = %q, want the stale lifecycle action logged as superseded", out.String())
+	}
+}
+
+func TestDrainerDrainState(t *testing.T) {
+	t.Setenv("STATE_TABLE", "state")
+	f := newTestDrainFixture()
+	table := newFakeDynamoDB()
+	table.addTable("state", "EC2InstanceId")
+	f.clients.dynamodb = table
+	d, out := newTestDrainer(t, f.clients)
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := newFakeClock(start)
+	d = d.withClock(clock)
+	ctx := context.Background()
+	duplicate := func() *CloudWatchEventDetail {
+		detail := *f.detail
+		return &detail
+	}
+
+	// The first invocation records the drain.
+	detail, err := d.Drain(ctx, duplicate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := table.item("state", "i-1")
+	if aws.StringValue(item["Status"].S) != DrainStatusDraining ||
+		aws.StringValue(item["LifecycleActionToken"].S) != "token" ||
+		aws.StringValue(item["DrainStartedAt"].S) != start.Format(time.RFC3339Nano) {
+		t.Fatalf("item = %v, want the drain of token started at %v", item, start)
+	}
+
+	// A duplicate delivery of the event resumes the stored start time.
+	clock.advance(time.Minute)
+	resumed, err := d.Drain(ctx, duplicate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.Wait || resumed.DrainStartedAt == nil || !resumed.DrainStartedAt.Equal(start) {
+		t.Errorf("Drain() = %+v, want to wait with the drain started at %v", resumed, start)
+	}
+
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait || aws.StringValue(table.item("state", "i-1")["Status"].S) != DrainStatusCompleted {
+		t.Fatalf("Drain() = %+v with item %v, want the drain completed", detail, table.item("state", "i-1"))
+	}
+
+	// The lifecycle action is not completed twice.
+	if resumed, err = d.Drain(ctx, resumed); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Wait || len(f.autoscaling.completedResults()) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want a single completion", resumed,
+			f.autoscaling.completedResults())
+	}
+	if !strings.Contains(out.String(), "already completed by another invocation") {
+		t.Errorf("log = %q, want the duplicate invocation logged", out.String())
+	}
+}
+
+func TestDrainerDrainStateless(t *testing.T) {
+	f := newTestDrainFixture()
+	table := newFakeDynamoDB()
+	f.clients.dynamodb = table
+	d, _ := newTestDrainer(t, f.clients)
+
+	f.stopTask()
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait || len(f.autoscaling.completedResults()) != 1 {
+		t.Errorf("Drain() = %+v, want the drain completed", detail)
+	}
+	if got := table.count("GetItem") + table.count("PutItem") + table.count("UpdateItem"); got != 0 {
+		t.Errorf("DynamoDB calls = %d, want none without `STATE_TABLE`", got)
+	}
+}
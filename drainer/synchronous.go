@@ -0,0 +1,91 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultLoopInterval = 10 * time.Second
+	loopSafetyMargin    = 5 * time.Second
+	loopJitterRatio     = 5
+)
+
+// drainSynchronously polls within the invocation until the drain completes, for callers that invoke
+// without the Step Functions loop, e.g. directly from EventBridge. It polls every `LOOP_INTERVAL_SECONDS`
+// (or `POLL_INTERVAL_SECONDS`) up to `LOOP_MAX_WAIT_SECONDS`, or until shortly before the Lambda deadline, when
+// it completes the lifecycle action, and returns no event because there is nothing left to wait for.
+func (d *Drainer) drainSynchronously(ctx context.Context, evt *events.CloudWatchEvent) (*events.CloudWatchEvent,
+	error) {
+	interval := d.config.LoopInterval
+	if interval == 0 {
+		interval = d.config.PollInterval
+	}
+	if interval == 0 {
+		interval = defaultLoopInterval
+	}
+	maxWait := d.config.LoopMaxWait
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		deadline = deadline.Add(-loopSafetyMargin)
+	}
+	if maxWait > 0 {
+		if limit := d.clock.Now().Add(maxWait); !hasDeadline || limit.Before(deadline) {
+			deadline, hasDeadline = limit, true
+		}
+	}
+
+	for {
+		next, err := d.poll(ctx, evt)
+		if err != nil {
+			// The event of the previous poll keeps the lease when the failed one did not return its own.
+			if next == nil {
+				next = evt
+			}
+			return next, err
+		}
+		evt = next
+
+		var detail *CloudWatchEventDetail
+		if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+			return nil, err
+		}
+		if !detail.Wait {
+			return nil, nil
+		}
+
+		// Jitter keeps instances draining together from polling and heartbeating in lockstep.
+		safeInterval := heartbeatSafeInterval(detail, interval)
+		wait := safeInterval + time.Duration(rand.Int63n(int64(safeInterval)/loopJitterRatio+1)) // nolint:gosec
+		if hasDeadline && d.clock.Now().Add(wait).After(deadline) {
+			return d.completeOutOfTime(ctx, evt, detail)
+		}
+		if err := d.clock.Sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// completeOutOfTime completes the lifecycle action with `TIMEOUT_LIFECYCLE_ACTION_RESULT` when the next poll would
+// pass the deadline, as nothing invokes the function again to go on with the drain.
+func (d *Drainer) completeOutOfTime(ctx context.Context, evt *events.CloudWatchEvent,
+	detail *CloudWatchEventDetail) (*events.CloudWatchEvent, error) {
+	result := d.config.TimeoutLifecycleActionResult
+	d.logger.with(logFields{"instanceId": detail.instanceKey(), "asg": detail.AutoScalingGroupName}).
+		warnf("tasks did not drain in time, completing with %s", result)
+	if _, err := d.completeWithoutDraining(ctx, d.newClients(evt), evt, detail, result); err != nil {
+		return evt, err
+	}
+	return nil, nil
+}
+
+// isSynchronous reports whether the drain loops within the invocation, by `LOOP_MODE=false` or its alias
+// `POLL_MODE=true`.
+func (d *Drainer) isSynchronous() bool {
+	return !d.config.LoopMode
+}
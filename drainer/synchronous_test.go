@@ -0,0 +1,154 @@
+package drainer
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sleepHookClock calls onSleep after every sleep of the fake clock with the duration slept, e.g. to change
+// the fakes while a drain waits.
+type sleepHookClock struct {
+	*fakeClock
+	onSleep func(time.Duration)
+}
+
+func (c *sleepHookClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := c.fakeClock.Sleep(ctx, d); err != nil {
+		return err
+	}
+	c.onSleep(d)
+	return nil
+}
+
+func TestDrainerHandleEventSynchronous(t *testing.T) {
+	t.Setenv("LOOP_MODE", "false")
+	t.Setenv("LOOP_INTERVAL_SECONDS", "10")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	var sleeps int
+	clock := &sleepHookClock{fakeClock: newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))}
+	// The poll sleeps are told apart from the zero `COMPLETE_DELAY_SECONDS`.
+	clock.onSleep = func(d time.Duration) {
+		if d == 0 {
+			return
+		}
+		if sleeps++; sleeps == 2 {
+			f.stopTask()
+		}
+	}
+	d = d.withClock(clock)
+
+	evt, err := d.handleEvent(context.Background(), testEvent(t, f.detail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evt != nil {
+		t.Errorf("handleEvent() = %+v, want no event to loop on", evt)
+	}
+	if sleeps != 2 {
+		t.Errorf("sleeps = %d, want 2 polls waited for", sleeps)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+		t.Errorf("completions = %v, want [CONTINUE]", got)
+	}
+}
+
+func TestDrainerHandleEventSynchronousMaxWait(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		result string
+		want   string
+	}{
+		{"default result", "", LifecycleActionResultContinue},
+		{"configured result", LifecycleActionResultAbandon, LifecycleActionResultAbandon},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LOOP_MODE", "false")
+			t.Setenv("LOOP_INTERVAL_SECONDS", "10")
+			t.Setenv("LOOP_MAX_WAIT_SECONDS", "30")
+			t.Setenv("TIMEOUT_LIFECYCLE_ACTION_RESULT", tt.result)
+			f := newTestDrainFixture()
+			d, out := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			start := clock.Now()
+
+			// The task never stops, so the loop runs out of time and completes instead of failing.
+			evt, err := d.handleEvent(context.Background(), testEvent(t, f.detail))
+			if err != nil || evt != nil {
+				t.Fatalf("handleEvent() = %+v, %v, want no event and no error", evt, err)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("completions = %v, want [%s]", got, tt.want)
+			}
+			if n := f.autoscaling.heartbeatCount(); n == 0 {
+				t.Error("no heartbeats, want one per poll")
+			}
+			if elapsed := clock.Now().Sub(start); elapsed > 30*time.Second {
+				t.Errorf("waited %s, want at most `LOOP_MAX_WAIT_SECONDS`", elapsed)
+			}
+			if !strings.Contains(out.String(), "did not drain in time") {
+				t.Errorf("log = %q, want the drain reported out of time", out.String())
+			}
+		})
+	}
+}
+
+func TestDrainerHandleEventPollMode(t *testing.T) {
+	t.Setenv("POLL_MODE", "true")
+	t.Setenv("POLL_INTERVAL_SECONDS", "20")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	var waited []time.Duration
+	clock := &sleepHookClock{fakeClock: newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))}
+	clock.onSleep = func(d time.Duration) {
+		if d == 0 {
+			return
+		}
+		if waited = append(waited, d); len(waited) == 3 {
+			f.stopTask()
+		}
+	}
+	d = d.withClock(clock)
+
+	evt, err := d.handleEvent(context.Background(), testEvent(t, f.detail))
+	if err != nil || evt != nil {
+		t.Fatalf("handleEvent() = %+v, %v, want the drain done within the invocation", evt, err)
+	}
+	for _, wait := range waited {
+		if wait < 20*time.Second || wait > 24*time.Second {
+			t.Errorf("waited %v between polls, want `POLL_INTERVAL_SECONDS` plus jitter", wait)
+		}
+	}
+	if got := f.autoscaling.heartbeatCount(); got != 3 {
+		t.Errorf("heartbeats = %d, want one per poll that waits", got)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 {
+		t.Errorf("completions = %v, want one after the tasks are gone", got)
+	}
+}
+
+func TestDrainerHandleEventPollModeDeadline(t *testing.T) {
+	t.Setenv("POLL_MODE", "true")
+	t.Setenv("POLL_INTERVAL_SECONDS", "10")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	// The fake time starts now to compare with the deadline of the context.
+	clock := newFakeClock(time.Now())
+	d = d.withClock(clock)
+	ctx, cancel := context.WithTimeout(context.Background(), 40*time.Second)
+	defer cancel()
+
+	// Polling stops before the deadline and completes with `TIMEOUT_LIFECYCLE_ACTION_RESULT`.
+	if _, err := d.handleEvent(ctx, testEvent(t, f.detail)); err != nil {
+		t.Fatalf("handleEvent() = %v, want the lifecycle action completed before the deadline", err)
+	}
+	if deadline, _ := ctx.Deadline(); !clock.Now().Before(deadline.Add(-loopSafetyMargin)) {
+		t.Errorf("polled until %s, want to stop before the safety margin of the deadline %s", clock.Now(), deadline)
+	}
+	if got := f.autoscaling.completedResults(); len(got) != 1 || got[0] != LifecycleActionResultContinue {
+		t.Errorf("completions = %v, want [CONTINUE]", got)
+	}
+}
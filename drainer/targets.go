@@ -0,0 +1,57 @@
+package drainer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// targetsDraining reports whether the instance is still a draining target of a target group
+// in `TARGET_GROUP_ARNS`, separated by commas, or of any target group when it is unset.
+// Only instance targets are matched; IP targets of awsvpc tasks go away with their tasks.
+func (d *Drainer) targetsDraining(ctx context.Context, svc elbv2API, instanceID string) (bool, error) {
+	targetGroupArns, err := d.getTargetGroupArns(ctx, svc)
+	if err != nil {
+		return false, err
+	}
+
+	for _, targetGroupArn := range targetGroupArns {
+		output, err := svc.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+			TargetGroupArn: targetGroupArn,
+		})
+		if err != nil {
+			return false, err
+		}
+		for _, description := range output.TargetHealthDescriptions {
+			if aws.StringValue(description.Target.Id) != instanceID || description.TargetHealth == nil {
+				continue
+			}
+			if aws.StringValue(description.TargetHealth.State) == elbv2.TargetHealthStateEnumDraining {
+				d.logger.infof("%q is still draining from %q", instanceID, aws.StringValue(targetGroupArn))
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (d *Drainer) getTargetGroupArns(ctx context.Context, svc elbv2API) ([]*string, error) {
+	if len(d.config.TargetGroupArns) > 0 {
+		return aws.StringSlice(d.config.TargetGroupArns), nil
+	}
+
+	var arns []*string
+	fn := func(output *elbv2.DescribeTargetGroupsOutput, _ bool) bool {
+		for _, targetGroup := range output.TargetGroups {
+			if aws.StringValue(targetGroup.TargetType) == elbv2.TargetTypeEnumInstance {
+				arns = append(arns, targetGroup.TargetGroupArn)
+			}
+		}
+		return true
+	}
+	if err := svc.DescribeTargetGroupsPagesWithContext(ctx, &elbv2.DescribeTargetGroupsInput{}, fn); err != nil {
+		return nil, err
+	}
+	return arns, nil
+}
@@ -0,0 +1,60 @@
+package drainer
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+func TestDrainerDrainWaitForTargetDeregistration(t *testing.T) {
+	t.Setenv("WAIT_FOR_TARGET_DEREGISTRATION", "true")
+	f := newTestDrainFixture()
+	svc := newFakeELBv2()
+	svc.addTarget("arn:tg-web", "i-1", elbv2.TargetHealthStateEnumDraining)
+	svc.addTarget("arn:tg-api", "i-1", elbv2.TargetHealthStateEnumUnused)
+	f.clients.elbv2 = svc
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	f.stopTask()
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(f.autoscaling.completedResults()) != 0 {
+		t.Fatalf("Drain() = %+v, want to wait for the draining target", detail)
+	}
+	if got := f.autoscaling.count("RecordLifecycleActionHeartbeat"); got == 0 {
+		t.Error("RecordLifecycleActionHeartbeat was not called while the target is draining")
+	}
+
+	svc.removeTarget("arn:tg-web", "i-1")
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if detail.Wait || len(f.autoscaling.completedResults()) != 1 {
+		t.Errorf("Drain() = %+v, want the drain completed once the target is gone", detail)
+	}
+	// The first check stops at the draining target; the second one describes both discovered target groups.
+	if got := svc.count("DescribeTargetHealth"); got != 3 {
+		t.Errorf("DescribeTargetHealth calls = %d, want 3", got)
+	}
+}
+
+func TestDrainerTargetsDrainingTargetGroupArns(t *testing.T) {
+	t.Setenv("TARGET_GROUP_ARNS", "arn:tg-api")
+	svc := newFakeELBv2()
+	svc.addTarget("arn:tg-web", "i-1", elbv2.TargetHealthStateEnumDraining)
+	svc.addTarget("arn:tg-api", "i-2", elbv2.TargetHealthStateEnumDraining)
+	svc.addTarget("arn:tg-api", "i-1", elbv2.TargetHealthStateEnumHealthy)
+	d, _ := newTestDrainer(t, &awsClients{})
+
+	draining, err := d.targetsDraining(context.Background(), svc, "i-1")
+	if err != nil || draining {
+		t.Errorf("targetsDraining() = %t, %v, want only the target groups of `TARGET_GROUP_ARNS` checked", draining, err)
+	}
+	if got := svc.count("DescribeTargetGroups"); got != 0 {
+		t.Errorf("DescribeTargetGroups calls = %d, want none with `TARGET_GROUP_ARNS`", got)
+	}
+}
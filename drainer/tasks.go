@@ -0,0 +1,543 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// maxDescribeTasks is the maximum number of tasks `DescribeTasks` accepts at once.
+const maxDescribeTasks = 100
+
+func listTaskArns(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string, desiredStatus string,
+) ([]*string, error) {
+	input := &ecs.ListTasksInput{
+		Cluster:           &clusterName,
+		ContainerInstance: containerInstanceArn,
+		DesiredStatus:     &desiredStatus,
+	}
+	var arns []*string
+	fn := func(output *ecs.ListTasksOutput, _ bool) bool {
+		arns = append(arns, output.TaskArns...)
+		return ctx.Err() == nil
+	}
+	if err := pagesErr(ctx, svc.ListTasksPagesWithContext(ctx, input, fn)); err != nil {
+		return nil, err
+	}
+	return arns, nil
+}
+
+// listCheckedTaskArns lists the tasks for the task check, only those of the families in `TASK_FAMILY_FILTER`
+// if it is set. A task is listed once even if several listings return it.
+func (d *Drainer) listCheckedTaskArns(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string, desiredStatus string,
+) ([]*string, error) {
+	families := d.config.TaskFamilyFilter
+	if len(families) == 0 {
+		return listTaskArns(ctx, svc, clusterName, containerInstanceArn, desiredStatus)
+	}
+
+	var arns []*string
+	seen := make(map[string]bool)
+	for _, family := range families {
+		input := &ecs.ListTasksInput{
+			Cluster:           &clusterName,
+			ContainerInstance: containerInstanceArn,
+			DesiredStatus:     &desiredStatus,
+			Family:            aws.String(family),
+		}
+		fn := func(output *ecs.ListTasksOutput, _ bool) bool {
+			for _, arn := range output.TaskArns {
+				if !seen[aws.StringValue(arn)] {
+					seen[aws.StringValue(arn)] = true
+					arns = append(arns, arn)
+				}
+			}
+			return ctx.Err() == nil
+		}
+		if err := pagesErr(ctx, svc.ListTasksPagesWithContext(ctx, input, fn)); err != nil {
+			return nil, err
+		}
+	}
+	return arns, nil
+}
+
+// trackTasks returns the union of the previously tracked tasks and the tasks currently on the container instance.
+func trackTasks(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string, tracked []string,
+) ([]string, error) {
+	seen := make(map[string]bool, len(tracked))
+	for _, arn := range tracked {
+		seen[arn] = true
+	}
+
+	for _, desiredStatus := range []string{ecs.DesiredStatusRunning, ecs.DesiredStatusStopped} {
+		arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, desiredStatus)
+		if err != nil {
+			return nil, err
+		}
+		for _, arn := range arns {
+			if !seen[*arn] {
+				seen[*arn] = true
+				tracked = append(tracked, *arn)
+			}
+		}
+	}
+	return tracked, nil
+}
+
+// allTasksStopped reports whether every tracked task has reached `LastStatus=STOPPED`.
+// Tasks that ECS no longer returns are regarded as stopped.
+func allTasksStopped(ctx context.Context, svc *ecsClient, clusterName string, tracked []string) (bool, error) {
+	tasks, err := svc.describeTasks(ctx, clusterName, aws.StringSlice(tracked))
+	if err != nil {
+		return false, err
+	}
+	for _, task := range tasks {
+		if aws.StringValue(task.LastStatus) != ecs.DesiredStatusStopped {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// describeTaskDefinitions returns the task definitions of the tasks keyed by ARN.
+func describeTaskDefinitions(
+	ctx context.Context, svc *ecsClient, tasks []*ecs.Task) (map[string]*ecs.TaskDefinition, error) {
+	taskDefinitions := make(map[string]*ecs.TaskDefinition)
+	for _, task := range tasks {
+		arn := aws.StringValue(task.TaskDefinitionArn)
+		taskDefinition, err := svc.describeTaskDefinition(ctx, arn)
+		if err != nil {
+			return nil, err
+		}
+		taskDefinitions[arn] = taskDefinition
+	}
+	return taskDefinitions, nil
+}
+
+func (d *Drainer) stopRunningTasks(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string, reason string) (int, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return 0, err
+	}
+	var stopped int
+	for _, task := range tasks {
+		ok, err := d.stopTask(ctx, svc, clusterName, task, reason)
+		if err != nil {
+			return stopped, err
+		}
+		if ok {
+			stopped++
+		}
+	}
+	return stopped, nil
+}
+
+// stopBlockingTasks stops the running tasks that block draining, which leaves daemon tasks running
+// unless `IGNORE_DAEMON_TASKS` is false.
+func (d *Drainer) stopBlockingTasks(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string, reason string) (int, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return 0, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return 0, err
+	}
+	var stopped int
+	for _, task := range tasks {
+		blocking, err := d.blocksDraining(ctx, svc, clusterName, task)
+		if err != nil {
+			return stopped, err
+		}
+		if !blocking {
+			continue
+		}
+		ok, err := d.stopTask(ctx, svc, clusterName, task, reason)
+		if err != nil {
+			return stopped, err
+		}
+		if ok {
+			stopped++
+		}
+	}
+	return stopped, nil
+}
+
+// TaskPreview is a task that a force stop would stop.
+type TaskPreview struct {
+	TaskArn   string
+	Family    string
+	StartedBy string `json:",omitempty"`
+}
+
+// previewForceStop returns the tasks that stopBlockingTasks would stop, without stopping any,
+// so that force stopping can be reviewed before it is enabled.
+func (d *Drainer) previewForceStop(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) ([]TaskPreview, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return nil, err
+	}
+	var preview []TaskPreview
+	for _, task := range tasks {
+		blocking, err := d.blocksDraining(ctx, svc, clusterName, task)
+		if err != nil {
+			return nil, err
+		}
+		if !blocking || svc.protectedTasks[aws.StringValue(task.TaskArn)] {
+			continue
+		}
+		preview = append(preview, TaskPreview{
+			TaskArn:   aws.StringValue(task.TaskArn),
+			Family:    taskFamily(task),
+			StartedBy: aws.StringValue(task.StartedBy),
+		})
+	}
+	return preview, nil
+}
+
+// stopReason describes the scale-in for the reasons of the tasks stopped during it.
+func stopReason(detail *CloudWatchEventDetail) string {
+	return fmt.Sprintf("ecs-auto-draining: ASG scale-in of %s in %s", detail.EC2InstanceId, detail.AutoScalingGroupName)
+}
+
+// stopTask stops the task and reports whether it did, which it does not for a task protected from scale-in.
+func (d *Drainer) stopTask(ctx context.Context, svc *ecsClient, clusterName string, task *ecs.Task,
+	reason string) (bool, error) {
+	if svc.protectedTasks[aws.StringValue(task.TaskArn)] {
+		d.logger.warnf("task %q is protected from scale-in, not stopping it", aws.StringValue(task.TaskArn))
+		return false, nil
+	}
+	_, err := svc.StopTaskWithContext(ctx, &ecs.StopTaskInput{
+		Cluster: &clusterName,
+		Task:    task.TaskArn,
+		Reason:  &reason,
+	})
+	if err != nil {
+		return false, err
+	}
+	svc.forgetTask(aws.StringValue(task.TaskArn))
+	// One line per stopped task lets operators audit exactly what was terminated.
+	d.logger.log(LogLevelInfo, "stopped task", logFields{
+		"taskArn": aws.StringValue(task.TaskArn),
+		"family":  taskFamily(task),
+		"reason":  reason,
+	})
+	return true, nil
+}
+
+// getTaskStatuses returns the desired statuses whose tasks are counted, `TASK_STATUSES` separated by commas,
+// RUNNING and STOPPED by default.
+func getTaskStatuses() ([]string, error) {
+	value := getenv("TASK_STATUSES")
+	if value == "" {
+		return []string{ecs.DesiredStatusRunning, ecs.DesiredStatusStopped}, nil
+	}
+	var statuses []string
+	for _, status := range strings.Split(value, ",") {
+		status = strings.TrimSpace(status)
+		if !containsString(ecs.DesiredStatus_Values(), status) {
+			return nil, fmt.Errorf("`TASK_STATUSES` has %q, not one of %s",
+				status, strings.Join(ecs.DesiredStatus_Values(), ", "))
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// defaultStopTimeout is the time the ECS agent waits by default between SIGTERM and SIGKILL.
+const defaultStopTimeout = 30 * time.Second
+
+// remainingStopTimeout returns how long until the tasks being stopped on the container instance reach the longest
+// `stopTimeout` of their containers, so that completing the lifecycle action does not kill them mid-shutdown.
+func (d *Drainer) remainingStopTimeout(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) (time.Duration, error) {
+	arns, err := listTaskArns(ctx, svc, clusterName, containerInstanceArn, ecs.DesiredStatusStopped)
+	if err != nil {
+		return 0, err
+	}
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return 0, err
+	}
+	var remaining time.Duration
+	for _, task := range tasks {
+		if aws.StringValue(task.LastStatus) == ecs.DesiredStatusStopped || task.StoppingAt == nil {
+			continue
+		}
+		taskDefinition, err := svc.describeTaskDefinition(ctx, aws.StringValue(task.TaskDefinitionArn))
+		if err != nil {
+			return 0, err
+		}
+		if r := d.remainingUntil(task.StoppingAt.Add(stopTimeout(taskDefinition))); r > remaining {
+			remaining = r
+		}
+	}
+	return remaining, nil
+}
+
+// stopTimeout returns the longest `stopTimeout` of the containers in the task definition.
+func stopTimeout(taskDefinition *ecs.TaskDefinition) time.Duration {
+	timeout := defaultStopTimeout
+	for _, container := range taskDefinition.ContainerDefinitions {
+		if container.StopTimeout == nil {
+			continue
+		}
+		if t := time.Duration(*container.StopTimeout) * time.Second; t > timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// isActiveTaskStatus reports whether a task in the last status is running or still being placed on the instance.
+// Completing the lifecycle action would kill a task that landed just before the scale-in, so it counts too.
+func isActiveTaskStatus(lastStatus string) bool {
+	switch lastStatus {
+	case "RUNNING", "PENDING", "PROVISIONING", "ACTIVATING":
+		return true
+	}
+	return false
+}
+
+// filtersTasks reports whether running tasks have to be described to decide whether they block draining.
+func (d *Drainer) filtersTasks() bool {
+	return d.config.IgnoreDisconnectedTasks || d.ignoresDaemonTasks() ||
+		d.config.IgnoreStartedByPrefix != "" || len(d.config.TaskFamilyFilter) > 0 ||
+		d.config.ContainerLevelStatus
+}
+
+// ignoresDaemonTasks reports whether tasks of DAEMON services are left out, which is the default
+// unless `IGNORE_DAEMON_TASKS` is false. They run one per instance and never move off during a drain.
+func (d *Drainer) ignoresDaemonTasks() bool {
+	return d.config.IgnoreDaemonTasks
+}
+
+// isDaemonTask reports whether the task belongs to a service with the DAEMON scheduling strategy.
+func isDaemonTask(ctx context.Context, svc *ecsClient, clusterName string, task *ecs.Task) (bool, error) {
+	serviceName := strings.TrimPrefix(aws.StringValue(task.Group), "service:")
+	if serviceName == aws.StringValue(task.Group) {
+		return false, nil
+	}
+	service, err := svc.describeService(ctx, clusterName, serviceName)
+	if err != nil || service == nil {
+		return false, err
+	}
+	return aws.StringValue(service.SchedulingStrategy) == ecs.SchedulingStrategyDaemon, nil
+}
+
+// blocksDraining is isBlockingTask that also leaves out daemon tasks unless `IGNORE_DAEMON_TASKS` is false.
+func (d *Drainer) blocksDraining(ctx context.Context, svc *ecsClient, clusterName string, task *ecs.Task) (bool,
+	error) {
+	if !d.isBlockingTask(task) {
+		return false, nil
+	}
+	if d.config.ContainerLevelStatus {
+		live, err := hasLiveEssentialContainer(ctx, svc, task)
+		if err != nil || !live {
+			return false, err
+		}
+	}
+	if !d.ignoresDaemonTasks() {
+		return true, nil
+	}
+	daemon, err := isDaemonTask(ctx, svc, clusterName, task)
+	return !daemon, err
+}
+
+// hasLiveEssentialContainer reports whether an essential container of the task is neither stopped nor unhealthy.
+// A task whose essential containers are all gone is RUNNING only until ECS notices, and does nothing meanwhile.
+func hasLiveEssentialContainer(ctx context.Context, svc *ecsClient, task *ecs.Task) (bool, error) {
+	taskDefinition, err := svc.describeTaskDefinition(ctx, aws.StringValue(task.TaskDefinitionArn))
+	if err != nil {
+		return false, err
+	}
+	essential := make(map[string]bool)
+	for _, container := range taskDefinition.ContainerDefinitions {
+		// Containers are essential unless marked otherwise.
+		if container.Essential == nil || *container.Essential {
+			essential[aws.StringValue(container.Name)] = true
+		}
+	}
+
+	var seen bool
+	for _, container := range task.Containers {
+		if !essential[aws.StringValue(container.Name)] {
+			continue
+		}
+		seen = true
+		if aws.StringValue(container.LastStatus) != ecs.DesiredStatusStopped &&
+			aws.StringValue(container.HealthStatus) != ecs.HealthStatusUnhealthy {
+			return true, nil
+		}
+	}
+	// Without the status of any essential container, the task is assumed to be busy.
+	return !seen, nil
+}
+
+// isBlockingTask reports whether the task has to go away before the instance can be terminated.
+func (d *Drainer) isBlockingTask(task *ecs.Task) bool {
+	// Fargate tasks never run on a container instance, even on clusters mixing EC2 and Fargate capacity.
+	if aws.StringValue(task.LaunchType) == ecs.LaunchTypeFargate || task.ContainerInstanceArn == nil {
+		return false
+	}
+	if d.config.IgnoreDisconnectedTasks &&
+		aws.StringValue(task.Connectivity) == ecs.ConnectivityDisconnected {
+		return false
+	}
+	// One-off tasks, e.g. batch runs started by a pipeline, are acceptable to lose on scale-in.
+	if prefix := d.config.IgnoreStartedByPrefix; prefix != "" &&
+		strings.HasPrefix(aws.StringValue(task.StartedBy), prefix) {
+		return false
+	}
+	return true
+}
+
+// blockingTaskCount counts the tasks blocking draining. When some tasks could not be described, it returns
+// the count of those described, a lower bound, with ErrIncompleteTaskDescribe.
+func (d *Drainer) blockingTaskCount(ctx context.Context, svc *ecsClient, clusterName string, arns []*string) (int,
+	error) {
+	tasks, describeErr := svc.describeTasks(ctx, clusterName, arns)
+	if describeErr != nil && !errors.Is(describeErr, ErrIncompleteTaskDescribe) {
+		return 0, describeErr
+	}
+	var count int
+	for _, task := range tasks {
+		if !isActiveTaskStatus(aws.StringValue(task.LastStatus)) {
+			continue
+		}
+		blocking, err := d.blocksDraining(ctx, svc, clusterName, task)
+		if err != nil {
+			return 0, err
+		}
+		if blocking {
+			count++
+		}
+	}
+	return count, describeErr
+}
+
+const defaultStuckStoppingDuration = 5 * time.Minute
+
+// warnStuckStoppingTasks logs the tasks desired to stop that have not stopped for `STUCK_STOPPING_SECONDS`,
+// 5 minutes by default, e.g. because a container ignores SIGTERM.
+// The tasks are already described by the task check, so it calls no API.
+func (d *Drainer) warnStuckStoppingTasks(ctx context.Context, svc *ecsClient, clusterName string,
+	arns []*string) error {
+	threshold := d.config.StuckStopping
+	if threshold == 0 {
+		threshold = defaultStuckStoppingDuration
+	}
+
+	tasks, err := svc.describeTasks(ctx, clusterName, arns)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if aws.StringValue(task.DesiredStatus) != ecs.DesiredStatusStopped ||
+			aws.StringValue(task.LastStatus) == ecs.DesiredStatusStopped || task.StoppingAt == nil {
+			continue
+		}
+		if elapsed := d.elapsedSince(*task.StoppingAt); elapsed > threshold {
+			d.logger.warnf("task %q of %q has been %s for %s since it was asked to stop",
+				aws.StringValue(task.TaskArn), taskFamily(task), aws.StringValue(task.LastStatus), elapsed)
+		}
+	}
+	return nil
+}
+
+// taskFamily returns the family of the task definition of the task.
+func taskFamily(task *ecs.Task) string {
+	parsed, err := arn.Parse(aws.StringValue(task.TaskDefinitionArn))
+	if err != nil {
+		return aws.StringValue(task.TaskDefinitionArn)
+	}
+	family := strings.TrimPrefix(parsed.Resource, "task-definition/")
+	if i := strings.LastIndex(family, ":"); i >= 0 {
+		family = family[:i]
+	}
+	return family
+}
+
+const (
+	TaskCheckStrategyInstance = "instance"
+	TaskCheckStrategyService  = "service"
+)
+
+// checkTaskCount counts the tasks blocking draining by the strategy selected by `TASK_CHECK_STRATEGY`.
+func (d *Drainer) checkTaskCount(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) (int, error) {
+	switch strategy := d.config.TaskCheckStrategy; strategy {
+	case "", TaskCheckStrategyInstance:
+		return d.countTasks(ctx, svc, clusterName, containerInstanceArn)
+	case TaskCheckStrategyService:
+		return d.countServiceTasks(ctx, svc, clusterName, containerInstanceArn)
+	default:
+		return 0, fmt.Errorf("`TASK_CHECK_STRATEGY` is %q, not one of instance or service", strategy)
+	}
+}
+
+// countServiceTasks counts the tasks of the cluster's services placed on the container instance.
+// Unlike listing tasks by instance, it does not lag behind placement, but it ignores standalone tasks.
+func (d *Drainer) countServiceTasks(
+	ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) (int, error) {
+	var serviceArns []*string
+	fn := func(output *ecs.ListServicesOutput, _ bool) bool {
+		serviceArns = append(serviceArns, output.ServiceArns...)
+		return ctx.Err() == nil
+	}
+	err := pagesErr(ctx, svc.ListServicesPagesWithContext(ctx, &ecs.ListServicesInput{Cluster: &clusterName}, fn))
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, serviceArn := range serviceArns {
+		input := &ecs.ListTasksInput{Cluster: &clusterName, ServiceName: serviceArn}
+		var taskArns []*string
+		fn := func(output *ecs.ListTasksOutput, _ bool) bool {
+			taskArns = append(taskArns, output.TaskArns...)
+			return ctx.Err() == nil
+		}
+		if err := pagesErr(ctx, svc.ListTasksPagesWithContext(ctx, input, fn)); err != nil {
+			return 0, err
+		}
+
+		tasks, err := svc.describeTasks(ctx, clusterName, taskArns)
+		if err != nil {
+			return 0, err
+		}
+		for _, task := range tasks {
+			if aws.StringValue(task.ContainerInstanceArn) != *containerInstanceArn {
+				continue
+			}
+			blocking, err := d.blocksDraining(ctx, svc, clusterName, task)
+			if err != nil {
+				return 0, err
+			}
+			if blocking {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,647 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDrainerStopTasksLogsEachTask(t *testing.T) {
+	f := newTestDrainFixture()
+	f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+	d, out := newTestDrainer(t, f.clients)
+
+	stopped, err := d.stopRunningTasks(context.Background(), f.clients.ecs, "default",
+		f.containerInstance.ContainerInstanceArn, "scale-in")
+	if err != nil || stopped != 2 {
+		t.Fatalf("stopRunningTasks() = %d, %v, want 2 tasks stopped", stopped, err)
+	}
+	var events []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]string
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		if entry["msg"] == "stopped task" {
+			events = append(events, entry)
+		}
+	}
+	if len(events) != 2 {
+		t.Fatalf("stop events = %v, want one per stopped task", events)
+	}
+	for i, family := range []string{"web", "worker"} {
+		want := testTaskArn("default", fmt.Sprintf("task-%d", i+1))
+		if got := events[i]; got["taskArn"] != want || got["family"] != family || got["reason"] != "scale-in" {
+			t.Errorf("stop event = %v, want %s of %s stopped for scale-in", got, want, family)
+		}
+	}
+}
+
+func TestDrainerDrainRequireStopped(t *testing.T) {
+	t.Setenv("REQUIRE_STOPPED", "true")
+	t.Setenv("TASK_STATUSES", "RUNNING")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the running task", detail)
+	}
+
+	// The task is no longer counted once it is desired to stop, but it has not stopped yet.
+	f.ecs.stateMu.Lock()
+	f.task.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	f.ecs.stateMu.Unlock()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(detail.TrackedTaskArns) != 1 || detail.TrackedTaskArns[0] != *f.task.TaskArn {
+		t.Fatalf("Drain() = %+v, want to wait for the tracked task to stop", detail)
+	}
+
+	f.ecs.finishStopping()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the drain completed once the task stopped", detail, got)
+	}
+}
+
+func TestDrainerCountTasksDisconnected(t *testing.T) {
+	for _, tt := range []struct {
+		ignore string
+		want   int
+	}{
+		{"false", 2},
+		{"true", 1},
+	} {
+		t.Run(tt.ignore, func(t *testing.T) {
+			t.Setenv("IGNORE_DISCONNECTED_TASKS", tt.ignore)
+			t.Setenv("TASK_STATUSES", "RUNNING")
+			f := newTestDrainFixture()
+			disconnected := f.ecs.addTask("default", "task-2", f.containerInstance, "web")
+			f.ecs.stateMu.Lock()
+			f.task.Connectivity = aws.String(ecs.ConnectivityConnected)
+			disconnected.Connectivity = aws.String(ecs.ConnectivityDisconnected)
+			f.ecs.stateMu.Unlock()
+			d, _ := newTestDrainer(t, f.clients)
+
+			count, err := d.countTasks(context.Background(), f.clients.ecs, "default",
+				f.containerInstance.ContainerInstanceArn)
+			if err != nil || count != tt.want {
+				t.Errorf("countTasks() = %d, %v, want %d", count, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainTaskDrainGrace(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		respect     string
+		elapsed     time.Duration
+		wantStopped bool
+	}{
+		{"ignored", "false", 200 * time.Second, true},
+		{"within the longest grace", "true", 200 * time.Second, false},
+		{"after the longest grace", "true", 301 * time.Second, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FORCE_STOP_AFTER_SECONDS", "60")
+			t.Setenv("RESPECT_TASK_DRAIN_TAG", tt.respect)
+			f := newTestDrainFixture()
+			long := f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+			f.ecs.stateMu.Lock()
+			f.task.Tags = []*ecs.Tag{{Key: aws.String(taskDrainGraceTag), Value: aws.String("100")}}
+			long.Tags = []*ecs.Tag{{Key: aws.String(taskDrainGraceTag), Value: aws.String("300")}}
+			f.ecs.stateMu.Unlock()
+			d, _ := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			started := clock.Now().Add(-tt.elapsed)
+			f.detail.DrainStartedAt = &started
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail.ForceStopped != tt.wantStopped {
+				t.Errorf("ForceStopped = %v, want %v", detail.ForceStopped, tt.wantStopped)
+			}
+			wantStopped := 0
+			if tt.wantStopped {
+				wantStopped = 2
+			}
+			if got := f.ecs.count("StopTask"); got != wantStopped {
+				t.Errorf("StopTask calls = %d, want %d", got, wantStopped)
+			}
+		})
+	}
+}
+
+func TestDrainerCheckTaskCountStrategies(t *testing.T) {
+	for _, tt := range []struct {
+		strategy string
+		want     int
+	}{
+		{"", 2},
+		{TaskCheckStrategyInstance, 2},
+		// The standalone task-1 is not found through services.
+		{TaskCheckStrategyService, 1},
+	} {
+		t.Run(tt.strategy, func(t *testing.T) {
+			t.Setenv("TASK_CHECK_STRATEGY", tt.strategy)
+			f := newTestDrainFixture()
+			other := f.ecs.addContainerInstance("default", "ci-2", "i-2")
+			f.ecs.addService("default", "api", f.ecs.addTask("default", "task-2", f.containerInstance, "api"),
+				f.ecs.addTask("default", "task-3", other, "api"))
+			d, _ := newTestDrainer(t, f.clients)
+
+			count, err := d.checkTaskCount(context.Background(), f.clients.ecs, "default",
+				f.containerInstance.ContainerInstanceArn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.want {
+				t.Errorf("checkTaskCount() = %d, want %d", count, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainIgnoresFargateTasks(t *testing.T) {
+	f := newTestDrainFixture()
+	// ECS must never list a Fargate task of a mixed cluster on the instance, but if it does, it does not block.
+	fargate := f.ecs.addTask("default", "task-fargate", f.containerInstance, "web")
+	fargate.LaunchType = aws.String(ecs.LaunchTypeFargate)
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the EC2 task", detail)
+	}
+
+	f.stopTask()
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the Fargate task not to block the drain", detail, got)
+	}
+}
+
+func TestDrainerDrainStartingTasks(t *testing.T) {
+	for _, status := range []string{"PENDING", "PROVISIONING", "ACTIVATING"} {
+		t.Run(status, func(t *testing.T) {
+			f := newTestDrainFixture()
+			// A deploy placed the task seconds before the scale-in.
+			f.task.LastStatus = aws.String(status)
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !detail.Wait {
+				t.Errorf("Drain() = %+v, want to wait for the %s task", detail, status)
+			}
+			if got := f.autoscaling.completedResults(); len(got) != 0 {
+				t.Errorf("completions = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestDrainerCountTasksSecondPage(t *testing.T) {
+	f := newTestDrainFixture()
+	f.ecs.emptyFirstTaskPage = true
+	d, _ := newTestDrainer(t, f.clients)
+
+	count, err := d.countTasks(context.Background(), f.clients.ecs, "default", f.containerInstance.ContainerInstanceArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("countTasks() = %d, want the task of the second page counted", count)
+	}
+	if got := f.ecs.count("DescribeTasks"); got == 0 {
+		t.Error("DescribeTasks calls = 0, want the listed task described to confirm its status")
+	}
+}
+
+func TestDrainerDrainDaemonTasks(t *testing.T) {
+	for _, tt := range []struct {
+		ignore   string
+		wantWait bool
+	}{
+		{"", false},
+		{"false", true},
+	} {
+		t.Run(tt.ignore, func(t *testing.T) {
+			t.Setenv("IGNORE_DAEMON_TASKS", tt.ignore)
+			f := newTestDrainFixture()
+			// The only remaining task is of a log shipper running on every instance.
+			service := f.ecs.addService("default", "log-shipper", f.task)
+			service.SchedulingStrategy = aws.String(ecs.SchedulingStrategyDaemon)
+			d, _ := newTestDrainer(t, f.clients)
+
+			detail, err := d.Drain(context.Background(), f.detail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detail.Wait != tt.wantWait {
+				t.Errorf("Drain() = %+v, want Wait %v", detail, tt.wantWait)
+			}
+			if got := len(f.autoscaling.completedResults()); (got == 1) == tt.wantWait {
+				t.Errorf("completions = %d, want the lifecycle action completed unless waiting", got)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainForceStopAfter(t *testing.T) {
+	t.Setenv("FORCE_STOP_AFTER_SECONDS", "300")
+	f := newTestDrainFixture()
+	daemon := f.ecs.addTask("default", "task-daemon", f.containerInstance, "log-shipper")
+	service := f.ecs.addService("default", "log-shipper", daemon)
+	service.SchedulingStrategy = aws.String(ecs.SchedulingStrategyDaemon)
+	other := f.ecs.addContainerInstance("default", "ci-2", "i-2")
+	f.ecs.addTask("default", "task-other", other, "web")
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	detail, err := d.Drain(ctx, f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(299 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.ecs.stoppedTasks) != 0 {
+		t.Fatalf("stopped tasks = %v within `FORCE_STOP_AFTER_SECONDS`, want none", f.ecs.stoppedTasks)
+	}
+
+	clock.advance(2 * time.Second)
+	if detail, err = d.Drain(ctx, detail); err != nil {
+		t.Fatal(err)
+	}
+	// Only the task of the instance that blocks draining is stopped, not the daemon task.
+	if want := []string{aws.StringValue(f.task.TaskArn)}; fmt.Sprint(f.ecs.stoppedTasks) != fmt.Sprint(want) {
+		t.Errorf("stopped tasks = %v, want %v", f.ecs.stoppedTasks, want)
+	}
+	if reason := aws.StringValue(f.task.StoppedReason); !strings.Contains(reason, "did not drain within 5m0s") {
+		t.Errorf("reason = %q, want why the task was stopped", reason)
+	}
+	if !detail.ForceStopped {
+		t.Errorf("Drain() = %+v, want ForceStopped", detail)
+	}
+}
+
+func TestDrainerDrainIgnoreStartedByPrefix(t *testing.T) {
+	t.Setenv("IGNORE_STARTED_BY_PREFIX", "pipeline/")
+	f := newTestDrainFixture()
+	f.task.StartedBy = aws.String("pipeline/nightly-report")
+	d, _ := newTestDrainer(t, f.clients)
+
+	// The node only runs the one-off task, which does not hold it.
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the one-off task not to block the drain", detail, got)
+	}
+
+	// A task of a service, or started by anything else, still blocks.
+	f = newTestDrainFixture()
+	f.task.StartedBy = aws.String("ecs-svc/1234567890")
+	d, _ = newTestDrainer(t, f.clients)
+	if detail, err = d.Drain(context.Background(), f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Errorf("Drain() = %+v, want to wait for the service task", detail)
+	}
+}
+
+func TestDrainerDrainWarnsStuckStoppingTasks(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	f := newTestDrainFixture()
+	// task-1 ignores SIGTERM, while task-2 has only just been asked to stop.
+	f.task.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	f.task.LastStatus = aws.String("DEACTIVATING")
+	f.task.StoppingAt = aws.Time(now.Add(-10 * time.Minute))
+	recent := f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+	recent.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	recent.StoppingAt = aws.Time(now.Add(-time.Minute))
+	d, out := newTestDrainer(t, f.clients)
+	d = d.withClock(newFakeClock(now))
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the stopping tasks", detail)
+	}
+	var warned []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.Contains(line, "since it was asked to stop") {
+			warned = append(warned, line)
+		}
+	}
+	if len(warned) != 1 || !strings.Contains(warned[0], testTaskArn("default", "task-1")) ||
+		!strings.Contains(warned[0], `of \"web\"`) || !strings.Contains(warned[0], "DEACTIVATING") {
+		t.Errorf("warnings = %q, want task-1 of web warned as stuck", warned)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		timeouts []*int64
+		want     time.Duration
+	}{
+		{"default", []*int64{nil}, defaultStopTimeout},
+		{"shorter than the default", []*int64{aws.Int64(10)}, defaultStopTimeout},
+		{"longest container", []*int64{aws.Int64(60), nil, aws.Int64(120)}, 120 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			taskDefinition := &ecs.TaskDefinition{}
+			for _, timeout := range tt.timeouts {
+				taskDefinition.ContainerDefinitions = append(taskDefinition.ContainerDefinitions,
+					&ecs.ContainerDefinition{StopTimeout: timeout})
+			}
+			if got := stopTimeout(taskDefinition); got != tt.want {
+				t.Errorf("stopTimeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainerRemainingStopTimeout(t *testing.T) {
+	f := newTestDrainFixture()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	d, _ := newTestDrainer(t, f.clients)
+	d = d.withClock(newFakeClock(now))
+
+	// Tasks of web and worker stopping for 30s, with stopTimeouts of 60s and 120s; a stopped one is done.
+	worker := f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+	done := f.ecs.addTask("default", "task-3", f.containerInstance, "batch")
+	f.ecs.stateMu.Lock()
+	for family, timeout := range map[string]int64{"web": 60, "worker": 120, "batch": 600} {
+		f.ecs.taskDefinitions[testTaskDefinitionArn(family)].ContainerDefinitions = []*ecs.ContainerDefinition{
+			{StopTimeout: aws.Int64(timeout)},
+		}
+	}
+	for _, task := range []*ecs.Task{f.task, worker, done} {
+		task.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+		task.StoppingAt = aws.Time(now.Add(-30 * time.Second))
+	}
+	done.LastStatus = aws.String(ecs.DesiredStatusStopped)
+	f.ecs.stateMu.Unlock()
+
+	grace, err := d.remainingStopTimeout(context.Background(), f.clients.ecs, "default",
+		f.containerInstance.ContainerInstanceArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grace != 90*time.Second {
+		t.Errorf("remainingStopTimeout() = %s, want the 90s left of the longest stopTimeout", grace)
+	}
+}
+
+func TestDrainerCountTasksStatuses(t *testing.T) {
+	for _, tt := range []struct {
+		statuses      string
+		want          int
+		wantListCalls int
+	}{
+		{"", 2, 2},
+		{"RUNNING", 1, 1},
+		{"PENDING, RUNNING, STOPPED", 2, 3},
+	} {
+		t.Run(tt.statuses, func(t *testing.T) {
+			t.Setenv("TASK_STATUSES", tt.statuses)
+			f := newTestDrainFixture()
+			// task-2 is desired to stop but still running, so only the STOPPED check counts it.
+			stopping := f.ecs.addTask("default", "task-2", f.containerInstance, "web")
+			f.ecs.stateMu.Lock()
+			stopping.DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+			f.ecs.stateMu.Unlock()
+			d, _ := newTestDrainer(t, f.clients)
+
+			count, err := d.countTasks(context.Background(), f.clients.ecs, "default",
+				f.containerInstance.ContainerInstanceArn)
+			if err != nil || count != tt.want {
+				t.Errorf("countTasks() = %d, %v, want %d", count, err, tt.want)
+			}
+			if got := f.ecs.count("ListTasks"); got != tt.wantListCalls {
+				t.Errorf("ListTasks calls = %d, want one per status", got)
+			}
+		})
+	}
+}
+
+func TestDrainerListCheckedTaskArnsFamilyFilter(t *testing.T) {
+	// web is listed twice, and its tasks once.
+	t.Setenv("TASK_FAMILY_FILTER", "web, worker, web")
+	f := newTestDrainFixture()
+	f.ecs.pageSize = 1
+	worker := f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+	web := f.ecs.addTask("default", "task-3", f.containerInstance, "web")
+	f.ecs.addTask("default", "task-4", f.containerInstance, "batch")
+	d, _ := newTestDrainer(t, f.clients)
+
+	arns, err := d.listCheckedTaskArns(context.Background(), f.clients.ecs, "default",
+		f.containerInstance.ContainerInstanceArn, ecs.DesiredStatusRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{aws.StringValue(f.task.TaskArn), aws.StringValue(web.TaskArn), aws.StringValue(worker.TaskArn)}
+	if got := aws.StringValueSlice(arns); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listCheckedTaskArns() = %v, want the union %v", got, want)
+	}
+	if got := f.ecs.count("ListTasks"); got != 3 {
+		t.Errorf("ListTasks calls = %d, want one per family", got)
+	}
+}
+
+func TestDrainerCountTasksContainerLevelStatus(t *testing.T) {
+	for _, tt := range []struct {
+		enabled string
+		want    int
+	}{
+		{"false", 4},
+		{"true", 2},
+	} {
+		t.Run(tt.enabled, func(t *testing.T) {
+			t.Setenv("USE_CONTAINER_LEVEL_STATUS", tt.enabled)
+			t.Setenv("TASK_STATUSES", "RUNNING")
+			f := newTestDrainFixture()
+			worker := f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+			api := f.ecs.addTask("default", "task-3", f.containerInstance, "api")
+			f.ecs.addTask("default", "task-4", f.containerInstance, "batch")
+			container := func(name, lastStatus, healthStatus string) *ecs.Container {
+				return &ecs.Container{
+					Name: aws.String(name), LastStatus: aws.String(lastStatus), HealthStatus: aws.String(healthStatus),
+				}
+			}
+			f.ecs.stateMu.Lock()
+			for _, family := range []string{"web", "worker", "api"} {
+				f.ecs.taskDefinitions[testTaskDefinitionArn(family)].ContainerDefinitions = []*ecs.ContainerDefinition{
+					{Name: aws.String("app")},
+					{Name: aws.String("sidecar"), Essential: aws.Bool(false)},
+				}
+			}
+			// The RUNNING task-1 has its essential container stopped and task-2 unhealthy, while task-3 is
+			// healthy and task-4 has no container status to tell.
+			f.task.Containers = []*ecs.Container{
+				container("app", ecs.DesiredStatusStopped, ecs.HealthStatusUnknown),
+				container("sidecar", ecs.DesiredStatusRunning, ecs.HealthStatusHealthy),
+			}
+			worker.Containers = []*ecs.Container{container("app", ecs.DesiredStatusRunning, ecs.HealthStatusUnhealthy)}
+			api.Containers = []*ecs.Container{container("app", ecs.DesiredStatusRunning, ecs.HealthStatusHealthy)}
+			f.ecs.stateMu.Unlock()
+			d, _ := newTestDrainer(t, f.clients)
+
+			count, err := d.countTasks(context.Background(), f.clients.ecs, "default",
+				f.containerInstance.ContainerInstanceArn)
+			if err != nil || count != tt.want {
+				t.Errorf("countTasks() = %d, %v, want %d", count, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainPreviewForceStop(t *testing.T) {
+	t.Setenv("PREVIEW_FORCE_STOP", "true")
+	t.Setenv("IGNORE_STARTED_BY_PREFIX", "pipeline/")
+	f := newTestDrainFixture()
+	worker := f.ecs.addTask("default", "task-2", f.containerInstance, "worker")
+	worker.StartedBy = aws.String("ecs-svc/1234567890")
+	f.ecs.addTask("default", "task-3", f.containerInstance, "report").StartedBy = aws.String("pipeline/nightly")
+	f.ecs.addTask("default", "task-4", f.containerInstance, "web").DesiredStatus = aws.String(ecs.DesiredStatusStopped)
+	d, out := newTestDrainer(t, f.clients)
+
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait || len(f.ecs.stoppedTasks) != 0 {
+		t.Fatalf("Drain() = %+v, stopped tasks = %v, want the tasks previewed only", detail, f.ecs.stoppedTasks)
+	}
+	var preview interface{}
+	for _, line := range logLines(t, out) {
+		if line["msg"] == "previewed the tasks a force stop would stop" {
+			preview = line["tasks"]
+		}
+	}
+	// The one-off task started by the pipeline and the stopped task would not be stopped.
+	want := []interface{}{
+		map[string]interface{}{"TaskArn": aws.StringValue(f.task.TaskArn), "Family": "web"},
+		map[string]interface{}{"TaskArn": aws.StringValue(worker.TaskArn), "Family": "worker",
+			"StartedBy": "ecs-svc/1234567890"},
+	}
+	if !reflect.DeepEqual(preview, want) {
+		t.Errorf("preview = %v, want %v", preview, want)
+	}
+
+	// Without `PREVIEW_FORCE_STOP`, nothing is previewed.
+	t.Setenv("PREVIEW_FORCE_STOP", "")
+	d, out = newTestDrainer(t, f.clients)
+	if _, err := d.Drain(context.Background(), detail); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "previewed the tasks") {
+		t.Errorf("log = %q, want no preview", out.String())
+	}
+}
+
+func TestListTaskArnsCancelled(t *testing.T) {
+	f := newTestDrainFixture()
+	f.ecs.pageSize = 1
+	f.ecs.addTask("default", "task-2", f.containerInstance, "web")
+	f.ecs.addTask("default", "task-3", f.containerInstance, "web")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var pages int
+	f.ecs.onPage = func() {
+		pages++
+		cancel()
+	}
+
+	arns, err := listTaskArns(ctx, f.clients.ecs, "default", f.containerInstance.ContainerInstanceArn,
+		ecs.DesiredStatusRunning)
+	if !errors.Is(err, context.Canceled) || arns != nil {
+		t.Errorf("listTaskArns() = %v, %v, want the error of the cancelled context", arns, err)
+	}
+	if pages != 1 {
+		t.Errorf("pages = %d, want paging to stop once the context is done", pages)
+	}
+}
+
+func TestDrainerCountTasksFastPath(t *testing.T) {
+	unfiltered := map[string]string{"IGNORE_DAEMON_TASKS": "false"}
+	latency := map[string]string{"IGNORE_DAEMON_TASKS": "false", "FAST_PATH": FastPathLatency}
+	for _, tt := range []struct {
+		name              string
+		env               map[string]string
+		empty             bool
+		want              int
+		wantListCalls     int
+		wantDescribeCalls int
+	}{
+		{"busy", unfiltered, false, 1, 2, 1},
+		{"busy for latency", latency, false, 1, 1, 0},
+		// The stopped task is still described to tell whether it has stopped.
+		{"empty", unfiltered, true, 0, 2, 1},
+		{"empty for latency", latency, true, 0, 2, 1},
+		// The tasks must be described when they are filtered, e.g. to leave out daemon tasks by default,
+		// so the listing settles nothing.
+		{"filtered for latency", map[string]string{"FAST_PATH": FastPathLatency}, false, 1, 2, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			f := newTestDrainFixture()
+			if tt.empty {
+				f.stopTask()
+			}
+			d, _ := newTestDrainer(t, f.clients)
+
+			count, err := d.countTasks(context.Background(), f.clients.ecs, "default",
+				f.containerInstance.ContainerInstanceArn)
+			if err != nil || count != tt.want {
+				t.Errorf("countTasks() = %d, %v, want %d", count, err, tt.want)
+			}
+			if got := f.ecs.count("ListTasks"); got != tt.wantListCalls {
+				t.Errorf("ListTasks calls = %d, want %d", got, tt.wantListCalls)
+			}
+			if got := f.ecs.count("DescribeTasks"); got != tt.wantDescribeCalls {
+				t.Errorf("DescribeTasks calls = %d, want %d", got, tt.wantDescribeCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package drainer
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+)
+
+// writeTimestreamRecords records the task count of every poll and the drain duration on completion.
+// It is a no-op unless `TIMESTREAM_DATABASE` and `TIMESTREAM_TABLE` are set, and failures are only logged
+// because analytics must not fail the drain.
+func (d *Drainer) writeTimestreamRecords(
+	ctx context.Context, clients *awsClients, detail *CloudWatchEventDetail, decision *DecisionRecord) {
+	database, table := d.config.TimestreamDatabase, d.config.TimestreamTable
+	if database == "" || table == "" {
+		return
+	}
+
+	records := []*timestreamwrite.Record{
+		newTimestreamRecord("RunningTasksCount", decision.RunningTasksCount),
+		newTimestreamRecord("PendingTasksCount", decision.PendingTasksCount),
+	}
+	if !detail.Wait {
+		records = append(records, newTimestreamRecord("DrainDurationSeconds", decision.ElapsedSeconds))
+	}
+
+	_, err := clients.timestream.WriteRecordsWithContext(ctx, &timestreamwrite.WriteRecordsInput{
+		DatabaseName: &database,
+		TableName:    &table,
+		CommonAttributes: &timestreamwrite.Record{
+			Dimensions: []*timestreamwrite.Dimension{
+				{Name: aws.String("ClusterName"), Value: &decision.ClusterName},
+				{Name: aws.String("AutoScalingGroupName"), Value: &detail.AutoScalingGroupName},
+				{Name: aws.String("EC2InstanceId"), Value: aws.String(detail.instanceKey())},
+			},
+			Time:     aws.String(strconv.FormatInt(decision.Time.UnixNano()/int64(time.Millisecond), 10)),
+			TimeUnit: aws.String(timestreamwrite.TimeUnitMilliseconds),
+		},
+		Records: records,
+	})
+	if err != nil {
+		d.logger.warnf("failed to write Timestream records: %v", err)
+	}
+}
+
+func newTimestreamRecord(name string, value int64) *timestreamwrite.Record {
+	return &timestreamwrite.Record{
+		MeasureName:      aws.String(name),
+		MeasureValue:     aws.String(strconv.FormatInt(value, 10)),
+		MeasureValueType: aws.String(timestreamwrite.MeasureValueTypeBigint),
+	}
+}
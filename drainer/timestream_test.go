@@ -0,0 +1,92 @@
+package drainer
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+)
+
+func TestDrainerDrainTimestreamRecords(t *testing.T) {
+	t.Setenv("TIMESTREAM_DATABASE", "drains")
+	t.Setenv("TIMESTREAM_TABLE", "polls")
+	f := newTestDrainFixture()
+	svc := &fakeTimestream{}
+	f.clients.timestream = svc
+	d, _ := newTestDrainer(t, f.clients)
+	clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	d = d.withClock(clock)
+	ctx := context.Background()
+
+	// The state machine passes the event on, and the drain lasts from its time.
+	evt := testEvent(t, f.detail)
+	evt.Time = clock.Now()
+	evt, err := d.handleEvent(ctx, evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.stopTask()
+	clock.advance(90 * time.Second)
+	if _, err := d.handleEvent(ctx, evt); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.inputs) != 2 {
+		t.Fatalf("WriteRecords calls = %d, want one per poll", len(svc.inputs))
+	}
+	first, last := svc.inputs[0], svc.inputs[1]
+	if aws.StringValue(first.DatabaseName) != "drains" || aws.StringValue(first.TableName) != "polls" {
+		t.Errorf("table = %s.%s, want drains.polls",
+			aws.StringValue(first.DatabaseName), aws.StringValue(first.TableName))
+	}
+	dimensions := map[string]string{}
+	for _, dimension := range first.CommonAttributes.Dimensions {
+		dimensions[aws.StringValue(dimension.Name)] = aws.StringValue(dimension.Value)
+	}
+	want := map[string]string{"ClusterName": "default", "AutoScalingGroupName": "asg", "EC2InstanceId": "i-1"}
+	if !reflect.DeepEqual(dimensions, want) {
+		t.Errorf("dimensions = %v, want %v", dimensions, want)
+	}
+	if got := aws.StringValue(first.CommonAttributes.Time); got != "1577934245000" {
+		t.Errorf("Time = %s, want the poll time in milliseconds", got)
+	}
+	if got, want := timestreamMeasures(first), map[string]string{
+		"RunningTasksCount": "1", "PendingTasksCount": "0",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("measures = %v, want %v while draining", got, want)
+	}
+	if got := timestreamMeasures(last)["DrainDurationSeconds"]; got != "90" {
+		t.Errorf("DrainDurationSeconds = %q, want 90 on completion", got)
+	}
+	for _, record := range last.Records {
+		if aws.StringValue(record.MeasureValueType) != timestreamwrite.MeasureValueTypeBigint {
+			t.Errorf("MeasureValueType = %s, want BIGINT", aws.StringValue(record.MeasureValueType))
+		}
+	}
+}
+
+func TestDrainerDrainTimestreamFailure(t *testing.T) {
+	t.Setenv("TIMESTREAM_DATABASE", "drains")
+	t.Setenv("TIMESTREAM_TABLE", "polls")
+	f := newTestDrainFixture()
+	svc := &fakeTimestream{}
+	svc.fail("WriteRecords", errors.New("access denied"))
+	f.clients.timestream = svc
+	d, _ := newTestDrainer(t, f.clients)
+
+	if detail, err := d.Drain(context.Background(), f.detail); err != nil || !detail.Wait {
+		t.Errorf("Drain() = %+v, %v, want the drain to go on without the records", detail, err)
+	}
+}
+
+func timestreamMeasures(input *timestreamwrite.WriteRecordsInput) map[string]string {
+	measures := map[string]string{}
+	for _, record := range input.Records {
+		measures[aws.StringValue(record.MeasureName)] = aws.StringValue(record.MeasureValue)
+	}
+	return measures
+}
@@ -0,0 +1,19 @@
+package drainer
+
+import "time"
+
+const (
+	PhaseClusterResolution = "clusterResolution"
+	PhaseContainerInstance = "containerInstanceLookup"
+	PhaseTaskCheck         = "taskCheck"
+	PhaseHeartbeat         = "heartbeat"
+	PhaseComplete          = "complete"
+)
+
+// phaseTimings are the durations of the phases of a poll in milliseconds, to tell which one dominates the runtime.
+type phaseTimings map[string]int64
+
+// add records elapsed as the duration of the phase.
+func (t phaseTimings) add(phase string, elapsed time.Duration) {
+	t[phase] += int64(elapsed / time.Millisecond)
+}
@@ -0,0 +1,23 @@
+package drainer
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// traceSession returns a copy of the session with its AWS calls instrumented with X-Ray. It is opt-in with
+// `ENABLE_XRAY` so that local runs without the X-Ray daemon do not fail. xray.AWSSession adds its handlers to
+// the session it is given, so the session cached across invocations is left as it is.
+func traceSession(sess *session.Session) *session.Session {
+	return xray.AWSSession(sess.Copy())
+}
+
+// traceSubsegment runs fn in an X-Ray subsegment when `ENABLE_XRAY` is enabled.
+func (d *Drainer) traceSubsegment(ctx context.Context, name string, fn func(context.Context) error) error {
+	if !d.config.XRay {
+		return fn(ctx)
+	}
+	return xray.Capture(ctx, name, fn)
+}
@@ -0,0 +1,104 @@
+package drainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// sampleAll samples every segment.
+type sampleAll struct{}
+
+func (sampleAll) ShouldTrace(*sampling.Request) *sampling.Decision {
+	return &sampling.Decision{Sample: true}
+}
+
+// traceDocument is a segment as sent to the X-Ray daemon.
+type traceDocument struct {
+	Name        string
+	Subsegments []traceDocument
+}
+
+func (doc traceDocument) names() []string {
+	var names []string
+	for _, subsegment := range doc.Subsegments {
+		names = append(names, subsegment.Name)
+		names = append(names, subsegment.names()...)
+	}
+	return names
+}
+
+// recordTraces returns a context sending the segments to a local daemon, and a function waiting for the
+// document of the segment named name.
+func recordTraces(t *testing.T, name string) (context.Context, func() traceDocument) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	emitter, err := xray.NewDefaultEmitter(conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := xray.ContextWithConfig(context.Background(), xray.Config{
+		DaemonAddr:       conn.LocalAddr().String(),
+		Emitter:          emitter,
+		SamplingStrategy: sampleAll{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx, func() traceDocument {
+		t.Helper()
+		buf := make([]byte, 64*1024)
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("segment %q was not sent: %v", name, err)
+			}
+			var doc traceDocument
+			if err := json.Unmarshal(bytes.TrimPrefix(buf[:n], []byte(xray.Header)), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if doc.Name == name {
+				return doc
+			}
+		}
+	}
+}
+
+func TestDrainerDrainTracing(t *testing.T) {
+	t.Setenv("ENABLE_XRAY", "true")
+	f := newTestDrainFixture()
+	d, _ := newTestDrainer(t, f.clients)
+	ctx, wait := recordTraces(t, "drain")
+
+	ctx, seg := xray.BeginSegment(ctx, "drain")
+	detail, err := d.Drain(ctx, f.detail)
+	seg.Close(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !detail.Wait {
+		t.Fatalf("Drain() = %+v, want to wait for the task", detail)
+	}
+
+	got := map[string]bool{}
+	for _, name := range wait().names() {
+		got[name] = true
+	}
+	for _, want := range []string{"getECSClusterName", "getContainerInstance", "taskExists", "heartbeat"} {
+		if !got[want] {
+			t.Errorf("subsegments = %v, want %s traced", got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// DetailTypeDrainCancelled is the detail type of the event put when a scale-in is cancelled after the drain began.
+// Its detail has `EC2InstanceId` and optionally `ClusterName`.
+const DetailTypeDrainCancelled = "ECS Node Drain Cancelled"
+
+// drainedAttribute marks the container instances set to DRAINING by this function, which are the only ones
+// uncordoned on cancellation.
+const drainedAttribute = "ecs-auto-draining.drained"
+
+// markDrained puts the attribute on the container instance. A failure only makes it impossible to uncordon.
+func (d *Drainer) markDrained(ctx context.Context, svc *ecsClient, clusterName string, containerInstanceArn *string) {
+	_, err := svc.PutAttributesWithContext(ctx, &ecs.PutAttributesInput{
+		Cluster: &clusterName,
+		Attributes: []*ecs.Attribute{{
+			Name:       aws.String(drainedAttribute),
+			Value:      aws.String("true"),
+			TargetId:   containerInstanceArn,
+			TargetType: aws.String(ecs.TargetTypeContainerInstance),
+		}},
+	})
+	if err != nil {
+		d.logger.warnf("failed to mark %q as drained: %v", aws.StringValue(containerInstanceArn), err)
+	}
+}
+
+func isMarkedDrained(containerInstance *ecs.ContainerInstance) bool {
+	for _, attr := range containerInstance.Attributes {
+		if aws.StringValue(attr.Name) == drainedAttribute {
+			return true
+		}
+	}
+	return false
+}
+
+// uncordonInstance sets the container instance back to ACTIVE when its scale-in was cancelled,
+// provided that this function drained it.
+func (d *Drainer) uncordonInstance(ctx context.Context, evt *events.CloudWatchEvent) (*events.CloudWatchEvent, error) {
+	d.logEvent(evt)
+
+	var detail *CloudWatchEventDetail
+	if err := json.Unmarshal(evt.Detail, &detail); err != nil {
+		return nil, err
+	}
+	if detail == nil || detail.EC2InstanceId == "" {
+		return nil, fmt.Errorf("`detail.EC2InstanceId` is empty: %w", ErrInvalidEventDetail)
+	}
+	lg := d.logger.with(logFields{"instanceId": detail.EC2InstanceId})
+
+	clients := d.newClients(evt)
+
+	clusterName, err := d.getECSClusterName(ctx, clients, evt, detail.EC2InstanceId)
+	if err != nil {
+		return nil, err
+	}
+	clusterName, containerInstances, err := d.resolveContainerInstances(
+		ctx, clients.ecs, clusterName, detail.EC2InstanceId)
+	if err != nil {
+		return nil, err
+	}
+	detail.Wait = false
+	if len(containerInstances) == 0 {
+		lg.infof("%q does not have the instance, skipping uncordoning", clusterName)
+		return returnDetail(evt, detail)
+	}
+
+	for _, containerInstance := range containerInstances {
+		if err := uncordonContainerInstance(ctx, lg, clients.ecs, clusterName, containerInstance); err != nil {
+			return nil, err
+		}
+	}
+	return returnDetail(evt, detail)
+}
+
+func uncordonContainerInstance(
+	ctx context.Context, lg *logger, svc *ecsClient, clusterName string, containerInstance *ecs.ContainerInstance,
+) error {
+	arn := aws.StringValue(containerInstance.ContainerInstanceArn)
+	status := aws.StringValue(containerInstance.Status)
+	if status != ecs.ContainerInstanceStatusDraining || !isMarkedDrained(containerInstance) {
+		lg.infof("%q is %s and was not drained by this function, leaving it", arn, status)
+		return nil
+	}
+
+	_, err := svc.UpdateContainerInstancesStateWithContext(ctx, &ecs.UpdateContainerInstancesStateInput{
+		Cluster:            &clusterName,
+		ContainerInstances: []*string{containerInstance.ContainerInstanceArn},
+		Status:             aws.String(ecs.ContainerInstanceStatusActive),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteAttributesWithContext(ctx, &ecs.DeleteAttributesInput{
+		Cluster: &clusterName,
+		Attributes: []*ecs.Attribute{{
+			Name:       aws.String(drainedAttribute),
+			TargetId:   containerInstance.ContainerInstanceArn,
+			TargetType: aws.String(ecs.TargetTypeContainerInstance),
+		}},
+	})
+	if err != nil {
+		lg.warnf("failed to unmark %q: %v", arn, err)
+	}
+	lg.infof("scale-in was cancelled, set %q in %q back to ACTIVE", arn, clusterName)
+	return nil
+}
@@ -0,0 +1,57 @@
+package drainer
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// cancelledEvent returns the event of the cancelled scale-in of the instance.
+func cancelledEvent(t *testing.T, instanceID string) *events.CloudWatchEvent {
+	t.Helper()
+	raw, err := json.Marshal(&CloudWatchEventDetail{EC2InstanceId: instanceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &events.CloudWatchEvent{DetailType: DetailTypeDrainCancelled, Detail: raw}
+}
+
+func TestDrainerHandleEventUncordon(t *testing.T) {
+	f := newTestDrainFixture()
+	// ci-2 was set to DRAINING by someone else.
+	other := f.ecs.addContainerInstance("default", "ci-2", "i-2")
+	other.Status = aws.String(ecs.ContainerInstanceStatusDraining)
+	f.ec2.addInstance("i-2", "#!/bin/bash\necho ECS_CLUSTER=default >> /etc/ecs/ecs.config\n")
+	d, _ := newTestDrainer(t, f.clients)
+	ctx := context.Background()
+	arn := *f.containerInstance.ContainerInstanceArn
+
+	if _, err := d.Drain(ctx, f.detail); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.containerInstanceStatus(arn); got != ecs.ContainerInstanceStatusDraining {
+		t.Fatalf("status = %q, want DRAINING", got)
+	}
+
+	if _, err := d.handleEvent(ctx, cancelledEvent(t, "i-1")); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.containerInstanceStatus(arn); got != ecs.ContainerInstanceStatusActive {
+		t.Errorf("status = %q, want ACTIVE after the scale-in was cancelled", got)
+	}
+	if got := f.ecs.attributes[arn][drainedAttribute]; got != "" {
+		t.Errorf("%s = %q, want the mark removed", drainedAttribute, got)
+	}
+
+	// An instance this function did not drain is left alone.
+	if _, err := d.handleEvent(ctx, cancelledEvent(t, "i-2")); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.ecs.containerInstanceStatus(*other.ContainerInstanceArn); got != ecs.ContainerInstanceStatusDraining {
+		t.Errorf("status = %q, want the DRAINING of someone else kept", got)
+	}
+}
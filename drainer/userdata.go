@@ -0,0 +1,110 @@
+package drainer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// decodeUserData unwraps gzip-compressed and cloud-init `multipart/mixed` UserData into plain text.
+// The text parts of a multipart document are concatenated.
+func decodeUserData(userData []byte) (string, error) {
+	if bytes.HasPrefix(userData, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(userData))
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		if userData, err = ioutil.ReadAll(reader); err != nil {
+			return "", err
+		}
+	}
+
+	// UserData that is not a multipart MIME document is plain text.
+	header, body, err := readMIMEHeader(userData)
+	if err != nil {
+		return string(userData), nil
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return string(userData), nil
+	}
+
+	var text strings.Builder
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType != "" &&
+			!strings.HasPrefix(partType, "text/") {
+			continue
+		}
+
+		var partReader io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			partReader = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		content, err := ioutil.ReadAll(partReader)
+		if err != nil {
+			return "", err
+		}
+		decoded, err := decodeUserData(content)
+		if err != nil {
+			return "", err
+		}
+		text.WriteString(decoded)
+		text.WriteString("\n")
+	}
+	return text.String(), nil
+}
+
+func readMIMEHeader(data []byte) (textproto.MIMEHeader, io.Reader, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, reader, nil
+}
+
+// validClusterNameRegexp is the character set of ECS cluster names.
+var validClusterNameRegexp = regexp.MustCompile(`^[-\w]{1,255}$`) // nolint:gochecknoglobals
+
+// extractClusterName returns the cluster name that `CLUSTER_NAME_REGEX` captures in the UserData, or "" if it has none.
+// When the UserData assigns it more than once, e.g. a base template and an override both appending to
+// `/etc/ecs/ecs.config`, the last assignment wins as it does for the agent.
+// The capture of a custom `CLUSTER_NAME_REGEX` may carry the rest of the line, so a trailing comment, whitespace
+// and quotes are stripped before the name is validated.
+func (d *Drainer) extractClusterName(userData string) (string, error) {
+	matches := d.config.ClusterNameRegexp.FindAllStringSubmatch(userData, -1)
+	if len(matches) == 0 || len(matches[len(matches)-1]) < 2 {
+		return "", nil
+	}
+	if len(matches) > 1 {
+		d.logger.infof("UserData assigns the cluster %d times, using the last one", len(matches))
+	}
+	captured := matches[len(matches)-1][1]
+	clusterName := captured
+	if i := strings.Index(clusterName, "#"); i >= 0 {
+		clusterName = clusterName[:i]
+	}
+	clusterName = strings.Trim(strings.TrimSpace(clusterName), `"'`)
+	if !validClusterNameRegexp.MatchString(clusterName) {
+		return "", fmt.Errorf("`ECS_CLUSTER` in UserData is %q, which is not a valid cluster name", captured)
+	}
+	return clusterName, nil
+}
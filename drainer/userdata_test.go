@@ -0,0 +1,139 @@
+package drainer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testMultipartUserData returns a cloud-init document whose shell script setting the cluster is base64-encoded.
+func testMultipartUserData() string {
+	return `Content-Type: multipart/mixed; boundary="==BOUNDARY=="
+MIME-Version: 1.0
+
+--==BOUNDARY==
+Content-Type: text/cloud-config; charset="us-ascii"
+
+packages:
+- jq
+
+--==BOUNDARY==
+Content-Type: application/octet-stream
+
+ECS_CLUSTER=ignored
+--==BOUNDARY==
+Content-Type: text/x-shellscript; charset="us-ascii"
+Content-Transfer-Encoding: base64
+
+` + base64.StdEncoding.EncodeToString([]byte("#!/bin/bash\necho ECS_CLUSTER=web >> /etc/ecs/ecs.config\n")) + `
+--==BOUNDARY==--
+`
+}
+
+func TestDecodeUserDataClusterName(t *testing.T) {
+	d, _ := newTestDrainer(t, &awsClients{})
+	for _, tt := range []struct {
+		name     string
+		userData []byte
+		want     string
+	}{
+		{"plain", []byte("#!/bin/bash\necho ECS_CLUSTER=web >> /etc/ecs/ecs.config\n"), "web"},
+		{"gzip", gzipBytes(t, "#!/bin/bash\necho ECS_CLUSTER=web >> /etc/ecs/ecs.config\n"), "web"},
+		{"multipart", []byte(testMultipartUserData()), "web"},
+		{"gzip multipart", gzipBytes(t, testMultipartUserData()), "web"},
+		{"double quoted", []byte("[Service]\nEnvironment=\"ECS_CLUSTER=web-1\"\n"), "web-1"},
+		{"single quoted", []byte("#!/bin/bash\necho 'ECS_CLUSTER=web_1' >> /etc/ecs/ecs.config\n"), "web_1"},
+		{"quoted value", []byte("ECS_CLUSTER=\"web\"\n"), "web"},
+		{"none", []byte("#!/bin/bash\nyum update -y\n"), ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := decodeUserData(tt.userData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clusterName, err := d.extractClusterName(text)
+			if err != nil || clusterName != tt.want {
+				t.Errorf("extractClusterName(%q) = %q, %v, want %q", text, clusterName, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractClusterNameCustomRegexp(t *testing.T) {
+	t.Setenv("CLUSTER_NAME_REGEX", `"ECS_CLUSTER"\s*:\s*"([^"]+)"`)
+	d, _ := newTestDrainer(t, &awsClients{})
+
+	text := "#!/bin/bash\ncat <<EOF > /etc/ecs/ecs.config.json\n" +
+		"{\"ECS_CLUSTER\": \"web\", \"ECS_LOGLEVEL\": \"info\"}\nEOF\n"
+	if clusterName, err := d.extractClusterName(text); err != nil || clusterName != "web" {
+		t.Errorf("extractClusterName() = %q, %v, want the first capture group web", clusterName, err)
+	}
+	// The default pattern no longer applies.
+	plain := "#!/bin/bash\necho ECS_CLUSTER=web >> /etc/ecs/ecs.config\n"
+	if clusterName, err := d.extractClusterName(plain); err != nil || clusterName != "" {
+		t.Errorf("extractClusterName() = %q, %v, want no cluster name", clusterName, err)
+	}
+}
+
+func TestExtractClusterNameTrimmed(t *testing.T) {
+	// A capture of the rest of the line carries whatever follows the name.
+	t.Setenv("CLUSTER_NAME_REGEX", `ECS_CLUSTER=(.*)`)
+	d, _ := newTestDrainer(t, &awsClients{})
+	heredoc := func(line string) string {
+		return "#!/bin/bash\ncat <<EOF >> /etc/ecs/ecs.config\n" + line + "\nEOF\n"
+	}
+	for _, tt := range []struct {
+		name    string
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"trailing whitespace", "ECS_CLUSTER=web \t", "web", false},
+		{"comment", "ECS_CLUSTER=web # production", "web", false},
+		{"quoted with comment", `ECS_CLUSTER="web-1" # production`, "web-1", false},
+		{"empty after trim", "ECS_CLUSTER=   # set by the pipeline", "", true},
+		{"invalid character", "ECS_CLUSTER=web/production", "", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clusterName, err := d.extractClusterName(heredoc(tt.line))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "not a valid cluster name") {
+					t.Errorf("extractClusterName() = %q, %v, want the malformed value reported", clusterName, err)
+				}
+				return
+			}
+			if err != nil || clusterName != tt.want {
+				t.Errorf("extractClusterName() = %q, %v, want %q", clusterName, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractClusterNameLastAssignment(t *testing.T) {
+	d, out := newTestDrainer(t, &awsClients{})
+
+	// The override appended after the base template wins, as it does in `/etc/ecs/ecs.config`.
+	text := "#!/bin/bash\necho ECS_CLUSTER=base >> /etc/ecs/ecs.config\n" +
+		"echo ECS_CLUSTER=override >> /etc/ecs/ecs.config\n"
+	if clusterName, err := d.extractClusterName(text); err != nil || clusterName != "override" {
+		t.Errorf("extractClusterName() = %q, %v, want the last assignment override", clusterName, err)
+	}
+	if !strings.Contains(out.String(), "UserData assigns the cluster 2 times, using the last one") {
+		t.Errorf("log = %q, want the assignments noted", out.String())
+	}
+}
@@ -0,0 +1,179 @@
+package drainer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+const (
+	webhookTimeout         = 5 * time.Second
+	webhookSignatureHeader = "X-Signature-256"
+)
+
+const (
+	CompletionTypeStarted  = "DrainStarted"
+	CompletionTypeDrained  = "DrainCompleted"
+	CompletionTypeTimedOut = "DrainTimedOut"
+)
+
+const (
+	CompletionEventSource     = "ecs-auto-draining"
+	CompletionEventDetailType = "ECS Node Drain Completed"
+	StartedEventDetailType    = "ECS Node Drain Started"
+)
+
+// CompletionPayload is sent to the notifiers when a drain completes, or starts if `NOTIFIERS` is set.
+// Drains that gave up on a timeout have the `DrainTimedOut` type.
+type CompletionPayload struct {
+	Type                 string
+	ClusterName          string
+	AutoScalingGroupName string
+	EC2InstanceId        string // nolint:golint,stylecheck
+	Outcome              string
+	DrainDurationSeconds int64
+	RunningTasksCount    int64
+	// Observer is set in `OBSERVER_MODE`, where the lifecycle action is left to another system.
+	Observer bool `json:",omitempty"`
+}
+
+func (d *Drainer) newCompletionPayload(detail *CloudWatchEventDetail, clusterName, result string) *CompletionPayload {
+	return &CompletionPayload{
+		Type:                 CompletionTypeDrained,
+		ClusterName:          clusterName,
+		AutoScalingGroupName: detail.AutoScalingGroupName,
+		EC2InstanceId:        detail.EC2InstanceId,
+		Outcome:              drainOutcome(detail, result),
+		DrainDurationSeconds: int64(d.elapsedSince(*detail.DrainStartedAt) / time.Second),
+		Observer:             d.isObserverMode(),
+	}
+}
+
+// putEvent puts the payload as the detail of an event to the event bus, with the detail type of its type.
+func putEvent(ctx context.Context, svc eventbridgeAPI, busName string, payload *CompletionPayload) error {
+	detail, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	detailType := CompletionEventDetailType
+	if payload.Type == CompletionTypeStarted {
+		detailType = StartedEventDetailType
+	}
+	output, err := svc.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{
+		Entries: []*eventbridge.PutEventsRequestEntry{{
+			EventBusName: &busName,
+			Source:       aws.String(CompletionEventSource),
+			DetailType:   aws.String(detailType),
+			Detail:       aws.String(string(detail)),
+		}},
+	})
+	if err == nil && aws.Int64Value(output.FailedEntryCount) > 0 {
+		err = fmt.Errorf("%s: %s",
+			aws.StringValue(output.Entries[0].ErrorCode), aws.StringValue(output.Entries[0].ErrorMessage))
+	}
+	return err
+}
+
+func (d *Drainer) postWebhook(ctx context.Context, clients *awsClients, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	secret, err := d.getWebhookSigningSecret(ctx, clients)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	if secret != "" {
+		header.Set(webhookSignatureHeader, "sha256="+signWebhookBody(secret, body))
+	}
+	return postJSON(ctx, url, body, header)
+}
+
+// postJSON posts the JSON body within webhookTimeout and fails on a non-2xx response.
+func postJSON(ctx context.Context, url string, body []byte, header http.Header) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return nil
+}
+
+// postChatMessage posts a summary of the payload to the incoming webhook of Slack or of Microsoft Teams,
+// both of which accept a `text` message.
+func postChatMessage(ctx context.Context, url string, payload *CompletionPayload) error {
+	headline := "Drained"
+	switch payload.Type {
+	case CompletionTypeStarted:
+		headline = "Started draining"
+	case CompletionTypeTimedOut:
+		headline = "Drain timed out on"
+	case CompletionTypeCircuitBroken:
+		headline = "Gave up draining"
+	}
+	text := fmt.Sprintf("%s %s in %s", headline, payload.EC2InstanceId, payload.ClusterName)
+	if payload.Type != CompletionTypeStarted {
+		text += fmt.Sprintf("\nOutcome: %s, remaining tasks: %d, duration: %s",
+			payload.Outcome, payload.RunningTasksCount, time.Duration(payload.DrainDurationSeconds)*time.Second)
+	}
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, url, body, nil)
+}
+
+// getWebhookSigningSecret returns `WEBHOOK_SIGNING_SECRET`, or the secret named by `WEBHOOK_SIGNING_SECRET_ID`
+// in Secrets Manager.
+func (d *Drainer) getWebhookSigningSecret(ctx context.Context, clients *awsClients) (string, error) {
+	if secret := d.config.WebhookSigningSecret; secret != "" {
+		return secret, nil
+	}
+	secretID := d.config.WebhookSigningSecretID
+	if secretID == "" {
+		return "", nil
+	}
+	output, err := clients.secretsmanager.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: &secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %q does not have a string value", secretID)
+	}
+	return *output.SecretString, nil
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body) // nolint:errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,156 @@
+package drainer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+func TestDrainerPostWebhookSignature(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		secret   string
+		secretID string
+		want     string
+	}{
+		{"secret", "s3cr3t", "", "s3cr3t"},
+		{"secrets manager", "", "webhook", "from-secrets-manager"},
+		{"unsigned", "", "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WEBHOOK_SIGNING_SECRET", tt.secret)
+			t.Setenv("WEBHOOK_SIGNING_SECRET_ID", tt.secretID)
+			var body []byte
+			var signature string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = ioutil.ReadAll(r.Body)
+				signature = r.Header.Get(webhookSignatureHeader)
+			}))
+			defer server.Close()
+			clients := &awsClients{
+				secretsmanager: &fakeSecretsManager{secrets: map[string]string{"webhook": "from-secrets-manager"}},
+			}
+			d, _ := newTestDrainer(t, clients)
+
+			payload := &CompletionPayload{EC2InstanceId: "i-1", ClusterName: "default"}
+			if err := d.postWebhook(context.Background(), clients, server.URL, payload); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if signature != "" {
+					t.Errorf("signature = %q, want none without a secret", signature)
+				}
+				return
+			}
+			mac := hmac.New(sha256.New, []byte(tt.want))
+			mac.Write(body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+				t.Errorf("signature = %q, want %q", signature, want)
+			}
+		})
+	}
+}
+
+func TestDrainerPostWebhookMissingSecret(t *testing.T) {
+	t.Setenv("WEBHOOK_SIGNING_SECRET_ID", "missing")
+	clients := &awsClients{secretsmanager: &fakeSecretsManager{}}
+	d, _ := newTestDrainer(t, clients)
+
+	// Nothing is posted unsigned when the secret cannot be read.
+	err := d.postWebhook(context.Background(), clients, "http://127.0.0.1:1", &CompletionPayload{})
+	if aerr, ok := asAWSError(err); !ok || aerr.Code() != secretsmanager.ErrCodeResourceNotFoundException {
+		t.Errorf("postWebhook() = %v, want ResourceNotFoundException", err)
+	}
+}
+
+// chatServer records the bodies posted to a fake incoming webhook, which responds with status.
+func chatServer(t *testing.T, status int) (*httptest.Server, *[]map[string]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var bodies []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			t.Errorf("request = %s %v, want a JSON body", r.Method, r.Header)
+		}
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+func TestDrainerHandleEventChatMessage(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		timeout bool
+		advance time.Duration
+		want    string
+	}{
+		{"drained", false, 90 * time.Second,
+			"Drained i-1 in default\nOutcome: complete, remaining tasks: 0, duration: 1m30s"},
+		{"timed out", true, 601 * time.Second,
+			"Drain timed out on i-1 in default\nOutcome: forced, remaining tasks: 1, duration: 10m1s"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, bodies := chatServer(t, http.StatusOK)
+			t.Setenv("SLACK_WEBHOOK_URL", server.URL)
+			t.Setenv("MAX_DRAIN_SECONDS", "600")
+			t.Setenv("FORCE_STOP_ON_DRAIN_TIMEOUT", "true")
+			f := newTestDrainFixture()
+			d, _ := newTestDrainer(t, f.clients)
+			clock := newFakeClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+			d = d.withClock(clock)
+			ctx := context.Background()
+
+			evt, err := d.handleEvent(ctx, testEvent(t, f.detail))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.timeout {
+				f.stopTask()
+			}
+			clock.advance(tt.advance)
+			if _, err = d.handleEvent(ctx, evt); err != nil {
+				t.Fatal(err)
+			}
+			if want := []map[string]string{{"text": tt.want}}; !reflect.DeepEqual(*bodies, want) {
+				t.Errorf("posted = %q, want %q", *bodies, want)
+			}
+		})
+	}
+}
+
+func TestDrainerDrainChatMessageFailure(t *testing.T) {
+	server, bodies := chatServer(t, http.StatusInternalServerError)
+	t.Setenv("SLACK_WEBHOOK_URL", server.URL)
+	f := newTestDrainFixture()
+	f.stopTask()
+	d, out := newTestDrainer(t, f.clients)
+
+	// The message is best-effort, so the lifecycle action is completed anyway.
+	detail, err := d.Drain(context.Background(), f.detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.autoscaling.completedResults(); detail.Wait || len(got) != 1 || len(*bodies) != 1 {
+		t.Errorf("Drain() = %+v with completions %v, want the lifecycle action completed", detail, got)
+	}
+	if !strings.Contains(out.String(), "webhook responded 500") {
+		t.Errorf("log = %q, want the failed message logged", out.String())
+	}
+}
@@ -3,6 +3,8 @@ module github.com/m4i/ecs-auto-draining
 go 1.14
 
 require (
-	github.com/aws/aws-lambda-go v1.15.0
-	github.com/aws/aws-sdk-go v1.29.19
+	github.com/aws/aws-lambda-go v1.28.0
+	github.com/aws/aws-sdk-go v1.44.200
+	github.com/aws/aws-xray-sdk-go v1.1.0
+	github.com/go-sql-driver/mysql v1.5.0 // indirect
 )